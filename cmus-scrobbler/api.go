@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// APIConfig enables the local control and status API of run.
+type APIConfig struct {
+	// Listen is host:port on a loopback address, or unix:/path/to/socket.
+	// The API is off when it is empty.
+	Listen string `yaml:"listen"`
+}
+
+// apiCommandHeader must be set on command requests. Browsers can't add it
+// to a cross-origin request without a preflight, which the API never
+// allows, so web pages can't send commands.
+const apiCommandHeader = "X-Cmus-Scrobbler"
+
+// sseKeepalive is how often an idle event stream gets a comment, so clients
+// and proxies don't time it out.
+const sseKeepalive = 30 * time.Second
+
+// validateAPIListen checks that addr is a Unix socket or a loopback address,
+// so the API is never reachable from other machines.
+func validateAPIListen(addr string) error {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return errors.New("unix socket path is empty")
+		}
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("must be host:port or unix:/path: %w", err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("host %q is not a loopback address", host)
+	}
+	return nil
+}
+
+func listenAPI(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	// A socket left behind by a process that didn't shut down cleanly would
+	// make Listen fail.
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// serveAPI starts the API in the background. The returned function stops
+// it.
+func serveAPI(config APIConfig, d *daemon) (func(), error) {
+	listener, err := listenAPI(config.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("error starting API: %w", err)
+	}
+
+	server := &http.Server{Handler: newAPIHandler(d)}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("error serving API", "err", err)
+		}
+	}()
+	slog.Info("API listening", "addr", config.Listen)
+
+	return func() { server.Close() }, nil
+}
+
+func newAPIHandler(d *daemon) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			apiError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+			return
+		}
+		writeJSON(w, http.StatusOK, d.Status())
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(w, r, d)
+	})
+	mux.Handle("/metrics", metricsHandler(d))
+
+	commands := map[string]func() error{
+		"pause":    func() error { d.SetPaused(true); return nil },
+		"resume":   func() error { d.SetPaused(false); return nil },
+		"skip":     d.SkipTrack,
+		"love":     func() error { return d.LoveTrack(true) },
+		"unlove":   func() error { return d.LoveTrack(false) },
+		"scrobble": d.ForceScrobble,
+	}
+	for name, run := range commands {
+		run := run
+		mux.HandleFunc("/"+name, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				apiError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+				return
+			}
+			if r.Header.Get(apiCommandHeader) == "" {
+				apiError(w, http.StatusForbidden, fmt.Errorf("commands need the %s header", apiCommandHeader))
+				return
+			}
+			if err := run(); err != nil {
+				apiError(w, http.StatusConflict, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, d.Status())
+		})
+	}
+	return localOnly(mux)
+}
+
+// localOnly rejects requests made by web pages: those with an Origin, and
+// those for a host name other than a loopback one, as sent after DNS
+// rebinding.
+func localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			apiError(w, http.StatusForbidden, errors.New("cross-origin requests are not allowed"))
+			return
+		}
+		if !isLoopbackHost(r.Host) {
+			apiError(w, http.StatusForbidden, fmt.Errorf("host %q is not a loopback address", r.Host))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackHost reports whether the Host header host names this machine.
+// Clients of a Unix socket may send no host at all.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if host == "" || strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveEvents streams the state as server-sent events: the current state
+// first, then the new state after every change.
+func serveEvents(w http.ResponseWriter, r *http.Request, d *daemon) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apiError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	updates, unsubscribe := d.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(status DaemonStatus) error {
+		data, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: status\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	if err := send(d.Status()); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case status := <-updates:
+			if err := send(status); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateAPIListen(t *testing.T) {
+	tests := []struct {
+		addr string
+		ok   bool
+	}{
+		{"127.0.0.1:7700", true},
+		{"localhost:7700", true},
+		{"[::1]:7700", true},
+		{"unix:/run/user/1000/cmus-scrobbler.sock", true},
+		{"0.0.0.0:7700", false},
+		{"192.168.1.2:7700", false},
+		{":7700", false},
+		{"unix:", false},
+		{"127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		err := validateAPIListen(tt.addr)
+		if (err == nil) != tt.ok {
+			t.Errorf("validateAPIListen(%q) = %v, want ok %v", tt.addr, err, tt.ok)
+		}
+	}
+}
+
+func postAPI(t *testing.T, server *httptest.Server, path string) (int, map[string]any) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, server.URL+path, nil)
+	req.Header.Set(apiCommandHeader, "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	var body map[string]any
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body
+}
+
+func TestAPICommands(t *testing.T) {
+	d := newDaemon()
+	server := httptest.NewServer(newAPIHandler(d))
+	defer server.Close()
+
+	if code, _ := postAPI(t, server, "/skip"); code != http.StatusConflict {
+		t.Errorf("skip with nothing playing: status %d, want %d", code, http.StatusConflict)
+	}
+
+	d.setTrack(&TrackStatus{Artist: "Low", Track: "Words"}, nil)
+
+	code, body := postAPI(t, server, "/skip")
+	if code != http.StatusOK {
+		t.Fatalf("skip: status %d, body %v", code, body)
+	}
+	if !d.skipped(&TrackStatus{Artist: "Low", Track: "Words"}) {
+		t.Error("track is not skipped after /skip")
+	}
+	if track := d.Status().Track; track == nil || !track.Skipped {
+		t.Errorf("status track = %+v, want skipped", track)
+	}
+
+	if code, _ := postAPI(t, server, "/scrobble"); code != http.StatusOK || !d.takeForce(&TrackStatus{Artist: "Low", Track: "Words"}) {
+		t.Errorf("scrobble: status %d, want a forced scrobble", code)
+	}
+	if d.skipped(&TrackStatus{Artist: "Low", Track: "Words"}) {
+		t.Error("forced scrobble did not clear the skip")
+	}
+	// A forced scrobble is only for the track that was playing.
+	postAPI(t, server, "/scrobble")
+	if d.takeForce(&TrackStatus{Artist: "Low", Track: "Sunflower"}) || d.takeForce(&TrackStatus{Artist: "Low", Track: "Words"}) {
+		t.Error("forced scrobble applied to the next track or was kept after it")
+	}
+
+	code, body = postAPI(t, server, "/pause")
+	if code != http.StatusOK || body["scrobbling_paused"] != true {
+		t.Errorf("pause: status %d, body %v", code, body)
+	}
+	postAPI(t, server, "/resume")
+	if d.Status().ScrobblingPaused {
+		t.Error("scrobbling still paused after /resume")
+	}
+
+	var loved []string
+	d.love = func(track TrackStatus, love bool) error {
+		loved = append(loved, fmt.Sprintf("%s %v", track.key(), love))
+		return nil
+	}
+	postAPI(t, server, "/love")
+	postAPI(t, server, "/unlove")
+	if want := []string{"Low - Words true", "Low - Words false"}; fmt.Sprint(loved) != fmt.Sprint(want) {
+		t.Errorf("love calls = %q, want %q", loved, want)
+	}
+
+	// Requests a web page could make are refused.
+	for name, header := range map[string]http.Header{
+		"no command header": {},
+		"origin":            {apiCommandHeader: {"1"}, "Origin": {"https://example.com"}},
+		"rebound host":      {apiCommandHeader: {"1"}, "Host": {"evil.example.com:7700"}},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/love", nil)
+		req.Header = header
+		if host := header.Get("Host"); host != "" {
+			req.Host = host
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: status %d, want %d", name, resp.StatusCode, http.StatusForbidden)
+		}
+	}
+	if len(loved) != 2 {
+		t.Errorf("refused requests loved tracks: %q", loved)
+	}
+
+	resp, err := http.Get(server.URL + "/pause")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /pause: status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAPIEvents(t *testing.T) {
+	d := newDaemon()
+	server := httptest.NewServer(newAPIHandler(d))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatalf("GET /events: %v", err)
+	}
+	defer resp.Body.Close()
+
+	events := make(chan DaemonStatus)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var status DaemonStatus
+				json.Unmarshal([]byte(data), &status)
+				events <- status
+			}
+		}
+		close(events)
+	}()
+
+	next := func() DaemonStatus {
+		t.Helper()
+		select {
+		case status := <-events:
+			return status
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+			return DaemonStatus{}
+		}
+	}
+
+	if status := next(); status.Player != "not_running" {
+		t.Errorf("first event player = %q, want not_running", status.Player)
+	}
+
+	d.setTrack(&TrackStatus{Artist: "Low", Track: "Words", Progress: 0.5}, nil)
+	status := next()
+	if status.Player != "playing" || status.Track == nil || status.Track.Track != "Words" {
+		t.Errorf("event after setTrack = %+v", status)
+	}
+
+	// Unchanged state is not sent again.
+	d.setTrack(&TrackStatus{Artist: "Low", Track: "Words", Progress: 0.5}, nil)
+	d.SetPaused(true)
+	if status := next(); !status.ScrobblingPaused {
+		t.Errorf("event after pause = %+v, want scrobbling paused", status)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Kinds from the audio track NIP draft, see nud.md.
+const (
+	KindAudioTrack    = 31337
+	KindMusicPlaylist = 30037
+)
+
+// AudioTrack is the metadata published in a kind 31337 event.
+type AudioTrack struct {
+	Artist string
+	Title  string
+	Album  string
+	Genre  string
+	MbID   string
+	// Identifiers are extra "i" tag values, such as other MusicBrainz IDs.
+	Identifiers []string
+	// Image is the cover art URL.
+	Image string
+}
+
+// normalizeName folds case and whitespace so names that differ only in
+// those match.
+func normalizeName(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// trackNameKey identifies a recording by artist and title.
+func trackNameKey(artist, title string) string {
+	return normalizeName(artist) + "\n" + normalizeName(title)
+}
+
+// DTag returns the track's identifier: its MusicBrainz recording ID when
+// known, otherwise a hash of the normalized artist and title, so
+// republishing the same track replaces its event instead of adding another.
+func (t AudioTrack) DTag() string {
+	if t.MbID != "" {
+		return t.MbID
+	}
+	sum := sha256.Sum256([]byte(trackNameKey(t.Artist, t.Title)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// audioTrackEvent builds the unsigned event for t.
+func audioTrackEvent(t AudioTrack) nostr.Event {
+	ev := nostr.Event{
+		Kind:      KindAudioTrack,
+		CreatedAt: nostr.Now(),
+		Content:   fmt.Sprintf("%s - %s", t.Artist, t.Title),
+		Tags: nostr.Tags{
+			{"d", t.DTag()},
+			{"title", t.Title},
+			{"c", t.Artist, "artist"},
+		},
+	}
+	if t.Album != "" {
+		ev.Tags = append(ev.Tags, nostr.Tag{"c", t.Album, "album"})
+	}
+	if t.Genre != "" {
+		ev.Tags = append(ev.Tags, nostr.Tag{"c", t.Genre, "genre"})
+	}
+	if t.MbID != "" {
+		ev.Tags = append(ev.Tags, nostr.Tag{"i", "mbid:recording:" + t.MbID})
+	}
+	for _, id := range t.Identifiers {
+		if id != "mbid:recording:"+t.MbID {
+			ev.Tags = append(ev.Tags, nostr.Tag{"i", id})
+		}
+	}
+	if t.Image != "" {
+		ev.Tags = append(ev.Tags, nostr.Tag{"imeta", "url " + t.Image})
+	}
+	return ev
+}
+
+// updateAudioTrackEvent builds the event for t that replaces current, the
+// event already published for its d tag. Both playlist publish and tracks
+// publish these events, each knowing only part of the metadata, so what
+// current has and t lacks is kept: album, genre and cover art when t has
+// none, every "i" tag, and tags this program doesn't write.
+func updateAudioTrackEvent(t AudioTrack, current *nostr.Event) nostr.Event {
+	if current == nil {
+		return audioTrackEvent(t)
+	}
+
+	t.Identifiers = slices.Clone(t.Identifiers)
+	var extra nostr.Tags
+	for _, tag := range current.Tags {
+		if len(tag) < 2 {
+			extra = append(extra, tag)
+			continue
+		}
+		switch {
+		case tag[0] == "d" || tag[0] == "title":
+		case tag[0] == "c" && len(tag) >= 3 && tag[2] == "artist":
+		case tag[0] == "c" && len(tag) >= 3 && tag[2] == "album":
+			if t.Album == "" {
+				t.Album = tag[1]
+			}
+		case tag[0] == "c" && len(tag) >= 3 && tag[2] == "genre":
+			if t.Genre == "" {
+				t.Genre = tag[1]
+			}
+		case tag[0] == "i":
+			if tag[1] != "mbid:recording:"+t.MbID && !slices.Contains(t.Identifiers, tag[1]) {
+				t.Identifiers = append(t.Identifiers, tag[1])
+			}
+		case tag[0] == "imeta" && strings.HasPrefix(tag[1], "url "):
+			if t.Image == "" {
+				t.Image = strings.TrimPrefix(tag[1], "url ")
+			}
+		default:
+			extra = append(extra, tag)
+		}
+	}
+	slices.Sort(t.Identifiers)
+
+	ev := audioTrackEvent(t)
+	ev.Tags = append(ev.Tags, extra...)
+	return ev
+}
+
+// addressOf returns the "a" tag value referring to a replaceable event.
+func addressOf(kind int, pubkey, d string) string {
+	return fmt.Sprintf("%d:%s:%s", kind, pubkey, d)
+}
+
+// sameEventContent reports whether two events of the same address carry the
+// same content and tags, so publishing one over the other changes nothing.
+func sameEventContent(a, b *nostr.Event) bool {
+	if a.Content != b.Content || len(a.Tags) != len(b.Tags) {
+		return false
+	}
+	for i := range a.Tags {
+		if !slices.Equal(a.Tags[i], b.Tags[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// addressableQueryBatch is how many d tags are sent in one filter.
+const addressableQueryBatch = 100
+
+// QueryAddressable fetches the newest of the user's events of kind for each
+// of the d tags, keyed by d tag.
+func (n *Nostr) QueryAddressable(kind int, dTags []string) (map[string]*nostr.Event, error) {
+	found := make(map[string]*nostr.Event)
+	for len(dTags) > 0 {
+		batch := dTags[:min(len(dTags), addressableQueryBatch)]
+		dTags = dTags[len(batch):]
+		if err := n.queryAddressable(kind, batch, found); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+func (n *Nostr) queryAddressable(kind int, dTags []string, found map[string]*nostr.Event) error {
+	filter := nostr.Filter{
+		Kinds:   []int{kind},
+		Authors: []string{n.pk},
+		Tags:    nostr.TagMap{"d": dTags},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	queried := 0
+	var lastErr error
+	for _, relay := range n.relays {
+		events, err := relay.QuerySync(ctx, filter)
+		if err != nil {
+			slog.Warn("error querying relay", "relay", relay.URL, "err", err)
+			lastErr = err
+			continue
+		}
+		queried++
+		for _, ev := range events {
+			d := ev.Tags.GetD()
+			if prev, ok := found[d]; !ok || ev.CreatedAt > prev.CreatedAt {
+				found[d] = ev
+			}
+		}
+	}
+	// Without a successful query every event would look new.
+	if queried == 0 && lastErr != nil {
+		return fmt.Errorf("error querying relays: %w", lastErr)
+	}
+	return nil
+}
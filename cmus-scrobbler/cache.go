@@ -0,0 +1,607 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	bolt "go.etcd.io/bbolt"
+)
+
+// CacheConfig controls the local history cache.
+type CacheConfig struct {
+	Disabled bool `yaml:"disabled"`
+	// Dir holds one database per public key. It defaults to
+	// cmus-scrobbler in the user's cache directory.
+	Dir string `yaml:"dir"`
+	// SyncInterval is how often run syncs the cache in the background, in
+	// minutes. It defaults to 5.
+	SyncInterval int `yaml:"sync_interval"`
+	// FullSyncInterval is how often run walks the complete history to pick
+	// up events older than the sync lookback, in hours. It defaults to 24.
+	FullSyncInterval int `yaml:"full_sync_interval"`
+}
+
+const (
+	defaultCacheSyncInterval     = 5 * time.Minute
+	defaultCacheFullSyncInterval = 24 * time.Hour
+	// cacheSyncLookback is how far before the last sync a sync starts
+	// again. Events are often published after their created_at: backdated
+	// and imported scrobbles, edits, listens with their original time.
+	cacheSyncLookback = 48 * time.Hour
+)
+
+var (
+	bucketEvents  = []byte("events")
+	bucketByTime  = []byte("by_time")
+	bucketCursors = []byte("cursors")
+)
+
+// errCacheLocked is returned when another process kept the cache locked
+// for longer than cacheLockTimeout.
+var errCacheLocked = errors.New("history cache is in use by another cmus-scrobbler process")
+
+const (
+	// cacheLockTimeout is how long a transaction waits for another process
+	// to finish its own.
+	cacheLockTimeout = 5 * time.Second
+	// cacheRangeChunk is how many events Range reads per transaction.
+	cacheRangeChunk = 500
+)
+
+// HistoryCache is a local store of the user's own scrobble events. Events
+// are indexed by ID and by created_at, and the newest created_at synced from
+// each relay is kept as a cursor for incremental syncs.
+//
+// The database is only open for the length of each transaction, read-only
+// with a shared lock for reads, so run syncing in the background and
+// commands reading at the same time take turns instead of locking each
+// other out.
+type HistoryCache struct {
+	path string
+}
+
+func defaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting cache directory: %w", err)
+	}
+	return filepath.Join(dir, "cmus-scrobbler"), nil
+}
+
+// OpenHistoryCache opens (or creates) the cache for pubkey in dir.
+func OpenHistoryCache(dir, pubkey string) (*HistoryCache, error) {
+	if dir == "" {
+		var err error
+		if dir, err = defaultCacheDir(); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating cache directory: %w", err)
+	}
+
+	c := &HistoryCache{path: filepath.Join(dir, pubkey+".db")}
+	err := c.update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketEvents, bucketByTime, bucketCursors} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *HistoryCache) open(readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(c.path, 0600, &bolt.Options{Timeout: cacheLockTimeout, ReadOnly: readOnly})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, errCacheLocked
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening history cache %s: %w", c.path, err)
+	}
+	return db, nil
+}
+
+// view runs fn in a read-only transaction.
+func (c *HistoryCache) view(fn func(tx *bolt.Tx) error) error {
+	db, err := c.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// update runs fn in a read-write transaction.
+func (c *HistoryCache) update(fn func(tx *bolt.Tx) error) error {
+	db, err := c.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// timeKey orders events by created_at, then ID.
+func timeKey(createdAt nostr.Timestamp, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(createdAt))
+	return append(key, id...)
+}
+
+// Put stores events, ignoring ones already present.
+func (c *HistoryCache) Put(events ...*nostr.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return c.update(func(tx *bolt.Tx) error {
+		byID := tx.Bucket(bucketEvents)
+		byTime := tx.Bucket(bucketByTime)
+		for _, ev := range events {
+			if byID.Get([]byte(ev.ID)) != nil {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			if err := byID.Put([]byte(ev.ID), data); err != nil {
+				return err
+			}
+			if err := byTime.Put(timeKey(ev.CreatedAt, ev.ID), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete removes events by ID.
+func (c *HistoryCache) Delete(ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return c.update(func(tx *bolt.Tx) error {
+		byID := tx.Bucket(bucketEvents)
+		byTime := tx.Bucket(bucketByTime)
+		for _, id := range ids {
+			data := byID.Get([]byte(id))
+			if data == nil {
+				continue
+			}
+			var ev nostr.Event
+			if err := json.Unmarshal(data, &ev); err != nil {
+				return err
+			}
+			if err := byTime.Delete(timeKey(ev.CreatedAt, ev.ID)); err != nil {
+				return err
+			}
+			if err := byID.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get returns the event with id, or nil.
+func (c *HistoryCache) Get(id string) (*nostr.Event, error) {
+	var ev *nostr.Event
+	err := c.view(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketEvents).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		ev = &nostr.Event{}
+		return json.Unmarshal(data, ev)
+	})
+	return ev, err
+}
+
+// Range calls fn for events with created_at in [since, until], newest
+// first. A zero since or until leaves that end open. Events are read a
+// chunk at a time, so fn runs outside any transaction and may write to the
+// cache.
+func (c *HistoryCache) Range(since, until nostr.Timestamp, fn func(ev *nostr.Event) error) error {
+	// before is the key the next chunk starts below; nil is the end.
+	var before []byte
+	if until != 0 {
+		before = timeKey(until+1, "")
+	}
+	for {
+		var events []*nostr.Event
+		err := c.view(func(tx *bolt.Tx) error {
+			byID := tx.Bucket(bucketEvents)
+			cursor := tx.Bucket(bucketByTime).Cursor()
+
+			var k []byte
+			if before == nil {
+				k, _ = cursor.Last()
+			} else if k, _ = cursor.Seek(before); k == nil {
+				k, _ = cursor.Last()
+			} else {
+				k, _ = cursor.Prev()
+			}
+
+			for ; k != nil && len(events) < cacheRangeChunk; k, _ = cursor.Prev() {
+				createdAt := nostr.Timestamp(binary.BigEndian.Uint64(k[:8]))
+				if since != 0 && createdAt < since {
+					break
+				}
+				ev := &nostr.Event{}
+				if err := json.Unmarshal(byID.Get(k[8:]), ev); err != nil {
+					return err
+				}
+				events = append(events, ev)
+				before = slices.Clone(k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, ev := range events {
+			if err := fn(ev); err != nil {
+				return err
+			}
+		}
+		if len(events) < cacheRangeChunk {
+			return nil
+		}
+	}
+}
+
+var errStopRange = errors.New("stop")
+
+// Recent returns up to limit events, newest first.
+func (c *HistoryCache) Recent(limit int) ([]nostr.Event, error) {
+	var events []nostr.Event
+	err := c.Range(0, 0, func(ev *nostr.Event) error {
+		if len(events) >= limit {
+			return errStopRange
+		}
+		events = append(events, *ev)
+		return nil
+	})
+	if errors.Is(err, errStopRange) {
+		err = nil
+	}
+	return events, err
+}
+
+// Count returns the number of cached events.
+func (c *HistoryCache) Count() int {
+	count := 0
+	c.view(func(tx *bolt.Tx) error {
+		count = tx.Bucket(bucketEvents).Stats().KeyN
+		return nil
+	})
+	return count
+}
+
+// Cursor returns the newest created_at synced from relay.
+func (c *HistoryCache) Cursor(relay string) nostr.Timestamp {
+	var cursor nostr.Timestamp
+	c.view(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(bucketCursors).Get([]byte(relay)); len(data) == 8 {
+			cursor = nostr.Timestamp(binary.BigEndian.Uint64(data))
+		}
+		return nil
+	})
+	return cursor
+}
+
+// Cursors returns the cursor of every relay synced so far.
+func (c *HistoryCache) Cursors() map[string]nostr.Timestamp {
+	cursors := make(map[string]nostr.Timestamp)
+	c.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketCursors).ForEach(func(k, v []byte) error {
+			if len(v) == 8 {
+				cursors[string(k)] = nostr.Timestamp(binary.BigEndian.Uint64(v))
+			}
+			return nil
+		})
+	})
+	return cursors
+}
+
+// HasCursors reports whether the cache has been synced at least once.
+func (c *HistoryCache) HasCursors() bool {
+	has := false
+	c.view(func(tx *bolt.Tx) error {
+		has = tx.Bucket(bucketCursors).Stats().KeyN > 0
+		return nil
+	})
+	return has
+}
+
+func (c *HistoryCache) SetCursor(relay string, cursor nostr.Timestamp) error {
+	return c.update(func(tx *bolt.Tx) error {
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint64(data, uint64(cursor))
+		return tx.Bucket(bucketCursors).Put([]byte(relay), data)
+	})
+}
+
+// UseCache makes n read its history from cache and record what it publishes
+// there.
+func (n *Nostr) UseCache(cache *HistoryCache) {
+	n.cache = cache
+}
+
+// historyCache returns the cache to read history from, or nil until it has
+// been synced from at least one relay.
+func (n *Nostr) historyCache() *HistoryCache {
+	if n.cache == nil || !n.cache.HasCursors() {
+		return nil
+	}
+	return n.cache
+}
+
+// SyncCache fetches the events from every relay created since a lookback
+// before its last sync and applies the user's deletion requests. With full
+// set, it walks the complete history instead and drops cached events no
+// relay has anymore.
+func (n *Nostr) SyncCache(full bool) (added, removed int, err error) {
+	if n.cache == nil {
+		return 0, 0, nil
+	}
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+
+	before := n.cache.Count()
+	seen := make(map[string]bool)
+	complete := true
+
+	for _, relay := range n.relays {
+		if n.closed.Load() {
+			return 0, 0, nil
+		}
+		started := nostr.Now()
+		since := syncSince(n.cache.Cursor(relay.URL))
+		if full {
+			since = 0
+		}
+
+		// Events are stored a page at a time, each page in one
+		// transaction.
+		var page []*nostr.Event
+		walkErr := n.walkRelayHistory(relay, since, 0, seen, func(ev *nostr.Event) error {
+			page = append(page, ev)
+			if len(page) < historyPageSize {
+				return nil
+			}
+			err := n.cache.Put(page...)
+			page = page[:0]
+			return err
+		})
+		if err := n.cache.Put(page...); err != nil && walkErr == nil {
+			walkErr = err
+		}
+		var queryErr *relayQueryError
+		if errors.As(walkErr, &queryErr) {
+			if n.closed.Load() {
+				return 0, 0, nil
+			}
+			slog.Warn("error syncing history", "relay", relay.URL, "err", queryErr.err)
+			complete = false
+			continue
+		}
+		if walkErr != nil {
+			return 0, 0, walkErr
+		}
+
+		deleted, err := n.queryDeletions(relay, since)
+		if err != nil {
+			if n.closed.Load() {
+				return 0, 0, nil
+			}
+			slog.Warn("error syncing deletions", "relay", relay.URL, "err", err)
+			complete = false
+			continue
+		}
+		if err := n.cache.Delete(deleted...); err != nil {
+			return 0, 0, err
+		}
+
+		if err := n.cache.SetCursor(relay.URL, started); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if full && complete {
+		var stale []string
+		n.cache.Range(0, 0, func(ev *nostr.Event) error {
+			if !seen[ev.ID] {
+				stale = append(stale, ev.ID)
+			}
+			return nil
+		})
+		if err := n.cache.Delete(stale...); err != nil {
+			return 0, 0, err
+		}
+		removed = len(stale)
+	}
+
+	after := n.cache.Count()
+	return max(0, after-before+removed), removed, nil
+}
+
+// queryDeletions returns the IDs of events the user asked relays to delete
+// since the given time.
+func (n *Nostr) queryDeletions(relay *nostr.Relay, since nostr.Timestamp) ([]string, error) {
+	filter := nostr.Filter{
+		Kinds:   []int{nostr.KindDeletion},
+		Authors: []string{n.pk},
+	}
+	if since != 0 {
+		filter.Since = &since
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	events, err := relay.QuerySync(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, ev := range events {
+		for _, tag := range ev.Tags {
+			if len(tag) >= 2 && tag[0] == "e" {
+				ids = append(ids, tag[1])
+			}
+		}
+	}
+	return ids, nil
+}
+
+// recordPublished keeps the cache in step with an event that at least one
+// relay accepted.
+func (n *Nostr) recordPublished(ev *nostr.Event) {
+	if n.cache == nil {
+		return
+	}
+
+	var err error
+	switch ev.Kind {
+	case KindScrobble, KindPrivateScrobble:
+		err = n.cache.Put(ev)
+	case nostr.KindDeletion:
+		var ids []string
+		for _, tag := range ev.Tags {
+			if len(tag) >= 2 && tag[0] == "e" {
+				ids = append(ids, tag[1])
+			}
+		}
+		err = n.cache.Delete(ids...)
+	}
+	if err != nil {
+		slog.Error("error updating history cache", "err", err)
+	}
+}
+
+// connectNostr creates a client for config and attaches its history cache.
+// Reads are served from the cache as it is while anything new is synced
+// from the relays in the background. Until the cache has been synced once,
+// and when it can't be opened, the client queries relays directly.
+func connectNostr(config Config) (*Nostr, error) {
+	s, err := newSigner(config)
+	if err != nil {
+		return nil, err
+	}
+	n, err := NewNostr(s, config.Relays)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if config.Cache.Disabled {
+		return n, nil
+	}
+
+	cache, err := OpenHistoryCache(config.Cache.Dir, n.pk)
+	if err != nil {
+		slog.Warn("not using history cache", "err", err)
+		return n, nil
+	}
+	n.UseCache(cache)
+
+	go func() {
+		if !cache.HasCursors() {
+			slog.Info("building history cache in the background")
+		}
+		if _, _, err := n.SyncCache(false); err != nil && !n.closed.Load() {
+			slog.Warn("error syncing history cache", "err", err)
+		}
+	}()
+	return n, nil
+}
+
+// syncSince is where a sync of a relay last synced at cursor starts. An
+// unsynced relay is synced from the start.
+func syncSince(cursor nostr.Timestamp) nostr.Timestamp {
+	if cursor == 0 {
+		return 0
+	}
+	return max(1, cursor-nostr.Timestamp(cacheSyncLookback/time.Second))
+}
+
+// syncCacheEvery syncs the cache of n in the background until stop is
+// closed, with a full sync every fullInterval.
+func syncCacheEvery(n *Nostr, interval, fullInterval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastFull := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			full := time.Since(lastFull) >= fullInterval
+			added, removed, err := n.SyncCache(full)
+			if err != nil {
+				slog.Warn("error syncing history cache", "full", full, "err", err)
+				continue
+			}
+			if full {
+				lastFull = time.Now()
+				slog.Info("synced full history cache", "added", added, "removed", removed)
+			}
+		}
+	}
+}
+
+func cmdCache(ctx *cliContext, args []string) error {
+	if ctx.nostr.cache == nil {
+		return fmt.Errorf("history cache is not available")
+	}
+	cache := ctx.nostr.cache
+
+	if len(args) == 0 {
+		args = []string{"info"}
+	}
+	switch args[0] {
+	case "sync":
+		fs := flag.NewFlagSet("cache sync", flag.ExitOnError)
+		full := fs.Bool("full", false, "Walk the complete history and drop events no relay has")
+		fs.Parse(args[1:])
+
+		added, removed, err := ctx.nostr.SyncCache(*full)
+		if err != nil {
+			return fmt.Errorf("error syncing history cache: %w", err)
+		}
+		fmt.Printf("Added %d and removed %d events, %d cached\n", added, removed, cache.Count())
+		return nil
+	case "info":
+		fmt.Println("Cache:", cache.path)
+		fmt.Println("Events:", cache.Count())
+		cursors := cache.Cursors()
+		relays := make([]string, 0, len(cursors))
+		for relay := range cursors {
+			relays = append(relays, relay)
+		}
+		sort.Strings(relays)
+		for _, relay := range relays {
+			fmt.Printf("  %s last synced %s\n", relay, cursors[relay].Time().Format(time.RFC3339))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown cache command %q", args[0])
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func openTestCache(t *testing.T) *HistoryCache {
+	t.Helper()
+	cache, err := OpenHistoryCache(t.TempDir(), "test")
+	if err != nil {
+		t.Fatalf("OpenHistoryCache: %v", err)
+	}
+	return cache
+}
+
+func cachedIDs(t *testing.T, cache *HistoryCache, since, until nostr.Timestamp) []string {
+	t.Helper()
+	var ids []string
+	err := cache.Range(since, until, func(ev *nostr.Event) error {
+		ids = append(ids, ev.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Range: %v", err)
+	}
+	return ids
+}
+
+func TestHistoryCacheRange(t *testing.T) {
+	cache := openTestCache(t)
+	err := cache.Put(
+		&nostr.Event{ID: "b", CreatedAt: 200, Kind: KindScrobble},
+		&nostr.Event{ID: "a", CreatedAt: 100, Kind: KindScrobble},
+		&nostr.Event{ID: "c", CreatedAt: 300, Kind: KindPrivateScrobble},
+		&nostr.Event{ID: "a", CreatedAt: 100, Kind: KindScrobble},
+	)
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if got := cache.Count(); got != 3 {
+		t.Fatalf("Count() = %d, want 3", got)
+	}
+
+	tests := []struct {
+		since, until nostr.Timestamp
+		want         []string
+	}{
+		{0, 0, []string{"c", "b", "a"}},
+		{200, 0, []string{"c", "b"}},
+		{0, 200, []string{"b", "a"}},
+		{150, 250, []string{"b"}},
+		{400, 0, nil},
+	}
+	for _, tt := range tests {
+		got := cachedIDs(t, cache, tt.since, tt.until)
+		if len(got) != len(tt.want) {
+			t.Errorf("Range(%d, %d) = %v, want %v", tt.since, tt.until, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("Range(%d, %d) = %v, want %v", tt.since, tt.until, got, tt.want)
+				break
+			}
+		}
+	}
+
+	recent, err := cache.Recent(2)
+	if err != nil {
+		t.Fatalf("Recent: %v", err)
+	}
+	if len(recent) != 2 || recent[0].ID != "c" || recent[1].ID != "b" {
+		t.Errorf("Recent(2) = %v, want c, b", recent)
+	}
+}
+
+func TestHistoryCacheDelete(t *testing.T) {
+	cache := openTestCache(t)
+	cache.Put(
+		&nostr.Event{ID: "a", CreatedAt: 100},
+		&nostr.Event{ID: "b", CreatedAt: 200},
+	)
+
+	if err := cache.Delete("a", "missing"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if ev, _ := cache.Get("a"); ev != nil {
+		t.Errorf("Get(a) = %v after delete, want nil", ev)
+	}
+	if got := cachedIDs(t, cache, 0, 0); len(got) != 1 || got[0] != "b" {
+		t.Errorf("Range after delete = %v, want [b]", got)
+	}
+}
+
+func TestHistoryCacheCursors(t *testing.T) {
+	cache := openTestCache(t)
+	if cache.HasCursors() {
+		t.Fatal("new cache has cursors")
+	}
+
+	if err := cache.SetCursor("wss://relay.example.com", 1700000000); err != nil {
+		t.Fatalf("SetCursor: %v", err)
+	}
+	if got := cache.Cursor("wss://relay.example.com"); got != 1700000000 {
+		t.Errorf("Cursor = %d, want 1700000000", got)
+	}
+	if got := cache.Cursor("wss://other.example.com"); got != 0 {
+		t.Errorf("Cursor of unsynced relay = %d, want 0", got)
+	}
+	if !cache.HasCursors() {
+		t.Error("HasCursors() = false after SetCursor")
+	}
+}
+
+func TestSyncSince(t *testing.T) {
+	if got := syncSince(0); got != 0 {
+		t.Errorf("syncSince(0) = %d, want 0", got)
+	}
+	// Events published late with an older created_at are still fetched.
+	if got := syncSince(1700000000); got != 1700000000-48*3600 {
+		t.Errorf("syncSince = %d, want 48 hours earlier", got)
+	}
+}
+
+func TestHistoryCacheShared(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := OpenHistoryCache(dir, "test")
+	if err != nil {
+		t.Fatalf("OpenHistoryCache: %v", err)
+	}
+	reader, err := OpenHistoryCache(dir, "test")
+	if err != nil {
+		t.Fatalf("second OpenHistoryCache: %v", err)
+	}
+
+	// More events than one chunk, read by one handle while Range's
+	// callback writes through the other.
+	var events []*nostr.Event
+	for i := 0; i < cacheRangeChunk+10; i++ {
+		events = append(events, &nostr.Event{ID: fmt.Sprintf("%04d", i), CreatedAt: nostr.Timestamp(1000 + i/2)})
+	}
+	if err := writer.Put(events...); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	err = reader.Range(0, 2000, func(ev *nostr.Event) error {
+		ids = append(ids, ev.ID)
+		return writer.Put(&nostr.Event{ID: "new-" + ev.ID, CreatedAt: 5000})
+	})
+	if err != nil {
+		t.Fatalf("Range: %v", err)
+	}
+	if len(ids) != len(events) || ids[0] != events[len(events)-1].ID || ids[len(ids)-1] != "0000" {
+		t.Errorf("read %d events from %v to %v", len(ids), ids[0], ids[len(ids)-1])
+	}
+	if got := reader.Count(); got != 2*len(events) {
+		t.Errorf("count = %d, want %d", got, 2*len(events))
+	}
+}
@@ -1,15 +1,32 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
+)
+
+// scrobbleThreshold is how long a track has to play before it is scrobbled.
+const scrobbleThreshold = 30 * time.Second
+
+// waitForCmus returns these when cmus simply isn't playing, as opposed to
+// failing to query it.
+var (
+	errCmusNotRunning = errors.New("cmus not running")
+	errCmusNotPlaying = errors.New("cmus not playing")
 )
 
 func isCmusRunning() (bool, error) {
 	cmd := exec.Command("pgrep", "cmus")
 	output, err := cmd.Output()
+	// pgrep exits with 1 when nothing matches.
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
 	if err != nil {
 		return false, err
 	}
@@ -25,7 +42,7 @@ func isCmusPlaying() (bool, error) {
 }
 
 func hasPlayedLongEnough(status CmusOutput) bool {
-	return status.Position > 30
+	return time.Duration(status.Position)*time.Second > scrobbleThreshold
 }
 
 func getCmusStatus() (CmusOutput, error) {
@@ -47,27 +64,141 @@ func getTags(cmusStatus CmusOutput) (map[string]string, error) {
 	return tags, nil
 }
 
-func getCurrentTrack() (ScrobbleEvent, error) {
-	status, err := getCmusStatus()
+// trackResolver turns cmus status into scrobbles, handling streams and
+// untagged files as well as regular tagged tracks.
+type trackResolver struct {
+	streamRules      []compiledStreamRule
+	streams          streamTracker
+	filenamePatterns []filenamePattern
+}
+
+func newTrackResolver(config Config) (*trackResolver, error) {
+	streamRules, err := compileStreamRules(config.Streams)
 	if err != nil {
-		return ScrobbleEvent{}, err
+		return nil, err
 	}
 
-	tags, err := getTags(status)
+	filenamePatterns, err := compileFilenamePatterns(config.FilenamePatterns)
+	if err != nil {
+		return nil, err
+	}
+
+	return &trackResolver{
+		streamRules:      streamRules,
+		filenamePatterns: filenamePatterns,
+	}, nil
+}
+
+// getCurrentTrack returns the playing track once it has played long enough
+// to be scrobbled, or an empty ScrobbleEvent before that.
+func (r *trackResolver) getCurrentTrack() (ScrobbleEvent, error) {
+	status, err := getCmusStatus()
 	if err != nil {
 		return ScrobbleEvent{}, err
 	}
+	return r.currentTrack(status)
+}
+
+func (r *trackResolver) currentTrack(status CmusOutput) (ScrobbleEvent, error) {
+	if status.Stream != "" {
+		return r.getCurrentStreamTrack(status), nil
+	}
 
 	if !hasPlayedLongEnough(status) {
 		return ScrobbleEvent{}, nil
 	}
 
-	return ScrobbleEvent{
+	return r.trackFromStatus(status)
+}
+
+// getPlayingTrack returns the playing track regardless of how long it has
+// been playing.
+func (r *trackResolver) getPlayingTrack() (ScrobbleEvent, error) {
+	status, err := getCmusStatus()
+	if err != nil {
+		return ScrobbleEvent{}, err
+	}
+	return r.playingTrack(status)
+}
+
+func (r *trackResolver) playingTrack(status CmusOutput) (ScrobbleEvent, error) {
+	if status.Stream != "" {
+		artist, title, _ := parseStreamTitle(r.streamRules, status.File, status.Stream)
+		return ScrobbleEvent{Artist: artist, Track: title, Stream: status.File}, nil
+	}
+
+	return r.trackFromStatus(status)
+}
+
+func (r *trackResolver) trackFromStatus(status CmusOutput) (ScrobbleEvent, error) {
+	tags, err := getTags(status)
+	if err != nil {
+		return ScrobbleEvent{}, err
+	}
+
+	scrobble := ScrobbleEvent{
 		Artist: tags["artist"],
 		Track:  tags["title"],
 		Album:  tags["album"],
 		MbID:   tags["mbid"],
-	}, nil
+	}
+
+	if scrobble.Artist == "" || scrobble.Track == "" {
+		if guessed, _, ok := parseFilename(r.filenamePatterns, status.File); ok {
+			scrobble = fillFromFilename(scrobble, guessed)
+		}
+	}
+
+	scrobble.Path = status.File
+	scrobble.Genre = tags["genre"]
+	scrobble.Duration = status.Duration
+	return scrobble, nil
+}
+
+// fillFromFilename fills the fields the tags left empty from what was
+// guessed from the file path, keeping the tags the file has.
+func fillFromFilename(scrobble, guessed ScrobbleEvent) ScrobbleEvent {
+	if scrobble.Artist == "" {
+		scrobble.Artist = guessed.Artist
+	}
+	if scrobble.Track == "" {
+		scrobble.Track = guessed.Track
+	}
+	if scrobble.Album == "" {
+		scrobble.Album = guessed.Album
+	}
+	scrobble.MetadataSource = guessed.MetadataSource
+	return scrobble
+}
+
+// progress returns how long the track in status has played towards
+// scrobbleThreshold. For streams it counts from when the current title
+// first appeared, so it is only meaningful after currentTrack.
+func (r *trackResolver) progress(status CmusOutput, now time.Time) time.Duration {
+	if status.Stream != "" {
+		if status.Stream != r.streams.title {
+			return 0
+		}
+		return now.Sub(r.streams.since)
+	}
+	return time.Duration(status.Position) * time.Second
+}
+
+func (r *trackResolver) getCurrentStreamTrack(status CmusOutput) ScrobbleEvent {
+	if !r.streams.playedLongEnough(status.Stream, time.Now()) {
+		return ScrobbleEvent{}
+	}
+
+	artist, title, ok := parseStreamTitle(r.streamRules, status.File, status.Stream)
+	if !ok {
+		return ScrobbleEvent{}
+	}
+
+	return ScrobbleEvent{
+		Artist: artist,
+		Track:  title,
+		Stream: status.File,
+	}
 }
 
 func waitForCmus() error {
@@ -76,7 +207,7 @@ func waitForCmus() error {
 		return err
 	}
 	if !running {
-		return fmt.Errorf("cmus not running")
+		return errCmusNotRunning
 	}
 
 	playing, err := isCmusPlaying()
@@ -84,15 +215,28 @@ func waitForCmus() error {
 		return err
 	}
 	if !playing {
-		return fmt.Errorf("cmus not playing")
+		return errCmusNotPlaying
 	}
 
 	return nil
 }
 
+// cmusPlayerState returns the cmus player status (playing, paused or
+// stopped), or not_running if cmus can't be reached.
+func cmusPlayerState() string {
+	status, err := getCmusStatus()
+	if err != nil || status.Status == "" {
+		return "not_running"
+	}
+	return status.Status
+}
+
 type CmusOutput struct {
 	Status   string
 	Position int
+	Duration int
+	File     string
+	Stream   string
 	Tags     map[string]string
 }
 
@@ -119,6 +263,16 @@ func parseCmusStatus(status string) (CmusOutput, error) {
 				return CmusOutput{}, fmt.Errorf("failed to parse position: %w", err)
 			}
 			output.Position = position
+		case "duration":
+			duration, err := strconv.Atoi(value)
+			if err != nil {
+				return CmusOutput{}, fmt.Errorf("failed to parse duration: %w", err)
+			}
+			output.Duration = duration
+		case "file":
+			output.File = value
+		case "stream":
+			output.Stream = value
 		case "tag":
 			tagParts := strings.SplitN(value, " ", 2)
 			if len(tagParts) == 2 {
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// cliContext carries what a command needs: the loaded config and, for
+// commands that talk to relays, a connected Nostr client.
+type cliContext struct {
+	configPath string
+	profile    string
+	// rawConfig is the config as loaded; config is rawConfig merged with
+	// the selected profile.
+	rawConfig Config
+	config    Config
+	nostr     *Nostr
+}
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	// needsConfig and needsNostr control what runCommand sets up before
+	// calling run.
+	needsConfig bool
+	needsNostr  bool
+	run         func(ctx *cliContext, args []string) error
+}
+
+var commands = []*command{
+	{name: "run", summary: "Watch cmus and publish scrobbles (default)", needsConfig: true, needsNostr: true, run: cmdRun},
+	{name: "ls", args: "[-n count] [-all-profiles]", summary: "List recent scrobbles", needsConfig: true, needsNostr: true, run: cmdList},
+	{name: "stats", args: "[-limit count] [-top count] [-all-profiles]", summary: "Show top artists and tracks", needsConfig: true, needsNostr: true, run: cmdStats},
+	{name: "scrobble", args: "-artist ... -track ... [-album ...] [-at time] [-mbid id] | -stdin", summary: "Record listens that happened outside cmus", needsConfig: true, needsNostr: true, run: cmdScrobble},
+	{name: "import", args: "[-format jsonl|scrobbler-log] [-tz zone] [-include-skipped] <file>", summary: "Import a .scrobbler.log or a JSONL backup", needsConfig: true, needsNostr: true, run: cmdImport},
+	{name: "export", args: "[-format jsonl|lastfm-csv|listenbrainz|scrobbler-log] [-o file [-resume]]", summary: "Export the full scrobble history", needsConfig: true, needsNostr: true, run: cmdExport},
+	{name: "love", args: "[-artist ... -track ... [-mbid id]] | -import-lastfm user", summary: "Love the playing track or a given one", needsConfig: true, needsNostr: true, run: cmdLove},
+	{name: "unlove", args: "[-artist ... -track ... [-mbid id]]", summary: "Remove a track from your loved tracks", needsConfig: true, needsNostr: true, run: cmdUnlove},
+	{name: "playlist", args: "publish [-title name] [-dry-run] <cmus playlist|file.m3u>", summary: "Publish a playlist as kind 30037 of kind 31337 tracks", needsConfig: true, needsNostr: true, run: cmdPlaylist},
+	{name: "tracks", args: "[-since date] [-until date] [-dry-run]", summary: "Publish kind 31337 audio tracks for scrobbled recordings", needsConfig: true, needsNostr: true, run: cmdTracks},
+	{name: "recap", args: "[-period week|month|year] [-date date] [-publish]", summary: "Preview and publish a listening recap", needsConfig: true, needsNostr: true, run: cmdRecap},
+	{name: "feed", args: "[-n count] [-json]", summary: "Follow the scrobbles of the people you follow", needsConfig: true, needsNostr: true, run: cmdFeed},
+	{name: "listen-along", args: "[-play] [-dry-run] <npub>", summary: "Queue the tracks a friend is playing in cmus", needsConfig: true, needsNostr: true, run: cmdListenAlong},
+	{name: "cache", args: "[info | sync [-full]]", summary: "Show or resync the local history cache", needsConfig: true, needsNostr: true, run: cmdCache},
+	{name: "delete", args: "[filters] <index|id>...", summary: "Publish deletion requests for scrobbles", needsConfig: true, needsNostr: true, run: cmdDelete},
+	{name: "edit", args: "[filters] -set-... <index|id>...", summary: "Correct scrobbles and delete the originals", needsConfig: true, needsNostr: true, run: cmdEdit},
+	{name: "reveal", args: "[filters] <index|id>...", summary: "Republish private scrobbles publicly", needsConfig: true, needsNostr: true, run: cmdReveal},
+	{name: "key", args: "[generate]", summary: "Show the configured public key, or generate a new key", run: cmdKey},
+	{name: "rules", args: "test [-artist ...] [-title ...] [-path ...]", summary: "Show which rule matches a track", needsConfig: true, run: cmdRules},
+	{name: "dry-run", args: "<path>", summary: "Show what would be scrobbled for an untagged file", needsConfig: true, run: cmdDryRun},
+	{name: "install-service", args: "[-force] [-print]", summary: "Install a systemd user service for run", run: cmdInstallService},
+	{name: "doctor", summary: "Check cmus, config, key and relays", run: cmdDoctor},
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: cmus-scrobbler [-config file] [-profile name] <command> [arguments]")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-8s %s\n", cmd.name, cmd.summary)
+		if cmd.args != "" {
+			fmt.Fprintf(out, "  %-8s   %s %s\n", "", cmd.name, cmd.args)
+		}
+	}
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Global flags:")
+	flag.PrintDefaults()
+}
+
+func runCommand(cmd *command, configPath, profile string, args []string) error {
+	ctx := &cliContext{configPath: configPath, profile: profile}
+
+	if cmd.needsConfig {
+		config, err := LoadConfig(configPath)
+		if err != nil {
+			return fmt.Errorf("error handling config: %w", err)
+		}
+		ctx.rawConfig = config
+		if ctx.config, err = config.Profile(profile); err != nil {
+			return err
+		}
+		slog.SetDefault(slog.New(newLogHandler(ctx.config.Log, os.Stderr, slog.HandlerOptions{})))
+	}
+
+	if cmd.needsNostr {
+		nostrClient, err := connectNostr(ctx.config)
+		if err != nil {
+			return fmt.Errorf("error creating Nostr client: %w", err)
+		}
+		defer nostrClient.Close()
+		ctx.nostr = nostrClient
+
+		// Written to stderr so commands can write data to stdout.
+		npub, _ := nip19.EncodePublicKey(nostrClient.pk)
+		if profile != "" {
+			fmt.Fprintln(os.Stderr, "Profile:", profile)
+		}
+		fmt.Fprintln(os.Stderr, "Public key:", npub)
+		fmt.Fprintln(os.Stderr, "Relays:", ctx.config.Relays)
+	}
+
+	return cmd.run(ctx, args)
+}
+
+// shutdownTimeout bounds how long run tries to publish queued scrobbles
+// when it is stopped.
+const shutdownTimeout = 10 * time.Second
+
+func cmdRun(ctx *cliContext, args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	useTUI := fs.Bool("tui", false, "Show a full-screen terminal UI instead of log lines")
+	fs.Parse(args)
+
+	runCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	targets, err := newProfileTargets(ctx.rawConfig, ctx.profile, ctx.nostr)
+	if err != nil {
+		return err
+	}
+	defer targets.Close(ctx.nostr)
+
+	if ctx.nostr.cache != nil {
+		interval := time.Duration(ctx.config.Cache.SyncInterval) * time.Minute
+		if interval == 0 {
+			interval = defaultCacheSyncInterval
+		}
+		fullInterval := time.Duration(ctx.config.Cache.FullSyncInterval) * time.Hour
+		if fullInterval == 0 {
+			fullInterval = defaultCacheFullSyncInterval
+		}
+		stop := make(chan struct{})
+		defer close(stop)
+		go syncCacheEvery(ctx.nostr, interval, fullInterval, stop)
+	}
+	if len(ctx.config.Recap.Periods) > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go recapEvery(ctx.nostr, ctx.config.Recap, stop)
+	}
+
+	d := newDaemon()
+	d.setHooks(newHookRunner(ctx.config.Hooks))
+	defer d.setHooks(nil)
+	d.setSinks(newSinkRunner(ctx.rawConfig))
+	defer d.setSinks(nil)
+	d.love = func(track TrackStatus, love bool) error {
+		_, err := ctx.nostr.SetLoved(LovedTrack{Artist: track.Artist, Title: track.Track, MbID: track.MbID}, love)
+		return err
+	}
+	if lastEvent, err := ctx.nostr.GetLastScrobble(); err == nil && lastEvent != nil {
+		d.update(func(status *DaemonStatus) { status.LastEvent = lastEvent })
+	}
+
+	statePath, err := runStatePath(ctx.nostr.pk)
+	if err != nil {
+		return err
+	}
+	if state, err := loadRunState(statePath); err != nil {
+		slog.Warn("not restoring state", "err", err)
+	} else {
+		d.restore(state, targets, time.Now())
+	}
+
+	if ctx.config.API.Listen != "" {
+		stopAPI, err := serveAPI(ctx.config.API, d)
+		if err != nil {
+			return err
+		}
+		defer stopAPI()
+	}
+
+	if ctx.config.Metrics.Listen != "" {
+		stopMetrics, err := serveMetrics(ctx.config.Metrics, d)
+		if err != nil {
+			return err
+		}
+		defer stopMetrics()
+	}
+
+	if ctx.config.Webhooks.Listen != "" || ctx.config.Lastfm.User != "" {
+		d.media = newMediaTracker()
+	}
+	if ctx.config.Webhooks.Listen != "" {
+		stopWebhooks, err := serveWebhooks(ctx.config.Webhooks, d)
+		if err != nil {
+			return err
+		}
+		defer stopWebhooks()
+	}
+	if ctx.config.Lastfm.User != "" {
+		lastfmPath, err := lastfmStatePath(ctx.nostr.pk)
+		if err != nil {
+			return err
+		}
+		source, err := newLastfmSource(ctx.config, lastfmPath, d.media, d.wakeUp)
+		if err != nil {
+			return err
+		}
+		go source.run(runCtx, ctx.config.Lastfm.interval())
+	}
+
+	slog.SetDefault(slog.New(newLogHandler(ctx.config.Log, os.Stdout, slog.HandlerOptions{})))
+	if *useTUI {
+		stopTUI, err := startTUI(d, ctx.nostr, ctx.config.Log, cancel)
+		if errors.Is(err, errNotTerminal) {
+			slog.Warn("not starting the terminal UI", "err", err)
+		} else if err != nil {
+			return fmt.Errorf("error starting terminal UI: %w", err)
+		} else {
+			defer stopTUI()
+		}
+	}
+
+	reloads := make(chan scrobblerReload, 1)
+	go reloadOnHangup(runCtx, ctx, d, reloads)
+	if timeout := watchdogInterval(); timeout > 0 {
+		go watchdog(runCtx, d, timeout)
+	}
+	notifySystemd("READY=1")
+
+	err = runScrobbler(runCtx, targets, ctx.config, d, reloads)
+
+	notifySystemd("STOPPING=1")
+	slog.Info("shutting down")
+	d.flushPending(shutdownTimeout)
+	if err := saveRunState(statePath, d.snapshot(time.Now())); err != nil {
+		slog.Error("error saving state", "err", err)
+	}
+	return err
+}
+
+// reloadOnHangup reloads the config on SIGHUP and sends it to the run loop.
+// Settings the loop can't change while running are logged as needing a
+// restart; an invalid config is logged and the running one kept.
+func reloadOnHangup(runCtx context.Context, ctx *cliContext, d *daemon, reloads chan scrobblerReload) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-runCtx.Done():
+			return
+		case <-hangup:
+		}
+
+		notifySystemd("RELOADING=1")
+		reload, config, err := loadScrobblerReload(ctx)
+		if err != nil {
+			slog.Error("not reloading config", "err", err)
+		} else {
+			for _, setting := range restartNeeded(ctx.config, config) {
+				slog.Warn("config change needs a restart", "setting", setting)
+			}
+			setLogLevel(config.Log)
+			d.setHooks(newHookRunner(config.Hooks))
+			d.setSinks(newSinkRunner(reload.targets.config))
+			// An unapplied reload is replaced by the newer one.
+			select {
+			case stale := <-reloads:
+				stale.targets.Close(ctx.nostr)
+			default:
+			}
+			reloads <- reload
+			d.wakeUp()
+		}
+		notifySystemd("READY=1")
+	}
+}
+
+func loadScrobblerReload(ctx *cliContext) (scrobblerReload, Config, error) {
+	rawConfig, err := LoadConfig(ctx.configPath)
+	if err != nil {
+		return scrobblerReload{}, Config{}, fmt.Errorf("error handling config: %w", err)
+	}
+	config, err := rawConfig.Profile(ctx.profile)
+	if err != nil {
+		return scrobblerReload{}, Config{}, err
+	}
+	targets, err := newProfileTargets(rawConfig, ctx.profile, ctx.nostr)
+	if err != nil {
+		return scrobblerReload{}, Config{}, err
+	}
+	resolver, err := newTrackResolver(config)
+	if err != nil {
+		return scrobblerReload{}, Config{}, err
+	}
+	return scrobblerReload{targets: targets, resolver: resolver}, config, nil
+}
+
+// restartNeeded lists the settings that differ between old and new but
+// are only read when run starts.
+func restartNeeded(old, new Config) []string {
+	var settings []string
+	for _, s := range []struct {
+		name     string
+		old, new any
+	}{
+		{"nsec", old.Nsec, new.Nsec},
+		{"bunker", old.Bunker, new.Bunker},
+		{"relays", old.Relays, new.Relays},
+		{"cache", old.Cache, new.Cache},
+		{"api", old.API, new.API},
+		{"recap", old.Recap, new.Recap},
+		{"log.format", old.Log.Format, new.Log.Format},
+		{"metrics", old.Metrics, new.Metrics},
+		{"webhooks", old.Webhooks, new.Webhooks},
+		{"lastfm", old.Lastfm, new.Lastfm},
+	} {
+		if !reflect.DeepEqual(s.old, s.new) {
+			settings = append(settings, s.name)
+		}
+	}
+	return settings
+}
+
+func cmdList(ctx *cliContext, args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	count := fs.Int("n", 50, "Number of scrobbles to list")
+	allProfiles := fs.Bool("all-profiles", false, "List scrobbles for every profile")
+	fs.Parse(args)
+
+	list := func(n *Nostr) error {
+		events, err := n.QueryRecentScrobbles(*count)
+		if err != nil {
+			return fmt.Errorf("error listing scrobbles: %w", err)
+		}
+		loved, err := n.FetchLovedTracks()
+		if err != nil {
+			fmt.Println("Not showing loved tracks:", err)
+		}
+		n.PrintScrobbles(events, loved)
+		return nil
+	}
+
+	if !*allProfiles {
+		return list(ctx.nostr)
+	}
+	return forEachProfile(ctx, func(profile string, n *Nostr) error {
+		fmt.Printf("\n== Profile %s ==\n", profile)
+		return list(n)
+	})
+}
+
+func cmdDelete(ctx *cliContext, args []string) error {
+	return runDelete(ctx.nostr, args)
+}
+
+func cmdEdit(ctx *cliContext, args []string) error {
+	return runEdit(ctx.nostr, args)
+}
+
+// cmdReveal republishes private scrobbles publicly. Each argument is either
+// an event ID or an index from the ls listing.
+func cmdReveal(ctx *cliContext, args []string) error {
+	fs := flag.NewFlagSet("reveal", flag.ExitOnError)
+	var selector scrobbleSelector
+	selector.registerFlags(fs)
+	fs.Parse(args)
+
+	events, err := selector.selectScrobbles(ctx.nostr, fs.Args())
+	if err != nil {
+		return err
+	}
+	return ctx.nostr.RevealScrobbles(events)
+}
+
+func cmdRules(ctx *cliContext, args []string) error {
+	if len(args) == 0 || args[0] != "test" {
+		return fmt.Errorf("usage: cmus-scrobbler rules test [-artist ...] [-title ...] [-path ...]")
+	}
+	return runRulesTest(ctx.config, args[1:])
+}
+
+func cmdDryRun(ctx *cliContext, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: cmus-scrobbler dry-run <path>")
+	}
+	patterns, err := compileFilenamePatterns(ctx.config.FilenamePatterns)
+	if err != nil {
+		return fmt.Errorf("error in filename patterns: %w", err)
+	}
+	printFilenameDryRun(patterns, args[0])
+	return nil
+}
+
+func cmdKey(ctx *cliContext, args []string) error {
+	if len(args) > 0 && args[0] == "generate" {
+		nsec, npub, err := generateKey()
+		if err != nil {
+			return err
+		}
+		fmt.Println("nsec:", nsec)
+		fmt.Println("npub:", npub)
+		fmt.Fprintln(os.Stderr, "Keep the nsec secret. Put it in your config to use this key.")
+		return nil
+	}
+
+	rawConfig, err := LoadConfig(ctx.configPath)
+	if err != nil {
+		return fmt.Errorf("error handling config: %w", err)
+	}
+	config, err := rawConfig.Profile(ctx.profile)
+	if err != nil {
+		return err
+	}
+
+	// A remote signer's key is the npub the config has for it.
+	if config.Bunker != "" {
+		pk, err := decodePubkey(config.Npub)
+		if err != nil {
+			return err
+		}
+		fmt.Println("npub:", config.Npub)
+		fmt.Println("hex: ", pk)
+		return nil
+	}
+
+	sk, err := decodeNsec(config.Nsec)
+	if err != nil {
+		return err
+	}
+	pk, npub, err := publicKeys(sk)
+	if err != nil {
+		return err
+	}
+	fmt.Println("npub:", npub)
+	fmt.Println("hex: ", pk)
+	return nil
+}
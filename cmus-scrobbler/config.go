@@ -1,82 +1,487 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 
-	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
 )
 
 const DefaultConfigFile = ".cmus-scrobbler.yaml"
 
+// DefaultRelays are written to the config when it has no relays.
+var DefaultRelays = []string{
+	"wss://relay.nostr-music.cc",
+}
+
+// EnvPrefix is the prefix of environment variables that override config
+// values, e.g. CMUS_SCROBBLER_RELAYS.
+const EnvPrefix = "CMUS_SCROBBLER_"
+
 type Config struct {
-	Nsec    string   `yaml:"nsec"`
+	Nsec string `yaml:"nsec"`
+	Npub string `yaml:"npub"`
+	// Bunker is a bunker:// URL of a NIP-46 remote signer to use instead
+	// of nsec. It needs npub.
+	Bunker  string   `yaml:"bunker"`
 	Relays  []string `yaml:"relays"`
 	APIKey  string   `yaml:"api_key"`
 	Secret  string   `yaml:"secret"`
 	Session string   `yaml:"session"`
+
+	Streams          []StreamRule `yaml:"streams"`
+	FilenamePatterns []string     `yaml:"filename_patterns"`
+	Rules            []Rule       `yaml:"rules"`
+	Private          bool         `yaml:"private"`
+	NowPlaying       bool         `yaml:"now_playing"`
+
+	Profiles      map[string]Profile `yaml:"profiles"`
+	ProfileSelect []ProfileSelector  `yaml:"profile_select"`
+
+	Cache CacheConfig `yaml:"cache"`
+	API   APIConfig   `yaml:"api"`
+	Recap RecapConfig `yaml:"recap"`
+
+	Log     LogConfig     `yaml:"log"`
+	Metrics MetricsConfig `yaml:"metrics"`
+	Hooks   []Hook        `yaml:"hooks"`
+	Sinks   []Sink        `yaml:"sinks"`
+
+	Webhooks WebhooksConfig `yaml:"webhooks"`
+	Lastfm   LastfmConfig   `yaml:"lastfm"`
 }
 
+// ConfigError is a validation error tied to a position in the config file
+// or to an environment variable.
+type ConfigError struct {
+	Source string
+	Line   int
+	Field  string
+	Msg    string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", e.Source, e.Line, e.Field, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Source, e.Field, e.Msg)
+}
+
+// resolveConfigPath returns configPath, or the default location in the
+// user's home directory when it is empty.
+func resolveConfigPath(configPath string) (string, error) {
+	if configPath != "" {
+		return configPath, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting home directory: %w", err)
+	}
+	return filepath.Join(homeDir, DefaultConfigFile), nil
+}
+
+// LoadConfig reads and validates the config file. Missing values (a key, or
+// relays) are filled in and written back without touching anything else in
+// the file, including comments and keys this version does not know about.
+// Environment variables override values from the file.
 func LoadConfig(configPath string) (Config, error) {
 	var config Config
 
-	if configPath == "" {
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			return config, fmt.Errorf("error getting home directory: %w", err)
-		}
-		configPath = filepath.Join(homeDir, DefaultConfigFile)
+	configPath, err := resolveConfigPath(configPath)
+	if err != nil {
+		return config, err
 	}
 
 	data, err := os.ReadFile(configPath)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return config, fmt.Errorf("error reading config file %s: %w", configPath, err)
 	}
+	created := os.IsNotExist(err)
 
-	err = yaml.Unmarshal(data, &config)
+	doc, err := parseConfigDocument(configPath, data)
 	if err != nil {
-		return config, fmt.Errorf("error parsing config file %s: %w", configPath, err)
+		return config, err
 	}
 
-	if config.Nsec == "" {
-		return generateNewConfig(configPath, true)
+	added := fillMissingConfig(doc)
+	if len(added) > 0 {
+		if err := writeConfigDocument(configPath, doc); err != nil {
+			return config, err
+		}
+		if created {
+			fmt.Println("Generated new config file:", configPath)
+		} else {
+			fmt.Printf("Added %s to config file %s\n", strings.Join(added, " and "), configPath)
+		}
 	}
 
-	return config, nil
+	return decodeConfig(configPath, doc)
 }
 
-func generateNewConfig(configPath string, generateKey bool) (Config, error) {
+// readConfig parses and validates a config file, with the environment
+// overrides applied, without modifying it.
+func readConfig(configPath string) (Config, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return Config{}, fmt.Errorf("error reading config file %s: %w", configPath, err)
+	}
+	doc, err := parseConfigDocument(configPath, data)
+	if err != nil {
+		return Config{}, err
+	}
+	return decodeConfig(configPath, doc)
+}
 
-	config := Config{
-		Nsec: "",
-		Relays: []string{
-			"wss://relay.nostr-music.cc",
-		},
+// parseConfigDocument parses data into a YAML mapping node, returning an
+// empty mapping for an empty file.
+func parseConfigDocument(configPath string, data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", configPath, err)
 	}
 
-	if generateKey {
-		sk := nostr.GeneratePrivateKey()
-		nsec, _ := nip19.EncodePrivateKey(sk)
-		config.Nsec = nsec
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
 	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("error parsing config file %s: expected a mapping of settings", configPath)
+	}
+	return &doc, nil
+}
 
-	data, err := yaml.Marshal(config)
+func writeConfigDocument(configPath string, doc *yaml.Node) error {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("error encoding config: %w", err)
+	}
+	enc.Close()
+
+	if err := os.WriteFile(configPath, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("error writing config file %s: %w", configPath, err)
+	}
+	return nil
+}
+
+// mappingValue returns the value node for key in a mapping node, or nil.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// fillMissingConfig adds a new key when there is neither nsec nor bunker
+// (and none in the environment) and the default relays when there are none. It returns the
+// names of the values it added.
+func fillMissingConfig(doc *yaml.Node) []string {
+	root := doc.Content[0]
+	var added []string
+
+	if os.Getenv(EnvPrefix+"NSEC") == "" && os.Getenv(EnvPrefix+"BUNKER") == "" {
+		nsec := mappingValue(root, "nsec")
+		bunker := mappingValue(root, "bunker")
+		if (nsec == nil || nsec.Value == "") && (bunker == nil || bunker.Value == "") {
+			newNsec, npub, err := generateKey()
+			if err == nil {
+				setScalar(root, "nsec", newNsec)
+				if npubNode := mappingValue(root, "npub"); npubNode == nil || npubNode.Value == "" {
+					setScalar(root, "npub", npub)
+				}
+				added = append(added, "a new private key (nsec)")
+			}
+		}
+	}
+
+	if os.Getenv(EnvPrefix+"RELAYS") == "" {
+		relays := mappingValue(root, "relays")
+		if relays == nil || (relays.Kind == yaml.SequenceNode && len(relays.Content) == 0) || (relays.Kind == yaml.ScalarNode && relays.Value == "") {
+			seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			for _, relay := range DefaultRelays {
+				seq.Content = append(seq.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: relay})
+			}
+			setNode(root, "relays", seq)
+			added = append(added, "default relays")
+		}
+	}
+
+	return added
+}
+
+func setScalar(mapping *yaml.Node, key, value string) {
+	setNode(mapping, key, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value})
+}
+
+// setNode replaces the value for key, keeping comments attached to the old
+// value, or appends key if it is not present.
+func setNode(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			old := mapping.Content[i+1]
+			if value.Kind == yaml.ScalarNode {
+				value.LineComment = old.LineComment
+			} else if mapping.Content[i].LineComment == "" {
+				// Block values render line comments after the key.
+				mapping.Content[i].LineComment = old.LineComment
+			}
+			value.HeadComment = old.HeadComment
+			value.FootComment = old.FootComment
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		value,
+	)
+}
+
+// decodeConfig decodes doc into a Config, applies the environment overrides
+// and validates the result. Errors point at the line in the file, or at the
+// environment variable the value came from.
+func decodeConfig(configPath string, doc *yaml.Node) (Config, error) {
+	var config Config
+	if err := doc.Decode(&config); err != nil {
+		return config, fmt.Errorf("error parsing config file %s: %w", configPath, err)
+	}
+	fromEnv, err := applyEnvOverrides(&config)
 	if err != nil {
-		return config, fmt.Errorf("error marshaling new config: %w", err)
+		return config, err
+	}
+
+	root := doc.Content[0]
+	errs := []error{validateConfig(config, func(field string, index int, msg string) *ConfigError {
+		if name, ok := fromEnv[field]; ok {
+			return &ConfigError{Source: "environment", Field: name, Msg: msg}
+		}
+		return &ConfigError{Source: configPath, Line: nodeLine(root, field, index), Field: fieldName(field, index), Msg: msg}
+	})}
+
+	// Profiles are validated merged with the top level. Errors in inherited
+	// values are already reported above, so only the profile's own fields
+	// are checked here.
+	profiles := mappingValue(root, "profiles")
+	for _, name := range config.ProfileNames()[1:] {
+		merged, _ := config.Profile(name)
+		var profileNode *yaml.Node
+		if profiles != nil {
+			profileNode = mappingValue(profiles, name)
+		}
+		errs = append(errs, validateConfig(merged, func(field string, index int, msg string) *ConfigError {
+			if profileNode == nil || mappingValue(profileNode, field) == nil {
+				return nil
+			}
+			return &ConfigError{
+				Source: configPath,
+				Line:   nodeLine(profileNode, field, index),
+				Field:  "profiles." + name + "." + fieldName(field, index),
+				Msg:    msg,
+			}
+		}))
 	}
 
-	err = os.WriteFile(configPath, data, 0600)
+	if _, err := compileProfileSelectors(config); err != nil {
+		errs = append(errs, &ConfigError{Source: configPath, Line: nodeLine(root, "profile_select", -1), Field: "profile_select", Msg: err.Error()})
+	}
+
+	return config, errors.Join(errs...)
+}
+
+// nodeLine returns the line of key in mapping, or of its index'th item when
+// index >= 0. It returns 0 if the key is not present.
+func nodeLine(mapping *yaml.Node, key string, index int) int {
+	value := mappingValue(mapping, key)
+	if value == nil {
+		return 0
+	}
+	if index >= 0 && value.Kind == yaml.SequenceNode && index < len(value.Content) {
+		return value.Content[index].Line
+	}
+	return value.Line
+}
+
+func fieldName(field string, index int) string {
+	if index < 0 {
+		return field
+	}
+	return fmt.Sprintf("%s[%d]", field, index)
+}
+
+// validateConfig checks every field of config. newError builds an error for
+// a field, or for an item of a list field when index >= 0; it may return nil
+// to ignore errors in that field.
+func validateConfig(config Config, newErrorFunc func(field string, index int, msg string) *ConfigError) error {
+	var errs []error
+	newError := func(field string, index int, msg string) error {
+		if err := newErrorFunc(field, index, msg); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if config.Bunker != "" {
+		if err := validateBunkerURL(config.Bunker); err != nil {
+			errs = append(errs, newError("bunker", -1, err.Error()))
+		}
+		if config.Nsec != "" {
+			errs = append(errs, newError("bunker", -1, "set either nsec or bunker"))
+		}
+		if config.Npub == "" {
+			errs = append(errs, newError("bunker", -1, "needs npub, the key the remote signer signs for"))
+		} else if prefix, _, err := nip19.Decode(config.Npub); err != nil || prefix != "npub" {
+			errs = append(errs, newError("npub", -1, "must be a valid npub1... key"))
+		}
+	} else if config.Nsec == "" {
+		errs = append(errs, newError("nsec", -1, "missing private key"))
+	} else if sk, err := decodeNsec(config.Nsec); err != nil {
+		errs = append(errs, newError("nsec", -1, "must be a valid nsec1... key"))
+	} else if config.Npub != "" {
+		prefix, _, err := nip19.Decode(config.Npub)
+		if err != nil || prefix != "npub" {
+			errs = append(errs, newError("npub", -1, "must be a valid npub1... key"))
+		} else if _, npub, err := publicKeys(sk); err == nil && npub != config.Npub {
+			errs = append(errs, newError("npub", -1, fmt.Sprintf("does not match nsec, which belongs to %s", npub)))
+		}
+	}
+
+	if len(config.Relays) == 0 {
+		errs = append(errs, newError("relays", -1, "at least one relay is required"))
+	}
+	for i, relay := range config.Relays {
+		if err := validateRelayURL(relay); err != nil {
+			errs = append(errs, newError("relays", i, err.Error()))
+		}
+	}
+
+	for i, rule := range config.Streams {
+		if _, err := compileStreamRules([]StreamRule{rule}); err != nil {
+			errs = append(errs, newError("streams", i, strings.TrimPrefix(err.Error(), "stream rule 0: ")))
+		}
+	}
+	for i, pattern := range config.FilenamePatterns {
+		if _, err := compileFilenamePattern(pattern); err != nil {
+			errs = append(errs, newError("filename_patterns", i, err.Error()))
+		}
+	}
+	for i, rule := range config.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if _, err := compileRules([]Rule{rule}); err != nil {
+			errs = append(errs, newError("rules", i, err.Error()))
+		}
+	}
+
+	if config.API.Listen != "" {
+		if err := validateAPIListen(config.API.Listen); err != nil {
+			errs = append(errs, newError("api", -1, "listen: "+err.Error()))
+		}
+	}
+
+	if config.Cache.SyncInterval < 0 {
+		errs = append(errs, newError("cache", -1, "sync_interval must not be negative"))
+	}
+	if config.Cache.FullSyncInterval < 0 {
+		errs = append(errs, newError("cache", -1, "full_sync_interval must not be negative"))
+	}
+	if err := validateLogConfig(config.Log); err != nil {
+		errs = append(errs, newError("log", -1, err.Error()))
+	}
+	if config.Metrics.Listen != "" {
+		if err := validateMetricsListen(config.Metrics.Listen); err != nil {
+			errs = append(errs, newError("metrics", -1, "listen: "+err.Error()))
+		}
+	}
+	if config.Webhooks.Listen != "" {
+		if err := validateWebhooksConfig(config.Webhooks); err != nil {
+			errs = append(errs, newError("webhooks", -1, err.Error()))
+		}
+	}
+	if err := validateLastfmConfig(config.Lastfm, config.APIKey); err != nil {
+		errs = append(errs, newError("lastfm", -1, err.Error()))
+	}
+	for i, hook := range config.Hooks {
+		if err := validateHook(hook); err != nil {
+			errs = append(errs, newError("hooks", i, err.Error()))
+		}
+	}
+	for i, sink := range config.Sinks {
+		if err := validateSink(sink); err != nil {
+			errs = append(errs, newError("sinks", i, err.Error()))
+		}
+	}
+	for _, period := range config.Recap.Periods {
+		if !validRecapPeriod(period) {
+			errs = append(errs, newError("recap", -1, fmt.Sprintf("unknown period %q, use week, month or year", period)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateRelayURL(relay string) error {
+	u, err := url.Parse(relay)
 	if err != nil {
-		return config, fmt.Errorf("error writing new config to file: %w", err)
+		return fmt.Errorf("invalid relay URL %q: %w", relay, err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return fmt.Errorf("relay URL %q must start with ws:// or wss://", relay)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("relay URL %q has no host", relay)
+	}
+	return nil
+}
+
+// applyEnvOverrides replaces config values with CMUS_SCROBBLER_* environment
+// variables. It returns the variable each overridden field came from, keyed
+// by field name. The result still needs validating.
+func applyEnvOverrides(config *Config) (map[string]string, error) {
+	overrides := map[string]*string{
+		"nsec":    &config.Nsec,
+		"npub":    &config.Npub,
+		"bunker":  &config.Bunker,
+		"api_key": &config.APIKey,
+		"secret":  &config.Secret,
+		"session": &config.Session,
+	}
+	fromEnv := make(map[string]string)
+	for field, value := range overrides {
+		name := EnvPrefix + strings.ToUpper(field)
+		if env, ok := os.LookupEnv(name); ok {
+			*value = env
+			fromEnv[field] = name
+		}
 	}
 
-	fmt.Println("Generated new config file with a new private key (nsec).")
-	fmt.Println("Config file location:", configPath)
-	fmt.Println("Please add your desired relay URLs to the config file.")
+	if value, ok := os.LookupEnv(EnvPrefix + "RELAYS"); ok {
+		config.Relays = nil
+		for _, relay := range strings.Split(value, ",") {
+			if relay = strings.TrimSpace(relay); relay != "" {
+				config.Relays = append(config.Relays, relay)
+			}
+		}
+		fromEnv["relays"] = EnvPrefix + "RELAYS"
+	}
 
-	return config, nil
+	if value, ok := os.LookupEnv(EnvPrefix + "PRIVATE"); ok {
+		private, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, &ConfigError{Source: "environment", Field: EnvPrefix + "PRIVATE", Msg: "must be true or false"}
+		}
+		config.Private = private
+		fromEnv["private"] = EnvPrefix + "PRIVATE"
+	}
+	return fromEnv, nil
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigFillsMissingValuesOnly(t *testing.T) {
+	path := writeTestConfig(t, `# my scrobbler
+nsec: ""
+relays:
+  - wss://relay.example.com # home relay
+api_key: abc123
+future_option: keep me
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if !strings.HasPrefix(config.Nsec, "nsec1") {
+		t.Errorf("nsec was not generated: %q", config.Nsec)
+	}
+	if len(config.Relays) != 1 || config.Relays[0] != "wss://relay.example.com" {
+		t.Errorf("relays = %v", config.Relays)
+	}
+	if config.APIKey != "abc123" {
+		t.Errorf("api_key = %q", config.APIKey)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	for _, want := range []string{"# my scrobbler", "# home relay", "future_option: keep me", "api_key: abc123", config.Nsec} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("rewritten config lost %q:\n%s", want, data)
+		}
+	}
+}
+
+func TestLoadConfigReportsLineNumbers(t *testing.T) {
+	_, npub, _ := generateKey()
+	nsec, _, _ := generateKey()
+	path := writeTestConfig(t, `nsec: `+nsec+`
+npub: `+npub+`
+relays:
+  - wss://relay.example.com
+  - https://relay.example.org
+`)
+
+	_, err := LoadConfig(path)
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{path + ":2: npub", path + ":5: relays[1]"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestLoadConfigEnvOverrides(t *testing.T) {
+	nsec, _, _ := generateKey()
+	path := writeTestConfig(t, "nsec: "+nsec+"\nrelays:\n  - wss://relay.example.com\n")
+
+	t.Setenv(EnvPrefix+"RELAYS", "wss://a.example.com, wss://b.example.com")
+	t.Setenv(EnvPrefix+"PRIVATE", "true")
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if len(config.Relays) != 2 || config.Relays[1] != "wss://b.example.com" {
+		t.Errorf("relays = %v", config.Relays)
+	}
+	if !config.Private {
+		t.Error("private was not overridden")
+	}
+
+	t.Setenv(EnvPrefix+"RELAYS", "http://not-a-relay")
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("expected an error for an invalid relay in the environment")
+	}
+}
+
+func TestLoadConfigFromEnvironmentOnly(t *testing.T) {
+	nsec, npub, _ := generateKey()
+	path := writeTestConfig(t, "private: true\n")
+	t.Setenv(EnvPrefix+"NSEC", nsec)
+	t.Setenv(EnvPrefix+"RELAYS", "wss://relay.example.com")
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if config.Nsec != nsec || len(config.Relays) != 1 || !config.Private {
+		t.Errorf("config = %+v", config)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "nsec") || strings.Contains(string(data), "relays") {
+		t.Errorf("values from the environment were written to the file:\n%s", data)
+	}
+
+	// Errors in values from the environment name the variable.
+	t.Setenv(EnvPrefix+"NPUB", strings.Replace(npub, "npub1", "npub1x", 1))
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "environment: "+EnvPrefix+"NPUB") {
+		t.Errorf("error %v does not name %sNPUB", err, EnvPrefix)
+	}
+}
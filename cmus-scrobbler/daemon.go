@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// maxPendingScrobbles bounds the retry queue; the oldest scrobble is dropped
+// when it is full.
+const maxPendingScrobbles = 100
+
+// DaemonStatus is the state of the run loop as served by the local API.
+type DaemonStatus struct {
+	// Player is playing, paused or stopped, or not_running when cmus is
+	// not running.
+	Player           string        `json:"player"`
+	Track            *TrackStatus  `json:"track,omitempty"`
+	ScrobblingPaused bool          `json:"scrobbling_paused"`
+	LastEvent        *nostr.Event  `json:"last_event,omitempty"`
+	QueueDepth       int           `json:"queue_depth"`
+	Relays           []RelayHealth `json:"relays"`
+}
+
+// TrackStatus is the playing track and how far it is from being scrobbled.
+type TrackStatus struct {
+	Artist   string `json:"artist"`
+	Track    string `json:"track"`
+	Album    string `json:"album,omitempty"`
+	MbID     string `json:"mbid,omitempty"`
+	Stream   string `json:"stream,omitempty"`
+	Profile  string `json:"profile,omitempty"`
+	Position int    `json:"position"`
+	Duration int    `json:"duration,omitempty"`
+	// Progress is the fraction of the scrobble threshold played so far,
+	// capped at 1.
+	Progress  float64 `json:"progress"`
+	Scrobbled bool    `json:"scrobbled"`
+	// Skipped is set when the track won't be scrobbled, with SkipReason
+	// saying why.
+	Skipped    bool   `json:"skipped"`
+	SkipReason string `json:"skip_reason,omitempty"`
+}
+
+func (t *TrackStatus) key() string {
+	return fmt.Sprintf("%s - %s", t.Artist, t.Track)
+}
+
+type pendingEvent struct {
+	profile string
+	nostr   *Nostr
+	event   *nostr.Event
+}
+
+// daemon holds the run loop's state, takes commands from the local API and
+// notifies subscribers when the state changes.
+type daemon struct {
+	mu          sync.Mutex
+	status      DaemonStatus
+	lastJSON    []byte
+	subscribers map[chan DaemonStatus]struct{}
+
+	// skipKey is the track the user asked not to scrobble.
+	skipKey string
+	// forceKey is the track the user asked to scrobble now.
+	forceKey string
+	pending  []pendingEvent
+	// lastTrack is the track the run loop last scrobbled or skipped. Only
+	// the run loop changes it while running.
+	lastTrack string
+
+	wake chan struct{}
+	// heartbeat is when the run loop last polled, in Unix nanoseconds.
+	heartbeat atomic.Int64
+
+	// love loves or unloves a track.
+	love func(track TrackStatus, love bool) error
+
+	metrics *metrics
+	hooks   atomic.Pointer[hookRunner]
+	sinks   atomic.Pointer[sinkRunner]
+	// media has the plays media servers and Last.fm sent; nil when the
+	// webhook receiver and the Last.fm mirror are off.
+	media *mediaTracker
+}
+
+func newDaemon() *daemon {
+	return &daemon{
+		status:      DaemonStatus{Player: "not_running", Relays: []RelayHealth{}},
+		subscribers: make(map[chan DaemonStatus]struct{}),
+		wake:        make(chan struct{}, 1),
+		metrics:     newMetrics(),
+	}
+}
+
+// Status returns a copy of the current state.
+func (d *daemon) Status() DaemonStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.copyStatus()
+}
+
+func (d *daemon) copyStatus() DaemonStatus {
+	status := d.status
+	if status.Track != nil {
+		track := *status.Track
+		status.Track = &track
+	}
+	status.Relays = append([]RelayHealth{}, status.Relays...)
+	return status
+}
+
+// update changes the state with fn and notifies subscribers if it changed.
+func (d *daemon) update(fn func(status *DaemonStatus)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.updateLocked(fn)
+}
+
+func (d *daemon) updateLocked(fn func(status *DaemonStatus)) {
+	fn(&d.status)
+	d.status.QueueDepth = len(d.pending)
+
+	data, _ := json.Marshal(d.status)
+	if string(data) == string(d.lastJSON) {
+		return
+	}
+	d.lastJSON = data
+
+	status := d.copyStatus()
+	for ch := range d.subscribers {
+		// Subscribers only need the latest state, so a slow one has its
+		// unread state replaced.
+		select {
+		case ch <- status:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- status
+		}
+	}
+}
+
+// Subscribe returns a channel that receives the state after every change,
+// and a function that closes it.
+func (d *daemon) Subscribe() (<-chan DaemonStatus, func()) {
+	ch := make(chan DaemonStatus, 1)
+	d.mu.Lock()
+	d.subscribers[ch] = struct{}{}
+	d.mu.Unlock()
+
+	return ch, func() {
+		d.mu.Lock()
+		delete(d.subscribers, ch)
+		d.mu.Unlock()
+	}
+}
+
+// wait sleeps for up to timeout, returning early when a command needs the
+// run loop or ctx is done.
+func (d *daemon) wait(ctx context.Context, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-d.wake:
+	case <-ctx.Done():
+	}
+}
+
+func (d *daemon) beat() {
+	d.heartbeat.Store(time.Now().UnixNano())
+}
+
+// lastBeat returns when the run loop last polled.
+func (d *daemon) lastBeat() time.Time {
+	return time.Unix(0, d.heartbeat.Load())
+}
+
+func (d *daemon) wakeUp() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SetPaused pauses or resumes scrobbling. The player state is still tracked
+// while paused.
+func (d *daemon) SetPaused(paused bool) {
+	d.update(func(status *DaemonStatus) {
+		status.ScrobblingPaused = paused
+	})
+}
+
+// SkipTrack stops the playing track from being scrobbled.
+func (d *daemon) SkipTrack() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.status.Track == nil {
+		return errors.New("nothing is playing")
+	}
+	if d.status.Track.Scrobbled {
+		return errors.New("track is already scrobbled")
+	}
+	d.skipKey = d.status.Track.key()
+	d.updateLocked(func(status *DaemonStatus) {
+		status.Track.Skipped = true
+		status.Track.SkipReason = "skipped"
+	})
+	return nil
+}
+
+// ForceScrobble scrobbles the playing track without waiting for it to play
+// long enough.
+func (d *daemon) ForceScrobble() error {
+	d.mu.Lock()
+	if d.status.Track == nil {
+		d.mu.Unlock()
+		return errors.New("nothing is playing")
+	}
+	if d.status.Track.Scrobbled {
+		d.mu.Unlock()
+		return errors.New("track is already scrobbled")
+	}
+	d.forceKey = d.status.Track.key()
+	d.skipKey = ""
+	d.mu.Unlock()
+
+	d.wakeUp()
+	return nil
+}
+
+// LoveTrack loves or unloves the playing track.
+func (d *daemon) LoveTrack(love bool) error {
+	status := d.Status()
+	if status.Track == nil {
+		return errors.New("nothing is playing")
+	}
+	if d.love == nil {
+		return errors.New("loving tracks is not available")
+	}
+	if err := d.love(*status.Track, love); err != nil {
+		return err
+	}
+	d.fireHook(hookPayload{
+		Event:   hookLoved,
+		Profile: status.Track.Profile,
+		Track: hookTrack{
+			Artist:   status.Track.Artist,
+			Track:    status.Track.Track,
+			Album:    status.Track.Album,
+			MbID:     status.Track.MbID,
+			Stream:   status.Track.Stream,
+			Duration: status.Track.Duration,
+		},
+		Loved: &love,
+	})
+	return nil
+}
+
+// setHooks replaces the hooks, stopping the old ones.
+func (d *daemon) setHooks(hooks *hookRunner) {
+	d.hooks.Swap(hooks).Close()
+}
+
+// setSinks replaces the sinks, stopping the old ones.
+func (d *daemon) setSinks(sinks *sinkRunner) {
+	d.sinks.Swap(sinks).Close()
+}
+
+func (d *daemon) fireHook(payload hookPayload) {
+	d.hooks.Load().fire(payload)
+}
+
+// firePublishHook tells hooks how publishing ev went, and hands ev to the
+// profile's sinks once a relay has it.
+func (d *daemon) firePublishHook(profile string, nostrClient *Nostr, ev *nostr.Event, results []PublishResult) {
+	event := hookPublishFailed
+	if anyPublished(results) {
+		event = hookScrobbled
+	}
+	// Hooks get the track even when the scrobble is private, since they
+	// run locally.
+	scrobble, err := nostrClient.ScrobbleFromEvent(ev)
+	if err != nil {
+		slog.Warn("not running hooks", "event", event, "id", ev.ID, "err", err)
+		return
+	}
+	if event == hookScrobbled {
+		d.sinks.Load().deliver(profile, ev, scrobble)
+	}
+	d.fireHook(hookPayload{
+		Event:   event,
+		Profile: profile,
+		Track:   newHookTrack(scrobble),
+		EventID: ev.ID,
+		Relays:  hookRelayResults(results),
+	})
+}
+
+// RetryQueue makes the run loop retry queued scrobbles now instead of on
+// its next poll.
+func (d *daemon) RetryQueue() error {
+	d.mu.Lock()
+	empty := len(d.pending) == 0
+	d.mu.Unlock()
+	if empty {
+		return errors.New("the retry queue is empty")
+	}
+	d.wakeUp()
+	return nil
+}
+
+// takeForce reports whether the user asked to scrobble track now, clearing
+// the request. A request for a track that is no longer playing is dropped.
+func (d *daemon) takeForce(track *TrackStatus) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	force := d.forceKey != "" && d.forceKey == track.key()
+	d.forceKey = ""
+	return force
+}
+
+// skipped reports whether the user asked to skip track.
+func (d *daemon) skipped(track *TrackStatus) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.skipKey != "" && d.skipKey == track.key()
+}
+
+// setTrack records the playing track, keeping what is already known about
+// it if it hasn't changed.
+func (d *daemon) setTrack(track *TrackStatus, relays []RelayHealth) {
+	d.update(func(status *DaemonStatus) {
+		status.Player = "playing"
+		if track != nil && status.Track != nil && status.Track.key() == track.key() {
+			track.Scrobbled = status.Track.Scrobbled
+			if !track.Skipped {
+				track.Skipped = status.Track.Skipped
+				track.SkipReason = status.Track.SkipReason
+			}
+		}
+		status.Track = track
+		if relays != nil {
+			status.Relays = relays
+		}
+	})
+}
+
+func (d *daemon) setPlayer(player string) {
+	d.update(func(status *DaemonStatus) {
+		status.Player = player
+		if player == "not_running" || player == "stopped" {
+			status.Track = nil
+		}
+	})
+}
+
+func (d *daemon) markTrack(fn func(track *TrackStatus)) {
+	d.update(func(status *DaemonStatus) {
+		if status.Track != nil {
+			fn(status.Track)
+		}
+	})
+}
+
+// publish publishes ev for profile, queueing it for another try if no
+// relay accepted it.
+func (d *daemon) publish(profile string, nostrClient *Nostr, ev *nostr.Event) {
+	results := nostrClient.PublishEventResults(ev)
+	d.metrics.recordPublish(results)
+	for _, result := range results {
+		if result.Err != nil {
+			slog.Warn("publish failed", "relay", result.Relay, "id", ev.ID, "err", result.Err)
+		} else {
+			slog.Info("published", "relay", result.Relay, "id", ev.ID)
+		}
+	}
+	d.firePublishHook(profile, nostrClient, ev, results)
+
+	d.update(func(status *DaemonStatus) {
+		if !anyPublished(results) {
+			d.pending = append(d.pending, pendingEvent{profile: profile, nostr: nostrClient, event: ev})
+			if len(d.pending) > maxPendingScrobbles {
+				slog.Warn("retry queue is full, dropping scrobble", "id", d.pending[0].event.ID)
+				d.pending = d.pending[1:]
+			}
+		} else {
+			status.LastEvent = ev
+		}
+		status.Relays = nostrClient.RelayHealth()
+	})
+}
+
+// queuedOn reports whether a queued scrobble is to be published with n.
+func (d *daemon) queuedOn(n *Nostr) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.ContainsFunc(d.pending, func(p pendingEvent) bool { return p.nostr == n })
+}
+
+// retryPending republishes queued scrobbles, oldest first, stopping at the
+// first one that still can't be published or when ctx is done. Scrobbles
+// whose profile isn't connected yet are passed over.
+func (d *daemon) retryPending(ctx context.Context) {
+	for ctx.Err() == nil {
+		d.mu.Lock()
+		i := slices.IndexFunc(d.pending, func(p pendingEvent) bool { return p.nostr != nil })
+		if i < 0 {
+			d.mu.Unlock()
+			return
+		}
+		next := d.pending[i]
+		d.mu.Unlock()
+
+		results := next.nostr.PublishEventResults(next.event)
+		d.metrics.recordPublish(results)
+		if !anyPublished(results) {
+			return
+		}
+		slog.Info("published queued scrobble", "id", next.event.ID)
+		d.firePublishHook(next.profile, next.nostr, next.event, results)
+
+		d.update(func(status *DaemonStatus) {
+			d.pending = slices.DeleteFunc(d.pending, func(p pendingEvent) bool { return p.event == next.event })
+			if status.LastEvent == nil || next.event.CreatedAt >= status.LastEvent.CreatedAt {
+				status.LastEvent = next.event
+			}
+			status.Relays = next.nostr.RelayHealth()
+		})
+	}
+}
+
+// flushPending tries for up to timeout to publish queued scrobbles, for
+// shutting down.
+func (d *daemon) flushPending(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		d.retryPending(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// CreateDeletionEvent builds a NIP-09 deletion request for events.
+func (n *Nostr) CreateDeletionEvent(events []nostr.Event, reason string) (*nostr.Event, error) {
+	ev := nostr.Event{
+		Kind:      nostr.KindDeletion,
+		CreatedAt: nostr.Timestamp(time.Now().Unix()),
+		Tags:      nostr.Tags{},
+		Content:   reason,
+	}
+
+	var kinds []int
+	for _, target := range events {
+		if target.PubKey != n.pk {
+			return nil, fmt.Errorf("event %s was not published by this key", target.ID)
+		}
+		ev.Tags = append(ev.Tags, nostr.Tag{"e", target.ID})
+		if !slices.Contains(kinds, target.Kind) {
+			kinds = append(kinds, target.Kind)
+		}
+	}
+	slices.Sort(kinds)
+	for _, kind := range kinds {
+		ev.Tags = append(ev.Tags, nostr.Tag{"k", strconv.Itoa(kind)})
+	}
+
+	if err := n.sign(&ev); err != nil {
+		return nil, fmt.Errorf("error signing deletion event: %w", err)
+	}
+	return &ev, nil
+}
+
+// DeleteEvents publishes a deletion request for events to every relay.
+func (n *Nostr) DeleteEvents(events []nostr.Event, reason string) ([]PublishResult, error) {
+	ev, err := n.CreateDeletionEvent(events, reason)
+	if err != nil {
+		return nil, err
+	}
+	return n.PublishEventResults(ev), nil
+}
+
+func printPublishResults(action string, results []PublishResult) {
+	ok := 0
+	for _, result := range results {
+		if result.Err != nil {
+			fmt.Printf("  %s: failed: %v\n", result.Relay, result.Err)
+		} else {
+			fmt.Printf("  %s: ok\n", result.Relay)
+			ok++
+		}
+	}
+	fmt.Printf("%s accepted by %d of %d relays\n", action, ok, len(results))
+}
+
+// confirm asks a yes/no question on stdin.
+func confirm(prompt string) bool {
+	return confirmFrom(os.Stdin, prompt)
+}
+
+func confirmFrom(r io.Reader, prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(r).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func printSelectedScrobbles(nostrClient *Nostr, events []nostr.Event) {
+	for i := range events {
+		ev := &events[i]
+		scrobble, err := nostrClient.ScrobbleFromEvent(ev)
+		if err != nil {
+			fmt.Printf("  %s [encrypted] (at %s)\n", ev.ID, ev.CreatedAt.Time().Format(time.RFC3339))
+			continue
+		}
+		fmt.Printf("  %s %s - %s (at %s)\n", ev.ID, scrobble.Artist, scrobble.Track, ev.CreatedAt.Time().Format(time.RFC3339))
+	}
+}
+
+// runDelete handles `cmus-scrobbler delete`.
+func runDelete(nostrClient *Nostr, args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	var selector scrobbleSelector
+	selector.registerFlags(fs)
+	reason := fs.String("reason", "", "Reason sent with the deletion request")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	fs.Parse(args)
+
+	events, err := selector.selectScrobbles(nostrClient, fs.Args())
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		fmt.Println("No scrobbles matched.")
+		return nil
+	}
+
+	fmt.Printf("Deleting %d scrobbles:\n", len(events))
+	printSelectedScrobbles(nostrClient, events)
+	if !*yes && !confirm("Publish deletion request?") {
+		fmt.Println("Aborted.")
+		return nil
+	}
+
+	results, err := nostrClient.DeleteEvents(events, *reason)
+	if err != nil {
+		return err
+	}
+	printPublishResults("Deletion", results)
+	return nil
+}
+
+// runEdit handles `cmus-scrobbler edit`. The corrected scrobble keeps the
+// original created_at and the original is deleted once it is published.
+func runEdit(nostrClient *Nostr, args []string) error {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	var selector scrobbleSelector
+	selector.registerFlags(fs)
+	setArtist := fs.String("set-artist", "", "Corrected artist")
+	setTrack := fs.String("set-track", "", "Corrected track title")
+	setAlbum := fs.String("set-album", "", "Corrected album")
+	setMbID := fs.String("set-mbid", "", "Corrected MusicBrainz recording ID")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	fs.Parse(args)
+
+	if *setArtist == "" && *setTrack == "" && *setAlbum == "" && *setMbID == "" {
+		return fmt.Errorf("nothing to change: use -set-artist, -set-track, -set-album or -set-mbid")
+	}
+
+	events, err := selector.selectScrobbles(nostrClient, fs.Args())
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		fmt.Println("No scrobbles matched.")
+		return nil
+	}
+
+	fmt.Printf("Editing %d scrobbles:\n", len(events))
+	printSelectedScrobbles(nostrClient, events)
+	if !*yes && !confirm("Publish corrections and delete the originals?") {
+		fmt.Println("Aborted.")
+		return nil
+	}
+
+	for i := range events {
+		original := &events[i]
+		scrobble, err := nostrClient.ScrobbleFromEvent(original)
+		if err != nil {
+			return err
+		}
+
+		if *setArtist != "" {
+			scrobble.Artist = *setArtist
+		}
+		if *setTrack != "" {
+			scrobble.Track = *setTrack
+		}
+		if *setAlbum != "" {
+			scrobble.Album = *setAlbum
+		}
+		if *setMbID != "" {
+			scrobble.MbID = *setMbID
+		}
+		scrobble.CreatedAt = original.CreatedAt
+
+		replacement, err := nostrClient.CreateScrobbleEvent(scrobble)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Publishing %s - %s in place of %s\n", scrobble.Artist, scrobble.Track, original.ID)
+		results := nostrClient.PublishEventResults(replacement)
+		printPublishResults("Correction", results)
+		if !anyPublished(results) {
+			fmt.Printf("Keeping %s because the correction was not accepted by any relay\n", original.ID)
+			continue
+		}
+
+		results, err = nostrClient.DeleteEvents([]nostr.Event{*original}, "corrected by "+replacement.ID)
+		if err != nil {
+			return err
+		}
+		printPublishResults("Deletion", results)
+	}
+	return nil
+}
+
+func anyPublished(results []PublishResult) bool {
+	for _, result := range results {
+		if result.Err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCreateDeletionEvent(t *testing.T) {
+	n := newTestNostr(t)
+	public, err := n.CreateScrobbleEvent(ScrobbleEvent{Artist: "Low", Track: "Words"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := n.CreateScrobbleEvent(ScrobbleEvent{Artist: "Low", Track: "Sunflower", Private: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := n.CreateScrobbleEvent(ScrobbleEvent{Artist: "Low", Track: "Lullaby"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ev, err := n.CreateDeletionEvent([]nostr.Event{*public, *private, *again}, "wrong track")
+	if err != nil {
+		t.Fatalf("CreateDeletionEvent: %v", err)
+	}
+	if ev.Kind != nostr.KindDeletion || ev.Content != "wrong track" || ev.PubKey != n.pk {
+		t.Errorf("deletion event = %+v", ev)
+	}
+	if ok, _ := ev.CheckSignature(); !ok {
+		t.Error("deletion event has an invalid signature")
+	}
+	var ids, kinds []string
+	for _, tag := range ev.Tags {
+		switch tag[0] {
+		case "e":
+			ids = append(ids, tag[1])
+		case "k":
+			kinds = append(kinds, tag[1])
+		}
+	}
+	if !slices.Equal(ids, []string{public.ID, private.ID, again.ID}) {
+		t.Errorf("e tags = %v", ids)
+	}
+	if !slices.Equal(kinds, []string{strconv.Itoa(KindScrobble), strconv.Itoa(KindPrivateScrobble)}) {
+		t.Errorf("k tags = %v, want each kind once", kinds)
+	}
+
+	// Relays would ignore a request to delete someone else's event, so it
+	// is refused before anything is signed.
+	other := newTestNostr(t)
+	theirs, err := other.CreateScrobbleEvent(ScrobbleEvent{Artist: "Low", Track: "Words"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.CreateDeletionEvent([]nostr.Event{*public, *theirs}, ""); err == nil {
+		t.Error("deletion of another key's event was accepted")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// KindDoctorPing is an ephemeral kind used by doctor to check that a relay
+// accepts events from this key and delivers them to subscribers.
+const KindDoctorPing = 22002
+
+type doctor struct {
+	failures int
+}
+
+func (d *doctor) ok(format string, args ...any) {
+	fmt.Printf("[ ok ] %s\n", fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) warn(format string, args ...any) {
+	fmt.Printf("[warn] %s\n", fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) fail(format string, args ...any) {
+	d.failures++
+	fmt.Printf("[FAIL] %s\n", fmt.Sprintf(format, args...))
+}
+
+func cmdDoctor(ctx *cliContext, args []string) error {
+	d := &doctor{}
+
+	d.checkCmus()
+	config, ok := d.checkConfig(ctx.configPath)
+	if ok {
+		for _, name := range config.ProfileNames() {
+			profile, _ := config.Profile(name)
+			if len(config.Profiles) > 0 {
+				fmt.Printf("Profile %s:\n", name)
+			}
+			if s, ok := d.checkKey(profile); ok {
+				d.checkRelays(profile.Relays, s)
+				s.Close()
+			}
+		}
+	}
+
+	if d.failures > 0 {
+		return fmt.Errorf("%d checks failed", d.failures)
+	}
+	fmt.Println("All checks passed.")
+	return nil
+}
+
+func (d *doctor) checkCmus() {
+	path, err := exec.LookPath("cmus-remote")
+	if err != nil {
+		d.fail("cmus-remote not found in PATH")
+		return
+	}
+	d.ok("cmus-remote found at %s", path)
+
+	status, err := getCmusStatus()
+	if err != nil {
+		d.warn("cmus-remote -Q failed (is cmus running?): %v", err)
+		return
+	}
+	if status.Status == "" {
+		d.warn("cmus-remote -Q returned no status")
+		return
+	}
+	d.ok("cmus responds, status %s", status.Status)
+}
+
+func (d *doctor) checkConfig(configPath string) (Config, bool) {
+	var config Config
+
+	path, err := resolveConfigPath(configPath)
+	if err != nil {
+		d.fail("%v", err)
+		return config, false
+	}
+
+	config, err = readConfig(path)
+	if err != nil {
+		d.fail("config is invalid:\n%v", err)
+		return config, false
+	}
+	d.ok("config %s is valid", path)
+	return config, true
+}
+
+// checkKey returns a signer for the key in config, connecting to the remote
+// signer if there is one.
+func (d *doctor) checkKey(config Config) (signer, bool) {
+	if config.Bunker != "" {
+		s, err := newSigner(config)
+		if err != nil {
+			d.fail("%v", err)
+			return nil, false
+		}
+		d.ok("remote signer signs for %s", config.Npub)
+		return s, true
+	}
+	if config.Nsec == "" {
+		d.fail("config has no nsec")
+		return nil, false
+	}
+
+	s, err := newKeySigner(config.Nsec)
+	if err != nil {
+		d.fail("nsec is invalid: %v", err)
+		return nil, false
+	}
+
+	npub, err := nip19.EncodePublicKey(s.PublicKey())
+	if err != nil {
+		d.fail("nsec is invalid: %v", err)
+		return nil, false
+	}
+
+	if config.Npub != "" && config.Npub != npub {
+		d.fail("nsec belongs to %s but config npub is %s", npub, config.Npub)
+		return nil, false
+	}
+	d.ok("key is valid: %s", npub)
+	return s, true
+}
+
+func (d *doctor) checkRelays(relayURLs []string, s signer) {
+	for _, url := range relayURLs {
+		d.checkRelay(url, s)
+	}
+}
+
+// checkRelay connects to url, subscribes to doctor pings from this key,
+// publishes one and waits for it to come back.
+func (d *doctor) checkRelay(url string, s signer) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	relay, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		d.fail("%s: cannot connect: %v", url, err)
+		return
+	}
+	defer relay.Close()
+	d.ok("%s: connected", url)
+
+	pk := s.PublicKey()
+	ping := nostr.Event{
+		Kind:      KindDoctorPing,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{},
+		Content:   "cmus-scrobbler doctor",
+	}
+	if err := s.SignEvent(&ping); err != nil {
+		d.fail("%s: cannot sign test event: %v", url, err)
+		return
+	}
+
+	sub, err := relay.Subscribe(ctx, nostr.Filters{{
+		Kinds:   []int{KindDoctorPing},
+		Authors: []string{pk},
+		Since:   &ping.CreatedAt,
+	}})
+	if err != nil {
+		d.fail("%s: cannot subscribe: %v", url, err)
+		return
+	}
+	defer sub.Unsub()
+
+	start := time.Now()
+	if err := relay.Publish(ctx, ping); err != nil {
+		d.fail("%s: rejected test event: %v", url, err)
+		return
+	}
+
+	for {
+		select {
+		case ev := <-sub.Events:
+			if ev.ID == ping.ID {
+				d.ok("%s: test event published and received back in %s", url, time.Since(start).Round(time.Millisecond))
+				return
+			}
+		case <-ctx.Done():
+			d.fail("%s: test event was accepted but never delivered back", url)
+			return
+		}
+	}
+}
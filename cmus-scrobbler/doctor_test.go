@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestDoctorCheckKey(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	nsec, _ := nip19.EncodePrivateKey(sk)
+	pk, _ := nostr.GetPublicKey(sk)
+	npub, _ := nip19.EncodePublicKey(pk)
+	otherPK, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	otherNpub, _ := nip19.EncodePublicKey(otherPK)
+
+	d := &doctor{}
+	s, ok := d.checkKey(Config{Nsec: nsec, Npub: npub})
+	if !ok || d.failures != 0 || s.PublicKey() != pk {
+		t.Fatalf("matching npub: ok %v, failures %d", ok, d.failures)
+	}
+	s.Close()
+
+	if _, ok := d.checkKey(Config{Nsec: nsec}); !ok || d.failures != 0 {
+		t.Errorf("without npub: ok %v, failures %d", ok, d.failures)
+	}
+
+	if _, ok := d.checkKey(Config{Nsec: nsec, Npub: otherNpub}); ok || d.failures != 1 {
+		t.Errorf("npub of another key: ok %v, failures %d", ok, d.failures)
+	}
+	if _, ok := d.checkKey(Config{}); ok || d.failures != 2 {
+		t.Errorf("no key: ok %v, failures %d", ok, d.failures)
+	}
+	if _, ok := d.checkKey(Config{Nsec: "nsec1invalid"}); ok || d.failures != 3 {
+		t.Errorf("invalid nsec: ok %v, failures %d", ok, d.failures)
+	}
+}
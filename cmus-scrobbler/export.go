@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	ExportFormatJSONL        = "jsonl"
+	ExportFormatLastfmCSV    = "lastfm-csv"
+	ExportFormatListenBrainz = "listenbrainz"
+	ExportFormatScrobblerLog = "scrobbler-log"
+)
+
+// exportFlushEvery is how many events are written between flushes of the
+// output and the resume state.
+const exportFlushEvery = 100
+
+// exportWriter writes scrobbles in one export format.
+type exportWriter interface {
+	// header is written when an export starts, but not when it resumes.
+	header() error
+	write(ev *nostr.Event, scrobble ScrobbleEvent) error
+	flush() error
+}
+
+func newExportWriter(format string, w io.Writer) (exportWriter, error) {
+	switch format {
+	case ExportFormatJSONL:
+		return &jsonlExport{w: bufio.NewWriter(w)}, nil
+	case ExportFormatLastfmCSV:
+		return &lastfmCSVExport{w: csv.NewWriter(w)}, nil
+	case ExportFormatListenBrainz:
+		return &listenBrainzExport{w: bufio.NewWriter(w)}, nil
+	case ExportFormatScrobblerLog:
+		return &scrobblerLogExport{w: bufio.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// jsonlExport writes the raw signed events, one per line.
+type jsonlExport struct {
+	w *bufio.Writer
+}
+
+func (e *jsonlExport) header() error { return nil }
+
+func (e *jsonlExport) write(ev *nostr.Event, scrobble ScrobbleEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	e.w.Write(data)
+	return e.w.WriteByte('\n')
+}
+
+func (e *jsonlExport) flush() error { return e.w.Flush() }
+
+// lastfmCSVExport writes the CSV layout used by common Last.fm exporters.
+type lastfmCSVExport struct {
+	w *csv.Writer
+}
+
+func (e *lastfmCSVExport) header() error {
+	return e.w.Write([]string{"uts", "utc_time", "artist", "artist_mbid", "album", "album_mbid", "track", "track_mbid"})
+}
+
+func (e *lastfmCSVExport) write(ev *nostr.Event, scrobble ScrobbleEvent) error {
+	at := ev.CreatedAt.Time().UTC()
+	return e.w.Write([]string{
+		strconv.FormatInt(int64(ev.CreatedAt), 10),
+		at.Format("02 Jan 2006, 15:04"),
+		scrobble.Artist, "",
+		scrobble.Album, "",
+		scrobble.Track, scrobble.MbID,
+	})
+}
+
+func (e *lastfmCSVExport) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// listenBrainzExport writes ListenBrainz listen objects, one per line.
+type listenBrainzExport struct {
+	w *bufio.Writer
+}
+
+type listenBrainzListen struct {
+	ListenedAt    int64                     `json:"listened_at"`
+	TrackMetadata listenBrainzTrackMetadata `json:"track_metadata"`
+}
+
+type listenBrainzTrackMetadata struct {
+	ArtistName     string         `json:"artist_name"`
+	TrackName      string         `json:"track_name"`
+	ReleaseName    string         `json:"release_name,omitempty"`
+	AdditionalInfo map[string]any `json:"additional_info,omitempty"`
+}
+
+func (e *listenBrainzExport) header() error { return nil }
+
+func (e *listenBrainzExport) write(ev *nostr.Event, scrobble ScrobbleEvent) error {
+	data, err := json.Marshal(newListenBrainzListen(ev, scrobble))
+	if err != nil {
+		return err
+	}
+	e.w.Write(data)
+	return e.w.WriteByte('\n')
+}
+
+func (e *listenBrainzExport) flush() error { return e.w.Flush() }
+
+// newListenBrainzListen returns the listen for the scrobble in ev.
+func newListenBrainzListen(ev *nostr.Event, scrobble ScrobbleEvent) listenBrainzListen {
+	listen := listenBrainzListen{
+		ListenedAt: int64(ev.CreatedAt),
+		TrackMetadata: listenBrainzTrackMetadata{
+			ArtistName:  scrobble.Artist,
+			TrackName:   scrobble.Track,
+			ReleaseName: scrobble.Album,
+			AdditionalInfo: map[string]any{
+				"submission_client": "cmus-scrobbler",
+				"nostr_event_id":    ev.ID,
+			},
+		},
+	}
+	if scrobble.MbID != "" {
+		listen.TrackMetadata.AdditionalInfo["recording_mbid"] = scrobble.MbID
+	}
+	return listen
+}
+
+// scrobblerLogExport writes an Audioscrobbler portable player log in UTC.
+type scrobblerLogExport struct {
+	w *bufio.Writer
+}
+
+func (e *scrobblerLogExport) header() error {
+	_, err := e.w.WriteString("#AUDIOSCROBBLER/1.1\n#TZ/UTC\n#CLIENT/cmus-scrobbler\n")
+	return err
+}
+
+var scrobblerLogReplacer = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+func (e *scrobblerLogExport) write(ev *nostr.Event, scrobble ScrobbleEvent) error {
+	fields := []string{
+		scrobble.Artist,
+		scrobble.Album,
+		scrobble.Track,
+		"",
+		"",
+		"L",
+		strconv.FormatInt(int64(ev.CreatedAt), 10),
+		scrobble.MbID,
+	}
+	for i, field := range fields {
+		fields[i] = scrobblerLogReplacer.Replace(field)
+	}
+	_, err := e.w.WriteString(strings.Join(fields, "\t") + "\n")
+	return err
+}
+
+func (e *scrobblerLogExport) flush() error { return e.w.Flush() }
+
+// exportState records the IDs of exported events next to the output file,
+// so an interrupted export can be resumed without duplicates.
+type exportState struct {
+	path string
+	seen map[string]bool
+	file *os.File
+	w    *bufio.Writer
+}
+
+func openExportState(output string, resume bool) (*exportState, error) {
+	state := &exportState{path: output + ".export-state", seen: make(map[string]bool)}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		data, err := os.ReadFile(state.path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no interrupted export of %s to resume", output)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading export state: %w", err)
+		}
+		for _, id := range strings.Fields(string(data)) {
+			state.seen[id] = true
+		}
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+
+	f, err := os.OpenFile(state.path, flags, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening export state: %w", err)
+	}
+	state.file = f
+	state.w = bufio.NewWriter(f)
+	return state, nil
+}
+
+func (s *exportState) add(id string) {
+	s.seen[id] = true
+	s.w.WriteString(id + "\n")
+}
+
+func (s *exportState) flush() error {
+	return s.w.Flush()
+}
+
+// finish removes the state file after a complete export.
+func (s *exportState) finish() error {
+	s.file.Close()
+	return os.Remove(s.path)
+}
+
+// cmdExport walks the complete scrobble history on every relay and streams it
+// to a file in the chosen format.
+func cmdExport(ctx *cliContext, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", ExportFormatJSONL, "Output format: jsonl, lastfm-csv, listenbrainz or scrobbler-log")
+	output := fs.String("o", "", "Output file (default stdout)")
+	since := fs.String("since", "", "Only export scrobbles at or after this date (YYYY-MM-DD or RFC3339)")
+	until := fs.String("until", "", "Only export scrobbles before this date (YYYY-MM-DD or RFC3339)")
+	resume := fs.Bool("resume", false, "Continue an interrupted export to -o")
+	fs.Parse(args)
+
+	if *resume && *output == "" {
+		return fmt.Errorf("-resume needs -o")
+	}
+
+	sinceTS, untilTS, err := historyRange(*since, *until)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	var state *exportState
+	fresh := true
+	if *output != "" {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if *resume {
+			if info, err := os.Stat(*output); err == nil && info.Size() > 0 {
+				flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+				fresh = false
+			}
+		}
+		f, err := os.OpenFile(*output, flags, 0600)
+		if err != nil {
+			return fmt.Errorf("error opening %s: %w", *output, err)
+		}
+		defer f.Close()
+		out = f
+
+		if state, err = openExportState(*output, !fresh); err != nil {
+			return err
+		}
+	}
+
+	writer, err := newExportWriter(*format, out)
+	if err != nil {
+		return err
+	}
+	if fresh {
+		if err := writer.header(); err != nil {
+			return fmt.Errorf("error writing export: %w", err)
+		}
+	}
+
+	flush := func() error {
+		if err := writer.flush(); err != nil {
+			return fmt.Errorf("error writing export: %w", err)
+		}
+		if state != nil {
+			if err := state.flush(); err != nil {
+				return fmt.Errorf("error writing export state: %w", err)
+			}
+		}
+		return nil
+	}
+
+	exported, previously, invalid, unreadable := 0, 0, 0, 0
+	err = ctx.nostr.WalkHistory(sinceTS, untilTS, func(ev *nostr.Event) error {
+		if state != nil && state.seen[ev.ID] {
+			previously++
+			return nil
+		}
+		if ok, _ := ev.CheckSignature(); !ok {
+			fmt.Fprintf(os.Stderr, "Skipping event %s: invalid signature\n", ev.ID)
+			invalid++
+			return nil
+		}
+
+		scrobble, err := ctx.nostr.ScrobbleFromEvent(ev)
+		if err != nil && *format != ExportFormatJSONL {
+			fmt.Fprintf(os.Stderr, "Skipping event %s: %v\n", ev.ID, err)
+			unreadable++
+			return nil
+		}
+
+		if err := writer.write(ev, scrobble); err != nil {
+			return fmt.Errorf("error writing export: %w", err)
+		}
+		if state != nil {
+			state.add(ev.ID)
+		}
+		exported++
+		if exported%exportFlushEvery == 0 {
+			fmt.Fprintf(os.Stderr, "Exported %d scrobbles...\n", exported)
+			return flush()
+		}
+		return nil
+	})
+	if ferr := flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return err
+	}
+
+	if state != nil {
+		if err := state.finish(); err != nil {
+			return fmt.Errorf("error removing export state: %w", err)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d scrobbles", exported)
+	if previously > 0 {
+		fmt.Fprintf(os.Stderr, " (%d already exported before resuming)", previously)
+	}
+	if invalid > 0 || unreadable > 0 {
+		fmt.Fprintf(os.Stderr, ", skipped %d with invalid signatures and %d unreadable", invalid, unreadable)
+	}
+	fmt.Fprintln(os.Stderr)
+	return nil
+}
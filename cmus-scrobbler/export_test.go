@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestExportFormats(t *testing.T) {
+	n := newTestNostr(t)
+	scrobble := ScrobbleEvent{
+		Artist:    "Stereolab",
+		Track:     "Cybele's Reverie",
+		Album:     "Emperor Tomato Ketchup",
+		MbID:      "7a1a1b5c-3c6e-4e84-9f0f-6c1f1b1c2d3e",
+		CreatedAt: nostr.Timestamp(1714580000),
+	}
+	ev, err := n.CreateScrobbleEvent(scrobble)
+	if err != nil {
+		t.Fatalf("CreateScrobbleEvent: %v", err)
+	}
+
+	tests := map[string][]string{
+		ExportFormatJSONL:        {`"id":"` + ev.ID + `"`, `"sig":"`},
+		ExportFormatLastfmCSV:    {"uts,utc_time,artist", "1714580000,\"01 May 2024, 16:13\",Stereolab,,Emperor Tomato Ketchup,,Cybele's Reverie," + scrobble.MbID},
+		ExportFormatListenBrainz: {`"listened_at":1714580000`, `"artist_name":"Stereolab"`, `"recording_mbid":"` + scrobble.MbID + `"`},
+		ExportFormatScrobblerLog: {"#TZ/UTC", "Stereolab\tEmperor Tomato Ketchup\tCybele's Reverie\t\t\tL\t1714580000\t" + scrobble.MbID},
+	}
+
+	for format, wants := range tests {
+		var buf bytes.Buffer
+		w, err := newExportWriter(format, &buf)
+		if err != nil {
+			t.Fatalf("newExportWriter(%s): %v", format, err)
+		}
+		if err := w.header(); err != nil {
+			t.Fatalf("%s header: %v", format, err)
+		}
+		if err := w.write(ev, scrobble); err != nil {
+			t.Fatalf("%s write: %v", format, err)
+		}
+		if err := w.flush(); err != nil {
+			t.Fatalf("%s flush: %v", format, err)
+		}
+		for _, want := range wants {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("%s output missing %q:\n%s", format, want, buf.String())
+			}
+		}
+	}
+}
+
+func TestScrobblerLogExportRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := newExportWriter(ExportFormatScrobblerLog, &buf)
+	w.header()
+	ev := &nostr.Event{CreatedAt: 1714580000}
+	w.write(ev, ScrobbleEvent{Artist: "Tab\tArtist", Track: "Title"})
+	w.flush()
+
+	entries, err := parseScrobblerLog(&buf, time.Local)
+	if err != nil {
+		t.Fatalf("parseScrobblerLog: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Artist != "Tab Artist" || entries[0].Time.Unix() != 1714580000 {
+		t.Fatalf("entries = %+v", entries)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+const (
+	KindMetadata    = 0
+	KindContactList = 3
+)
+
+// feedAuthorBatch is how many authors go into one filter. Relays reject
+// filters that are too large.
+const feedAuthorBatch = 250
+
+// contactsFromEvent returns the followed public keys of a kind 3 contact
+// list, in order and without duplicates.
+func contactsFromEvent(ev *nostr.Event) []string {
+	if ev == nil {
+		return nil
+	}
+	var contacts []string
+	seen := make(map[string]bool)
+	for _, tag := range ev.Tags {
+		if len(tag) < 2 || tag[0] != "p" || !nostr.IsValidPublicKey(tag[1]) || seen[tag[1]] {
+			continue
+		}
+		seen[tag[1]] = true
+		contacts = append(contacts, tag[1])
+	}
+	return contacts
+}
+
+// profileName returns the name to show for a kind 0 metadata event.
+func profileName(ev *nostr.Event) string {
+	var profile struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"display_name"`
+	}
+	if err := json.Unmarshal([]byte(ev.Content), &profile); err != nil {
+		return ""
+	}
+	if name := strings.TrimSpace(profile.DisplayName); name != "" {
+		return name
+	}
+	return strings.TrimSpace(profile.Name)
+}
+
+// shortNpub is a readable stand-in for someone without a name.
+func shortNpub(pubkey string) string {
+	npub, err := nip19.EncodePublicKey(pubkey)
+	if err != nil || len(npub) < 16 {
+		return pubkey
+	}
+	return npub[:12] + "…" + npub[len(npub)-4:]
+}
+
+// queryNewest runs filters on every relay and returns the newest event per
+// author. It fails only if no relay could be queried.
+func (n *Nostr) queryNewest(filters []nostr.Filter) (map[string]*nostr.Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	newest := make(map[string]*nostr.Event)
+	var errs []error
+	for _, relay := range n.relays {
+		for _, filter := range filters {
+			events, err := relay.QuerySync(ctx, filter)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", relay.URL, err))
+				continue
+			}
+			for _, ev := range events {
+				if prev, ok := newest[ev.PubKey]; !ok || ev.CreatedAt > prev.CreatedAt {
+					newest[ev.PubKey] = ev
+				}
+			}
+		}
+	}
+	if len(errs) == len(n.relays)*len(filters) && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return newest, nil
+}
+
+// authorFilters splits authors into filters of at most feedAuthorBatch
+// authors each, all with the template's other fields.
+func authorFilters(template nostr.Filter, authors []string) []nostr.Filter {
+	var filters []nostr.Filter
+	for start := 0; start < len(authors); start += feedAuthorBatch {
+		f := template
+		f.Authors = authors[start:min(start+feedAuthorBatch, len(authors))]
+		filters = append(filters, f)
+	}
+	return filters
+}
+
+// FetchContacts returns the public keys the user follows.
+func (n *Nostr) FetchContacts() ([]string, error) {
+	newest, err := n.queryNewest([]nostr.Filter{{Kinds: []int{KindContactList}, Authors: []string{n.pk}, Limit: 1}})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching contact list: %w", err)
+	}
+	return contactsFromEvent(newest[n.pk]), nil
+}
+
+// FetchNames resolves the names of pubkeys from their kind 0 metadata.
+// Pubkeys without a name are left out.
+func (n *Nostr) FetchNames(pubkeys []string) (map[string]string, error) {
+	newest, err := n.queryNewest(authorFilters(nostr.Filter{Kinds: []int{KindMetadata}}, pubkeys))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching profiles: %w", err)
+	}
+	names := make(map[string]string)
+	for pk, ev := range newest {
+		if name := profileName(ev); name != "" {
+			names[pk] = name
+		}
+	}
+	return names, nil
+}
+
+// feedEntry is one scrobble in the feed, as written by -json.
+type feedEntry struct {
+	Time   time.Time `json:"time"`
+	Pubkey string    `json:"pubkey"`
+	Name   string    `json:"name,omitempty"`
+	Artist string    `json:"artist"`
+	Track  string    `json:"track"`
+	Album  string    `json:"album,omitempty"`
+	MbID   string    `json:"mbid,omitempty"`
+	ID     string    `json:"id"`
+}
+
+func newFeedEntry(ev *nostr.Event, names map[string]string) (feedEntry, bool) {
+	scrobble := scrobbleFromTags(ev)
+	if scrobble.Artist == "" || scrobble.Track == "" {
+		return feedEntry{}, false
+	}
+	mbid, _ := scrobbleIdentifiers(ev)
+	return feedEntry{
+		Time:   ev.CreatedAt.Time(),
+		Pubkey: ev.PubKey,
+		Name:   names[ev.PubKey],
+		Artist: scrobble.Artist,
+		Track:  scrobble.Track,
+		Album:  scrobble.Album,
+		MbID:   mbid,
+		ID:     ev.ID,
+	}, true
+}
+
+func (e feedEntry) String() string {
+	name := e.Name
+	if name == "" {
+		name = shortNpub(e.Pubkey)
+	}
+	line := fmt.Sprintf("%s  %-20s  %s - %s", e.Time.Local().Format("Jan 02 15:04"), name, e.Artist, e.Track)
+	if e.Album != "" {
+		line += " (" + e.Album + ")"
+	}
+	return line
+}
+
+// queryFeed returns the latest limit scrobbles of authors, oldest first.
+func (n *Nostr) queryFeed(authors []string, limit int) ([]*nostr.Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	filters := authorFilters(nostr.Filter{Kinds: []int{KindScrobble}, Limit: limit}, authors)
+	seen := make(map[string]bool)
+	var events []*nostr.Event
+	var errs []error
+	for _, relay := range n.relays {
+		for _, filter := range filters {
+			found, err := relay.QuerySync(ctx, filter)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", relay.URL, err))
+				continue
+			}
+			for _, ev := range found {
+				if !seen[ev.ID] {
+					seen[ev.ID] = true
+					events = append(events, ev)
+				}
+			}
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].CreatedAt > events[j].CreatedAt
+	})
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].CreatedAt < events[j].CreatedAt
+	})
+	return events, errors.Join(errs...)
+}
+
+// cmdFeed shows the scrobbles of everyone the user follows as they are
+// published.
+func cmdFeed(ctx *cliContext, args []string) error {
+	fs := flag.NewFlagSet("feed", flag.ExitOnError)
+	count := fs.Int("n", 20, "Number of recent scrobbles to show before following")
+	asJSON := fs.Bool("json", false, "Write one JSON object per line")
+	fs.Parse(args)
+
+	contacts, err := ctx.nostr.FetchContacts()
+	if err != nil {
+		return err
+	}
+	if len(contacts) == 0 {
+		return fmt.Errorf("your contact list is empty or wasn't found on the relays")
+	}
+	fmt.Fprintf(os.Stderr, "Following %d people\n", len(contacts))
+
+	names, err := ctx.nostr.FetchNames(contacts)
+	if err != nil {
+		// The feed still works with npubs in place of names.
+		fmt.Fprintln(os.Stderr, "Error resolving names:", err)
+		names = map[string]string{}
+	}
+
+	write := func(ev *nostr.Event) {
+		entry, ok := newFeedEntry(ev, names)
+		if !ok {
+			return
+		}
+		if !*asJSON {
+			fmt.Println(entry)
+			return
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error encoding entry:", err)
+			return
+		}
+		fmt.Println(string(data))
+	}
+
+	// Recent scrobbles are printed oldest first so the live ones follow on.
+	since := nostr.Now()
+	seen := make(map[string]bool)
+	if *count > 0 {
+		recent, err := ctx.nostr.queryFeed(contacts, *count)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error fetching recent scrobbles:", err)
+		}
+		for _, ev := range recent {
+			seen[ev.ID] = true
+			write(ev)
+		}
+	}
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	events, err := ctx.nostr.SubscribeEvents(sigCtx, authorFilters(nostr.Filter{Kinds: []int{KindScrobble}, Since: &since}, contacts)...)
+	if err != nil {
+		return err
+	}
+	for ev := range events {
+		if !seen[ev.ID] {
+			write(ev)
+		}
+	}
+	return nil
+}
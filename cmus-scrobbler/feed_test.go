@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var (
+	alicePK, _ = nostr.GetPublicKey(strings.Repeat("01", 32))
+	bobPK, _   = nostr.GetPublicKey(strings.Repeat("02", 32))
+)
+
+func TestContactsFromEvent(t *testing.T) {
+	ev := &nostr.Event{Kind: KindContactList, Tags: nostr.Tags{
+		{"p", alicePK, "wss://relay.example.com", "alice"},
+		{"p", "not-a-key"},
+		{"t", "music"},
+		{"p", bobPK},
+		{"p", alicePK},
+	}}
+	got := contactsFromEvent(ev)
+	if len(got) != 2 || got[0] != alicePK || got[1] != bobPK {
+		t.Errorf("contactsFromEvent = %v, want alice and bob", got)
+	}
+	if contactsFromEvent(nil) != nil {
+		t.Error("contactsFromEvent(nil) is not empty")
+	}
+}
+
+func TestProfileName(t *testing.T) {
+	tests := []struct {
+		content, want string
+	}{
+		{`{"name":"alice","display_name":"Alice A."}`, "Alice A."},
+		{`{"name":"bob","display_name":" "}`, "bob"},
+		{`not json`, ""},
+	}
+	for _, tt := range tests {
+		if got := profileName(&nostr.Event{Kind: KindMetadata, Content: tt.content}); got != tt.want {
+			t.Errorf("profileName(%s) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorFilters(t *testing.T) {
+	authors := make([]string, feedAuthorBatch*2+1)
+	filters := authorFilters(nostr.Filter{Kinds: []int{KindScrobble}, Limit: 5}, authors)
+	if len(filters) != 3 {
+		t.Fatalf("authorFilters returned %d filters, want 3", len(filters))
+	}
+	if len(filters[2].Authors) != 1 || filters[2].Limit != 5 || filters[2].Kinds[0] != KindScrobble {
+		t.Errorf("last filter = %+v", filters[2])
+	}
+}
+
+func TestFeedEntry(t *testing.T) {
+	ev := scrobbleFixture(1700000000,
+		nostr.Tag{"artist", "Low"},
+		nostr.Tag{"track", "Words"},
+		nostr.Tag{"album", "I Could Live in Hope"},
+		nostr.Tag{"i", "mbid:recording:rec-1"},
+	)
+	ev.PubKey = alicePK
+	ev.ID = "id-1"
+
+	entry, ok := newFeedEntry(ev, map[string]string{alicePK: "Alice"})
+	if !ok {
+		t.Fatal("newFeedEntry rejected a scrobble")
+	}
+	if s := entry.String(); !strings.Contains(s, "Alice") || !strings.Contains(s, "Low - Words (I Could Live in Hope)") {
+		t.Errorf("entry = %q", s)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]any
+	json.Unmarshal(data, &decoded)
+	if decoded["name"] != "Alice" || decoded["mbid"] != "rec-1" || decoded["pubkey"] != alicePK {
+		t.Errorf("JSON = %s", data)
+	}
+
+	unnamed, _ := newFeedEntry(ev, nil)
+	if !strings.Contains(unnamed.String(), "npub1") {
+		t.Errorf("entry without a name = %q, want an npub", unnamed.String())
+	}
+
+	if _, ok := newFeedEntry(scrobbleFixture(1, nostr.Tag{"artist", "Low"}), nil); ok {
+		t.Error("newFeedEntry accepted a scrobble without a track")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DefaultFilenamePatterns are tried when the config has none. They match the
+// trailing components of a file path, so each needs something that only
+// music file names have, such as a track number or " - ".
+var DefaultFilenamePatterns = []string{
+	"{artist}/{album}/{track} - {title}.*",
+	"{artist} - {title}.*",
+}
+
+// filenamePattern is a compiled path template such as
+// "{artist}/{album}/{track} - {title}.flac".
+type filenamePattern struct {
+	source string
+	re     *regexp.Regexp
+}
+
+var placeholderRe = regexp.MustCompile(`\{(\w+)\}`)
+
+func compileFilenamePattern(pattern string) (filenamePattern, error) {
+	var b strings.Builder
+	b.WriteString(`(?:^|/)`)
+
+	last := 0
+	for _, loc := range placeholderRe.FindAllStringSubmatchIndex(pattern, -1) {
+		b.WriteString(literalPattern(pattern[last:loc[0]]))
+		name := pattern[loc[2]:loc[3]]
+		switch name {
+		case "artist", "album", "title":
+			fmt.Fprintf(&b, `(?P<%s>[^/]+?)`, name)
+		case "track":
+			b.WriteString(`(?P<track>\d+)`)
+		default:
+			b.WriteString(`[^/]+?`)
+		}
+		last = loc[1]
+	}
+	b.WriteString(literalPattern(pattern[last:]))
+	b.WriteString(`$`)
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return filenamePattern{}, fmt.Errorf("invalid filename pattern %q: %w", pattern, err)
+	}
+	if re.SubexpIndex("title") < 0 {
+		return filenamePattern{}, fmt.Errorf("filename pattern %q must contain {title}", pattern)
+	}
+	return filenamePattern{source: pattern, re: re}, nil
+}
+
+// literalPattern quotes a literal template segment, keeping * as a wildcard
+// within a single path component.
+func literalPattern(s string) string {
+	parts := strings.Split(s, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return strings.Join(parts, `[^/]*`)
+}
+
+func compileFilenamePatterns(patterns []string) ([]filenamePattern, error) {
+	if len(patterns) == 0 {
+		patterns = DefaultFilenamePatterns
+	}
+
+	var compiled []filenamePattern
+	for _, pattern := range patterns {
+		p, err := compileFilenamePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, p)
+	}
+	return compiled, nil
+}
+
+// parseFilename fills in a scrobble from the first pattern matching path.
+// The result is marked as low-confidence metadata.
+func parseFilename(patterns []filenamePattern, path string) (ScrobbleEvent, string, bool) {
+	path = filepath.ToSlash(path)
+	for _, p := range patterns {
+		match := p.re.FindStringSubmatch(path)
+		if match == nil {
+			continue
+		}
+
+		group := func(name string) string {
+			if i := p.re.SubexpIndex(name); i >= 0 {
+				return strings.TrimSpace(strings.ReplaceAll(match[i], "_", " "))
+			}
+			return ""
+		}
+
+		scrobble := ScrobbleEvent{
+			Artist:         group("artist"),
+			Track:          group("title"),
+			Album:          group("album"),
+			MetadataSource: MetadataSourceFilename,
+		}
+		if scrobble.Track == "" {
+			continue
+		}
+		return scrobble, p.source, true
+	}
+
+	return ScrobbleEvent{}, "", false
+}
+
+// printFilenameDryRun shows what would be scrobbled for path without
+// publishing anything.
+func printFilenameDryRun(patterns []filenamePattern, path string) {
+	scrobble, pattern, ok := parseFilename(patterns, path)
+	if !ok {
+		fmt.Println("No filename pattern matched:", path)
+		return
+	}
+
+	fmt.Println("Pattern:", pattern)
+	fmt.Println("Artist: ", scrobble.Artist)
+	fmt.Println("Track:  ", scrobble.Track)
+	fmt.Println("Album:  ", scrobble.Album)
+	fmt.Println("Would scrobble:", fmt.Sprintf("%s - %s", scrobble.Artist, scrobble.Track), "(low-confidence filename metadata)")
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestParseFilename(t *testing.T) {
+	patterns, err := compileFilenamePatterns([]string{
+		"{artist}/{album}/{track} - {title}.flac",
+		"{artist} - {title}.*",
+	})
+	if err != nil {
+		t.Fatalf("compileFilenamePatterns: %v", err)
+	}
+
+	tests := []struct {
+		path, artist, album, title string
+		ok                         bool
+	}{
+		{"/music/Phosphorescent/Muchacho/03 - The Quotidian Beasts.flac", "Phosphorescent", "Muchacho", "The Quotidian Beasts", true},
+		{"/music/misc/Air - La_Femme_d'Argent.mp3", "Air", "", "La Femme d'Argent", true},
+		{"/music/misc/untitled.mp3", "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		scrobble, _, ok := parseFilename(patterns, tt.path)
+		if ok != tt.ok || scrobble.Artist != tt.artist || scrobble.Album != tt.album || scrobble.Track != tt.title {
+			t.Errorf("parseFilename(%q) = %+v, %v", tt.path, scrobble, ok)
+		}
+		if ok && scrobble.MetadataSource != MetadataSourceFilename {
+			t.Errorf("parseFilename(%q) source = %q", tt.path, scrobble.MetadataSource)
+		}
+	}
+}
+
+func TestDefaultFilenamePatterns(t *testing.T) {
+	patterns, err := compileFilenamePatterns(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scrobble, _, ok := parseFilename(patterns, "/home/alice/Downloads/podcasts/ep1.mp3"); ok {
+		t.Errorf("a path that isn't music was parsed as %+v", scrobble)
+	}
+}
+
+func TestFillFromFilename(t *testing.T) {
+	tagged := ScrobbleEvent{Track: "Words", Album: "I Could Live in Hope", MbID: "5b6c7d8e"}
+	guessed := ScrobbleEvent{Artist: "Low", Track: "words", Album: "Hope", MetadataSource: MetadataSourceFilename}
+	got := fillFromFilename(tagged, guessed)
+	if got.Artist != "Low" || got.Track != "Words" || got.Album != "I Could Live in Hope" || got.MbID != "5b6c7d8e" {
+		t.Errorf("fillFromFilename = %+v", got)
+	}
+}
+
+func TestCompileFilenamePatternRequiresTitle(t *testing.T) {
+	if _, err := compileFilenamePattern("{artist}/{album}.flac"); err == nil {
+		t.Fatal("expected error for pattern without {title}")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// historyPageSize is how many events are requested per page when walking
+// the full history.
+const historyPageSize = 500
+
+// WalkHistory calls fn once for every scrobble event of this key with
+// created_at in [since, until]. A zero since or until leaves that end open.
+// With a synced history cache the events come from it, newest first;
+// otherwise see walkRelaysHistory.
+func (n *Nostr) WalkHistory(since, until nostr.Timestamp, fn func(ev *nostr.Event) error) error {
+	if cache := n.historyCache(); cache != nil {
+		return cache.Range(since, until, fn)
+	}
+	return n.walkRelaysHistory(since, until, fn)
+}
+
+// walkRelaysHistory walks the history on every relay. Events are paged
+// newest first per relay and deduplicated across relays, so fn sees them
+// roughly but not strictly in order. Relays that fail are reported and
+// skipped.
+func (n *Nostr) walkRelaysHistory(since, until nostr.Timestamp, fn func(ev *nostr.Event) error) error {
+	seen := make(map[string]bool)
+	for _, relay := range n.relays {
+		err := n.walkRelayHistory(relay, since, until, seen, fn)
+		var queryErr *relayQueryError
+		if errors.As(err, &queryErr) {
+			slog.Warn("error querying relay", "relay", relay.URL, "err", queryErr.err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relayQueryError wraps a failed relay query, as opposed to an error
+// returned by a walk callback.
+type relayQueryError struct {
+	err error
+}
+
+func (e *relayQueryError) Error() string { return e.err.Error() }
+
+// walkRelayHistory pages through the history on relay, newest first, and
+// calls fn for the events not in seen yet, adding them to it. Paging only
+// looks at what this relay returned, so events other relays already had
+// don't end the walk before the older ones only this relay has.
+func (n *Nostr) walkRelayHistory(relay *nostr.Relay, since, until nostr.Timestamp, seen map[string]bool, fn func(ev *nostr.Event) error) error {
+	filter := nostr.Filter{
+		Kinds:   []int{KindScrobble, KindPrivateScrobble},
+		Authors: []string{n.pk},
+		Limit:   historyPageSize,
+	}
+	if since != 0 {
+		filter.Since = &since
+	}
+	cursor := until
+	returned := make(map[string]bool)
+
+	for {
+		if cursor != 0 {
+			filter.Until = &cursor
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		events, err := relay.QuerySync(ctx, filter)
+		cancel()
+		if err != nil {
+			return &relayQueryError{err: err}
+		}
+
+		// Pages overlap by one second so events sharing a timestamp with
+		// the end of a page aren't lost; stop once a page has nothing the
+		// relay hasn't returned already.
+		fresh := 0
+		oldest := cursor
+		for _, ev := range events {
+			if oldest == 0 || ev.CreatedAt < oldest {
+				oldest = ev.CreatedAt
+			}
+			if returned[ev.ID] {
+				continue
+			}
+			returned[ev.ID] = true
+			fresh++
+			if seen[ev.ID] {
+				continue
+			}
+			seen[ev.ID] = true
+			if err := fn(ev); err != nil {
+				return err
+			}
+		}
+
+		// Relays may cap the page size below historyPageSize, so keep
+		// paging until a page has nothing new rather than until a short one.
+		if fresh == 0 {
+			return nil
+		}
+		if oldest == cursor {
+			// A full page within one second; step past it.
+			oldest--
+		}
+		cursor = oldest
+	}
+}
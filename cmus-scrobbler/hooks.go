@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hook events.
+const (
+	hookTrackStarted        = "track_started"
+	hookNowPlayingPublished = "now_playing_published"
+	hookScrobbled           = "scrobbled"
+	hookPublishFailed       = "publish_failed"
+	hookLoved               = "loved"
+)
+
+var hookEvents = []string{hookTrackStarted, hookNowPlayingPublished, hookScrobbled, hookPublishFailed, hookLoved}
+
+const (
+	defaultHookTimeout = 10 * time.Second
+	// hookQueueSize bounds the events waiting for a slow hook; newer events
+	// are dropped when it is full.
+	hookQueueSize = 32
+	// hookOutputLimit bounds how much of a failed command's output is
+	// logged.
+	hookOutputLimit = 512
+)
+
+// Hook runs a command or posts to a URL when run does something.
+type Hook struct {
+	Name string `yaml:"name"`
+	// Events are the events the hook runs on; all of them when empty.
+	Events []string `yaml:"events"`
+	// Command is run with sh -c and gets the payload on stdin.
+	Command string `yaml:"command"`
+	// URL gets the payload in a POST body.
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// Timeout is in seconds; it defaults to 10.
+	Timeout int `yaml:"timeout"`
+}
+
+func (h Hook) String() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	if h.URL != "" {
+		return h.URL
+	}
+	return h.Command
+}
+
+func (h Hook) runsOn(event string) bool {
+	return len(h.Events) == 0 || slices.Contains(h.Events, event)
+}
+
+func validateHook(h Hook) error {
+	if (h.Command == "") == (h.URL == "") {
+		return errors.New("needs either command or url")
+	}
+	if h.URL != "" {
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url %q must be an http:// or https:// URL", h.URL)
+		}
+	}
+	for _, event := range h.Events {
+		if !slices.Contains(hookEvents, event) {
+			return fmt.Errorf("unknown event %q, use %s", event, strings.Join(hookEvents, ", "))
+		}
+	}
+	if h.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	return nil
+}
+
+// hookTrack is a track as hooks see it.
+type hookTrack struct {
+	Artist   string `json:"artist"`
+	Track    string `json:"track"`
+	Album    string `json:"album,omitempty"`
+	MbID     string `json:"mbid,omitempty"`
+	Stream   string `json:"stream,omitempty"`
+	Duration int    `json:"duration,omitempty"`
+	Private  bool   `json:"private,omitempty"`
+}
+
+func newHookTrack(s ScrobbleEvent) hookTrack {
+	return hookTrack{
+		Artist:   s.Artist,
+		Track:    s.Track,
+		Album:    s.Album,
+		MbID:     s.MbID,
+		Stream:   s.Stream,
+		Duration: s.Duration,
+		Private:  s.Private,
+	}
+}
+
+type hookRelayResult struct {
+	Relay string `json:"relay"`
+	Error string `json:"error,omitempty"`
+}
+
+// hookPayload is the JSON a hook gets.
+type hookPayload struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Profile string    `json:"profile,omitempty"`
+	Track   hookTrack `json:"track"`
+	// EventID is the Nostr event that was published or failed to.
+	EventID string            `json:"event_id,omitempty"`
+	Relays  []hookRelayResult `json:"relays,omitempty"`
+	// Loved is set for loved, false when the track was unloved.
+	Loved *bool `json:"loved,omitempty"`
+}
+
+func hookRelayResults(results []PublishResult) []hookRelayResult {
+	var relays []hookRelayResult
+	for _, result := range results {
+		r := hookRelayResult{Relay: result.Relay}
+		if result.Err != nil {
+			r.Error = result.Err.Error()
+		}
+		relays = append(relays, r)
+	}
+	return relays
+}
+
+// hookRunner runs hooks in the background. Each hook has its own queue and
+// goroutine, so a slow or failing hook delays neither the run loop nor the
+// other hooks.
+type hookRunner struct {
+	workers []*hookWorker
+	client  *http.Client
+	stop    chan struct{}
+	once    sync.Once
+}
+
+type hookWorker struct {
+	hook  Hook
+	queue chan hookPayload
+}
+
+func newHookRunner(hooks []Hook) *hookRunner {
+	r := &hookRunner{client: &http.Client{}, stop: make(chan struct{})}
+	for _, hook := range hooks {
+		w := &hookWorker{hook: hook, queue: make(chan hookPayload, hookQueueSize)}
+		r.workers = append(r.workers, w)
+		go r.work(w)
+	}
+	return r
+}
+
+// fire queues payload for every hook that runs on its event. It never
+// blocks. A nil runner does nothing.
+func (r *hookRunner) fire(payload hookPayload) {
+	if r == nil {
+		return
+	}
+	if payload.Time.IsZero() {
+		payload.Time = time.Now()
+	}
+	for _, w := range r.workers {
+		if !w.hook.runsOn(payload.Event) {
+			continue
+		}
+		select {
+		case w.queue <- payload:
+		default:
+			slog.Warn("hook is falling behind, dropping event", "hook", w.hook.String(), "event", payload.Event)
+		}
+	}
+}
+
+// Close stops the hooks once the running ones finish. Queued events are
+// dropped.
+func (r *hookRunner) Close() {
+	if r != nil {
+		r.once.Do(func() { close(r.stop) })
+	}
+}
+
+func (r *hookRunner) work(w *hookWorker) {
+	for {
+		select {
+		case <-r.stop:
+			return
+		case payload := <-w.queue:
+			start := time.Now()
+			if err := r.run(w.hook, payload); err != nil {
+				slog.Warn("hook failed", "hook", w.hook.String(), "event", payload.Event, "err", err)
+			} else {
+				slog.Debug("ran hook", "hook", w.hook.String(), "event", payload.Event, "duration", time.Since(start))
+			}
+		}
+	}
+}
+
+// run runs hook once. A panic is reported as an error so it can't take
+// down run.
+func (r *hookRunner) run(hook Hook, payload hookPayload) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+	timeout := defaultHookTimeout
+	if hook.Timeout > 0 {
+		timeout = time.Duration(hook.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if hook.URL != "" {
+		return r.post(ctx, hook, payload.Event, body)
+	}
+	return runHookCommand(ctx, hook.Command, payload.Event, body)
+}
+
+func (r *hookRunner) post(ctx context.Context, hook Hook, event string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Cmus-Scrobbler-Event", event)
+	for name, value := range hook.Headers {
+		req.Header.Set(name, os.ExpandEnv(value))
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", hook.URL, resp.Status)
+	}
+	return nil
+}
+
+// runHookCommand runs command with the payload on stdin and the event in
+// $CMUS_SCROBBLER_EVENT.
+func runHookCommand(ctx context.Context, command, event string, payload []byte) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), EnvPrefix+"EVENT="+event)
+	// Don't wait on background children that keep the output open.
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.New("timed out")
+	}
+	if err != nil {
+		output := strings.TrimSpace(string(out))
+		if len(output) > hookOutputLimit {
+			output = output[:hookOutputLimit] + "…"
+		}
+		if output != "" {
+			return fmt.Errorf("%w: %s", err, output)
+		}
+		return err
+	}
+	return nil
+}
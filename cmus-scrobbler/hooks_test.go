@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookCommand(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	r := newHookRunner(nil)
+	t.Setenv("OUT", out)
+	err := r.run(Hook{Command: `cat > "$OUT"; echo "$CMUS_SCROBBLER_EVENT" >> "$OUT"`}, hookPayload{
+		Event: hookScrobbled,
+		Track: hookTrack{Artist: "Low", Track: "Words"},
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	data, _ := os.ReadFile(out)
+	payload, event, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+	var got hookPayload
+	if err := json.Unmarshal([]byte(payload), &got); err != nil || got.Track.Artist != "Low" || got.Event != hookScrobbled {
+		t.Errorf("stdin = %s (%v)", payload, err)
+	}
+	if event != hookScrobbled {
+		t.Errorf("$CMUS_SCROBBLER_EVENT = %q", event)
+	}
+
+	err = r.run(Hook{Command: "echo oops >&2; exit 3"}, hookPayload{Event: hookLoved})
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("failing hook error = %v", err)
+	}
+
+	start := time.Now()
+	err = r.run(Hook{Command: "sleep 10", Timeout: 1}, hookPayload{Event: hookLoved})
+	if err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("slow hook returned %v after %v", err, time.Since(start))
+	}
+}
+
+func TestHookURL(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("HOOK_TOKEN", "secret")
+	r := newHookRunner([]Hook{{
+		URL:     server.URL,
+		Events:  []string{hookScrobbled},
+		Headers: map[string]string{"Authorization": "Bearer ${HOOK_TOKEN}"},
+	}})
+	defer r.Close()
+
+	// Only scrobbled runs the hook.
+	r.fire(hookPayload{Event: hookLoved})
+	r.fire(hookPayload{Event: hookScrobbled, Track: hookTrack{Artist: "Low", Track: "Words"}, EventID: "abc"})
+	select {
+	case req := <-received:
+		body := <-bodies
+		if req.Method != http.MethodPost || req.Header.Get("X-Cmus-Scrobbler-Event") != hookScrobbled {
+			t.Errorf("request %s with event %q", req.Method, req.Header.Get("X-Cmus-Scrobbler-Event"))
+		}
+		var got hookPayload
+		if err := json.Unmarshal(body, &got); err != nil || got.EventID != "abc" || got.Time.IsZero() {
+			t.Errorf("body = %s (%v)", body, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hook didn't run")
+	}
+	select {
+	case req := <-received:
+		t.Errorf("hook ran again for %s", req.Header.Get("X-Cmus-Scrobbler-Event"))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	err := r.run(Hook{URL: server.URL}, hookPayload{Event: hookLoved})
+	<-received
+	<-bodies
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("rejected webhook error = %v", err)
+	}
+}
+
+func TestValidateHook(t *testing.T) {
+	for _, h := range []Hook{
+		{},
+		{Command: "true", URL: "https://example.com"},
+		{URL: "ftp://example.com"},
+		{Command: "true", Events: []string{"paused"}},
+		{Command: "true", Timeout: -1},
+	} {
+		if validateHook(h) == nil {
+			t.Errorf("validateHook(%+v) accepted an invalid hook", h)
+		}
+	}
+	if err := validateHook(Hook{URL: "https://example.com/hook", Events: []string{hookScrobbled, hookLoved}}); err != nil {
+		t.Errorf("validateHook: %v", err)
+	}
+}
+
+func TestMusicStatusEvent(t *testing.T) {
+	n := newTestNostr(t)
+	now := time.Unix(1700000000, 0)
+	track := &TrackStatus{Artist: "Low", Track: "Words", Position: 20, Duration: 200}
+
+	ev, err := n.CreateMusicStatusEvent(ScrobbleEvent{Artist: "Low", Track: "Words"}, nowPlayingExpiry(track, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Kind != KindUserStatus || ev.Tags.GetD() != "music" {
+		t.Errorf("kind %d, d %q", ev.Kind, ev.Tags.GetD())
+	}
+	if exp := ev.Tags.GetFirst([]string{"expiration"}); exp == nil || (*exp)[1] != "1700000180" {
+		t.Errorf("expiration = %v", exp)
+	}
+	if got, ok := announcedTrackFromEvent(ev); !ok || got.Artist != "Low" || got.Title != "Words" {
+		t.Errorf("listen-along reads %v, %v", got, ok)
+	}
+}
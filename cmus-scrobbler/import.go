@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	ImportFormatJSONL        = "jsonl"
+	ImportFormatScrobblerLog = "scrobbler-log"
+)
+
+// detectImportFormat guesses the format of an import file from its name and
+// first line.
+func detectImportFormat(path string, r *bufio.Reader) string {
+	if strings.HasSuffix(path, ".scrobbler.log") {
+		return ImportFormatScrobblerLog
+	}
+	head, _ := r.Peek(16)
+	if bytes.HasPrefix(bytes.TrimPrefix(head, []byte("\ufeff")), []byte("#AUDIOSCROBBLER")) {
+		return ImportFormatScrobblerLog
+	}
+	return ImportFormatJSONL
+}
+
+// cmdImport imports listens from a JSONL backup written by export, or from
+// a portable player's .scrobbler.log.
+func cmdImport(ctx *cliContext, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "", "Input format: jsonl or scrobbler-log (default: detect)")
+	tz := fs.String("tz", "Local", "Timezone of the player for .scrobbler.log files with #TZ/UNKNOWN")
+	includeSkipped := fs.Bool("include-skipped", false, "Import .scrobbler.log entries rated S (skipped)")
+	dryRun := fs.Bool("dry-run", false, "Show what would be imported without publishing")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: cmus-scrobbler import [-format jsonl|scrobbler-log] <file>")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", fs.Arg(0), err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	if *format == "" {
+		*format = detectImportFormat(fs.Arg(0), r)
+	}
+	switch *format {
+	case ImportFormatJSONL:
+		return importJSONL(ctx, r)
+	case ImportFormatScrobblerLog:
+		loc, err := time.LoadLocation(*tz)
+		if err != nil {
+			return fmt.Errorf("invalid -tz: %w", err)
+		}
+		return importScrobblerLog(ctx, r, loc, *includeSkipped, *dryRun, *yes)
+	default:
+		return fmt.Errorf("unknown import format %q", *format)
+	}
+}
+
+// importJSONL republishes signed scrobble events from a JSONL backup.
+func importJSONL(ctx *cliContext, r io.Reader) error {
+	imported, skipped, failed := 0, 0, 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var ev nostr.Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if ev.Kind != KindScrobble && ev.Kind != KindPrivateScrobble {
+			skipped++
+			continue
+		}
+		if ok, err := ev.CheckSignature(); !ok {
+			fmt.Printf("Line %d: skipping event %s with invalid signature: %v\n", line, ev.ID, err)
+			skipped++
+			continue
+		}
+
+		results := ctx.nostr.PublishEventResults(&ev)
+		logPublishResults(&ev, results)
+		if !anyPublished(results) {
+			failed++
+			continue
+		}
+		imported++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading backup: %w", err)
+	}
+
+	fmt.Printf("Imported %d events, skipped %d, failed %d\n", imported, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d events were not accepted by any relay", failed)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// decodeNsec returns the hex private key for an nsec.
+func decodeNsec(nsec string) (string, error) {
+	prefix, value, err := nip19.Decode(nsec)
+	if err != nil {
+		return "", fmt.Errorf("error decoding private key: %w", err)
+	}
+	if prefix != "nsec" {
+		return "", fmt.Errorf("error decoding private key: expected nsec, got %s", prefix)
+	}
+	return value.(string), nil
+}
+
+// publicKeys returns the hex public key and npub for a hex private key.
+func publicKeys(sk string) (string, string, error) {
+	pk, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		return "", "", fmt.Errorf("error getting public key: %w", err)
+	}
+	npub, err := nip19.EncodePublicKey(pk)
+	if err != nil {
+		return "", "", fmt.Errorf("error encoding public key: %w", err)
+	}
+	return pk, npub, nil
+}
+
+// generateKey creates a new key pair and returns it as nsec and npub.
+func generateKey() (string, string, error) {
+	sk := nostr.GeneratePrivateKey()
+	nsec, err := nip19.EncodePrivateKey(sk)
+	if err != nil {
+		return "", "", fmt.Errorf("error encoding private key: %w", err)
+	}
+	_, npub, err := publicKeys(sk)
+	if err != nil {
+		return "", "", err
+	}
+	return nsec, npub, nil
+}
+
+// decodePubkey returns the hex public key for an npub or a hex key.
+func decodePubkey(key string) (string, error) {
+	if nostr.IsValidPublicKey(key) {
+		return key, nil
+	}
+	prefix, value, err := nip19.Decode(key)
+	if err != nil {
+		return "", fmt.Errorf("error decoding public key: %w", err)
+	}
+	switch prefix {
+	case "npub":
+		return value.(string), nil
+	case "nprofile":
+		return value.(nostr.ProfilePointer).PublicKey, nil
+	}
+	return "", fmt.Errorf("error decoding public key: expected npub, got %s", prefix)
+}
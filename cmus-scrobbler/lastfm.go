@@ -0,0 +1,385 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	lastfmAPIURL = "https://ws.audioscrobbler.com/2.0/"
+	// defaultLastfmInterval is how often run polls Last.fm for recent
+	// tracks by default.
+	defaultLastfmInterval = 20 * time.Second
+	// lastfmPageSize is the most recent tracks Last.fm returns per page.
+	lastfmPageSize = 200
+	// maxLastfmResponse bounds Last.fm response bodies.
+	maxLastfmResponse = 8 << 20
+)
+
+// LastfmConfig makes run mirror the scrobbles of a Last.fm user.
+type LastfmConfig struct {
+	// User is the Last.fm user whose scrobbles are mirrored.
+	User string `yaml:"user"`
+	// BaseURL is the Last.fm API endpoint; it defaults to Last.fm's own.
+	BaseURL string `yaml:"base_url"`
+	// Interval is how often recent tracks are polled, in seconds; it
+	// defaults to 20.
+	Interval int `yaml:"interval"`
+}
+
+func validateLastfmConfig(config LastfmConfig, apiKey string) error {
+	if config.BaseURL != "" {
+		u, err := url.Parse(config.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("base_url %q must be an http:// or https:// URL", config.BaseURL)
+		}
+	}
+	if config.Interval < 0 {
+		return errors.New("interval must not be negative")
+	}
+	if config.User != "" && apiKey == "" {
+		return errors.New("user needs api_key to be set")
+	}
+	return nil
+}
+
+func (c LastfmConfig) interval() time.Duration {
+	if c.Interval > 0 {
+		return time.Duration(c.Interval) * time.Second
+	}
+	return defaultLastfmInterval
+}
+
+// lastfmClient calls the read-only methods of the Last.fm API.
+type lastfmClient struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+func newLastfmClient(config Config) *lastfmClient {
+	baseURL := config.Lastfm.BaseURL
+	if baseURL == "" {
+		baseURL = lastfmAPIURL
+	}
+	return &lastfmClient{baseURL: baseURL, apiKey: config.APIKey, http: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// get calls the method in params and decodes the JSON response into v.
+func (c *lastfmClient) get(params url.Values, v any) error {
+	params.Set("api_key", c.apiKey)
+	params.Set("format", "json")
+	resp, err := c.http.Get(c.baseURL + "?" + params.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxLastfmResponse))
+	if err != nil {
+		return fmt.Errorf("error reading Last.fm response: %w", err)
+	}
+
+	var apiErr struct {
+		Error   int    `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != 0 {
+		return fmt.Errorf("Last.fm error %d: %s", apiErr.Error, apiErr.Message)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Last.fm returned %s", resp.Status)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error reading Last.fm response: %w", err)
+	}
+	return nil
+}
+
+// lastfmText is a Last.fm name with its MusicBrainz ID.
+type lastfmText struct {
+	Text string `json:"#text"`
+	MbID string `json:"mbid"`
+}
+
+type lastfmRecentTrack struct {
+	Name   string     `json:"name"`
+	MbID   string     `json:"mbid"`
+	Artist lastfmText `json:"artist"`
+	Album  lastfmText `json:"album"`
+	// Date is missing for the track playing now.
+	Date *struct {
+		UTS string `json:"uts"`
+	} `json:"date"`
+	Attr struct {
+		NowPlaying string `json:"nowplaying"`
+	} `json:"@attr"`
+}
+
+func (t lastfmRecentTrack) nowPlaying() bool {
+	return t.Attr.NowPlaying == "true"
+}
+
+// uts is when the track was scrobbled, or 0 when it wasn't.
+func (t lastfmRecentTrack) uts() int64 {
+	if t.Date == nil {
+		return 0
+	}
+	uts, _ := strconv.ParseInt(t.Date.UTS, 10, 64)
+	return uts
+}
+
+func (t lastfmRecentTrack) scrobble() ScrobbleEvent {
+	return ScrobbleEvent{
+		Artist:    t.Artist.Text,
+		Track:     t.Name,
+		Album:     t.Album.Text,
+		MbID:      t.MbID,
+		CreatedAt: nostr.Timestamp(t.uts()),
+	}
+}
+
+// recentTracks fetches the tracks user scrobbled from from to to, and the
+// one playing now, newest first. A zero from fetches only the latest page.
+func (c *lastfmClient) recentTracks(user string, from, to int64) ([]lastfmRecentTrack, error) {
+	var tracks []lastfmRecentTrack
+	for page := 1; ; page++ {
+		var body struct {
+			RecentTracks struct {
+				// Track is an object instead of a list when there is
+				// only one.
+				Track json.RawMessage `json:"track"`
+				Attr  struct {
+					TotalPages string `json:"totalPages"`
+				} `json:"@attr"`
+			} `json:"recenttracks"`
+		}
+		params := url.Values{
+			"method": {"user.getrecenttracks"},
+			"user":   {user},
+			"limit":  {strconv.Itoa(lastfmPageSize)},
+			"page":   {strconv.Itoa(page)},
+		}
+		if from > 0 {
+			// A fixed range keeps pages from shifting as new scrobbles
+			// come in.
+			params.Set("from", strconv.FormatInt(from, 10))
+			params.Set("to", strconv.FormatInt(to, 10))
+		}
+		if err := c.get(params, &body); err != nil {
+			return nil, fmt.Errorf("error fetching Last.fm recent tracks: %w", err)
+		}
+
+		var pageTracks []lastfmRecentTrack
+		if raw := body.RecentTracks.Track; len(raw) > 0 && raw[0] == '{' {
+			var track lastfmRecentTrack
+			if err := json.Unmarshal(raw, &track); err != nil {
+				return nil, fmt.Errorf("error reading Last.fm recent tracks: %w", err)
+			}
+			pageTracks = append(pageTracks, track)
+		} else if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &pageTracks); err != nil {
+				return nil, fmt.Errorf("error reading Last.fm recent tracks: %w", err)
+			}
+		}
+		// Later pages repeat the track playing now.
+		for _, track := range pageTracks {
+			if page == 1 || !track.nowPlaying() {
+				tracks = append(tracks, track)
+			}
+		}
+
+		totalPages, _ := strconv.Atoi(body.RecentTracks.Attr.TotalPages)
+		if from == 0 || page >= totalPages {
+			return tracks, nil
+		}
+	}
+}
+
+// lastfmCursor is the newest Last.fm scrobble mirrored so far.
+type lastfmCursor struct {
+	UTS int64 `json:"uts"`
+	// Seen are the tracks scrobbled at UTS that were mirrored; Last.fm can
+	// have more than one in the same second.
+	Seen []string `json:"seen,omitempty"`
+}
+
+func (c lastfmCursor) covers(uts int64, key string) bool {
+	return uts < c.UTS || uts == c.UTS && slices.Contains(c.Seen, key)
+}
+
+func (c *lastfmCursor) advance(uts int64, key string) {
+	switch {
+	case uts > c.UTS:
+		c.UTS = uts
+		c.Seen = []string{key}
+	case uts == c.UTS && !slices.Contains(c.Seen, key):
+		// Clipped, since the cursors may share Seen.
+		c.Seen = append(slices.Clip(c.Seen), key)
+	}
+}
+
+// lastfmState is what run keeps of a Last.fm mirror across restarts.
+type lastfmState struct {
+	User   string       `json:"user"`
+	Cursor lastfmCursor `json:"cursor"`
+}
+
+// lastfmStatePath is the Last.fm mirror state file of run for pubkey.
+func lastfmStatePath(pubkey string) (string, error) {
+	return stateFilePath("lastfm-" + pubkey + ".json")
+}
+
+// lastfmSource mirrors a Last.fm user's scrobbles into a mediaTracker.
+// Scrobbles keep the time Last.fm has for them and the track playing now
+// is only announced. Two cursors keep scrobbles from being missed or
+// mirrored twice: queued is the newest scrobble handed to the run loop,
+// and saved the newest the run loop has handled, which is what a restart
+// resumes from.
+type lastfmSource struct {
+	client  *lastfmClient
+	user    string
+	path    string
+	tracker *mediaTracker
+	// notify is called when the tracker has plays for the run loop.
+	notify func()
+
+	mu      sync.Mutex
+	started bool
+	queued  lastfmCursor
+	saved   lastfmCursor
+	playing ScrobbleEvent
+}
+
+func newLastfmSource(config Config, path string, tracker *mediaTracker, notify func()) (*lastfmSource, error) {
+	var state lastfmState
+	if err := readStateFile(path, &state); err != nil {
+		return nil, err
+	}
+	s := &lastfmSource{
+		client:  newLastfmClient(config),
+		user:    config.Lastfm.User,
+		path:    path,
+		tracker: tracker,
+		notify:  notify,
+	}
+	// The cursor of another user doesn't apply.
+	if state.User == s.user && state.Cursor.UTS > 0 {
+		s.started = true
+		s.queued = state.Cursor
+		s.saved = state.Cursor
+	}
+	return s, nil
+}
+
+func (s *lastfmSource) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.poll(time.Now()); err != nil {
+			slog.Warn("error polling Last.fm", "user", s.user, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll hands the scrobbles made since the last poll, oldest first, and a
+// change of the track playing now to the tracker. The first poll without a
+// saved cursor starts the mirror at the latest scrobble.
+func (s *lastfmSource) poll(now time.Time) error {
+	s.mu.Lock()
+	from, started := s.queued.UTS, s.started
+	s.mu.Unlock()
+
+	tracks, err := s.client.recentTracks(s.user, from, now.Unix())
+	if err != nil {
+		return err
+	}
+
+	var scrobbles []lastfmRecentTrack
+	var playing ScrobbleEvent
+	for _, track := range tracks {
+		if track.nowPlaying() {
+			playing = track.scrobble()
+		} else if track.uts() > 0 {
+			scrobbles = append(scrobbles, track)
+		}
+	}
+	slices.SortStableFunc(scrobbles, func(a, b lastfmRecentTrack) int {
+		return cmp.Compare(a.uts(), b.uts())
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !started {
+		s.started = true
+		s.queued = lastfmCursor{UTS: now.Unix()}
+		if len(scrobbles) > 0 {
+			latest := scrobbles[len(scrobbles)-1]
+			s.queued = lastfmCursor{UTS: latest.uts(), Seen: []string{mediaKey(latest.scrobble())}}
+		}
+		s.saved = s.queued
+		slog.Info("mirroring Last.fm scrobbles", "user", s.user, "after", time.Unix(s.queued.UTS, 0))
+		if err := writeStateFile(s.path, lastfmState{User: s.user, Cursor: s.saved}); err != nil {
+			return err
+		}
+		scrobbles = nil
+	}
+
+	ready := false
+	if mediaKey(playing) != mediaKey(s.playing) {
+		source := "lastfm:" + s.user
+		if s.playing.Track != "" {
+			s.tracker.handle(mediaEvent{source: source, action: mediaStop, track: s.playing, position: -1}, now)
+		}
+		if playing.Track != "" {
+			ready = s.tracker.handle(mediaEvent{source: source, action: mediaNowPlaying, track: playing}, now) || ready
+		}
+		s.playing = playing
+	}
+	for _, track := range scrobbles {
+		scrobble := track.scrobble()
+		uts, key := track.uts(), mediaKey(scrobble)
+		if s.queued.covers(uts, key) {
+			continue
+		}
+		s.queued.advance(uts, key)
+		ready = s.tracker.handle(mediaEvent{
+			source: "lastfm:" + s.user,
+			action: mediaScrobble,
+			track:  scrobble,
+			done:   func() { s.commit(uts, key) },
+		}, now) || ready
+	}
+	if ready {
+		s.notify()
+	}
+	return nil
+}
+
+// commit records that the run loop handled the scrobble at uts.
+func (s *lastfmSource) commit(uts int64, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saved.advance(uts, key)
+	if err := writeStateFile(s.path, lastfmState{User: s.user, Cursor: s.saved}); err != nil {
+		slog.Error("error saving Last.fm cursor", "err", err)
+	}
+}
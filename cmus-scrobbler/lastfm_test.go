@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type fakeScrobble struct {
+	uts           int64
+	artist, track string
+}
+
+// fakeLastfm serves user.getrecenttracks the way Last.fm does: newest
+// first, the track playing now on top of every page, and a single track
+// as an object instead of a list.
+type fakeLastfm struct {
+	scrobbles []fakeScrobble // oldest first
+	playing   *fakeScrobble
+	pageSize  int
+}
+
+func (f *fakeLastfm) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("api_key") != "key" {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]any{"error": 10, "message": "Invalid API key"})
+		return
+	}
+	from, _ := strconv.ParseInt(q.Get("from"), 10, 64)
+	to, err := strconv.ParseInt(q.Get("to"), 10, 64)
+	if err != nil {
+		to = 1 << 62
+	}
+	page, _ := strconv.Atoi(q.Get("page"))
+
+	var matching []fakeScrobble
+	for i := len(f.scrobbles) - 1; i >= 0; i-- {
+		if s := f.scrobbles[i]; s.uts >= from && s.uts <= to {
+			matching = append(matching, s)
+		}
+	}
+	totalPages := max(1, (len(matching)+f.pageSize-1)/f.pageSize)
+	start := min(len(matching), (page-1)*f.pageSize)
+	matching = matching[start:min(len(matching), start+f.pageSize)]
+
+	var tracks []map[string]any
+	if f.playing != nil {
+		tracks = append(tracks, map[string]any{
+			"artist": map[string]string{"#text": f.playing.artist, "mbid": ""},
+			"name":   f.playing.track,
+			"album":  map[string]string{"#text": "", "mbid": ""},
+			"@attr":  map[string]string{"nowplaying": "true"},
+		})
+	}
+	for _, s := range matching {
+		tracks = append(tracks, map[string]any{
+			"artist": map[string]string{"#text": s.artist, "mbid": ""},
+			"name":   s.track,
+			"mbid":   "",
+			"album":  map[string]string{"#text": "", "mbid": ""},
+			"date":   map[string]string{"uts": strconv.FormatInt(s.uts, 10), "#text": "14 Feb 2024, 18:30"},
+		})
+	}
+	var track any = tracks
+	if len(tracks) == 1 {
+		track = tracks[0]
+	}
+	json.NewEncoder(w).Encode(map[string]any{"recenttracks": map[string]any{
+		"track": track,
+		"@attr": map[string]string{"page": strconv.Itoa(page), "totalPages": strconv.Itoa(totalPages)},
+	}})
+}
+
+func newTestLastfmSource(t *testing.T, server *httptest.Server, path string) (*lastfmSource, *mediaTracker) {
+	t.Helper()
+	tracker := newMediaTracker()
+	config := Config{APIKey: "key", Lastfm: LastfmConfig{User: "alice", BaseURL: server.URL}}
+	source, err := newLastfmSource(config, path, tracker, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source, tracker
+}
+
+// handled takes the tasks from tracker and reports them the way the run
+// loop does.
+func handled(tracker *mediaTracker, now time.Time) (started, scrobbled []string) {
+	for _, task := range tracker.take(now) {
+		if task.started {
+			started = append(started, task.track.Track)
+			continue
+		}
+		scrobbled = append(scrobbled, task.track.Track+"@"+strconv.FormatInt(int64(task.track.CreatedAt), 10))
+		if task.done != nil {
+			task.done()
+		}
+	}
+	return started, scrobbled
+}
+
+func TestLastfmSource(t *testing.T) {
+	fake := &fakeLastfm{pageSize: 2, scrobbles: []fakeScrobble{{1000, "Low", "Words"}}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "lastfm.json")
+	now := time.Unix(2000, 0)
+
+	// The first poll starts after the latest scrobble.
+	source, tracker := newTestLastfmSource(t, server, path)
+	if err := source.poll(now); err != nil {
+		t.Fatal(err)
+	}
+	if started, scrobbled := handled(tracker, now); len(started) != 0 || len(scrobbled) != 0 {
+		t.Errorf("first poll: started %v, scrobbled %v", started, scrobbled)
+	}
+
+	// New scrobbles, over several pages, come oldest first with their
+	// own time, including two in the same second. The track playing now
+	// is announced once.
+	fake.scrobbles = append(fake.scrobbles,
+		fakeScrobble{1200, "Broadcast", "Black Cat"},
+		fakeScrobble{1400, "Stereolab", "Cybele's Reverie"},
+		fakeScrobble{1400, "Stereolab", "French Disko"},
+		fakeScrobble{1600, "Low", "Lullaby"},
+	)
+	fake.playing = &fakeScrobble{artist: "Low", track: "Sunflower"}
+	if err := source.poll(now); err != nil {
+		t.Fatal(err)
+	}
+	started, scrobbled := handled(tracker, now)
+	if want := []string{"Black Cat@1200", "French Disko@1400", "Cybele's Reverie@1400", "Lullaby@1600"}; !slices.Equal(scrobbled, want) {
+		t.Errorf("scrobbled %v, want %v", scrobbled, want)
+	}
+	if len(started) != 1 || started[0] != "Sunflower" {
+		t.Errorf("started %v", started)
+	}
+	if err := source.poll(now); err != nil {
+		t.Fatal(err)
+	}
+	if started, scrobbled := handled(tracker, now); len(started) != 0 || len(scrobbled) != 0 {
+		t.Errorf("second poll: started %v, scrobbled %v", started, scrobbled)
+	}
+
+	// A scrobble queued but not yet handled by the run loop is polled
+	// again after a restart; handled ones aren't.
+	fake.scrobbles = append(fake.scrobbles, fakeScrobble{1800, "Low", "Sunflower"})
+	fake.playing = nil
+	if err := source.poll(now); err != nil {
+		t.Fatal(err)
+	}
+	source, tracker = newTestLastfmSource(t, server, path)
+	if err := source.poll(now); err != nil {
+		t.Fatal(err)
+	}
+	if _, scrobbled := handled(tracker, now); !slices.Equal(scrobbled, []string{"Sunflower@1800"}) {
+		t.Errorf("after restart scrobbled %v", scrobbled)
+	}
+}
+
+func TestLastfmErrors(t *testing.T) {
+	server := httptest.NewServer(&fakeLastfm{pageSize: 10})
+	defer server.Close()
+
+	client := &lastfmClient{baseURL: server.URL, apiKey: "wrong", http: server.Client()}
+	if _, err := client.recentTracks("alice", 0, 0); err == nil {
+		t.Error("recentTracks with a bad API key succeeded")
+	}
+
+	for _, config := range []LastfmConfig{
+		{User: "alice"},
+		{BaseURL: "ws.audioscrobbler.com/2.0/"},
+		{Interval: -1},
+	} {
+		apiKey := "key"
+		if config.User != "" {
+			apiKey = ""
+		}
+		if validateLastfmConfig(config, apiKey) == nil {
+			t.Errorf("validateLastfmConfig(%+v) accepted an invalid config", config)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// libraryTrack is a file in the cmus library with its tags.
+type libraryTrack struct {
+	File   string
+	Artist string
+	Title  string
+	Album  string
+	MbID   string
+}
+
+// cmusLibrary indexes the cmus library for matching tracks announced by
+// others against local files.
+type cmusLibrary struct {
+	tracks []libraryTrack
+	byMbID map[string]*libraryTrack
+	// fuzzy holds the fuzzyName of each track's artist and title.
+	fuzzy [][2]string
+}
+
+func newCmusLibrary(tracks []libraryTrack) *cmusLibrary {
+	lib := &cmusLibrary{
+		tracks: tracks,
+		byMbID: make(map[string]*libraryTrack),
+		fuzzy:  make([][2]string, len(tracks)),
+	}
+	for i := range lib.tracks {
+		t := &lib.tracks[i]
+		if t.MbID != "" {
+			lib.byMbID[t.MbID] = t
+		}
+		lib.fuzzy[i] = [2]string{fuzzyName(t.Artist), fuzzyName(t.Title)}
+	}
+	return lib
+}
+
+// loadCmusLibrary reads the library from the running cmus, which knows the
+// tags of every file. If cmus can't be asked, it falls back to the file
+// list in lib.pl with metadata from the filename patterns.
+func loadCmusLibrary(patterns []filenamePattern) (*cmusLibrary, error) {
+	out, err := exec.Command("cmus-remote", "-C", "save -e -l -").Output()
+	if err == nil {
+		tracks, err := parseCmusLibrary(bytes.NewReader(out))
+		if err == nil && len(tracks) > 0 {
+			return newCmusLibrary(tracks), nil
+		}
+	}
+
+	dir, err := cmusConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(dir, "lib.pl"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading cmus library: %w", err)
+	}
+	defer f.Close()
+
+	files, err := parsePlaylist(f, dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cmus library: %w", err)
+	}
+	var tracks []libraryTrack
+	for _, file := range files {
+		if guessed, _, ok := parseFilename(patterns, file); ok {
+			tracks = append(tracks, libraryTrack{File: file, Artist: guessed.Artist, Title: guessed.Track, Album: guessed.Album})
+		}
+	}
+	return newCmusLibrary(tracks), nil
+}
+
+// parseCmusLibrary reads cmus's extended playlist format, where each track
+// starts with a "file" line followed by "tag <name> <value>" lines.
+func parseCmusLibrary(r io.Reader) ([]libraryTrack, error) {
+	var tracks []libraryTrack
+	var current *libraryTrack
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		switch key {
+		case "file":
+			tracks = append(tracks, libraryTrack{File: value})
+			current = &tracks[len(tracks)-1]
+		case "tag":
+			if current == nil {
+				continue
+			}
+			name, value, _ := strings.Cut(value, " ")
+			value = strings.TrimSpace(value)
+			switch name {
+			case "artist":
+				current.Artist = value
+			case "title":
+				current.Title = value
+			case "album":
+				current.Album = value
+			case "musicbrainz_trackid", "mbid":
+				current.MbID = value
+			}
+		}
+	}
+	return tracks, scanner.Err()
+}
+
+// cmusConfigDir is cmus's configuration directory.
+func cmusConfigDir() (string, error) {
+	if dir := os.Getenv("CMUS_HOME"); dir != "" {
+		return dir, nil
+	}
+	playlists, err := cmusPlaylistDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Dir(playlists), nil
+}
+
+var (
+	bracketed = regexp.MustCompile(`\s*[(\[][^)\]]*[)\]]`)
+	featuring = regexp.MustCompile(`\s+(feat\.?|ft\.?|featuring)\s.*$`)
+	// versionSuffix matches the " - Remastered 2009" style some services
+	// append to titles.
+	versionSuffix = regexp.MustCompile(`\s+-\s+.*\b(remaster(ed)?|version|edit|mix|mono|stereo)\b.*$`)
+)
+
+// fuzzyName reduces a name to what matters for matching: case, brackets
+// like "(Remastered 2011)", version suffixes, featured artists, punctuation
+// and a leading "the" are dropped.
+func fuzzyName(s string) string {
+	s = strings.ToLower(s)
+	s = bracketed.ReplaceAllString(s, "")
+	s = featuring.ReplaceAllString(s, "")
+	s = versionSuffix.ReplaceAllString(s, "")
+	s = strings.ReplaceAll(s, "&", " and ")
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) {
+			return r
+		}
+		return -1
+	}, s)
+	s = strings.Join(strings.Fields(s), " ")
+	return strings.TrimPrefix(s, "the ")
+}
+
+// similarity is 1 minus the edit distance between a and b relative to the
+// longer one.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return 1 - float64(prev[len(rb)])/float64(max(len(ra), len(rb)))
+}
+
+// minSimilarity is how similar artist and title each have to be for a
+// fuzzy match.
+const minSimilarity = 0.85
+
+// Match finds the local file for a track, by MBID first and then by the
+// most similar artist and title.
+func (lib *cmusLibrary) Match(artist, title, mbid string) (*libraryTrack, bool) {
+	if mbid != "" {
+		if t, ok := lib.byMbID[mbid]; ok {
+			return t, true
+		}
+	}
+
+	wantArtist, wantTitle := fuzzyName(artist), fuzzyName(title)
+	var best *libraryTrack
+	bestScore := 0.0
+	for i, names := range lib.fuzzy {
+		if names[0] == "" || names[1] == "" {
+			continue
+		}
+		artistScore := similarity(wantArtist, names[0])
+		if artistScore < minSimilarity {
+			continue
+		}
+		titleScore := similarity(wantTitle, names[1])
+		if titleScore < minSimilarity {
+			continue
+		}
+		if score := artistScore + titleScore; score > bestScore {
+			best, bestScore = &lib.tracks[i], score
+		}
+	}
+	return best, best != nil
+}
+
+func (lib *cmusLibrary) Len() int {
+	return len(lib.tracks)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseCmusLibrary(t *testing.T) {
+	input := "file /music/Low/I Could Live in Hope/01 Words.flac\n" +
+		"duration 326\n" +
+		"tag artist Low\n" +
+		"tag title Words\n" +
+		"tag album I Could Live in Hope\n" +
+		"tag musicbrainz_trackid 4a9c7cf5-1c04-4e4b-a5a0-4e0bd3f4b1b7\n" +
+		"file /music/Broadcast/02 Black Cat.flac\n" +
+		"tag artist Broadcast\n" +
+		"tag title Black Cat\n"
+
+	tracks, err := parseCmusLibrary(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseCmusLibrary: %v", err)
+	}
+	if len(tracks) != 2 {
+		t.Fatalf("parseCmusLibrary returned %d tracks, want 2: %+v", len(tracks), tracks)
+	}
+	want := libraryTrack{
+		File:   "/music/Low/I Could Live in Hope/01 Words.flac",
+		Artist: "Low",
+		Title:  "Words",
+		Album:  "I Could Live in Hope",
+		MbID:   "4a9c7cf5-1c04-4e4b-a5a0-4e0bd3f4b1b7",
+	}
+	if tracks[0] != want {
+		t.Errorf("track = %+v, want %+v", tracks[0], want)
+	}
+	if tracks[1].Artist != "Broadcast" || tracks[1].Title != "Black Cat" || tracks[1].MbID != "" {
+		t.Errorf("second track = %+v", tracks[1])
+	}
+}
+
+func TestFuzzyName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"The Beatles", "beatles"},
+		{"Here Comes the Sun (Remastered 2009)", "here comes the sun"},
+		{"Crazy in Love feat. Jay-Z", "crazy in love"},
+		{"Simon & Garfunkel", "simon and garfunkel"},
+		{"  Don't   Stop  ", "dont stop"},
+	}
+	for _, tt := range tests {
+		if got := fuzzyName(tt.in); got != tt.want {
+			t.Errorf("fuzzyName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLibraryMatch(t *testing.T) {
+	lib := newCmusLibrary([]libraryTrack{
+		{File: "/music/words.flac", Artist: "Low", Title: "Words", MbID: "rec-1"},
+		{File: "/music/sun.flac", Artist: "The Beatles", Title: "Here Comes the Sun"},
+		{File: "/music/sunking.flac", Artist: "The Beatles", Title: "Sun King"},
+		{File: "/music/untagged.flac"},
+	})
+
+	tests := []struct {
+		artist, title, mbid string
+		want                string
+	}{
+		// The MBID wins even when the names differ.
+		{"LOW", "Words (Live)", "rec-1", "/music/words.flac"},
+		{"Beatles", "Here Comes The Sun - Remastered 2009", "", "/music/sun.flac"},
+		{"The Beatles", "Here Come the Sun", "", "/music/sun.flac"},
+		{"The Beatles", "Something", "", ""},
+		{"Low", "Lullaby", "rec-2", ""},
+	}
+	for _, tt := range tests {
+		got, ok := lib.Match(tt.artist, tt.title, tt.mbid)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("Match(%q, %q) = %s, want no match", tt.artist, tt.title, got.File)
+			}
+			continue
+		}
+		if !ok || got.File != tt.want {
+			t.Errorf("Match(%q, %q, %q) = %v, %v, want %s", tt.artist, tt.title, tt.mbid, got, ok, tt.want)
+		}
+	}
+}
+
+func TestAnnouncedTrackFromEvent(t *testing.T) {
+	status := &nostr.Event{Kind: KindUserStatus, Content: "Low - Words", Tags: nostr.Tags{{"d", "music"}}}
+	if got, ok := announcedTrackFromEvent(status); !ok || got.Artist != "Low" || got.Title != "Words" {
+		t.Errorf("music status = %+v, %v", got, ok)
+	}
+
+	general := &nostr.Event{Kind: KindUserStatus, Content: "Working - from home", Tags: nostr.Tags{{"d", "general"}}}
+	if _, ok := announcedTrackFromEvent(general); ok {
+		t.Error("general status was read as a track")
+	}
+
+	scrobble := scrobbleFixture(100,
+		nostr.Tag{"artist", "Low"},
+		nostr.Tag{"track", "Words"},
+		nostr.Tag{"i", "mbid:recording:rec-1"},
+	)
+	if got, ok := announcedTrackFromEvent(scrobble); !ok || got.MbID != "rec-1" {
+		t.Errorf("scrobble = %+v, %v", got, ok)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// KindUserStatus is a NIP-38 user status. Music players publish the playing
+// track as the status with d tag "music".
+const KindUserStatus = 30315
+
+// announcedTrack is a track someone scrobbled or reported as playing.
+type announcedTrack struct {
+	Artist string
+	Title  string
+	MbID   string
+}
+
+func (t announcedTrack) String() string {
+	return fmt.Sprintf("%s - %s", t.Artist, t.Title)
+}
+
+// announcedTrackFromEvent reads the track from a scrobble or a music status.
+func announcedTrackFromEvent(ev *nostr.Event) (announcedTrack, bool) {
+	switch ev.Kind {
+	case KindScrobble:
+		scrobble := scrobbleFromTags(ev)
+		mbid, _ := scrobbleIdentifiers(ev)
+		t := announcedTrack{Artist: scrobble.Artist, Title: scrobble.Track, MbID: mbid}
+		return t, t.Artist != "" && t.Title != ""
+	case KindUserStatus:
+		if ev.Tags.GetD() != "music" || ev.Content == "" {
+			return announcedTrack{}, false
+		}
+		artist, title, ok := strings.Cut(ev.Content, " - ")
+		if !ok {
+			return announcedTrack{}, false
+		}
+		t := announcedTrack{Artist: strings.TrimSpace(artist), Title: strings.TrimSpace(title)}
+		return t, t.Artist != "" && t.Title != ""
+	}
+	return announcedTrack{}, false
+}
+
+// cmusEnqueue adds file to the cmus queue, or plays it right away.
+func cmusEnqueue(file string, play bool) error {
+	cmd := exec.Command("cmus-remote", "-q", file)
+	if play {
+		cmd = exec.Command("cmus-remote", "-C", "player-play "+file)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cmus-remote: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// listenAlong queues the tracks a followed user announces.
+type listenAlong struct {
+	library *cmusLibrary
+	play    bool
+	dryRun  bool
+
+	// last is the most recent track handled, so a now-playing status and
+	// the scrobble that follows it queue the track only once.
+	last       string
+	queued     int
+	unresolved []announcedTrack
+}
+
+func (l *listenAlong) handle(t announcedTrack) {
+	key := trackNameKey(t.Artist, t.Title)
+	if key == l.last {
+		return
+	}
+	l.last = key
+
+	match, ok := l.library.Match(t.Artist, t.Title, t.MbID)
+	if !ok {
+		fmt.Printf("Not in library: %s\n", t)
+		l.unresolved = append(l.unresolved, t)
+		return
+	}
+
+	action := "Queued"
+	if l.play {
+		action = "Playing"
+	}
+	if l.dryRun {
+		action = "Would queue"
+	} else if err := cmusEnqueue(match.File, l.play); err != nil {
+		fmt.Printf("Error queueing %s: %v\n", match.File, err)
+		l.unresolved = append(l.unresolved, t)
+		return
+	}
+	l.queued++
+	fmt.Printf("%s %s (%s)\n", action, t, match.File)
+}
+
+func (l *listenAlong) printSummary() {
+	fmt.Printf("\n%d tracks queued, %d not found\n", l.queued, len(l.unresolved))
+	for _, t := range l.unresolved {
+		fmt.Printf("  %s\n", t)
+	}
+}
+
+func cmdListenAlong(ctx *cliContext, args []string) error {
+	fs := flag.NewFlagSet("listen-along", flag.ExitOnError)
+	play := fs.Bool("play", false, "Play each track right away instead of adding it to the queue")
+	dryRun := fs.Bool("dry-run", false, "Only show which local files would be queued")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: cmus-scrobbler listen-along [-play] [-dry-run] <npub>")
+	}
+
+	pubkey, err := decodePubkey(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	patterns, err := compileFilenamePatterns(ctx.config.FilenamePatterns)
+	if err != nil {
+		return fmt.Errorf("error in filename patterns: %w", err)
+	}
+	library, err := loadCmusLibrary(patterns)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d tracks in the cmus library\n", library.Len())
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	since := nostr.Now()
+	events, err := ctx.nostr.SubscribeEvents(sigCtx, nostr.Filter{
+		Kinds:   []int{KindScrobble, KindUserStatus},
+		Authors: []string{pubkey},
+		Since:   &since,
+	})
+	if err != nil {
+		return err
+	}
+
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	fmt.Printf("Listening along with %s, press Ctrl-C to stop\n", npub)
+
+	l := &listenAlong{library: library, play: *play, dryRun: *dryRun}
+	for ev := range events {
+		if t, ok := announcedTrackFromEvent(ev); ok {
+			l.handle(t)
+		}
+	}
+	l.printSummary()
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// LogConfig sets how log messages are written.
+type LogConfig struct {
+	// Level is debug, info, warn or error. It defaults to info.
+	Level string `yaml:"level"`
+	// Format is text or json. It defaults to text.
+	Format string `yaml:"format"`
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, use debug, info, warn or error", level)
+}
+
+func validateLogConfig(config LogConfig) error {
+	if _, err := parseLogLevel(config.Level); err != nil {
+		return err
+	}
+	switch strings.ToLower(config.Format) {
+	case "", "text", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown log format %q, use text or json", config.Format)
+}
+
+// logLevel is the level of every handler from newLogHandler, so a config
+// reload can change it.
+var logLevel = new(slog.LevelVar)
+
+// setLogLevel applies the level from config.
+func setLogLevel(config LogConfig) {
+	// The config is validated on load, so an invalid level can't get here.
+	level, _ := parseLogLevel(config.Level)
+	logLevel.Set(level)
+}
+
+// newLogHandler returns a handler writing to w as config says. opts may
+// set ReplaceAttr; its Level is taken from config.
+func newLogHandler(config LogConfig, w io.Writer, opts slog.HandlerOptions) slog.Handler {
+	setLogLevel(config)
+	opts.Level = logLevel
+	if strings.ToLower(config.Format) == "json" {
+		return slog.NewJSONHandler(w, &opts)
+	}
+	return slog.NewTextHandler(w, &opts)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindLovedTracks is the replaceable list of the user's loved tracks. Each
+// track is an ["i", "mbid:recording:<mbid>", artist, title] tag when its
+// MusicBrainz ID is known, and an ["track", artist, title] tag otherwise.
+const KindLovedTracks = 12002
+
+// LovedTrack is one entry of the loved tracks list.
+type LovedTrack struct {
+	Artist string
+	Title  string
+	MbID   string
+}
+
+func (t LovedTrack) tag() nostr.Tag {
+	if t.MbID != "" {
+		return nostr.Tag{"i", "mbid:recording:" + t.MbID, t.Artist, t.Title}
+	}
+	return nostr.Tag{"track", t.Artist, t.Title}
+}
+
+func lovedNameKey(artist, title string) string {
+	return strings.ToLower(strings.TrimSpace(artist)) + "\n" + strings.ToLower(strings.TrimSpace(title))
+}
+
+// LovedTracks is the loved tracks list. Tracks are matched by MBID when
+// both sides have one, and by case-insensitive artist and title otherwise.
+type LovedTracks struct {
+	tracks []LovedTrack
+	// prev is the created_at of the event the list was read from.
+	prev nostr.Timestamp
+}
+
+func lovedTracksFromEvent(ev *nostr.Event) *LovedTracks {
+	loved := &LovedTracks{}
+	if ev == nil {
+		return loved
+	}
+	loved.prev = ev.CreatedAt
+	for _, tag := range ev.Tags {
+		switch {
+		case len(tag) >= 4 && tag[0] == "i" && strings.HasPrefix(tag[1], "mbid:recording:"):
+			loved.tracks = append(loved.tracks, LovedTrack{Artist: tag[2], Title: tag[3], MbID: strings.TrimPrefix(tag[1], "mbid:recording:")})
+		case len(tag) >= 3 && tag[0] == "track":
+			loved.tracks = append(loved.tracks, LovedTrack{Artist: tag[1], Title: tag[2]})
+		}
+	}
+	return loved
+}
+
+func (l *LovedTracks) index(artist, title, mbid string) int {
+	for i, t := range l.tracks {
+		if mbid != "" && t.MbID == mbid {
+			return i
+		}
+	}
+	key := lovedNameKey(artist, title)
+	for i, t := range l.tracks {
+		if lovedNameKey(t.Artist, t.Title) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// Contains reports whether the track is loved.
+func (l *LovedTracks) Contains(artist, title, mbid string) bool {
+	return l != nil && l.index(artist, title, mbid) >= 0
+}
+
+// Add loves track, reporting false if it already was.
+func (l *LovedTracks) Add(track LovedTrack) bool {
+	if i := l.index(track.Artist, track.Title, track.MbID); i >= 0 {
+		// Learn the MBID of a track loved by name.
+		if l.tracks[i].MbID == "" && track.MbID != "" {
+			l.tracks[i].MbID = track.MbID
+			return true
+		}
+		return false
+	}
+	l.tracks = append(l.tracks, track)
+	return true
+}
+
+// Remove unloves a track, reporting false if it wasn't loved.
+func (l *LovedTracks) Remove(artist, title, mbid string) bool {
+	i := l.index(artist, title, mbid)
+	if i < 0 {
+		return false
+	}
+	l.tracks = append(l.tracks[:i], l.tracks[i+1:]...)
+	return true
+}
+
+func (l *LovedTracks) Len() int {
+	return len(l.tracks)
+}
+
+// event builds the replacement list event. Its created_at is kept after the
+// previous list's so relays replace it even if clocks disagree.
+func (l *LovedTracks) event() nostr.Event {
+	ev := nostr.Event{
+		Kind:      KindLovedTracks,
+		CreatedAt: max(nostr.Now(), l.prev+1),
+		Tags:      nostr.Tags{},
+	}
+	for _, t := range l.tracks {
+		ev.Tags = append(ev.Tags, t.tag())
+	}
+	return ev
+}
+
+// FetchLovedTracks returns the newest loved tracks list on any relay.
+func (n *Nostr) FetchLovedTracks() (*LovedTracks, error) {
+	filter := nostr.Filter{
+		Kinds:   []int{KindLovedTracks},
+		Authors: []string{n.pk},
+		Limit:   1,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var newest *nostr.Event
+	var errs []error
+	for _, relay := range n.relays {
+		events, err := relay.QuerySync(ctx, filter)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", relay.URL, err))
+			continue
+		}
+		for _, ev := range events {
+			if newest == nil || ev.CreatedAt > newest.CreatedAt {
+				newest = ev
+			}
+		}
+	}
+	// Publishing over a list that couldn't be read anywhere would lose it.
+	if len(errs) == len(n.relays) && len(errs) > 0 {
+		return nil, fmt.Errorf("error fetching loved tracks: %w", errors.Join(errs...))
+	}
+	return lovedTracksFromEvent(newest), nil
+}
+
+// PublishLovedTracks signs and publishes loved as the new list.
+func (n *Nostr) PublishLovedTracks(loved *LovedTracks) error {
+	ev := loved.event()
+	if err := n.sign(&ev); err != nil {
+		return fmt.Errorf("error signing loved tracks: %w", err)
+	}
+	results := n.PublishEventResults(&ev)
+	logPublishResults(&ev, results)
+	if !anyPublished(results) {
+		return errors.New("no relay accepted the loved tracks list")
+	}
+	loved.prev = ev.CreatedAt
+	return nil
+}
+
+// SetLoved loves or unloves one track, publishing the list if it changed.
+func (n *Nostr) SetLoved(track LovedTrack, love bool) (changed bool, err error) {
+	loved, err := n.FetchLovedTracks()
+	if err != nil {
+		return false, err
+	}
+	if love {
+		changed = loved.Add(track)
+	} else {
+		changed = loved.Remove(track.Artist, track.Title, track.MbID)
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, n.PublishLovedTracks(loved)
+}
+
+// lovedTracks fetches every loved track of a Last.fm user.
+func (c *lastfmClient) lovedTracks(user string) ([]LovedTrack, error) {
+	var tracks []LovedTrack
+	for page := 1; ; page++ {
+		var body struct {
+			LovedTracks struct {
+				Track []struct {
+					Name   string `json:"name"`
+					MbID   string `json:"mbid"`
+					Artist struct {
+						Name string `json:"name"`
+					} `json:"artist"`
+				} `json:"track"`
+				Attr struct {
+					TotalPages string `json:"totalPages"`
+				} `json:"@attr"`
+			} `json:"lovedtracks"`
+		}
+		err := c.get(url.Values{
+			"method": {"user.getlovedtracks"},
+			"user":   {user},
+			"limit":  {"1000"},
+			"page":   {strconv.Itoa(page)},
+		}, &body)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching Last.fm loved tracks: %w", err)
+		}
+
+		for _, t := range body.LovedTracks.Track {
+			tracks = append(tracks, LovedTrack{Artist: t.Artist.Name, Title: t.Name, MbID: t.MbID})
+		}
+		totalPages, _ := strconv.Atoi(body.LovedTracks.Attr.TotalPages)
+		if page >= totalPages {
+			return tracks, nil
+		}
+	}
+}
+
+func cmdLove(ctx *cliContext, args []string) error {
+	return runLove(ctx, args, true)
+}
+
+func cmdUnlove(ctx *cliContext, args []string) error {
+	return runLove(ctx, args, false)
+}
+
+func runLove(ctx *cliContext, args []string, love bool) error {
+	name := "love"
+	if !love {
+		name = "unlove"
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	artist := fs.String("artist", "", "Artist name (default: the track playing in cmus)")
+	track := fs.String("track", "", "Track title")
+	mbid := fs.String("mbid", "", "MusicBrainz recording ID")
+	var lastfmUser *string
+	if love {
+		lastfmUser = fs.String("import-lastfm", "", "Love every track loved by this Last.fm user")
+	}
+	fs.Parse(args)
+
+	if lastfmUser != nil && *lastfmUser != "" {
+		return importLastfmLoved(ctx, *lastfmUser)
+	}
+
+	t := LovedTrack{Artist: *artist, Title: *track, MbID: *mbid}
+	if t.Artist == "" && t.Title == "" {
+		resolver, err := newTrackResolver(ctx.config)
+		if err != nil {
+			return err
+		}
+		playing, err := resolver.getPlayingTrack()
+		if err != nil {
+			return fmt.Errorf("error getting current track: %w", err)
+		}
+		t = LovedTrack{Artist: playing.Artist, Title: playing.Track, MbID: playing.MbID}
+	}
+	if t.Artist == "" || t.Title == "" {
+		return fmt.Errorf("no track given and nothing playing in cmus; use -artist and -track")
+	}
+
+	changed, err := ctx.nostr.SetLoved(t, love)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !changed && love:
+		fmt.Printf("%s - %s is already loved\n", t.Artist, t.Title)
+	case !changed:
+		fmt.Printf("%s - %s is not loved\n", t.Artist, t.Title)
+	case love:
+		fmt.Printf("Loved %s - %s\n", t.Artist, t.Title)
+	default:
+		fmt.Printf("Unloved %s - %s\n", t.Artist, t.Title)
+	}
+	return nil
+}
+
+func importLastfmLoved(ctx *cliContext, user string) error {
+	if ctx.config.APIKey == "" {
+		return fmt.Errorf("importing from Last.fm needs api_key in the config")
+	}
+
+	tracks, err := newLastfmClient(ctx.config).lovedTracks(user)
+	if err != nil {
+		return err
+	}
+	loved, err := ctx.nostr.FetchLovedTracks()
+	if err != nil {
+		return err
+	}
+
+	added := 0
+	for _, t := range tracks {
+		if loved.Add(t) {
+			added++
+		}
+	}
+	fmt.Printf("%d loved tracks on Last.fm, %d new\n", len(tracks), added)
+	if added == 0 {
+		return nil
+	}
+	if err := ctx.nostr.PublishLovedTracks(loved); err != nil {
+		return err
+	}
+	fmt.Printf("Published %d loved tracks\n", len(loved.tracks))
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestLovedTracks(t *testing.T) {
+	loved := lovedTracksFromEvent(nil)
+
+	if !loved.Add(LovedTrack{Artist: "Low", Title: "Words"}) {
+		t.Fatal("Add of a new track returned false")
+	}
+	if loved.Add(LovedTrack{Artist: "low", Title: "WORDS "}) {
+		t.Error("Add of the same track in other case returned true")
+	}
+	if !loved.Add(LovedTrack{Artist: "Low", Title: "Words", MbID: "a1b2"}) {
+		t.Error("Add did not record the MBID of a track loved by name")
+	}
+	loved.Add(LovedTrack{Artist: "Broadcast", Title: "Tears in the Typing Pool", MbID: "c3d4"})
+
+	tests := []struct {
+		artist, title, mbid string
+		want                bool
+	}{
+		{"Low", "Words", "", true},
+		{"Someone Else", "Other Name", "c3d4", true},
+		{"Broadcast", "Tears in the Typing Pool", "", true},
+		{"Broadcast", "Come On Let's Go", "", false},
+	}
+	for _, tt := range tests {
+		if got := loved.Contains(tt.artist, tt.title, tt.mbid); got != tt.want {
+			t.Errorf("Contains(%q, %q, %q) = %v, want %v", tt.artist, tt.title, tt.mbid, got, tt.want)
+		}
+	}
+
+	ev := loved.event()
+	if ev.Kind != KindLovedTracks {
+		t.Fatalf("kind = %d, want %d", ev.Kind, KindLovedTracks)
+	}
+	roundTrip := lovedTracksFromEvent(&ev)
+	if roundTrip.Len() != 2 || !roundTrip.Contains("", "", "a1b2") {
+		t.Errorf("list from event = %+v", roundTrip.tracks)
+	}
+	if next := roundTrip.event(); next.CreatedAt <= ev.CreatedAt {
+		t.Errorf("replacement created_at %d is not after %d", next.CreatedAt, ev.CreatedAt)
+	}
+
+	if !loved.Remove("BROADCAST", "tears in the typing pool", "") {
+		t.Error("Remove of a loved track returned false")
+	}
+	if loved.Remove("Broadcast", "Tears in the Typing Pool", "") {
+		t.Error("Remove of a track no longer loved returned true")
+	}
+	if loved.Contains("", "", "c3d4") {
+		t.Error("removed track is still loved")
+	}
+}
+
+func TestLovedTracksNil(t *testing.T) {
+	var loved *LovedTracks
+	if loved.Contains("Low", "Words", "") {
+		t.Error("nil list contains a track")
+	}
+}
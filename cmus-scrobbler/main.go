@@ -1,141 +1,243 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"time"
 
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/nbd-wtf/go-nostr/nip19"
 )
 
 func main() {
-	configPath, listScrobbles := parseFlags()
+	flag.Usage = printUsage
+	configPath := flag.String("config", "", "Path to the config file")
+	profile := flag.String("profile", os.Getenv(EnvPrefix+"PROFILE"), "Config profile to use")
+	listScrobbles := flag.Bool("ls", false, "List recent scrobbles (same as the ls command)")
+	dryRunPath := flag.String("dry-run", "", "Show what would be scrobbled for an untagged file path")
+	flag.Parse()
 
-	config, err := LoadConfig(configPath)
-	if err != nil {
-		fmt.Println("Error handling config:", err)
-		os.Exit(1)
+	name, args := "run", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
 	}
-
-	nostrClient, err := NewNostr(config.Nsec, config.Relays)
-	if err != nil {
-		fmt.Println("Error creating Nostr client:", err)
-		os.Exit(1)
+	if *listScrobbles {
+		name = "ls"
+	}
+	if *dryRunPath != "" {
+		name, args = "dry-run", []string{*dryRunPath}
 	}
-	defer nostrClient.Close()
-
-	npub, _ := nip19.EncodePublicKey(nostrClient.pk)
-	fmt.Println("Public key:", npub)
-	fmt.Println("Relays:", config.Relays)
 
-	if listScrobbles {
-		events, err := nostrClient.QueryRecentScrobbles(50)
-		if err != nil {
-			fmt.Println("Error listing scrobbles:", err)
-			os.Exit(1)
-		}
-		PrintScrobbles(events)
+	if name == "help" {
+		printUsage()
 		return
 	}
 
-	if err := runScrobbler(nostrClient); err != nil {
-		fmt.Println("Error running scrobbler:", err)
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Printf("Unknown command %q\n\n", name)
+		printUsage()
+		os.Exit(2)
+	}
+
+	if err := runCommand(cmd, *configPath, *profile, args); err != nil {
+		fmt.Printf("Error running %s: %v\n", cmd.name, err)
 		os.Exit(1)
 	}
 }
 
-func parseFlags() (string, bool) {
-	configPath := flag.String("config", "", "Path to the config file")
-	listScrobbles := flag.Bool("ls", false, "List recent scrobbles")
-	flag.Parse()
-	return *configPath, *listScrobbles
+// resubmitThreshold is how long after scrobbling a track the same track
+// counts as a duplicate rather than a replay.
+const resubmitThreshold = 10 * time.Minute
+
+// scrobblerReload is a reloaded config for the run loop.
+type scrobblerReload struct {
+	targets  *profileTargets
+	resolver *trackResolver
 }
 
-func runScrobbler(nostrClient *Nostr) error {
-	var lastTrack string
+// runScrobbler polls cmus and scrobbles until ctx is done. Configs sent on
+// reloads are applied between polls.
+func runScrobbler(ctx context.Context, targets *profileTargets, config Config, d *daemon, reloads <-chan scrobblerReload) error {
 	const sleepDuration = 10 * time.Second
-	const resubmitThreshold = 10 * time.Minute
 
-	for {
+	resolver, err := newTrackResolver(config)
+	if err != nil {
+		return err
+	}
+	// startedTrack is the playing track that track_started last ran for.
+	var startedTrack string
+
+	for ; ctx.Err() == nil; d.wait(ctx, sleepDuration) {
+		d.beat()
+		select {
+		case reload := <-reloads:
+			if err := targets.replace(reload.targets); err != nil {
+				slog.Error("error applying reloaded config", "err", err)
+				reload.targets.Close(targets.initial)
+				break
+			}
+			resolver = reload.resolver
+			slog.Info("reloaded config")
+		default:
+		}
+
+		d.connectPending(targets)
+		d.retryPending(ctx)
+		targets.closeRetired(d.queuedOn)
+		handleMediaPlays(d, targets, time.Now())
+
 		if err := waitForCmus(); err != nil {
-			fmt.Println("Error waiting for cmus:", err)
-			time.Sleep(sleepDuration)
+			if errors.Is(err, errCmusNotRunning) || errors.Is(err, errCmusNotPlaying) {
+				slog.Debug("waiting for cmus", "reason", err)
+			} else {
+				slog.Error("error waiting for cmus", "err", err)
+				d.metrics.recordPollError()
+			}
+			player := cmusPlayerState()
+			if player != "paused" {
+				startedTrack = ""
+			}
+			d.setPlayer(player)
 			continue
 		}
 
-		scrobble, err := getCurrentTrack()
+		status, err := getCmusStatus()
+		if err != nil {
+			slog.Error("error getting current track", "err", err)
+			d.metrics.recordPollError()
+			continue
+		}
+		scrobble, err := resolver.currentTrack(status)
 		if err != nil {
-			fmt.Println("Error getting current track:", err)
-			time.Sleep(sleepDuration)
+			slog.Error("error getting current track", "err", err)
+			d.metrics.recordPollError()
 			continue
 		}
+		playing, err := resolver.playingTrack(status)
+		if err != nil {
+			slog.Error("error getting current track", "err", err)
+			d.metrics.recordPollError()
+			continue
+		}
+		if playing.Track == "" {
+			startedTrack = ""
+			d.setTrack(nil, nil)
+			continue
+		}
+
+		track := &TrackStatus{
+			Artist:   playing.Artist,
+			Track:    playing.Track,
+			Album:    playing.Album,
+			MbID:     playing.MbID,
+			Stream:   playing.Stream,
+			Position: status.Position,
+			Duration: status.Duration,
+			Progress: min(1, resolver.progress(status, time.Now()).Seconds()/scrobbleThreshold.Seconds()),
+		}
+		slog.Debug("polled cmus", "track", track.key(), "position", track.Position, "progress", track.Progress)
+		if track.key() != startedTrack {
+			startedTrack = track.key()
+			startTrack(d, targets, playing, track, time.Now())
+		}
+
+		forced := d.takeForce(track)
+		if forced {
+			scrobble = playing
+		}
 		if scrobble.Track == "" {
-			time.Sleep(sleepDuration)
+			d.setTrack(track, nil)
+			continue
+		}
+
+		if scrobble, err = scrobble.Normalize(); err != nil {
+			slog.Error("error in current track", "err", err)
+			continue
+		}
+
+		target, scrobble, rule, publish, err := targets.prepare(scrobble, time.Now())
+		if err != nil {
+			slog.Error("error selecting profile", "err", err)
 			continue
 		}
+		nostrClient := target.nostr
+		track.Profile = target.profile
 
 		currentTrack := fmt.Sprintf("%s - %s", scrobble.Artist, scrobble.Track)
-		if currentTrack != lastTrack {
-			lastEvent, err := nostrClient.GetLastScrobble()
-			if err != nil {
-				fmt.Println("Error getting last scrobble:", err)
-			} else {
-				shouldSubmit := true
-				if lastEvent != nil {
-					lastEventTime := time.Unix(int64(lastEvent.CreatedAt), 0)
-					timeSinceLastEvent := time.Since(lastEventTime)
-					lastEventTrack := getTrackFromEvent(lastEvent)
-
-					if timeSinceLastEvent < resubmitThreshold && lastEventTrack == currentTrack {
-						shouldSubmit = false
-						lastTrack = lastEvent.Content
-						fmt.Println("Skipping submission: Recent duplicate track")
-					}
-				}
-
-				if shouldSubmit {
-					if err := createAndPublishScrobble(nostrClient, scrobble); err != nil {
-						fmt.Println("Error with scrobble event:", err)
-					} else {
-						lastTrack = currentTrack
-					}
-				}
+		if !publish {
+			track.Skipped = true
+			track.SkipReason = fmt.Sprintf("matched rule %q", rule.Name)
+			d.setTrack(track, nostrClient.RelayHealth())
+			if currentTrack != d.lastTrack {
+				slog.Info("skipping submission", "track", currentTrack, "reason", "matched rule", "rule", rule.Name)
+				d.lastTrack = currentTrack
 			}
+			continue
 		}
 
-		time.Sleep(sleepDuration)
-	}
-}
-
-func getTrackFromEvent(event *nostr.Event) string {
-	artist := ""
-	track := ""
-	for _, tag := range event.Tags {
-		if len(tag) >= 2 {
-			switch tag[0] {
-			case "artist":
-				artist = tag[1]
-			case "track":
-				track = tag[1]
+		d.setTrack(track, nostrClient.RelayHealth())
+		if d.Status().ScrobblingPaused && !forced {
+			continue
+		}
+		if d.skipped(track) {
+			if currentTrack != d.lastTrack {
+				slog.Info("skipping submission", "track", currentTrack, "reason", "skipped on request")
+				d.lastTrack = currentTrack
 			}
+			continue
+		}
+
+		if currentTrack == d.lastTrack {
+			continue
+		}
+
+		duplicate, err := isRecentDuplicate(nostrClient, currentTrack, time.Now())
+		if err != nil {
+			slog.Error("error getting last scrobble", "err", err)
+			continue
+		}
+		if duplicate {
+			d.lastTrack = currentTrack
+			d.markTrack(func(t *TrackStatus) { t.Scrobbled = true })
+			slog.Info("skipping submission", "track", currentTrack, "reason", "recent duplicate track")
+			continue
+		}
+
+		ev, err := nostrClient.CreateScrobbleEvent(scrobble)
+		if err != nil {
+			slog.Error("error creating scrobble event", "err", err)
+			continue
 		}
+		slog.Info("new scrobble", "track", currentTrack, "profile", target.profile, "id", ev.ID)
+		d.publish(target.profile, nostrClient, ev)
+		d.markTrack(func(t *TrackStatus) { t.Scrobbled = true })
+		d.lastTrack = currentTrack
 	}
-	return fmt.Sprintf("%s - %s", artist, track)
+	return nil
 }
 
-func createAndPublishScrobble(nostrClient *Nostr, scrobble ScrobbleEvent) error {
-	ev, err := nostrClient.CreateScrobbleEvent(scrobble)
-	if err != nil {
-		return fmt.Errorf("error creating scrobble event: %w", err)
+// isRecentDuplicate reports whether the last scrobble is of track and
+// within resubmitThreshold of at.
+func isRecentDuplicate(nostrClient *Nostr, track string, at time.Time) (bool, error) {
+	lastEvent, err := nostrClient.GetLastScrobble()
+	if err != nil || lastEvent == nil {
+		return false, err
 	}
+	since := at.Sub(lastEvent.CreatedAt.Time())
+	if since < 0 {
+		since = -since
+	}
+	return since < resubmitThreshold && getTrackFromEvent(nostrClient, lastEvent) == track, nil
+}
 
-	fmt.Println("New scrobble event:", ev)
-	err = nostrClient.PublishEvent(ev)
+func getTrackFromEvent(nostrClient *Nostr, event *nostr.Event) string {
+	scrobble, err := nostrClient.ScrobbleFromEvent(event)
 	if err != nil {
-		return fmt.Errorf("error publishing event: %w", err)
+		return ""
 	}
-
-	return nil
+	return fmt.Sprintf("%s - %s", scrobble.Artist, scrobble.Track)
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// maxBackdate is how far back a manual scrobble may go without -force.
+const maxBackdate = 14 * 24 * time.Hour
+
+// maxClockSkew is how far in the future a manual scrobble may be.
+const maxClockSkew = 5 * time.Minute
+
+// manualScrobble is one listen read from stdin with -stdin.
+type manualScrobble struct {
+	Artist string          `json:"artist"`
+	Track  string          `json:"track"`
+	Album  string          `json:"album"`
+	MbID   string          `json:"mbid"`
+	At     json.RawMessage `json:"at"`
+}
+
+// parseTime accepts RFC3339, "YYYY-MM-DD HH:MM" in local time, or Unix
+// seconds.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Now(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", value, time.Local); err == nil {
+		return t, nil
+	}
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: use RFC3339, \"YYYY-MM-DD HH:MM\" or Unix seconds", value)
+}
+
+// checkBackdate rejects times in the future and, unless force is set, times
+// older than maxBackdate.
+func checkBackdate(at, now time.Time, force bool) error {
+	if at.After(now.Add(maxClockSkew)) {
+		return fmt.Errorf("%s is in the future", at.Format(time.RFC3339))
+	}
+	if !force && at.Before(now.Add(-maxBackdate)) {
+		return fmt.Errorf("%s is more than %d days ago; use -force to scrobble it anyway", at.Format(time.RFC3339), int(maxBackdate.Hours()/24))
+	}
+	return nil
+}
+
+func readManualScrobbles(r io.Reader) ([]ScrobbleEvent, error) {
+	var scrobbles []ScrobbleEvent
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var m manualScrobble
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		var at time.Time
+		var err error
+		if len(m.At) > 0 {
+			var unix int64
+			var value string
+			if json.Unmarshal(m.At, &unix) == nil {
+				at = time.Unix(unix, 0)
+			} else if json.Unmarshal(m.At, &value) == nil {
+				at, err = parseTime(value)
+			} else {
+				err = fmt.Errorf("at must be a string or a number")
+			}
+		} else {
+			at = time.Now()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		scrobbles = append(scrobbles, ScrobbleEvent{
+			Artist:    m.Artist,
+			Track:     m.Track,
+			Album:     m.Album,
+			MbID:      m.MbID,
+			CreatedAt: nostr.Timestamp(at.Unix()),
+		})
+	}
+	return scrobbles, scanner.Err()
+}
+
+type pendingScrobble struct {
+	target   *scrobbleTarget
+	scrobble ScrobbleEvent
+}
+
+// publishScrobbles publishes each listen to its profile's relays and prints
+// how many made it. It fails if any listen wasn't accepted by a relay.
+func publishScrobbles(pending []pendingScrobble) error {
+	failed := 0
+	for _, p := range pending {
+		ev, err := p.target.nostr.CreateScrobbleEvent(p.scrobble)
+		if err != nil {
+			return fmt.Errorf("error creating scrobble event: %w", err)
+		}
+		results := p.target.nostr.PublishEventResults(ev)
+		logPublishResults(ev, results)
+		if !anyPublished(results) {
+			fmt.Printf("Failed to publish %s - %s\n", p.scrobble.Artist, p.scrobble.Track)
+			failed++
+		}
+	}
+	fmt.Printf("Published %d of %d listens\n", len(pending)-failed, len(pending))
+	if failed > 0 {
+		return fmt.Errorf("%d listens were not accepted by any relay", failed)
+	}
+	return nil
+}
+
+// cmdScrobble records listens that happened outside cmus. They go through
+// the same validation, profile selection and rules as automatic scrobbles.
+func cmdScrobble(ctx *cliContext, args []string) error {
+	fs := flag.NewFlagSet("scrobble", flag.ExitOnError)
+	artist := fs.String("artist", "", "Artist name")
+	track := fs.String("track", "", "Track title")
+	album := fs.String("album", "", "Album name")
+	mbid := fs.String("mbid", "", "MusicBrainz recording ID")
+	at := fs.String("at", "", "When the listen happened (RFC3339, \"YYYY-MM-DD HH:MM\" or Unix seconds; default now)")
+	stdin := fs.Bool("stdin", false, "Read listens from stdin as JSON lines")
+	force := fs.Bool("force", false, fmt.Sprintf("Allow listens older than %d days", int(maxBackdate.Hours()/24)))
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	fs.Parse(args)
+
+	var scrobbles []ScrobbleEvent
+	if *stdin {
+		var err error
+		if scrobbles, err = readManualScrobbles(os.Stdin); err != nil {
+			return fmt.Errorf("error reading stdin: %w", err)
+		}
+	} else {
+		when, err := parseTime(*at)
+		if err != nil {
+			return err
+		}
+		scrobbles = []ScrobbleEvent{{
+			Artist:    *artist,
+			Track:     *track,
+			Album:     *album,
+			MbID:      *mbid,
+			CreatedAt: nostr.Timestamp(when.Unix()),
+		}}
+	}
+
+	targets, err := newProfileTargets(ctx.rawConfig, ctx.profile, ctx.nostr)
+	if err != nil {
+		return err
+	}
+	defer targets.Close(ctx.nostr)
+
+	now := time.Now()
+	var pending []pendingScrobble
+	for i, scrobble := range scrobbles {
+		scrobble, err := scrobble.Normalize()
+		if err == nil {
+			err = checkBackdate(scrobble.CreatedAt.Time(), now, *force)
+		}
+		if err != nil {
+			return fmt.Errorf("listen %d: %w", i+1, err)
+		}
+
+		target, result, rule, publish, err := targets.prepare(scrobble, scrobble.CreatedAt.Time())
+		if err != nil {
+			return fmt.Errorf("listen %d: %w", i+1, err)
+		}
+		if !publish {
+			fmt.Printf("Skipping %s - %s: matched rule %q\n", scrobble.Artist, scrobble.Track, rule.Name)
+			continue
+		}
+		pending = append(pending, pendingScrobble{target: target, scrobble: result})
+	}
+
+	if len(pending) == 0 {
+		fmt.Println("Nothing to scrobble.")
+		return nil
+	}
+
+	fmt.Printf("About to scrobble %d listens:\n", len(pending))
+	for _, p := range pending {
+		visibility := ""
+		if p.scrobble.Private {
+			visibility = " [private]"
+		}
+		fmt.Printf("  %s  %s - %s", p.scrobble.CreatedAt.Time().Format("2006-01-02 15:04"), p.scrobble.Artist, p.scrobble.Track)
+		if p.scrobble.Album != "" {
+			fmt.Printf(" (%s)", p.scrobble.Album)
+		}
+		fmt.Printf("%s -> %s\n", visibility, p.target.profile)
+	}
+	if !*yes {
+		// Listens read from stdin leave nothing there to answer with.
+		answers := io.Reader(os.Stdin)
+		if *stdin {
+			tty, err := os.Open("/dev/tty")
+			if err != nil {
+				return fmt.Errorf("cannot ask for confirmation while reading listens from stdin; use -yes")
+			}
+			defer tty.Close()
+			answers = tty
+		}
+		if !confirmFrom(answers, "Publish?") {
+			fmt.Println("Aborted.")
+			return nil
+		}
+	}
+
+	return publishScrobbles(pending)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadManualScrobbles(t *testing.T) {
+	input := `{"artist": "Stereolab", "track": "French Disko", "at": "2024-05-01T20:15:00Z"}
+
+{"artist": "Broadcast", "track": "Come On Let's Go", "album": "The Noise Made by People", "at": 1714594500}
+`
+	scrobbles, err := readManualScrobbles(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("readManualScrobbles: %v", err)
+	}
+	if len(scrobbles) != 2 {
+		t.Fatalf("got %d scrobbles, want 2", len(scrobbles))
+	}
+	if scrobbles[0].CreatedAt.Time().UTC() != time.Date(2024, 5, 1, 20, 15, 0, 0, time.UTC) {
+		t.Errorf("first listen at %v", scrobbles[0].CreatedAt.Time())
+	}
+	if scrobbles[1].Album != "The Noise Made by People" || scrobbles[1].CreatedAt != 1714594500 {
+		t.Errorf("second listen = %+v", scrobbles[1])
+	}
+
+	if _, err := readManualScrobbles(strings.NewReader(`{"artist": "x", "at": true}`)); err == nil {
+		t.Error("expected error for a boolean at")
+	}
+}
+
+func TestCheckBackdate(t *testing.T) {
+	now := time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC)
+
+	if err := checkBackdate(now.Add(-time.Hour), now, false); err != nil {
+		t.Errorf("an hour ago: %v", err)
+	}
+	if err := checkBackdate(now.Add(time.Hour), now, true); err == nil {
+		t.Error("future listens should be rejected even with force")
+	}
+	if err := checkBackdate(now.Add(-30*24*time.Hour), now, false); err == nil {
+		t.Error("old listens should need force")
+	}
+	if err := checkBackdate(now.Add(-30*24*time.Hour), now, true); err != nil {
+		t.Errorf("old listen with force: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MetricsConfig enables the Prometheus metrics endpoint of run.
+type MetricsConfig struct {
+	// Listen is the host:port serving /metrics. Unlike the API it may be
+	// reachable from other machines, since metrics can't control anything.
+	Listen string `yaml:"listen"`
+}
+
+func validateMetricsListen(addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("must be host:port: %w", err)
+	}
+	return nil
+}
+
+// publishLatencyBuckets are the upper bounds of the publish latency
+// histogram, in seconds.
+var publishLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	// counts holds the observations per bucket, with one more for those
+	// above the last bound.
+	counts []uint64
+	sum    float64
+	total  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(publishLatencyBuckets)+1)
+	}
+	i := sort.SearchFloat64s(publishLatencyBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.total++
+}
+
+// metrics counts what run does, for the /metrics endpoint. Gauges such as
+// the queue depth are read from the daemon's state when scraped.
+type metrics struct {
+	mu         sync.Mutex
+	attempted  map[string]uint64
+	published  map[string]uint64
+	failed     map[string]uint64
+	latency    map[string]*histogram
+	pollErrors uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		attempted: make(map[string]uint64),
+		published: make(map[string]uint64),
+		failed:    make(map[string]uint64),
+		latency:   make(map[string]*histogram),
+	}
+}
+
+// recordPublish counts the outcome of publishing one scrobble to each
+// relay.
+func (m *metrics) recordPublish(results []PublishResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, result := range results {
+		m.attempted[result.Relay]++
+		if result.Err != nil {
+			m.failed[result.Relay]++
+		} else {
+			m.published[result.Relay]++
+		}
+		h, ok := m.latency[result.Relay]
+		if !ok {
+			h = &histogram{}
+			m.latency[result.Relay] = h
+		}
+		h.observe(result.Duration.Seconds())
+	}
+}
+
+func (m *metrics) recordPollError() {
+	m.mu.Lock()
+	m.pollErrors++
+	m.mu.Unlock()
+}
+
+// escapeLabel escapes a label value for the Prometheus text format.
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *metrics) write(w io.Writer, status DaemonStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	header := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	perRelay := func(name, help string, values map[string]uint64) {
+		header(name, "counter", help)
+		for _, relay := range sortedKeys(values) {
+			fmt.Fprintf(w, "%s{relay=\"%s\"} %d\n", name, escapeLabel(relay), values[relay])
+		}
+	}
+	gauge := func(name, help string, value float64) {
+		header(name, "gauge", help)
+		fmt.Fprintf(w, "%s %g\n", name, value)
+	}
+	boolValue := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	perRelay("cmus_scrobbler_scrobbles_attempted_total", "Scrobbles sent to a relay.", m.attempted)
+	perRelay("cmus_scrobbler_scrobbles_published_total", "Scrobbles a relay accepted.", m.published)
+	perRelay("cmus_scrobbler_scrobbles_failed_total", "Scrobbles a relay rejected or that failed to reach it.", m.failed)
+
+	header("cmus_scrobbler_publish_duration_seconds", "histogram", "Time to publish a scrobble to a relay.")
+	for _, relay := range sortedKeys(m.latency) {
+		h := m.latency[relay]
+		label := escapeLabel(relay)
+		var cumulative uint64
+		for i, bound := range publishLatencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "cmus_scrobbler_publish_duration_seconds_bucket{relay=\"%s\",le=\"%g\"} %d\n", label, bound, cumulative)
+		}
+		fmt.Fprintf(w, "cmus_scrobbler_publish_duration_seconds_bucket{relay=\"%s\",le=\"+Inf\"} %d\n", label, h.total)
+		fmt.Fprintf(w, "cmus_scrobbler_publish_duration_seconds_sum{relay=\"%s\"} %g\n", label, h.sum)
+		fmt.Fprintf(w, "cmus_scrobbler_publish_duration_seconds_count{relay=\"%s\"} %d\n", label, h.total)
+	}
+
+	header("cmus_scrobbler_player_poll_errors_total", "counter", "Failed attempts to read the player state from cmus.")
+	fmt.Fprintf(w, "cmus_scrobbler_player_poll_errors_total %d\n", m.pollErrors)
+
+	gauge("cmus_scrobbler_queue_depth", "Scrobbles waiting to be retried.", float64(status.QueueDepth))
+	gauge("cmus_scrobbler_playing", "Whether cmus is playing.", boolValue(status.Player == "playing"))
+	gauge("cmus_scrobbler_scrobbling_paused", "Whether scrobbling is paused.", boolValue(status.ScrobblingPaused))
+	var last float64
+	if status.LastEvent != nil {
+		last = float64(status.LastEvent.CreatedAt)
+	}
+	gauge("cmus_scrobbler_last_scrobble_timestamp_seconds", "Time of the last published scrobble.", last)
+
+	header("cmus_scrobbler_relay_connected", "gauge", "Whether the relay connection is up.")
+	for _, relay := range status.Relays {
+		fmt.Fprintf(w, "cmus_scrobbler_relay_connected{relay=\"%s\"} %g\n", escapeLabel(relay.URL), boolValue(relay.Connected))
+	}
+}
+
+func metricsHandler(d *daemon) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		d.metrics.write(w, d.Status())
+	}
+}
+
+// serveMetrics serves /metrics in the background. The returned function
+// stops it.
+func serveMetrics(config MetricsConfig, d *daemon) (func(), error) {
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("error starting metrics endpoint: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(d))
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("error serving metrics", "err", err)
+		}
+	}()
+	slog.Info("metrics listening", "addr", config.Listen)
+
+	return func() { server.Close() }, nil
+}
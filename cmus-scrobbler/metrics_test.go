@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	m := newMetrics()
+	m.recordPublish([]PublishResult{
+		{Relay: "wss://a.example.com", Duration: 80 * time.Millisecond},
+		{Relay: "wss://b.example.com", Err: errors.New("blocked"), Duration: 3 * time.Second},
+	})
+	m.recordPublish([]PublishResult{{Relay: "wss://a.example.com", Duration: 700 * time.Millisecond}})
+	m.recordPollError()
+
+	var out bytes.Buffer
+	m.write(&out, DaemonStatus{
+		Player:     "playing",
+		QueueDepth: 3,
+		LastEvent:  &nostr.Event{CreatedAt: 1700000000},
+		Relays:     []RelayHealth{{URL: "wss://a.example.com", Connected: true}},
+	})
+	text := out.String()
+	for _, want := range []string{
+		"# TYPE cmus_scrobbler_scrobbles_attempted_total counter",
+		`cmus_scrobbler_scrobbles_attempted_total{relay="wss://a.example.com"} 2`,
+		`cmus_scrobbler_scrobbles_published_total{relay="wss://a.example.com"} 2`,
+		`cmus_scrobbler_scrobbles_failed_total{relay="wss://b.example.com"} 1`,
+		`cmus_scrobbler_publish_duration_seconds_bucket{relay="wss://a.example.com",le="0.05"} 0`,
+		`cmus_scrobbler_publish_duration_seconds_bucket{relay="wss://a.example.com",le="0.1"} 1`,
+		`cmus_scrobbler_publish_duration_seconds_bucket{relay="wss://a.example.com",le="1"} 2`,
+		`cmus_scrobbler_publish_duration_seconds_bucket{relay="wss://a.example.com",le="+Inf"} 2`,
+		`cmus_scrobbler_publish_duration_seconds_count{relay="wss://b.example.com"} 1`,
+		"cmus_scrobbler_player_poll_errors_total 1",
+		"cmus_scrobbler_queue_depth 3",
+		"cmus_scrobbler_playing 1",
+		"cmus_scrobbler_last_scrobble_timestamp_seconds 1.7e+09",
+		`cmus_scrobbler_relay_connected{relay="wss://a.example.com"} 1`,
+	} {
+		if !strings.Contains(text, want+"\n") {
+			t.Errorf("metrics are missing %q:\n%s", want, text)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	d := newDaemon()
+	server := httptest.NewServer(newAPIHandler(d))
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if got := escapeLabel("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("escapeLabel = %s", got)
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(newLogHandler(LogConfig{Level: "warn", Format: "json"}, &out, slog.HandlerOptions{}))
+	logger.Info("hidden")
+	logger.Warn("publish failed", "relay", "wss://a.example.com")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d log lines, want 1: %q", len(lines), out.String())
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("log line is not JSON: %v", err)
+	}
+	if record["level"] != "WARN" || record["msg"] != "publish failed" || record["relay"] != "wss://a.example.com" {
+		t.Errorf("log record = %v", record)
+	}
+
+	if err := validateLogConfig(LogConfig{Level: "loud"}); err == nil {
+		t.Error("validateLogConfig accepted level loud")
+	}
+	if err := validateLogConfig(LogConfig{Format: "xml"}); err == nil {
+		t.Error("validateLogConfig accepted format xml")
+	}
+}
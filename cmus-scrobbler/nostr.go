@@ -2,37 +2,46 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"regexp"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/nbd-wtf/go-nostr/nip19"
 )
 
 type Nostr struct {
-	sk     string
+	signer signer
 	pk     string
 	relays []*nostr.Relay
-}
+	cache  *HistoryCache
+	// syncMu keeps cache syncs from overlapping.
+	syncMu sync.Mutex
+	// closed is set by Close, so a background sync stops quietly.
+	closed atomic.Bool
 
-func NewNostr(nsec string, relayURLs []string) (*Nostr, error) {
-	_, sk, err := nip19.Decode(nsec)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding private key: %w", err)
-	}
+	// lastPublish holds the latest publish outcome per relay URL.
+	mu          sync.Mutex
+	lastPublish map[string]relayPublish
+}
 
-	pk, err := nostr.GetPublicKey(sk.(string))
-	if err != nil {
-		return nil, fmt.Errorf("error getting public key: %w", err)
-	}
+type relayPublish struct {
+	at  time.Time
+	err error
+}
 
+func NewNostr(s signer, relayURLs []string) (*Nostr, error) {
 	n := &Nostr{
-		sk: sk.(string),
-		pk: pk,
+		signer: s,
+		pk:     s.PublicKey(),
 	}
 
-	err = n.connectToRelays(relayURLs)
+	err := n.connectToRelays(relayURLs)
 	if err != nil {
 		return nil, err
 	}
@@ -44,7 +53,7 @@ func (n *Nostr) connectToRelays(relayURLs []string) error {
 	for _, url := range relayURLs {
 		relay, err := nostr.RelayConnect(context.Background(), url)
 		if err != nil {
-			fmt.Printf("Error connecting to relay %s: %v\n", url, err)
+			slog.Warn("error connecting to relay", "relay", url, "err", err)
 			continue
 		}
 		n.relays = append(n.relays, relay)
@@ -58,23 +67,83 @@ func (n *Nostr) connectToRelays(relayURLs []string) error {
 }
 
 func (n *Nostr) Close() {
+	n.closed.Store(true)
 	for _, relay := range n.relays {
 		relay.Close()
 	}
+	n.signer.Close()
+}
+
+// sign signs ev with the user's key.
+func (n *Nostr) sign(ev *nostr.Event) error {
+	return n.signer.SignEvent(ev)
 }
 
+// MetadataSourceFilename marks scrobbles whose metadata was guessed from the
+// file path rather than read from tags.
+const MetadataSourceFilename = "filename"
+
 type ScrobbleEvent struct {
-	Artist string
-	Track  string
-	Album  string
-	MbID   string
+	Artist         string
+	Track          string
+	Album          string
+	MbID           string
+	Stream         string
+	MetadataSource string
+	Private        bool
+
+	// CreatedAt backdates the scrobble; zero means now.
+	CreatedAt nostr.Timestamp
+
+	// Used for rule matching only, never published.
+	Path     string
+	Genre    string
+	Duration int
+}
+
+// maxTagLength bounds artist, track and album values.
+const maxTagLength = 512
+
+// Normalize trims whitespace from the scrobble's fields and checks that it
+// can be published.
+func (s ScrobbleEvent) Normalize() (ScrobbleEvent, error) {
+	s.Artist = strings.TrimSpace(s.Artist)
+	s.Track = strings.TrimSpace(s.Track)
+	s.Album = strings.TrimSpace(s.Album)
+	s.MbID = strings.TrimSpace(s.MbID)
+
+	if s.Track == "" {
+		return s, fmt.Errorf("track title is required")
+	}
+	for name, value := range map[string]string{"artist": s.Artist, "track": s.Track, "album": s.Album} {
+		if len(value) > maxTagLength {
+			return s, fmt.Errorf("%s is longer than %d bytes", name, maxTagLength)
+		}
+	}
+	if s.MbID != "" && !mbidRe.MatchString(s.MbID) {
+		return s, fmt.Errorf("mbid %q is not a MusicBrainz ID", s.MbID)
+	}
+	return s, nil
+}
+
+var mbidRe = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func scrobbleTimestamp(scrobble ScrobbleEvent) nostr.Timestamp {
+	if scrobble.CreatedAt != 0 {
+		return scrobble.CreatedAt
+	}
+	return nostr.Timestamp(time.Now().Unix())
 }
 
 func (n *Nostr) CreateScrobbleEvent(scrobble ScrobbleEvent) (*nostr.Event, error) {
+	if scrobble.Private {
+		return n.CreatePrivateScrobbleEvent(scrobble)
+	}
+
 	content := fmt.Sprintf("%s - %s", scrobble.Artist, scrobble.Track)
 	ev := nostr.Event{
-		Kind:      2002,
-		CreatedAt: nostr.Timestamp(time.Now().Unix()),
+		Kind:      KindScrobble,
+		CreatedAt: scrobbleTimestamp(scrobble),
 		Tags:      nostr.Tags{},
 		Content:   content,
 	}
@@ -83,26 +152,271 @@ func (n *Nostr) CreateScrobbleEvent(scrobble ScrobbleEvent) (*nostr.Event, error
 	ev.Tags = append(ev.Tags, nostr.Tag{"track", scrobble.Track})
 	ev.Tags = append(ev.Tags, nostr.Tag{"album", scrobble.Album})
 	ev.Tags = append(ev.Tags, nostr.Tag{"mbid", scrobble.MbID})
+	if scrobble.Stream != "" {
+		ev.Tags = append(ev.Tags, nostr.Tag{"r", scrobble.Stream})
+	}
+	if scrobble.MetadataSource != "" {
+		ev.Tags = append(ev.Tags, nostr.Tag{"confidence", "low", scrobble.MetadataSource})
+	}
 
-	ev.Sign(n.sk)
+	if err := n.sign(&ev); err != nil {
+		return nil, fmt.Errorf("error signing scrobble: %w", err)
+	}
 	return &ev, nil
 }
 
-func (n *Nostr) PublishEvent(ev *nostr.Event) error {
+const (
+	// resubscribeMinDelay and resubscribeMaxDelay bound the wait before
+	// subscribing again to a relay that ended a subscription.
+	resubscribeMinDelay = 5 * time.Second
+	resubscribeMaxDelay = 5 * time.Minute
+	// subscriptionSeenWindow is how many recent event IDs a subscription
+	// remembers to deliver each event once.
+	subscriptionSeenWindow = 10000
+)
+
+// SubscribeEvents subscribes to filters on every relay and delivers each
+// event once, whichever relay sends it first. A relay that closes the
+// subscription or drops the connection is subscribed to again, waiting
+// longer after each failure. The channel is closed when ctx is done.
+func (n *Nostr) SubscribeEvents(ctx context.Context, filters ...nostr.Filter) (<-chan *nostr.Event, error) {
+	subs := make([]*nostr.Subscription, len(n.relays))
+	subscribed := 0
+	for i, relay := range n.relays {
+		sub, err := relay.Subscribe(ctx, nostr.Filters(filters))
+		if err != nil {
+			slog.Warn("error subscribing", "relay", relay.URL, "err", err)
+			continue
+		}
+		subs[i] = sub
+		subscribed++
+	}
+	if subscribed == 0 {
+		return nil, fmt.Errorf("could not subscribe on any relay")
+	}
+
+	events := make(chan *nostr.Event)
+	merged := make(chan *nostr.Event)
+	for i, relay := range n.relays {
+		go n.keepSubscribed(ctx, relay, subs[i], filters, merged)
+	}
+
+	go func() {
+		defer close(events)
+		seen := make(map[string]bool)
+		var order []string
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev := <-merged:
+				if seen[ev.ID] {
+					continue
+				}
+				seen[ev.ID] = true
+				order = append(order, ev.ID)
+				if len(order) > subscriptionSeenWindow {
+					delete(seen, order[0])
+					order = order[1:]
+				}
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// keepSubscribed forwards the events of sub, a subscription to relay or nil
+// if subscribing failed, to merged. Whenever the subscription ends it
+// subscribes again from the newest event seen, on a new connection if the
+// relay's has dropped, until ctx is done or n is closed.
+func (n *Nostr) keepSubscribed(ctx context.Context, relay *nostr.Relay, sub *nostr.Subscription, filters []nostr.Filter, merged chan<- *nostr.Event) {
+	// own is the connection opened here once relay's has dropped.
+	var own *nostr.Relay
+	defer func() {
+		if own != nil {
+			own.Close()
+		}
+	}()
+
+	var newest nostr.Timestamp
+	delay := resubscribeMinDelay
+	for {
+		if sub != nil {
+			if forwardEvents(ctx, sub, merged, &newest) {
+				delay = resubscribeMinDelay
+			}
+			sub.Unsub()
+		}
+		if ctx.Err() != nil || n.closed.Load() {
+			return
+		}
+		slog.Warn("relay subscription ended, subscribing again", "relay", relay.URL, "in", delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, resubscribeMaxDelay)
+
+		target := relay
+		if !relay.IsConnected() {
+			if own == nil || !own.IsConnected() {
+				if own != nil {
+					own.Close()
+					own = nil
+				}
+				conn, err := nostr.RelayConnect(ctx, relay.URL)
+				if err != nil {
+					slog.Warn("error connecting to relay", "relay", relay.URL, "err", err)
+					sub = nil
+					continue
+				}
+				own = conn
+			}
+			target = own
+		}
+
+		var err error
+		if sub, err = target.Subscribe(ctx, resumeFilters(filters, newest)); err != nil {
+			slog.Warn("error subscribing", "relay", relay.URL, "err", err)
+			sub = nil
+		}
+	}
+}
+
+// forwardEvents sends the events of sub to merged, keeping the newest
+// created_at in newest, until the relay ends the subscription or ctx is
+// done. It reports whether any event came.
+func forwardEvents(ctx context.Context, sub *nostr.Subscription, merged chan<- *nostr.Event, newest *nostr.Timestamp) bool {
+	got := false
+	for {
+		select {
+		case <-ctx.Done():
+			return got
+		case reason := <-sub.ClosedReason:
+			slog.Warn("relay closed subscription", "relay", sub.Relay.URL, "reason", reason)
+			return got
+		case ev, ok := <-sub.Events:
+			if !ok {
+				return got
+			}
+			got = true
+			*newest = max(*newest, ev.CreatedAt)
+			select {
+			case merged <- ev:
+			case <-ctx.Done():
+				return got
+			}
+		}
+	}
+}
+
+// resumeFilters returns filters limited to events from since on, so a new
+// subscription doesn't send the stored events again.
+func resumeFilters(filters []nostr.Filter, since nostr.Timestamp) nostr.Filters {
+	resumed := make(nostr.Filters, len(filters))
+	for i, f := range filters {
+		if since > 0 && (f.Since == nil || *f.Since < since) {
+			f.Since = &since
+		}
+		resumed[i] = f
+	}
+	return resumed
+}
+
+// PublishResult is the outcome of publishing an event to one relay.
+type PublishResult struct {
+	Relay    string
+	Err      error
+	Duration time.Duration
+}
+
+// PublishEventResults publishes ev to every relay and reports each outcome.
+func (n *Nostr) PublishEventResults(ev *nostr.Event) []PublishResult {
+	var results []PublishResult
 	for _, relay := range n.relays {
+		start := time.Now()
 		err := relay.Publish(context.Background(), *ev)
-		if err != nil {
-			fmt.Printf("Error publishing event to %s: %v\n", relay.URL, err)
+		results = append(results, PublishResult{Relay: relay.URL, Err: err, Duration: time.Since(start)})
+	}
+
+	n.mu.Lock()
+	if n.lastPublish == nil {
+		n.lastPublish = make(map[string]relayPublish)
+	}
+	for _, result := range results {
+		n.lastPublish[result.Relay] = relayPublish{at: time.Now(), err: result.Err}
+	}
+	n.mu.Unlock()
+
+	if anyPublished(results) {
+		n.recordPublished(ev)
+	}
+	return results
+}
+
+// PublishEvent publishes ev to every relay, failing if none accepted it.
+func (n *Nostr) PublishEvent(ev *nostr.Event) error {
+	results := n.PublishEventResults(ev)
+	logPublishResults(ev, results)
+	if !anyPublished(results) {
+		return errors.New("no relay accepted the event")
+	}
+	return nil
+}
+
+// logPublishResults logs how publishing ev went on each relay. Commands
+// print their own summary.
+func logPublishResults(ev *nostr.Event, results []PublishResult) {
+	for _, result := range results {
+		if result.Err != nil {
+			slog.Warn("publish failed", "relay", result.Relay, "id", ev.ID, "err", result.Err)
 		} else {
-			fmt.Printf("Event published successfully to %s\n", relay.URL)
+			slog.Debug("published", "relay", result.Relay, "id", ev.ID)
 		}
 	}
-	return nil
+}
+
+// RelayHealth describes the connection to a relay and how the last publish
+// to it went.
+type RelayHealth struct {
+	URL         string     `json:"url"`
+	Connected   bool       `json:"connected"`
+	LastPublish *time.Time `json:"last_publish,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+func (n *Nostr) RelayHealth() []RelayHealth {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	health := make([]RelayHealth, 0, len(n.relays))
+	for _, relay := range n.relays {
+		h := RelayHealth{URL: relay.URL, Connected: relay.IsConnected()}
+		if last, ok := n.lastPublish[relay.URL]; ok {
+			at := last.at
+			h.LastPublish = &at
+			if last.err != nil {
+				h.LastError = last.err.Error()
+			}
+		}
+		health = append(health, h)
+	}
+	return health
 }
 
 func (n *Nostr) QueryRecentScrobbles(limit int) ([]nostr.Event, error) {
+	if cache := n.historyCache(); cache != nil {
+		return cache.Recent(limit)
+	}
+
 	filter := nostr.Filter{
-		Kinds:   []int{2002},
+		Kinds:   []int{KindScrobble, KindPrivateScrobble},
 		Authors: []string{n.pk},
 		Limit:   limit,
 	}
@@ -111,15 +425,20 @@ func (n *Nostr) QueryRecentScrobbles(limit int) ([]nostr.Event, error) {
 	defer cancel()
 
 	var allEvents []nostr.Event
+	seen := make(map[string]bool)
 	for _, relay := range n.relays {
 		events, err := relay.QuerySync(ctx, filter)
 		if err != nil {
-			fmt.Printf("Error querying relay %s: %v\n", relay.URL, err)
+			slog.Warn("error querying relay", "relay", relay.URL, "err", err)
 			continue
 		}
 
+		// Relays share most events; keep each once.
 		for _, event := range events {
-			allEvents = append(allEvents, *event)
+			if !seen[event.ID] {
+				seen[event.ID] = true
+				allEvents = append(allEvents, *event)
+			}
 		}
 	}
 
@@ -136,6 +455,57 @@ func (n *Nostr) QueryRecentScrobbles(limit int) ([]nostr.Event, error) {
 	return allEvents, nil
 }
 
+// QueryScrobblesByID fetches the user's scrobble events with the given IDs,
+// from the cache when it has them.
+func (n *Nostr) QueryScrobblesByID(ids []string) ([]nostr.Event, error) {
+	var allEvents []nostr.Event
+	if cache := n.historyCache(); cache != nil {
+		var missing []string
+		for _, id := range ids {
+			ev, err := cache.Get(id)
+			if err != nil {
+				return nil, err
+			}
+			if ev != nil {
+				allEvents = append(allEvents, *ev)
+			} else {
+				missing = append(missing, id)
+			}
+		}
+		if len(missing) == 0 {
+			return allEvents, nil
+		}
+		ids = missing
+	}
+
+	filter := nostr.Filter{
+		IDs:     ids,
+		Kinds:   []int{KindScrobble, KindPrivateScrobble},
+		Authors: []string{n.pk},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	seen := make(map[string]bool)
+	for _, relay := range n.relays {
+		events, err := relay.QuerySync(ctx, filter)
+		if err != nil {
+			slog.Warn("error querying relay", "relay", relay.URL, "err", err)
+			continue
+		}
+
+		for _, event := range events {
+			if !seen[event.ID] {
+				seen[event.ID] = true
+				allEvents = append(allEvents, *event)
+			}
+		}
+	}
+
+	return allEvents, nil
+}
+
 func (n *Nostr) GetLastScrobble() (*nostr.Event, error) {
 	events, err := n.QueryRecentScrobbles(1)
 	if err != nil {
@@ -149,9 +519,24 @@ func (n *Nostr) GetLastScrobble() (*nostr.Event, error) {
 	return &events[0], nil
 }
 
-func PrintScrobbles(events []nostr.Event) {
+// PrintScrobbles lists events, marking tracks in loved, which may be nil.
+func (n *Nostr) PrintScrobbles(events []nostr.Event, loved *LovedTracks) {
 	fmt.Println("Recent scrobbles:")
-	for _, ev := range events {
-		fmt.Printf("- %s (at %s)\n", ev.Content, ev.CreatedAt.Time().Format(time.RFC3339))
+	for i := range events {
+		ev := &events[i]
+		scrobble, err := n.ScrobbleFromEvent(ev)
+		if err != nil {
+			fmt.Printf("%3d. [encrypted] (at %s) %s\n", i+1, ev.CreatedAt.Time().Format(time.RFC3339), ev.ID)
+			continue
+		}
+
+		marks := ""
+		if loved.Contains(scrobble.Artist, scrobble.Track, scrobble.MbID) {
+			marks += " [loved]"
+		}
+		if scrobble.Private {
+			marks += " [private]"
+		}
+		fmt.Printf("%3d. %s - %s%s (at %s) %s\n", i+1, scrobble.Artist, scrobble.Track, marks, ev.CreatedAt.Time().Format(time.RFC3339), ev.ID)
 	}
 }
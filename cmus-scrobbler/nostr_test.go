@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestResumeFilters(t *testing.T) {
+	old, later := nostr.Timestamp(1000), nostr.Timestamp(5000)
+	filters := []nostr.Filter{
+		{Kinds: []int{KindScrobble}, Since: &old},
+		{Kinds: []int{KindScrobble}, Since: &later},
+		{Kinds: []int{KindScrobble}},
+	}
+
+	resumed := resumeFilters(filters, 2000)
+	if *resumed[0].Since != 2000 || *resumed[1].Since != 5000 || *resumed[2].Since != 2000 {
+		t.Errorf("since = %d, %d, %d", *resumed[0].Since, *resumed[1].Since, *resumed[2].Since)
+	}
+	if *filters[0].Since != 1000 || filters[2].Since != nil {
+		t.Error("the original filters were changed")
+	}
+
+	// Before any event came, the filters are used as they are.
+	if resumed := resumeFilters(filters, 0); resumed[2].Since != nil || *resumed[0].Since != 1000 {
+		t.Errorf("resumed without events = %+v", resumed)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// nowPlayingFallback is how long a music status lasts when the length of
+// the track isn't known, as for streams.
+const nowPlayingFallback = 10 * time.Minute
+
+// CreateMusicStatusEvent returns a NIP-38 music status for scrobble that
+// expires at expires.
+func (n *Nostr) CreateMusicStatusEvent(scrobble ScrobbleEvent, expires time.Time) (*nostr.Event, error) {
+	ev := nostr.Event{
+		Kind:      KindUserStatus,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"d", "music"},
+			{"expiration", strconv.FormatInt(expires.Unix(), 10)},
+		},
+		Content: fmt.Sprintf("%s - %s", scrobble.Artist, scrobble.Track),
+	}
+	if scrobble.Stream != "" {
+		ev.Tags = append(ev.Tags, nostr.Tag{"r", scrobble.Stream})
+	}
+	if err := n.sign(&ev); err != nil {
+		return nil, fmt.Errorf("error signing music status: %w", err)
+	}
+	return &ev, nil
+}
+
+// nowPlayingExpiry is when the status for track should expire: when it
+// ends, or after nowPlayingFallback when its length isn't known.
+func nowPlayingExpiry(track *TrackStatus, now time.Time) time.Time {
+	if track.Duration <= 0 || track.Position >= track.Duration {
+		return now.Add(nowPlayingFallback)
+	}
+	return now.Add(time.Duration(track.Duration-track.Position) * time.Second)
+}
+
+// startTrack runs the track_started hooks for a track that just started
+// playing, and publishes it as the music status when its profile has
+// now_playing set. Tracks that are private, skipped by a rule or played
+// while scrobbling is paused aren't published.
+func startTrack(d *daemon, targets *profileTargets, playing ScrobbleEvent, track *TrackStatus, now time.Time) {
+	normalized, err := playing.Normalize()
+	if err != nil {
+		d.fireHook(hookPayload{Event: hookTrackStarted, Track: newHookTrack(playing)})
+		return
+	}
+	target, result, _, publish, err := targets.prepare(normalized, now)
+	if err != nil {
+		slog.Error("error selecting profile", "err", err)
+		d.fireHook(hookPayload{Event: hookTrackStarted, Track: newHookTrack(normalized)})
+		return
+	}
+	d.fireHook(hookPayload{Event: hookTrackStarted, Profile: target.profile, Track: newHookTrack(result)})
+
+	if !target.config.NowPlaying || !publish || result.Private || d.Status().ScrobblingPaused {
+		return
+	}
+	ev, err := target.nostr.CreateMusicStatusEvent(result, nowPlayingExpiry(track, now))
+	if err != nil {
+		slog.Error("error creating now playing status", "err", err)
+		return
+	}
+	results := target.nostr.PublishEventResults(ev)
+	if !anyPublished(results) {
+		slog.Warn("no relay accepted the now playing status", "track", track.key(), "id", ev.ID)
+		return
+	}
+	slog.Info("published now playing", "track", track.key(), "id", ev.ID)
+	d.fireHook(hookPayload{
+		Event:   hookNowPlayingPublished,
+		Profile: target.profile,
+		Track:   newHookTrack(result),
+		EventID: ev.ID,
+		Relays:  hookRelayResults(results),
+	})
+}
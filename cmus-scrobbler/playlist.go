@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// cmusPlaylistDir is where cmus keeps its saved playlists.
+func cmusPlaylistDir() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "cmus", "playlists"), nil
+}
+
+// findPlaylist returns the path of a playlist given as a file or as the
+// name of a cmus playlist.
+func findPlaylist(arg string) (string, error) {
+	if _, err := os.Stat(arg); err == nil {
+		return arg, nil
+	}
+	dir, err := cmusPlaylistDir()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, arg)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("no playlist file %s and no cmus playlist in %s", arg, dir)
+	}
+	return path, nil
+}
+
+// parsePlaylist reads a cmus playlist (one path per line) or an m3u file.
+// Comment lines are skipped and relative paths are resolved against dir.
+func parsePlaylist(r io.Reader, dir string) ([]string, error) {
+	var files []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.Contains(line, "://") {
+			// Streams have no tags to publish.
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(dir, line)
+		}
+		files = append(files, line)
+	}
+	return files, scanner.Err()
+}
+
+// readFileTags reads a file's tags with ffprobe, which must be installed.
+// Tag names are lowercased.
+func readFileTags(path string) (map[string]string, error) {
+	out, err := exec.Command("ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe %s: %w", path, err)
+	}
+	var probe struct {
+		Format struct {
+			Tags map[string]string `json:"tags"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, fmt.Errorf("ffprobe %s: %w", path, err)
+	}
+	tags := make(map[string]string)
+	for k, v := range probe.Format.Tags {
+		tags[strings.ToLower(k)] = strings.TrimSpace(v)
+	}
+	return tags, nil
+}
+
+// audioTrackFromTags picks the track metadata out of ffprobe tags, which
+// are named differently by each container format.
+func audioTrackFromTags(tags map[string]string) AudioTrack {
+	first := func(names ...string) string {
+		for _, name := range names {
+			if v := tags[name]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	return AudioTrack{
+		Artist: first("artist", "album_artist"),
+		Title:  first("title"),
+		Album:  first("album"),
+		Genre:  first("genre"),
+		MbID:   first("musicbrainz_trackid", "musicbrainz track id", "mbid"),
+	}
+}
+
+// resolveAudioTrack gets the metadata of a file from its tags, falling back
+// to the configured filename patterns.
+func resolveAudioTrack(path string, patterns []filenamePattern) (AudioTrack, error) {
+	tags, tagErr := readFileTags(path)
+	track := audioTrackFromTags(tags)
+	if track.Artist != "" && track.Title != "" {
+		return track, nil
+	}
+
+	if guessed, _, ok := parseFilename(patterns, path); ok && guessed.Artist != "" {
+		return AudioTrack{Artist: guessed.Artist, Title: guessed.Track, Album: guessed.Album}, nil
+	}
+	if tagErr != nil {
+		return AudioTrack{}, tagErr
+	}
+	return AudioTrack{}, errors.New("no artist and title tags")
+}
+
+var nonSlug = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+// playlistDTag derives a stable identifier from a playlist name: its
+// letters and digits, followed by a short hash of the whole name so that
+// names differing only in punctuation get different ones.
+func playlistDTag(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:4])
+	slug := strings.Trim(nonSlug.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if slug == "" {
+		return hash
+	}
+	return slug + "-" + hash
+}
+
+// playlistEvent builds the unsigned kind 30037 playlist of tracks.
+func playlistEvent(pubkey, d, title string, tracks []AudioTrack) nostr.Event {
+	ev := nostr.Event{
+		Kind:      KindMusicPlaylist,
+		CreatedAt: nostr.Now(),
+		Content:   title,
+		Tags: nostr.Tags{
+			{"d", d},
+			{"title", title},
+		},
+	}
+	for _, t := range tracks {
+		ev.Tags = append(ev.Tags, nostr.Tag{"a", addressOf(KindAudioTrack, pubkey, t.DTag())})
+	}
+	return ev
+}
+
+// publishIfChanged signs and publishes ev unless current already has the
+// same content. It reports whether ev was published.
+func (n *Nostr) publishIfChanged(ev *nostr.Event, current *nostr.Event, dryRun bool) (bool, error) {
+	if current != nil && sameEventContent(ev, current) {
+		return false, nil
+	}
+	if current != nil && ev.CreatedAt <= current.CreatedAt {
+		ev.CreatedAt = current.CreatedAt + 1
+	}
+	if dryRun {
+		return true, nil
+	}
+	if err := n.sign(ev); err != nil {
+		return false, err
+	}
+	results := n.PublishEventResults(ev)
+	if !anyPublished(results) {
+		logPublishResults(ev, results)
+		return false, errors.New("no relay accepted the event")
+	}
+	return true, nil
+}
+
+func cmdPlaylist(ctx *cliContext, args []string) error {
+	if len(args) == 0 || args[0] != "publish" {
+		return fmt.Errorf("usage: cmus-scrobbler playlist publish [-title name] [-dry-run] <cmus playlist|file.m3u>")
+	}
+
+	fs := flag.NewFlagSet("playlist publish", flag.ExitOnError)
+	title := fs.String("title", "", "Playlist title (default: the playlist file name)")
+	dryRun := fs.Bool("dry-run", false, "Show what would be published")
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: cmus-scrobbler playlist publish [-title name] [-dry-run] <cmus playlist|file.m3u>")
+	}
+
+	path, err := findPlaylist(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *title == "" {
+		*title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening playlist: %w", err)
+	}
+	files, err := parsePlaylist(f, filepath.Dir(path))
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("error reading playlist: %w", err)
+	}
+
+	patterns, err := compileFilenamePatterns(ctx.config.FilenamePatterns)
+	if err != nil {
+		return fmt.Errorf("error in filename patterns: %w", err)
+	}
+
+	var tracks []AudioTrack
+	seen := make(map[string]bool)
+	var dTags []string
+	for _, file := range files {
+		track, err := resolveAudioTrack(file, patterns)
+		if err != nil {
+			fmt.Printf("Skipping %s: %v\n", file, err)
+			continue
+		}
+		tracks = append(tracks, track)
+		if d := track.DTag(); !seen[d] {
+			seen[d] = true
+			dTags = append(dTags, d)
+		}
+	}
+	if len(tracks) == 0 {
+		return fmt.Errorf("no tracks in %s could be resolved", path)
+	}
+
+	existing, err := ctx.nostr.QueryAddressable(KindAudioTrack, dTags)
+	if err != nil {
+		return err
+	}
+
+	published := 0
+	done := make(map[string]bool)
+	for _, track := range tracks {
+		d := track.DTag()
+		if done[d] {
+			continue
+		}
+		done[d] = true
+
+		ev := updateAudioTrackEvent(track, existing[d])
+		changed, err := ctx.nostr.publishIfChanged(&ev, existing[d], *dryRun)
+		if err != nil {
+			return fmt.Errorf("error publishing %s - %s: %w", track.Artist, track.Title, err)
+		}
+		if changed {
+			published++
+			fmt.Printf("Track %s - %s (d=%s)\n", track.Artist, track.Title, d)
+		}
+	}
+
+	d := playlistDTag(*title)
+	current, err := ctx.nostr.QueryAddressable(KindMusicPlaylist, []string{d})
+	if err != nil {
+		return err
+	}
+	playlist := playlistEvent(ctx.nostr.pk, d, *title, tracks)
+	changed, err := ctx.nostr.publishIfChanged(&playlist, current[d], *dryRun)
+	if err != nil {
+		return fmt.Errorf("error publishing playlist: %w", err)
+	}
+
+	verb := "Published"
+	if *dryRun {
+		verb = "Would publish"
+	}
+	fmt.Printf("%s %d of %d tracks\n", verb, published, len(done))
+	switch {
+	case changed:
+		fmt.Printf("%s playlist %q with %d tracks: %s\n", verb, *title, len(tracks), addressOf(KindMusicPlaylist, ctx.nostr.pk, d))
+	default:
+		fmt.Printf("Playlist %q is up to date\n", *title)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParsePlaylist(t *testing.T) {
+	input := "\ufeff#EXTM3U\n" +
+		"#EXTINF:226,Low - Words\n" +
+		"Low/I Could Live in Hope/01 Words.flac\n" +
+		"\n" +
+		"/music/Broadcast/Tender Buttons/02 Black Cat.flac\n" +
+		"http://ice.somafm.com/groovesalad\n"
+
+	got, err := parsePlaylist(strings.NewReader(input), "/music")
+	if err != nil {
+		t.Fatalf("parsePlaylist: %v", err)
+	}
+	want := []string{
+		"/music/Low/I Could Live in Hope/01 Words.flac",
+		"/music/Broadcast/Tender Buttons/02 Black Cat.flac",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("parsePlaylist = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("file %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestAudioTrackFromTags(t *testing.T) {
+	track := audioTrackFromTags(map[string]string{
+		"album_artist":         "Various Artists",
+		"artist":               "Broadcast",
+		"title":                "Black Cat",
+		"musicbrainz track id": "0e1d3a54-0b33-4e80-9b1e-1f1f5e9a2f0c",
+	})
+	want := AudioTrack{Artist: "Broadcast", Title: "Black Cat", MbID: "0e1d3a54-0b33-4e80-9b1e-1f1f5e9a2f0c"}
+	if !reflect.DeepEqual(track, want) {
+		t.Errorf("audioTrackFromTags = %+v, want %+v", track, want)
+	}
+}
+
+func TestAudioTrackDTag(t *testing.T) {
+	withMbID := AudioTrack{Artist: "Low", Title: "Words", MbID: "abc"}
+	if got := withMbID.DTag(); got != "abc" {
+		t.Errorf("DTag with MBID = %q, want abc", got)
+	}
+
+	a := AudioTrack{Artist: "Low", Title: "Words", Album: "I Could Live in Hope"}
+	b := AudioTrack{Artist: "LOW ", Title: "words", Album: "A Live Album", Genre: "Slowcore"}
+	if a.DTag() != b.DTag() {
+		t.Errorf("DTag differs by case, album or genre: %q vs %q", a.DTag(), b.DTag())
+	}
+	c := AudioTrack{Artist: "Low", Title: "Words (Live)"}
+	if a.DTag() == c.DTag() {
+		t.Error("DTag is the same for different titles")
+	}
+}
+
+func TestPlaylistEvent(t *testing.T) {
+	tracks := []AudioTrack{
+		{Artist: "Low", Title: "Words", MbID: "abc"},
+		{Artist: "Broadcast", Title: "Black Cat"},
+	}
+	d := playlistDTag("Late Night / Slow!")
+	ev := playlistEvent("pk", d, "Late Night / Slow!", tracks)
+
+	if got := ev.Tags.GetD(); got != d || !strings.HasPrefix(d, "late-night-slow-") {
+		t.Errorf("d = %q, want late-night-slow-<hash>", got)
+	}
+	refs := ev.Tags.GetAll([]string{"a"})
+	if len(refs) != 2 || refs[0][1] != "31337:pk:abc" || refs[1][1] != "31337:pk:"+tracks[1].DTag() {
+		t.Errorf("a tags = %v", refs)
+	}
+
+	same := playlistEvent("pk", d, "Late Night / Slow!", tracks)
+	same.CreatedAt = ev.CreatedAt + 100
+	if !sameEventContent(&ev, &same) {
+		t.Error("identical playlists are reported as changed")
+	}
+	reordered := playlistEvent("pk", d, "Late Night / Slow!", []AudioTrack{tracks[1], tracks[0]})
+	if sameEventContent(&ev, &reordered) {
+		t.Error("reordered playlist is reported as unchanged")
+	}
+}
+
+func TestPlaylistDTag(t *testing.T) {
+	if d := playlistDTag("Ночные песни"); !strings.HasPrefix(d, "ночные-песни-") {
+		t.Errorf("d = %q, want the Cyrillic name kept", d)
+	}
+	if playlistDTag("Rock & Roll") == playlistDTag("Rock Roll") {
+		t.Error("names differing only in punctuation share a d tag")
+	}
+	if d := playlistDTag("!!!"); d == "" || d != playlistDTag("!!!") {
+		t.Errorf("d = %q for a name without letters", d)
+	}
+}
+
+func TestAudioTrackEvent(t *testing.T) {
+	ev := audioTrackEvent(AudioTrack{Artist: "Low", Title: "Words", Album: "I Could Live in Hope", MbID: "abc"})
+	if ev.Kind != KindAudioTrack {
+		t.Fatalf("kind = %d, want %d", ev.Kind, KindAudioTrack)
+	}
+	for _, want := range []nostr.Tag{
+		{"d", "abc"},
+		{"title", "Words"},
+		{"c", "Low", "artist"},
+		{"c", "I Could Live in Hope", "album"},
+		{"i", "mbid:recording:abc"},
+	} {
+		if !containsTag(ev.Tags, want) {
+			t.Errorf("tags %v are missing %v", ev.Tags, want)
+		}
+	}
+}
+
+func containsTag(tags nostr.Tags, want nostr.Tag) bool {
+	for _, tag := range tags {
+		if strings.Join(tag, "\x00") == strings.Join(want, "\x00") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestUpdateAudioTrackEvent(t *testing.T) {
+	// tracks published cover art and identifiers; playlist publish knows
+	// the genre.
+	fromScrobbles := audioTrackEvent(AudioTrack{
+		Artist:      "Low",
+		Title:       "Words",
+		MbID:        "abc",
+		Identifiers: []string{"isrc:USSUB9300001"},
+		Image:       "https://example.com/cover.jpg",
+	})
+	fromScrobbles.Tags = append(fromScrobbles.Tags, nostr.Tag{"t", "slowcore"})
+	fromFile := AudioTrack{Artist: "Low", Title: "Words", Album: "I Could Live in Hope", Genre: "Rock", MbID: "abc"}
+
+	ev := updateAudioTrackEvent(fromFile, &fromScrobbles)
+	for _, want := range []nostr.Tag{
+		{"c", "I Could Live in Hope", "album"},
+		{"c", "Rock", "genre"},
+		{"i", "mbid:recording:abc"},
+		{"i", "isrc:USSUB9300001"},
+		{"imeta", "url https://example.com/cover.jpg"},
+		{"t", "slowcore"},
+	} {
+		if !containsTag(ev.Tags, want) {
+			t.Errorf("tags %v are missing %v", ev.Tags, want)
+		}
+	}
+
+	// Publishing from scrobbles again keeps the genre and changes nothing.
+	again := updateAudioTrackEvent(AudioTrack{
+		Artist:      "Low",
+		Title:       "Words",
+		MbID:        "abc",
+		Identifiers: []string{"isrc:USSUB9300001"},
+		Image:       "https://example.com/cover.jpg",
+	}, &ev)
+	if !sameEventContent(&ev, &again) {
+		t.Errorf("tags changed from %v to %v", ev.Tags, again.Tags)
+	}
+	if again := updateAudioTrackEvent(fromFile, &ev); !sameEventContent(&ev, &again) {
+		t.Errorf("tags changed from %v to %v", ev.Tags, again.Tags)
+	}
+}
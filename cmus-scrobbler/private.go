@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	KindScrobble = 2002
+	// KindPrivateScrobble events carry a scrobble NIP-44 encrypted to the
+	// author's own pubkey, with no plaintext track tags.
+	KindPrivateScrobble = 2003
+)
+
+// privateScrobble is the plaintext payload of a KindPrivateScrobble event.
+type privateScrobble struct {
+	Artist         string `json:"artist"`
+	Track          string `json:"track"`
+	Album          string `json:"album,omitempty"`
+	MbID           string `json:"mbid,omitempty"`
+	Stream         string `json:"stream,omitempty"`
+	MetadataSource string `json:"metadata_source,omitempty"`
+}
+
+// CreatePrivateScrobbleEvent encrypts scrobble to the user's own key.
+func (n *Nostr) CreatePrivateScrobbleEvent(scrobble ScrobbleEvent) (*nostr.Event, error) {
+	payload, err := json.Marshal(privateScrobble{
+		Artist:         scrobble.Artist,
+		Track:          scrobble.Track,
+		Album:          scrobble.Album,
+		MbID:           scrobble.MbID,
+		Stream:         scrobble.Stream,
+		MetadataSource: scrobble.MetadataSource,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error encoding private scrobble: %w", err)
+	}
+
+	content, err := n.signer.EncryptSelf(string(payload))
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting private scrobble: %w", err)
+	}
+
+	ev := nostr.Event{
+		Kind:      KindPrivateScrobble,
+		CreatedAt: scrobbleTimestamp(scrobble),
+		Tags:      nostr.Tags{},
+		Content:   content,
+	}
+	if err := n.sign(&ev); err != nil {
+		return nil, fmt.Errorf("error signing private scrobble: %w", err)
+	}
+	return &ev, nil
+}
+
+// ScrobbleFromEvent reads a public or private scrobble event, decrypting the
+// latter when it was written by this key.
+func (n *Nostr) ScrobbleFromEvent(ev *nostr.Event) (ScrobbleEvent, error) {
+	if ev.Kind != KindPrivateScrobble {
+		return scrobbleFromTags(ev), nil
+	}
+
+	if ev.PubKey != n.pk {
+		return ScrobbleEvent{}, fmt.Errorf("private scrobble %s belongs to another key", ev.ID)
+	}
+
+	plaintext, err := n.signer.DecryptSelf(ev.Content)
+	if err != nil {
+		return ScrobbleEvent{}, fmt.Errorf("error decrypting scrobble %s: %w", ev.ID, err)
+	}
+
+	var payload privateScrobble
+	if err := json.Unmarshal([]byte(plaintext), &payload); err != nil {
+		return ScrobbleEvent{}, fmt.Errorf("error decoding scrobble %s: %w", ev.ID, err)
+	}
+
+	return ScrobbleEvent{
+		Artist:         payload.Artist,
+		Track:          payload.Track,
+		Album:          payload.Album,
+		MbID:           payload.MbID,
+		Stream:         payload.Stream,
+		MetadataSource: payload.MetadataSource,
+		Private:        true,
+		CreatedAt:      ev.CreatedAt,
+	}, nil
+}
+
+func scrobbleFromTags(ev *nostr.Event) ScrobbleEvent {
+	scrobble := ScrobbleEvent{CreatedAt: ev.CreatedAt}
+	for _, tag := range ev.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "artist":
+			scrobble.Artist = tag[1]
+		case "track":
+			scrobble.Track = tag[1]
+		case "album":
+			scrobble.Album = tag[1]
+		case "mbid":
+			scrobble.MbID = tag[1]
+		case "r":
+			scrobble.Stream = tag[1]
+		case "confidence":
+			if len(tag) >= 3 {
+				scrobble.MetadataSource = tag[2]
+			}
+		}
+	}
+	return scrobble
+}
+
+// RevealScrobbles republishes private scrobbles as public kind 2002 events,
+// keeping their original timestamps.
+func (n *Nostr) RevealScrobbles(events []nostr.Event) error {
+	for i := range events {
+		ev := &events[i]
+		if ev.Kind != KindPrivateScrobble {
+			fmt.Printf("Skipping %s: already public\n", ev.ID)
+			continue
+		}
+
+		scrobble, err := n.ScrobbleFromEvent(ev)
+		if err != nil {
+			return err
+		}
+		scrobble.Private = false
+
+		public, err := n.CreateScrobbleEvent(scrobble)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Revealing %s - %s (%s)\n", scrobble.Artist, scrobble.Track, ev.ID)
+		if err := n.PublishEvent(public); err != nil {
+			return err
+		}
+	}
+	return nil
+}
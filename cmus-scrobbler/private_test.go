@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func newTestNostr(t *testing.T) *Nostr {
+	t.Helper()
+	sk := nostr.GeneratePrivateKey()
+	pk, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		t.Fatalf("GetPublicKey: %v", err)
+	}
+	return &Nostr{signer: &keySigner{sk: sk, pk: pk}, pk: pk}
+}
+
+func TestPrivateScrobbleRoundTrip(t *testing.T) {
+	n := newTestNostr(t)
+	scrobble := ScrobbleEvent{Artist: "Phosphorescent", Track: "Song for Zula", Album: "Muchacho", Private: true}
+
+	ev, err := n.CreateScrobbleEvent(scrobble)
+	if err != nil {
+		t.Fatalf("CreateScrobbleEvent: %v", err)
+	}
+	if ev.Kind != KindPrivateScrobble {
+		t.Fatalf("kind = %d, want %d", ev.Kind, KindPrivateScrobble)
+	}
+	if len(ev.Tags) != 0 || strings.Contains(ev.Content, "Phosphorescent") {
+		t.Fatalf("private event leaks plaintext: %+v", ev)
+	}
+	if ok, _ := ev.CheckSignature(); !ok {
+		t.Fatal("private event has an invalid signature")
+	}
+
+	got, err := n.ScrobbleFromEvent(ev)
+	if err != nil {
+		t.Fatalf("ScrobbleFromEvent: %v", err)
+	}
+	if got.Artist != scrobble.Artist || got.Track != scrobble.Track || got.Album != scrobble.Album || !got.Private {
+		t.Fatalf("decrypted scrobble = %+v", got)
+	}
+
+	other := newTestNostr(t)
+	if _, err := other.ScrobbleFromEvent(ev); err == nil {
+		t.Fatal("another key should not be able to read the scrobble")
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"time"
+)
+
+// DefaultProfile is the name of the profile made of the top-level config.
+const DefaultProfile = "default"
+
+// Profile overrides parts of the top-level config. Unset fields are
+// inherited from it; rules, when set, replace the top-level rules.
+type Profile struct {
+	Nsec string `yaml:"nsec"`
+	Npub string `yaml:"npub"`
+	// Bunker signs with a remote signer instead of an nsec, as at the top
+	// level. The profile's npub goes with it.
+	Bunker  string   `yaml:"bunker"`
+	Relays  []string `yaml:"relays"`
+	Rules   []Rule   `yaml:"rules"`
+	Private *bool    `yaml:"private"`
+	// Sinks, when set, replace the top-level sinks.
+	Sinks []Sink `yaml:"sinks"`
+}
+
+// ProfileSelector picks a profile for a track automatically. Every condition
+// that is set must match; the first matching selector wins.
+type ProfileSelector struct {
+	Profile string `yaml:"profile"`
+	// Path is a glob matched against the file path, as in rules.
+	Path string `yaml:"path"`
+	// Hours is a local time range such as "09:00-17:30". Ranges may wrap
+	// past midnight.
+	Hours string `yaml:"hours"`
+}
+
+// ProfileNames returns the default profile followed by the configured
+// profiles in name order.
+func (c Config) ProfileNames() []string {
+	names := []string{DefaultProfile}
+	var others []string
+	for name := range c.Profiles {
+		if name != DefaultProfile {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	return append(names, others...)
+}
+
+// Profile returns the config for the named profile, with inherited values
+// filled in from the top level.
+func (c Config) Profile(name string) (Config, error) {
+	if name == "" || name == DefaultProfile {
+		if p, ok := c.Profiles[DefaultProfile]; ok {
+			return c.mergeProfile(p), nil
+		}
+		return c, nil
+	}
+
+	p, ok := c.Profiles[name]
+	if !ok {
+		return c, fmt.Errorf("unknown profile %q", name)
+	}
+	return c.mergeProfile(p), nil
+}
+
+func (c Config) mergeProfile(p Profile) Config {
+	merged := c
+	if p.Bunker != "" {
+		merged.Bunker = p.Bunker
+		merged.Nsec = ""
+		merged.Npub = p.Npub
+	} else if p.Nsec != "" {
+		merged.Nsec = p.Nsec
+		merged.Bunker = ""
+		merged.Npub = p.Npub
+	} else if p.Npub != "" {
+		merged.Npub = p.Npub
+	}
+	if len(p.Relays) > 0 {
+		merged.Relays = p.Relays
+	}
+	if p.Rules != nil {
+		merged.Rules = p.Rules
+	}
+	if p.Private != nil {
+		merged.Private = *p.Private
+	}
+	if p.Sinks != nil {
+		merged.Sinks = p.Sinks
+	}
+	return merged
+}
+
+type compiledProfileSelector struct {
+	ProfileSelector
+	path       *regexp.Regexp
+	start, end int // minutes since midnight
+}
+
+func compileProfileSelectors(config Config) ([]compiledProfileSelector, error) {
+	var selectors []compiledProfileSelector
+	for i, selector := range config.ProfileSelect {
+		if _, err := config.Profile(selector.Profile); err != nil {
+			return nil, fmt.Errorf("profile_select[%d]: %w", i, err)
+		}
+
+		c := compiledProfileSelector{ProfileSelector: selector, start: -1}
+		if selector.Path != "" {
+			re, err := globToRegexp(selector.Path)
+			if err != nil {
+				return nil, fmt.Errorf("profile_select[%d]: invalid path glob: %w", i, err)
+			}
+			c.path = re
+		}
+		if selector.Hours != "" {
+			start, end, err := parseHours(selector.Hours)
+			if err != nil {
+				return nil, fmt.Errorf("profile_select[%d]: %w", i, err)
+			}
+			c.start, c.end = start, end
+		}
+		selectors = append(selectors, c)
+	}
+	return selectors, nil
+}
+
+// parseHours parses "HH:MM-HH:MM" into minutes since midnight.
+func parseHours(hours string) (int, int, error) {
+	var h1, m1, h2, m2 int
+	if _, err := fmt.Sscanf(hours, "%d:%d-%d:%d", &h1, &m1, &h2, &m2); err != nil {
+		return 0, 0, fmt.Errorf("invalid hours %q, expected HH:MM-HH:MM", hours)
+	}
+	for _, v := range []int{h1, h2} {
+		if v < 0 || v > 24 {
+			return 0, 0, fmt.Errorf("invalid hours %q", hours)
+		}
+	}
+	for _, v := range []int{m1, m2} {
+		if v < 0 || v > 59 {
+			return 0, 0, fmt.Errorf("invalid hours %q", hours)
+		}
+	}
+	return h1*60 + m1, h2*60 + m2, nil
+}
+
+func (s compiledProfileSelector) matches(scrobble ScrobbleEvent, now time.Time) bool {
+	if s.path != nil && !s.path.MatchString(filepath.ToSlash(scrobble.Path)) {
+		return false
+	}
+	if s.start >= 0 {
+		minute := now.Hour()*60 + now.Minute()
+		if s.start <= s.end {
+			if minute < s.start || minute >= s.end {
+				return false
+			}
+		} else if minute < s.start && minute >= s.end {
+			return false
+		}
+	}
+	return true
+}
+
+// scrobbleTarget is where scrobbles for one profile go.
+type scrobbleTarget struct {
+	profile string
+	config  Config
+	nostr   *Nostr
+	rules   *RuleSet
+}
+
+// profileTargets connects to profiles as they are first needed and picks
+// the profile for each track.
+type profileTargets struct {
+	config    Config
+	fixed     string
+	selectors []compiledProfileSelector
+	targets   map[string]*scrobbleTarget
+	// retired are clients of profiles whose keys or relays changed on a
+	// reload. They stay open for scrobbles still queued on them.
+	retired []*Nostr
+	// initial is the client the targets were created with, which the
+	// caller owns.
+	initial *Nostr
+}
+
+// newProfileTargets returns targets for config. If profile is set, every
+// scrobble goes to it; otherwise profile_select picks one per track, falling
+// back to the default profile. nostrClient is the already connected client
+// for profile (or the default profile).
+func newProfileTargets(config Config, profile string, nostrClient *Nostr) (*profileTargets, error) {
+	if profile == "" {
+		profile = DefaultProfile
+	}
+
+	t := &profileTargets{
+		config:  config,
+		targets: make(map[string]*scrobbleTarget),
+		initial: nostrClient,
+	}
+	if profile != DefaultProfile || len(config.ProfileSelect) == 0 {
+		t.fixed = profile
+	} else {
+		selectors, err := compileProfileSelectors(config)
+		if err != nil {
+			return nil, err
+		}
+		t.selectors = selectors
+	}
+
+	target, err := t.newTarget(profile, nostrClient)
+	if err != nil {
+		return nil, err
+	}
+	t.targets[profile] = target
+	return t, nil
+}
+
+func (t *profileTargets) newTarget(profile string, nostrClient *Nostr) (*scrobbleTarget, error) {
+	config, err := t.config.Profile(profile)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := compileRules(config.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %w", profile, err)
+	}
+	if nostrClient == nil {
+		if nostrClient, err = connectNostr(config); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", profile, err)
+		}
+	}
+	return &scrobbleTarget{profile: profile, config: config, nostr: nostrClient, rules: rules}, nil
+}
+
+// forTrack returns the target for scrobble, connecting to it if needed.
+func (t *profileTargets) forTrack(scrobble ScrobbleEvent, now time.Time) (*scrobbleTarget, error) {
+	profile := t.fixed
+	if profile == "" {
+		profile = DefaultProfile
+		for _, selector := range t.selectors {
+			if selector.matches(scrobble, now) {
+				profile = selector.Profile
+				break
+			}
+		}
+	}
+	return t.forProfile(profile)
+}
+
+// forProfile returns the target for profile, connecting to it if needed.
+func (t *profileTargets) forProfile(profile string) (*scrobbleTarget, error) {
+	if target, ok := t.targets[profile]; ok {
+		return target, nil
+	}
+	target, err := t.newTarget(profile, nil)
+	if err != nil {
+		return nil, err
+	}
+	t.targets[profile] = target
+	return target, nil
+}
+
+// prepare picks the target for scrobble and applies its rules and privacy
+// setting. publish is false when a rule skips the scrobble.
+func (t *profileTargets) prepare(scrobble ScrobbleEvent, now time.Time) (target *scrobbleTarget, result ScrobbleEvent, rule *Rule, publish bool, err error) {
+	target, err = t.forTrack(scrobble, now)
+	if err != nil {
+		return nil, scrobble, nil, false, err
+	}
+
+	result, rule, publish = target.rules.Apply(scrobble)
+	if target.config.Private {
+		result.Private = true
+	}
+	return target, result, rule, publish, nil
+}
+
+// replace switches t to the config of next, a fresh newProfileTargets for
+// the reloaded config. Connections are kept for profiles whose key and
+// relays are unchanged.
+func (t *profileTargets) replace(next *profileTargets) error {
+	targets := make(map[string]*scrobbleTarget)
+	for profile, target := range t.targets {
+		config, err := next.config.Profile(profile)
+		if err == nil && config.Nsec == target.config.Nsec && config.Bunker == target.config.Bunker && slices.Equal(config.Relays, target.config.Relays) {
+			if targets[profile], err = next.newTarget(profile, target.nostr); err != nil {
+				return err
+			}
+			continue
+		}
+		t.retired = append(t.retired, target.nostr)
+	}
+	for profile, target := range next.targets {
+		kept, ok := targets[profile]
+		switch {
+		case !ok:
+			targets[profile] = target
+		case target.nostr != kept.nostr && target.nostr != t.initial:
+			// next connected to a profile whose old client is kept.
+			target.nostr.Close()
+		}
+	}
+
+	t.config = next.config
+	t.fixed = next.fixed
+	t.selectors = next.selectors
+	t.targets = targets
+	return nil
+}
+
+// closeRetired closes the retired clients that no queued scrobble uses any
+// more.
+func (t *profileTargets) closeRetired(inUse func(n *Nostr) bool) {
+	var retired []*Nostr
+	for _, n := range t.retired {
+		switch {
+		case n == t.initial:
+			// Not ours to close.
+		case inUse(n):
+			retired = append(retired, n)
+		default:
+			n.Close()
+		}
+	}
+	t.retired = retired
+}
+
+// Close closes connections opened for profiles other than the initial one.
+func (t *profileTargets) Close(keep *Nostr) {
+	for _, target := range t.targets {
+		if target.nostr != keep {
+			target.nostr.Close()
+		}
+	}
+	for _, n := range t.retired {
+		if n != keep {
+			n.Close()
+		}
+	}
+}
+
+// forEachProfile calls fn with a connected client for every profile. The
+// client already in ctx is reused for the selected profile.
+func forEachProfile(ctx *cliContext, fn func(profile string, n *Nostr) error) error {
+	current := ctx.profile
+	if current == "" {
+		current = DefaultProfile
+	}
+
+	for _, name := range ctx.rawConfig.ProfileNames() {
+		if name == current {
+			if err := fn(name, ctx.nostr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		config, err := ctx.rawConfig.Profile(name)
+		if err != nil {
+			return err
+		}
+		n, err := connectNostr(config)
+		if err != nil {
+			fmt.Printf("Skipping profile %s: %v\n", name, err)
+			continue
+		}
+		err = fn(name, n)
+		n.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
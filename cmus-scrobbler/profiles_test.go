@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigProfileInheritsTopLevel(t *testing.T) {
+	private := true
+	config := Config{
+		Nsec:   "nsec-default",
+		Relays: []string{"wss://default.example.com"},
+		Rules:  []Rule{{Name: "default rule"}},
+		Profiles: map[string]Profile{
+			"work": {Nsec: "nsec-work", Private: &private},
+		},
+	}
+
+	work, err := config.Profile("work")
+	if err != nil {
+		t.Fatalf("Profile: %v", err)
+	}
+	if work.Nsec != "nsec-work" || !work.Private {
+		t.Errorf("profile values not applied: %+v", work)
+	}
+	if len(work.Relays) != 1 || work.Relays[0] != "wss://default.example.com" || len(work.Rules) != 1 {
+		t.Errorf("top-level values not inherited: %+v", work)
+	}
+
+	if _, err := config.Profile("missing"); err == nil {
+		t.Error("expected error for unknown profile")
+	}
+}
+
+func TestProfileSelectors(t *testing.T) {
+	config := Config{
+		Profiles: map[string]Profile{"work": {}, "night": {}},
+		ProfileSelect: []ProfileSelector{
+			{Profile: "work", Path: "**/work/**"},
+			{Profile: "night", Hours: "22:00-06:00"},
+		},
+	}
+	selectors, err := compileProfileSelectors(config)
+	if err != nil {
+		t.Fatalf("compileProfileSelectors: %v", err)
+	}
+	targets := &profileTargets{config: config, selectors: selectors}
+
+	pick := func(path string, hour int) string {
+		now := time.Date(2024, 1, 1, hour, 30, 0, 0, time.Local)
+		for _, s := range targets.selectors {
+			if s.matches(ScrobbleEvent{Path: path}, now) {
+				return s.Profile
+			}
+		}
+		return DefaultProfile
+	}
+
+	if got := pick("/music/work/focus.flac", 23); got != "work" {
+		t.Errorf("work path picked %q", got)
+	}
+	if got := pick("/music/home/song.flac", 23); got != "night" {
+		t.Errorf("late night picked %q", got)
+	}
+	if got := pick("/music/home/song.flac", 3); got != "night" {
+		t.Errorf("early morning picked %q", got)
+	}
+	if got := pick("/music/home/song.flac", 12); got != DefaultProfile {
+		t.Errorf("midday picked %q", got)
+	}
+}
+
+func TestLoadConfigValidatesProfiles(t *testing.T) {
+	nsec, _, _ := generateKey()
+	path := writeTestConfig(t, `nsec: `+nsec+`
+relays:
+  - wss://relay.example.com
+profiles:
+  work:
+    relays:
+      - http://wrong.example.com
+profile_select:
+  - profile: nope
+`)
+
+	_, err := LoadConfig(path)
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{path + ":7: profiles.work.relays[0]", `unknown profile "nope"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestProfileBunker(t *testing.T) {
+	nsec, npub, _ := generateKey()
+	_, workNpub, _ := generateKey()
+	bunker := "bunker://" + strings.Repeat("ab", 32) + "?relay=wss://relay.example.com"
+	config := Config{
+		Nsec:   nsec,
+		Npub:   npub,
+		Relays: []string{"wss://relay.example.com"},
+		Profiles: map[string]Profile{
+			"work": {Bunker: bunker, Npub: workNpub},
+		},
+	}
+	work, _ := config.Profile("work")
+	if work.Nsec != "" || work.Bunker != bunker || work.Npub != workNpub {
+		t.Errorf("bunker profile merged as %+v", work)
+	}
+
+	path := writeTestConfig(t, `nsec: `+nsec+`
+relays:
+  - wss://relay.example.com
+profiles:
+  work:
+    bunker: `+bunker+`
+  home:
+    bunker: https://example.com
+    npub: `+workNpub+`
+`)
+	_, err := LoadConfig(path)
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{path + ":6: profiles.work.bunker: needs npub", path + ":8: profiles.home.bunker: must be a bunker:// URL"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestCloseRetired(t *testing.T) {
+	initial, queued, idle := newTestNostr(t), newTestNostr(t), newTestNostr(t)
+	targets := &profileTargets{initial: initial, retired: []*Nostr{initial, queued, idle}}
+
+	targets.closeRetired(func(n *Nostr) bool { return n == queued })
+	if len(targets.retired) != 1 || targets.retired[0] != queued {
+		t.Errorf("retired = %v, want only the client with queued scrobbles", targets.retired)
+	}
+	if !idle.closed.Load() || queued.closed.Load() || initial.closed.Load() {
+		t.Errorf("closed: idle %v, queued %v, initial %v", idle.closed.Load(), queued.closed.Load(), initial.closed.Load())
+	}
+
+	targets.closeRetired(func(n *Nostr) bool { return false })
+	if len(targets.retired) != 0 || !queued.closed.Load() {
+		t.Error("client kept after its queue emptied")
+	}
+}
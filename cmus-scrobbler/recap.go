@@ -0,0 +1,521 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// KindRecap is an addressable listening summary for a period, with the
+// period as its d tag. It mirrors the scrobble kind 2002.
+const KindRecap = 32002
+
+// recapTop is the length of each top list in a recap.
+const recapTop = 5
+
+// RecapConfig makes run prepare recaps by itself.
+type RecapConfig struct {
+	// Periods lists the recaps to prepare when a period ends: week, month
+	// or year. Each is written as a draft to review and publish with
+	// recap -publish.
+	Periods []string `yaml:"periods"`
+	// AutoPublish publishes them right away instead, without review.
+	AutoPublish bool `yaml:"auto_publish"`
+}
+
+// recapPeriod is a calendar week (Monday to Sunday), month or year in
+// local time. End is exclusive.
+type recapPeriod struct {
+	Name  string
+	Start time.Time
+	End   time.Time
+}
+
+func validRecapPeriod(name string) bool {
+	return name == "week" || name == "month" || name == "year"
+}
+
+// recapPeriodAt returns the period of the given kind that contains t.
+func recapPeriodAt(name string, t time.Time) (recapPeriod, error) {
+	t = t.Local()
+	year, month, day := t.Date()
+	p := recapPeriod{Name: name}
+	switch name {
+	case "week":
+		offset := (int(t.Weekday()) + 6) % 7
+		p.Start = time.Date(year, month, day-offset, 0, 0, 0, 0, time.Local)
+		p.End = p.Start.AddDate(0, 0, 7)
+	case "month":
+		p.Start = time.Date(year, month, 1, 0, 0, 0, 0, time.Local)
+		p.End = p.Start.AddDate(0, 1, 0)
+	case "year":
+		p.Start = time.Date(year, 1, 1, 0, 0, 0, 0, time.Local)
+		p.End = p.Start.AddDate(1, 0, 0)
+	default:
+		return recapPeriod{}, fmt.Errorf("unknown recap period %q, use week, month or year", name)
+	}
+	return p, nil
+}
+
+// Previous is the period before p.
+func (p recapPeriod) Previous() recapPeriod {
+	prev, _ := recapPeriodAt(p.Name, p.Start.Add(-time.Hour))
+	return prev
+}
+
+// Label identifies the period, e.g. 2024-W07, 2024-02 or 2024.
+func (p recapPeriod) Label() string {
+	switch p.Name {
+	case "week":
+		year, week := p.Start.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case "month":
+		return p.Start.Format("2006-01")
+	}
+	return p.Start.Format("2006")
+}
+
+// Title names the period in prose.
+func (p recapPeriod) Title() string {
+	switch p.Name {
+	case "week":
+		year, week := p.Start.ISOWeek()
+		return fmt.Sprintf("week %d of %d", week, year)
+	case "month":
+		return p.Start.Format("January 2006")
+	}
+	return p.Start.Format("2006")
+}
+
+// DTag is the d tag of the period's summary event.
+func (p recapPeriod) DTag() string {
+	return p.Name + ":" + p.Label()
+}
+
+// recapPlay is one scrobble as the recap sees it.
+type recapPlay struct {
+	ID      string
+	At      time.Time
+	Artist  string
+	Album   string
+	Track   string
+	Private bool
+}
+
+// Recap summarises the public scrobbles of a period.
+type Recap struct {
+	Period      recapPeriod
+	Plays       int
+	Artists     []countEntry
+	Albums      []countEntry
+	Tracks      []countEntry
+	Discoveries []countEntry
+	// Streak is the longest run of days in the period with plays.
+	Streak      int
+	StreakStart time.Time
+	// TopTrackEvent is the latest scrobble of the most played track.
+	TopTrackEvent string
+}
+
+// computeRecap summarises the plays in period. plays may include earlier
+// ones, which decide what counts as a discovery: an artist first played in
+// the period. Private plays count as earlier listens but are otherwise left
+// out, since the recap is public.
+func computeRecap(period recapPeriod, plays []recapPlay) Recap {
+	r := Recap{Period: period}
+	firstPlayed := make(map[string]time.Time)
+	artists := make(map[string]int)
+	albums := make(map[string]int)
+	tracks := make(map[string]int)
+	trackEvents := make(map[string]recapPlay)
+	days := make(map[string]bool)
+
+	for _, play := range plays {
+		if first, ok := firstPlayed[play.Artist]; !ok || play.At.Before(first) {
+			firstPlayed[play.Artist] = play.At
+		}
+		if play.Private || play.At.Before(period.Start) || !play.At.Before(period.End) {
+			continue
+		}
+
+		r.Plays++
+		artists[play.Artist]++
+		if play.Album != "" {
+			albums[fmt.Sprintf("%s - %s", play.Artist, play.Album)]++
+		}
+		track := fmt.Sprintf("%s - %s", play.Artist, play.Track)
+		tracks[track]++
+		if latest, ok := trackEvents[track]; !ok || play.At.After(latest.At) {
+			trackEvents[track] = play
+		}
+		days[play.At.Local().Format("2006-01-02")] = true
+	}
+
+	r.Artists = topCounts(artists, recapTop)
+	r.Albums = topCounts(albums, recapTop)
+	r.Tracks = topCounts(tracks, recapTop)
+	if len(r.Tracks) > 0 {
+		r.TopTrackEvent = trackEvents[r.Tracks[0].Name].ID
+	}
+
+	discoveries := make(map[string]int)
+	for artist, count := range artists {
+		if !firstPlayed[artist].Before(period.Start) {
+			discoveries[artist] = count
+		}
+	}
+	r.Discoveries = topCounts(discoveries, recapTop)
+
+	run := 0
+	for day := period.Start; day.Before(period.End); day = day.AddDate(0, 0, 1) {
+		if !days[day.Format("2006-01-02")] {
+			run = 0
+			continue
+		}
+		run++
+		if run > r.Streak {
+			r.Streak = run
+			r.StreakStart = day.AddDate(0, 0, 1-run)
+		}
+	}
+	return r
+}
+
+// recapSummary is the content of the summary event.
+type recapSummary struct {
+	Period        string       `json:"period"`
+	Label         string       `json:"label"`
+	Start         int64        `json:"start"`
+	End           int64        `json:"end"`
+	Plays         int          `json:"plays"`
+	TopArtists    []countEntry `json:"top_artists"`
+	TopAlbums     []countEntry `json:"top_albums"`
+	TopTracks     []countEntry `json:"top_tracks"`
+	Discoveries   []countEntry `json:"discoveries"`
+	LongestStreak int          `json:"longest_streak_days"`
+	StreakStart   string       `json:"longest_streak_start,omitempty"`
+}
+
+func recapSummaryEvent(r Recap) nostr.Event {
+	summary := recapSummary{
+		Period:        r.Period.Name,
+		Label:         r.Period.Label(),
+		Start:         r.Period.Start.Unix(),
+		End:           r.Period.End.Unix(),
+		Plays:         r.Plays,
+		TopArtists:    r.Artists,
+		TopAlbums:     r.Albums,
+		TopTracks:     r.Tracks,
+		Discoveries:   r.Discoveries,
+		LongestStreak: r.Streak,
+	}
+	if r.Streak > 0 {
+		summary.StreakStart = r.StreakStart.Format("2006-01-02")
+	}
+	content, _ := json.Marshal(summary)
+
+	return nostr.Event{
+		Kind:      KindRecap,
+		CreatedAt: nostr.Now(),
+		Content:   string(content),
+		Tags: nostr.Tags{
+			{"d", r.Period.DTag()},
+			{"period", r.Period.Name},
+			{"start", strconv.FormatInt(summary.Start, 10)},
+			{"end", strconv.FormatInt(summary.End, 10)},
+			{"plays", strconv.Itoa(r.Plays)},
+			{"alt", "Listening recap for " + r.Period.Title()},
+		},
+	}
+}
+
+// recapText renders the recap as a note. nevent and naddr are the nostr:
+// references to the top track's latest scrobble and to the summary event;
+// either may be empty.
+func recapText(r Recap, nevent, naddr string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "My %s in music: %d plays\n", r.Period.Title(), r.Plays)
+
+	writeTop := func(title string, entries []countEntry) {
+		if len(entries) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "\n%s\n", title)
+		for i, entry := range entries {
+			fmt.Fprintf(&b, "%d. %s (%d)\n", i+1, entry.Name, entry.Count)
+		}
+	}
+	writeTop("Top artists", r.Artists)
+	writeTop("Top albums", r.Albums)
+	writeTop("Top tracks", r.Tracks)
+
+	if len(r.Discoveries) > 0 {
+		names := make([]string, len(r.Discoveries))
+		for i, entry := range r.Discoveries {
+			names[i] = entry.Name
+		}
+		fmt.Fprintf(&b, "\nNew discoveries: %s\n", strings.Join(names, ", "))
+	}
+	if r.Streak > 1 {
+		fmt.Fprintf(&b, "Longest streak: %d days in a row from %s\n", r.Streak, r.StreakStart.Format("Jan 2"))
+	}
+	if nevent != "" {
+		fmt.Fprintf(&b, "\nMost played:\nnostr:%s\n", nevent)
+	}
+	if naddr != "" {
+		fmt.Fprintf(&b, "\nnostr:%s\n", naddr)
+	}
+	b.WriteString("\n#music #recap")
+	return b.String()
+}
+
+// recapNoteEvent is the kind 1 note announcing r, referencing the top
+// track's scrobble and the summary event.
+func (n *Nostr) recapNoteEvent(r Recap) nostr.Event {
+	var hints []string
+	if len(n.relays) > 0 {
+		hints = []string{n.relays[0].URL}
+	}
+
+	summaryAddr := addressOf(KindRecap, n.pk, r.Period.DTag())
+	naddr, _ := nip19.EncodeEntity(n.pk, KindRecap, r.Period.DTag(), hints)
+	tags := nostr.Tags{
+		{"a", summaryAddr},
+		{"t", "music"},
+		{"t", "recap"},
+	}
+	var nevent string
+	if r.TopTrackEvent != "" {
+		nevent, _ = nip19.EncodeEvent(r.TopTrackEvent, hints, n.pk)
+		tags = append(tags, nostr.Tag{"q", r.TopTrackEvent})
+	}
+
+	return nostr.Event{
+		Kind:      1,
+		CreatedAt: nostr.Now(),
+		Content:   recapText(r, nevent, naddr),
+		Tags:      tags,
+	}
+}
+
+// BuildRecap reads the history up to the end of period and summarises it.
+func (n *Nostr) BuildRecap(period recapPeriod) (Recap, error) {
+	var plays []recapPlay
+	until := nostr.Timestamp(period.End.Unix() - 1)
+	err := n.WalkHistory(0, until, func(ev *nostr.Event) error {
+		scrobble, err := n.ScrobbleFromEvent(ev)
+		if err != nil || scrobble.Artist == "" || scrobble.Track == "" {
+			return nil
+		}
+		plays = append(plays, recapPlay{
+			ID:      ev.ID,
+			At:      ev.CreatedAt.Time(),
+			Artist:  scrobble.Artist,
+			Album:   scrobble.Album,
+			Track:   scrobble.Track,
+			Private: scrobble.Private,
+		})
+		return nil
+	})
+	if err != nil {
+		return Recap{}, fmt.Errorf("error reading history: %w", err)
+	}
+	sort.Slice(plays, func(i, j int) bool { return plays[i].At.Before(plays[j].At) })
+	return computeRecap(period, plays), nil
+}
+
+// PublishRecap publishes the summary event of r and, if it is new or has
+// changed, the note. It returns false if the relays already had the same
+// summary.
+func (n *Nostr) PublishRecap(r Recap, current *nostr.Event) (bool, error) {
+	summary := recapSummaryEvent(r)
+	changed, err := n.publishIfChanged(&summary, current, false)
+	if err != nil || !changed {
+		return false, err
+	}
+
+	note := n.recapNoteEvent(r)
+	if err := n.sign(&note); err != nil {
+		return false, err
+	}
+	results := n.PublishEventResults(&note)
+	if !anyPublished(results) {
+		logPublishResults(&note, results)
+		return false, fmt.Errorf("no relay accepted the recap note")
+	}
+	return true, nil
+}
+
+// currentRecap returns the published summary event for period, if any.
+func (n *Nostr) currentRecap(period recapPeriod) (*nostr.Event, error) {
+	found, err := n.QueryAddressable(KindRecap, []string{period.DTag()})
+	if err != nil {
+		return nil, err
+	}
+	return found[period.DTag()], nil
+}
+
+// autoRecap handles a finished period unless its recap is on the relays
+// already: with publish it publishes the recap, otherwise it writes a draft
+// for review.
+func (n *Nostr) autoRecap(period recapPeriod, publish bool) error {
+	current, err := n.currentRecap(period)
+	if err != nil || current != nil {
+		return err
+	}
+	r, err := n.BuildRecap(period)
+	if err != nil || r.Plays == 0 {
+		return err
+	}
+	if !publish {
+		return n.writeRecapDraft(r)
+	}
+	slog.Info("publishing recap", "period", period.DTag(), "plays", r.Plays, "text", recapText(r, "", ""))
+	_, err = n.PublishRecap(r, nil)
+	return err
+}
+
+// recapDraftPath is where the draft of the recap for period is written.
+func (n *Nostr) recapDraftPath(period recapPeriod) (string, error) {
+	return stateFilePath(filepath.Join("recaps", n.pk, strings.ReplaceAll(period.DTag(), ":", "-")+".txt"))
+}
+
+// writeRecapDraft writes the note of r to its draft file and logs how to
+// publish it. A draft written before is left as it is.
+func (n *Nostr) writeRecapDraft(r Recap) error {
+	path, err := n.recapDraftPath(r.Period)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating recap draft directory: %w", err)
+	}
+	note := n.recapNoteEvent(r)
+	if err := os.WriteFile(path, []byte(note.Content+"\n"), 0600); err != nil {
+		return fmt.Errorf("error writing recap draft: %w", err)
+	}
+	slog.Info("recap ready for review", "period", r.Period.DTag(), "draft", path,
+		"publish", fmt.Sprintf("cmus-scrobbler recap -period %s -date %s -publish", r.Period.Name, r.Period.Start.Format("2006-01-02")))
+	return nil
+}
+
+// recapEvery drafts or publishes the recap of each period in config once
+// it has ended, checking every hour until stop is closed.
+func recapEvery(n *Nostr, config RecapConfig, stop <-chan struct{}) {
+	done := make(map[string]string)
+	check := func() {
+		for _, name := range config.Periods {
+			current, err := recapPeriodAt(name, time.Now())
+			if err != nil {
+				continue
+			}
+			period := current.Previous()
+			if done[name] == period.Label() {
+				continue
+			}
+			if err := n.autoRecap(period, config.AutoPublish); err != nil {
+				slog.Error("error preparing recap", "period", name, "err", err)
+				continue
+			}
+			done[name] = period.Label()
+		}
+	}
+
+	check()
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
+
+// cmdRecap previews the recap of a period and publishes it with -publish.
+func cmdRecap(ctx *cliContext, args []string) error {
+	fs := flag.NewFlagSet("recap", flag.ExitOnError)
+	periodName := fs.String("period", "week", "Period to summarise: week, month or year")
+	date := fs.String("date", "", "A date in the period (default: the last finished period)")
+	publish := fs.Bool("publish", false, "Publish the recap after the preview")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	fs.Parse(args)
+
+	var period recapPeriod
+	var err error
+	if *date != "" {
+		t, err := parseDate(*date)
+		if err != nil {
+			return fmt.Errorf("invalid -date: %w", err)
+		}
+		period, err = recapPeriodAt(*periodName, t)
+		if err != nil {
+			return err
+		}
+	} else {
+		period, err = recapPeriodAt(*periodName, time.Now())
+		if err != nil {
+			return err
+		}
+		period = period.Previous()
+	}
+
+	r, err := ctx.nostr.BuildRecap(period)
+	if err != nil {
+		return err
+	}
+	if r.Plays == 0 {
+		fmt.Printf("No public scrobbles in %s.\n", period.Title())
+		return nil
+	}
+
+	note := ctx.nostr.recapNoteEvent(r)
+	fmt.Printf("Recap for %s (%s to %s):\n\n%s\n\n", period.Title(),
+		period.Start.Format("2006-01-02"), period.End.AddDate(0, 0, -1).Format("2006-01-02"), note.Content)
+	if period.End.After(time.Now()) {
+		fmt.Println("This period hasn't ended yet.")
+	}
+	if !*publish {
+		fmt.Println("Run with -publish to publish this recap.")
+		return nil
+	}
+
+	current, err := ctx.nostr.currentRecap(period)
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		fmt.Println("A recap for this period was published before; publishing replaces its summary.")
+	}
+	if !*yes && !confirm("Publish?") {
+		return nil
+	}
+	published, err := ctx.nostr.PublishRecap(r, current)
+	if err != nil {
+		return err
+	}
+	if !published {
+		fmt.Println("The published recap is already up to date.")
+		return nil
+	}
+	if path, err := ctx.nostr.recapDraftPath(period); err == nil {
+		os.Remove(path)
+	}
+	fmt.Println("Recap published.")
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecapPeriodAt(t *testing.T) {
+	// A Wednesday.
+	at := time.Date(2024, 2, 14, 18, 30, 0, 0, time.Local)
+
+	tests := []struct {
+		name, label, start, end string
+	}{
+		{"week", "2024-W07", "2024-02-12", "2024-02-19"},
+		{"month", "2024-02", "2024-02-01", "2024-03-01"},
+		{"year", "2024", "2024-01-01", "2025-01-01"},
+	}
+	for _, tt := range tests {
+		p, err := recapPeriodAt(tt.name, at)
+		if err != nil {
+			t.Fatalf("recapPeriodAt(%s): %v", tt.name, err)
+		}
+		if p.Label() != tt.label || p.Start.Format("2006-01-02") != tt.start || p.End.Format("2006-01-02") != tt.end {
+			t.Errorf("%s period = %s from %s to %s, want %s from %s to %s", tt.name,
+				p.Label(), p.Start.Format("2006-01-02"), p.End.Format("2006-01-02"), tt.label, tt.start, tt.end)
+		}
+	}
+
+	week, _ := recapPeriodAt("week", at)
+	if prev := week.Previous(); prev.Label() != "2024-W06" || !prev.End.Equal(week.Start) {
+		t.Errorf("previous week = %s ending %v", prev.Label(), prev.End)
+	}
+	if _, err := recapPeriodAt("decade", at); err == nil {
+		t.Error("recapPeriodAt accepted an unknown period")
+	}
+}
+
+func TestComputeRecap(t *testing.T) {
+	period, _ := recapPeriodAt("week", time.Date(2024, 2, 14, 12, 0, 0, 0, time.Local))
+	day := func(d, hour int) time.Time {
+		return time.Date(2024, 2, d, hour, 0, 0, 0, time.Local)
+	}
+	plays := []recapPlay{
+		// Before the period: Low is not new.
+		{ID: "old", At: day(1, 12), Artist: "Low", Track: "Words"},
+		// Heard privately before, so not a discovery either.
+		{ID: "priv-old", At: day(2, 12), Artist: "Stereolab", Track: "French Disko", Private: true},
+		{ID: "a", At: day(12, 10), Artist: "Low", Track: "Words", Album: "I Could Live in Hope"},
+		{ID: "b", At: day(13, 10), Artist: "Low", Track: "Words", Album: "I Could Live in Hope"},
+		{ID: "c", At: day(13, 11), Artist: "Broadcast", Track: "Black Cat"},
+		{ID: "d", At: day(14, 10), Artist: "Stereolab", Track: "French Disko"},
+		{ID: "e", At: day(16, 10), Artist: "Broadcast", Track: "Echo's Answer"},
+		{ID: "f", At: day(16, 11), Artist: "Grouper", Track: "Heavy Water", Private: true},
+		// After the period.
+		{ID: "later", At: day(19, 10), Artist: "Low", Track: "Words"},
+	}
+
+	r := computeRecap(period, plays)
+	if r.Plays != 5 {
+		t.Errorf("plays = %d, want 5", r.Plays)
+	}
+	if len(r.Tracks) == 0 || r.Tracks[0].Name != "Low - Words" || r.Tracks[0].Count != 2 {
+		t.Errorf("top tracks = %v", r.Tracks)
+	}
+	if r.TopTrackEvent != "b" {
+		t.Errorf("top track event = %q, want the latest play b", r.TopTrackEvent)
+	}
+	if len(r.Albums) != 1 || r.Albums[0].Name != "Low - I Could Live in Hope" {
+		t.Errorf("top albums = %v", r.Albums)
+	}
+	if len(r.Discoveries) != 1 || r.Discoveries[0].Name != "Broadcast" || r.Discoveries[0].Count != 2 {
+		t.Errorf("discoveries = %v, want only Broadcast", r.Discoveries)
+	}
+	if r.Streak != 3 || !r.StreakStart.Equal(day(12, 0)) {
+		t.Errorf("streak = %d from %v, want 3 from Feb 12", r.Streak, r.StreakStart)
+	}
+}
+
+func TestRecapEvents(t *testing.T) {
+	period, _ := recapPeriodAt("month", time.Date(2024, 2, 14, 12, 0, 0, 0, time.Local))
+	r := Recap{
+		Period:      period,
+		Plays:       3,
+		Artists:     []countEntry{{Name: "Low", Count: 3}},
+		Tracks:      []countEntry{{Name: "Low - Words", Count: 3}},
+		Streak:      2,
+		StreakStart: time.Date(2024, 2, 3, 0, 0, 0, 0, time.Local),
+	}
+
+	summary := recapSummaryEvent(r)
+	if summary.Kind != KindRecap || summary.Tags.GetD() != "month:2024-02" {
+		t.Errorf("summary kind %d, d %q", summary.Kind, summary.Tags.GetD())
+	}
+	var content recapSummary
+	if err := json.Unmarshal([]byte(summary.Content), &content); err != nil {
+		t.Fatalf("summary content: %v", err)
+	}
+	if content.Plays != 3 || content.TopArtists[0].Name != "Low" || content.StreakStart != "2024-02-03" {
+		t.Errorf("summary content = %+v", content)
+	}
+
+	again := recapSummaryEvent(r)
+	again.CreatedAt += 10
+	if !sameEventContent(&summary, &again) {
+		t.Error("the same recap gives a different summary, so it would be republished")
+	}
+
+	text := recapText(r, "nevent1abc", "naddr1xyz")
+	for _, want := range []string{"My February 2024 in music: 3 plays", "1. Low - Words (3)", "2 days in a row", "nostr:nevent1abc", "nostr:naddr1xyz"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("recap text is missing %q:\n%s", want, text)
+		}
+	}
+}
+
+func TestWriteRecapDraft(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	n := newTestNostr(t)
+	period, _ := recapPeriodAt("week", time.Date(2024, 2, 14, 12, 0, 0, 0, time.Local))
+	r := Recap{Period: period, Plays: 3, Tracks: []countEntry{{Name: "Low - Words", Count: 3}}}
+
+	if err := n.writeRecapDraft(r); err != nil {
+		t.Fatalf("writeRecapDraft: %v", err)
+	}
+	path, err := n.recapDraftPath(period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(path, "week-2024-W07.txt") {
+		t.Errorf("draft path = %s", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), "1. Low - Words (3)") {
+		t.Errorf("draft = %q, %v", data, err)
+	}
+
+	// A draft that was already written is kept.
+	if err := os.WriteFile(path, []byte("edited"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r.Plays = 4
+	if err := n.writeRecapDraft(r); err != nil {
+		t.Fatalf("writeRecapDraft: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "edited" {
+		t.Errorf("draft overwritten: %q", data)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	RuleActionSkip    = "skip"
+	RuleActionRewrite = "rewrite"
+	RuleActionPrivate = "private"
+)
+
+// Rule skips or rewrites scrobbles. Every condition that is set must match
+// for the rule to apply; the first matching rule wins.
+type Rule struct {
+	Name        string            `yaml:"name"`
+	Artist      string            `yaml:"artist"`
+	Album       string            `yaml:"album"`
+	Title       string            `yaml:"title"`
+	Path        string            `yaml:"path"`
+	Genre       string            `yaml:"genre"`
+	MinDuration int               `yaml:"min_duration"`
+	Action      string            `yaml:"action"`
+	Set         map[string]string `yaml:"set"`
+	Private     bool              `yaml:"private"`
+}
+
+type compiledRule struct {
+	Rule
+	artist *regexp.Regexp
+	album  *regexp.Regexp
+	title  *regexp.Regexp
+	path   *regexp.Regexp
+	genre  *regexp.Regexp
+}
+
+// RuleSet is the compiled form of the rules section of the config.
+type RuleSet struct {
+	rules []compiledRule
+}
+
+func compileRules(rules []Rule) (*RuleSet, error) {
+	set := &RuleSet{}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if rule.Action == "" {
+			rule.Action = RuleActionSkip
+		}
+		if rule.Action != RuleActionSkip && rule.Action != RuleActionRewrite && rule.Action != RuleActionPrivate {
+			return nil, fmt.Errorf("%s: unknown action %q", rule.Name, rule.Action)
+		}
+		if rule.Action == RuleActionRewrite && len(rule.Set) == 0 {
+			return nil, fmt.Errorf("%s: rewrite rules need a set section", rule.Name)
+		}
+		for key := range rule.Set {
+			if key != "artist" && key != "album" && key != "title" {
+				return nil, fmt.Errorf("%s: cannot set %q", rule.Name, key)
+			}
+		}
+		// A rule without conditions matches every track, which is never
+		// what was meant; a misspelled condition is ignored by the config
+		// loader and would leave one.
+		if rule.Artist == "" && rule.Album == "" && rule.Title == "" && rule.Path == "" && rule.Genre == "" && rule.MinDuration == 0 {
+			return nil, fmt.Errorf("%s: needs at least one of artist, album, title, path, genre or min_duration", rule.Name)
+		}
+
+		c := compiledRule{Rule: rule}
+		var err error
+		if c.artist, err = compileRuleRegexp(rule.Artist); err != nil {
+			return nil, fmt.Errorf("%s: invalid artist regex: %w", rule.Name, err)
+		}
+		if c.album, err = compileRuleRegexp(rule.Album); err != nil {
+			return nil, fmt.Errorf("%s: invalid album regex: %w", rule.Name, err)
+		}
+		if c.title, err = compileRuleRegexp(rule.Title); err != nil {
+			return nil, fmt.Errorf("%s: invalid title regex: %w", rule.Name, err)
+		}
+		if c.genre, err = compileRuleRegexp(rule.Genre); err != nil {
+			return nil, fmt.Errorf("%s: invalid genre regex: %w", rule.Name, err)
+		}
+		if rule.Path != "" {
+			if c.path, err = globToRegexp(rule.Path); err != nil {
+				return nil, fmt.Errorf("%s: invalid path glob: %w", rule.Name, err)
+			}
+		}
+		set.rules = append(set.rules, c)
+	}
+	return set, nil
+}
+
+// compileRuleRegexp compiles a case-insensitive regex, or returns nil for an
+// empty pattern.
+func compileRuleRegexp(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("(?i)" + pattern)
+}
+
+// globToRegexp converts a path glob to a regex. "**" matches across
+// directories, "*" and "?" stay within one path component.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	glob = filepath.ToSlash(glob)
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+func (r compiledRule) matches(scrobble ScrobbleEvent) bool {
+	if r.artist != nil && !r.artist.MatchString(scrobble.Artist) {
+		return false
+	}
+	if r.album != nil && !r.album.MatchString(scrobble.Album) {
+		return false
+	}
+	if r.title != nil && !r.title.MatchString(scrobble.Track) {
+		return false
+	}
+	if r.genre != nil && !r.genre.MatchString(scrobble.Genre) {
+		return false
+	}
+	if r.path != nil && !r.path.MatchString(filepath.ToSlash(scrobble.Path)) {
+		return false
+	}
+	// Durations of zero or less are unknown (e.g. streams) and never match.
+	if r.MinDuration > 0 && (scrobble.Duration <= 0 || scrobble.Duration >= r.MinDuration) {
+		return false
+	}
+	return true
+}
+
+// Match returns the first rule that applies to scrobble, or nil.
+func (s *RuleSet) Match(scrobble ScrobbleEvent) *Rule {
+	for i := range s.rules {
+		if s.rules[i].matches(scrobble) {
+			return &s.rules[i].Rule
+		}
+	}
+	return nil
+}
+
+// Apply runs the rules against scrobble. It returns the possibly rewritten
+// scrobble, the rule that matched (if any) and whether the scrobble should
+// still be published.
+func (s *RuleSet) Apply(scrobble ScrobbleEvent) (ScrobbleEvent, *Rule, bool) {
+	rule := s.Match(scrobble)
+	if rule == nil {
+		return scrobble, nil, true
+	}
+
+	if rule.Action == RuleActionSkip {
+		return scrobble, rule, false
+	}
+
+	if rule.Action == RuleActionPrivate || rule.Private {
+		scrobble.Private = true
+	}
+	for key, value := range rule.Set {
+		switch key {
+		case "artist":
+			scrobble.Artist = value
+		case "album":
+			scrobble.Album = value
+		case "title":
+			scrobble.Track = value
+		}
+	}
+	return scrobble, rule, true
+}
+
+// runRulesTest reports which rule matches a track given on the command line,
+// or the track currently playing in cmus when no track flags are given.
+func runRulesTest(config Config, args []string) error {
+	fs := flag.NewFlagSet("rules test", flag.ExitOnError)
+	artist := fs.String("artist", "", "Artist name")
+	album := fs.String("album", "", "Album name")
+	title := fs.String("title", "", "Track title")
+	path := fs.String("path", "", "File path")
+	genre := fs.String("genre", "", "Genre tag")
+	duration := fs.Int("duration", 0, "Duration in seconds")
+	fs.Parse(args)
+
+	rules, err := compileRules(config.Rules)
+	if err != nil {
+		return err
+	}
+
+	scrobble := ScrobbleEvent{
+		Artist:   *artist,
+		Album:    *album,
+		Track:    *title,
+		Path:     *path,
+		Genre:    *genre,
+		Duration: *duration,
+	}
+	if fs.NFlag() == 0 {
+		resolver, err := newTrackResolver(config)
+		if err != nil {
+			return err
+		}
+		if scrobble, err = resolver.getPlayingTrack(); err != nil {
+			return fmt.Errorf("error getting current track: %w", err)
+		}
+	}
+
+	fmt.Printf("Track: %s - %s (album %q, genre %q, %ds)\n", scrobble.Artist, scrobble.Track, scrobble.Album, scrobble.Genre, scrobble.Duration)
+	if scrobble.Path != "" {
+		fmt.Println("Path: ", scrobble.Path)
+	}
+
+	result, rule, publish := rules.Apply(scrobble)
+	switch {
+	case rule == nil:
+		fmt.Println("No rule matched; the track would be scrobbled as is.")
+	case !publish:
+		fmt.Printf("Matched %q: the track would be skipped.\n", rule.Name)
+	case result.Private:
+		fmt.Printf("Matched %q: the track would be scrobbled privately as %s - %s (album %q).\n", rule.Name, result.Artist, result.Track, result.Album)
+	default:
+		fmt.Printf("Matched %q: the track would be scrobbled as %s - %s (album %q).\n", rule.Name, result.Artist, result.Track, result.Album)
+	}
+	return nil
+}
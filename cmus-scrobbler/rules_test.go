@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestRuleSetApply(t *testing.T) {
+	rules, err := compileRules([]Rule{
+		{Name: "podcasts", Path: "**/podcasts/**"},
+		{Name: "short", MinDuration: 60},
+		{Name: "audiobooks", Genre: "^audiobook$"},
+		{Name: "beatles", Artist: "^the beatles$", Action: RuleActionRewrite, Set: map[string]string{"artist": "The Beatles"}},
+	})
+	if err != nil {
+		t.Fatalf("compileRules: %v", err)
+	}
+
+	tests := []struct {
+		scrobble ScrobbleEvent
+		rule     string
+		publish  bool
+		artist   string
+	}{
+		{ScrobbleEvent{Artist: "A", Track: "B", Path: "/home/me/podcasts/show/ep1.mp3", Duration: 3600}, "podcasts", false, "A"},
+		{ScrobbleEvent{Artist: "A", Track: "B", Duration: 20}, "short", false, "A"},
+		{ScrobbleEvent{Artist: "A", Track: "B", Duration: -1}, "", true, "A"},
+		{ScrobbleEvent{Artist: "A", Track: "B", Genre: "Audiobook", Duration: 600}, "audiobooks", false, "A"},
+		{ScrobbleEvent{Artist: "THE BEATLES", Track: "Help!", Duration: 140}, "beatles", true, "The Beatles"},
+		{ScrobbleEvent{Artist: "A", Track: "B", Path: "/music/A/B.flac", Duration: 200}, "", true, "A"},
+	}
+
+	for _, tt := range tests {
+		result, rule, publish := rules.Apply(tt.scrobble)
+		name := ""
+		if rule != nil {
+			name = rule.Name
+		}
+		if name != tt.rule || publish != tt.publish || result.Artist != tt.artist {
+			t.Errorf("Apply(%+v) = %q, %v, %q; want %q, %v, %q", tt.scrobble, name, publish, result.Artist, tt.rule, tt.publish, tt.artist)
+		}
+	}
+}
+
+func TestCompileRulesRejectsUnknownAction(t *testing.T) {
+	if _, err := compileRules([]Rule{{Artist: "x", Action: "delete"}}); err == nil {
+		t.Fatal("expected error for unknown action")
+	}
+}
+
+func TestCompileRulesRejectsRuleWithoutConditions(t *testing.T) {
+	if _, err := compileRules([]Rule{{Name: "typo", Action: RuleActionPrivate}}); err == nil {
+		t.Fatal("expected error for a rule without conditions")
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// scrobblerLogEntry is one line of an Audioscrobbler portable player log
+// (.scrobbler.log), as written by Rockbox and other portable players.
+type scrobblerLogEntry struct {
+	Artist      string
+	Album       string
+	Title       string
+	TrackNumber string
+	Length      int
+	Rating      string // "L" listened, "S" skipped
+	Time        time.Time
+	MbID        string
+}
+
+// parseScrobblerLog reads a .scrobbler.log. Timestamps in logs with a
+// "#TZ/UNKNOWN" header are the player's local wall-clock time and are read
+// in loc; "#TZ/UTC" logs are read as UTC.
+func parseScrobblerLog(r io.Reader, loc *time.Location) ([]scrobblerLogEntry, error) {
+	var entries []scrobblerLogEntry
+	utc := false
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if line == 1 {
+			text = strings.TrimPrefix(text, "\ufeff")
+		}
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "#") {
+			if tz, ok := strings.CutPrefix(text, "#TZ/"); ok {
+				switch strings.TrimSpace(tz) {
+				case "UTC":
+					utc = true
+				case "UNKNOWN":
+					utc = false
+				default:
+					return nil, fmt.Errorf("line %d: unknown timezone header %q", line, text)
+				}
+			}
+			continue
+		}
+
+		fields := strings.Split(text, "\t")
+		if len(fields) < 7 {
+			return nil, fmt.Errorf("line %d: expected at least 7 tab-separated fields, got %d", line, len(fields))
+		}
+
+		entry := scrobblerLogEntry{
+			Artist:      fields[0],
+			Album:       fields[1],
+			Title:       fields[2],
+			TrackNumber: fields[3],
+			Rating:      strings.ToUpper(fields[5]),
+		}
+		if len(fields) > 7 {
+			entry.MbID = fields[7]
+		}
+
+		if fields[4] != "" {
+			length, err := strconv.Atoi(fields[4])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid length %q", line, fields[4])
+			}
+			entry.Length = length
+		}
+		if entry.Rating != "L" && entry.Rating != "S" {
+			return nil, fmt.Errorf("line %d: rating must be L or S, got %q", line, fields[5])
+		}
+
+		ts, err := strconv.ParseInt(fields[6], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid timestamp %q", line, fields[6])
+		}
+		entry.Time = time.Unix(ts, 0).UTC()
+		if !utc {
+			t := entry.Time
+			entry.Time = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+func (e scrobblerLogEntry) scrobble() ScrobbleEvent {
+	return ScrobbleEvent{
+		Artist:    e.Artist,
+		Track:     e.Title,
+		Album:     e.Album,
+		MbID:      e.MbID,
+		Duration:  e.Length,
+		CreatedAt: nostr.Timestamp(e.Time.Unix()),
+	}
+}
+
+// scrobbleKey identifies a listen for deduplication.
+func scrobbleKey(scrobble ScrobbleEvent) string {
+	return fmt.Sprintf("%d|%s|%s", scrobble.CreatedAt, strings.ToLower(scrobble.Artist), strings.ToLower(scrobble.Track))
+}
+
+// importScrobblerLog publishes the listens in a .scrobbler.log as backdated
+// scrobbles, skipping ones already in the history.
+func importScrobblerLog(ctx *cliContext, r io.Reader, loc *time.Location, includeSkipped, dryRun, yes bool) error {
+	entries, err := parseScrobblerLog(r, loc)
+	if err != nil {
+		return err
+	}
+
+	targets, err := newProfileTargets(ctx.rawConfig, ctx.profile, ctx.nostr)
+	if err != nil {
+		return err
+	}
+	defer targets.Close(ctx.nostr)
+
+	var pending []pendingScrobble
+	skipped, invalid := 0, 0
+	for _, entry := range entries {
+		if entry.Rating == "S" && !includeSkipped {
+			skipped++
+			continue
+		}
+
+		scrobble, err := entry.scrobble().Normalize()
+		if err != nil {
+			fmt.Printf("Skipping %s - %s: %v\n", entry.Artist, entry.Title, err)
+			invalid++
+			continue
+		}
+
+		target, result, rule, publish, err := targets.prepare(scrobble, entry.Time)
+		if err != nil {
+			return err
+		}
+		if !publish {
+			fmt.Printf("Skipping %s - %s: matched rule %q\n", scrobble.Artist, scrobble.Track, rule.Name)
+			continue
+		}
+		pending = append(pending, pendingScrobble{target: target, scrobble: result})
+	}
+
+	pending, duplicates, err := dropExistingScrobbles(pending)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d listens in log: %d to import, %d already scrobbled, %d skipped (S), %d invalid\n",
+		len(entries), len(pending), duplicates, skipped, invalid)
+	if len(pending) == 0 {
+		return nil
+	}
+	for _, p := range pending {
+		fmt.Printf("  %s  %s - %s -> %s\n", p.scrobble.CreatedAt.Time().Format("2006-01-02 15:04"), p.scrobble.Artist, p.scrobble.Track, p.target.profile)
+	}
+	if dryRun {
+		return nil
+	}
+	if !yes && !confirm("Publish?") {
+		fmt.Println("Aborted.")
+		return nil
+	}
+
+	return publishScrobbles(pending)
+}
+
+// dropExistingScrobbles removes listens that each target's history already
+// has at the same second.
+func dropExistingScrobbles(pending []pendingScrobble) ([]pendingScrobble, int, error) {
+	byTarget := make(map[*scrobbleTarget][]pendingScrobble)
+	for _, p := range pending {
+		byTarget[p.target] = append(byTarget[p.target], p)
+	}
+
+	var kept []pendingScrobble
+	duplicates := 0
+	for target, listens := range byTarget {
+		since, until := listens[0].scrobble.CreatedAt, listens[0].scrobble.CreatedAt
+		for _, p := range listens {
+			since = min(since, p.scrobble.CreatedAt)
+			until = max(until, p.scrobble.CreatedAt)
+		}
+
+		existing := make(map[string]bool)
+		err := target.nostr.WalkHistory(since, until, func(ev *nostr.Event) error {
+			if scrobble, err := target.nostr.ScrobbleFromEvent(ev); err == nil {
+				existing[scrobbleKey(scrobble)] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, p := range listens {
+			key := scrobbleKey(p.scrobble)
+			if existing[key] {
+				duplicates++
+				continue
+			}
+			existing[key] = true
+			kept = append(kept, p)
+		}
+	}
+
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].scrobble.CreatedAt < kept[j].scrobble.CreatedAt
+	})
+	return kept, duplicates, nil
+}
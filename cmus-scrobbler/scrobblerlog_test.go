@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testScrobblerLog = "#AUDIOSCROBBLER/1.1\n" +
+	"#TZ/UNKNOWN\n" +
+	"#CLIENT/Rockbox sansae200 $Revision$\n" +
+	"Portishead\tDummy\tSour Times\t4\t251\tL\t1714580000\t\n" +
+	"Portishead\tDummy\tRoads\t5\t305\tS\t1714580300\t\n" +
+	"Massive Attack\tMezzanine\tTeardrop\t3\t330\tL\t1714580700\t2bb6e5b4-1e0d-4b6e-8b3a-2d1e3c6b8a8f\n"
+
+func TestParseScrobblerLog(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	entries, err := parseScrobblerLog(strings.NewReader(testScrobblerLog), loc)
+	if err != nil {
+		t.Fatalf("parseScrobblerLog: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+
+	first := entries[0]
+	if first.Artist != "Portishead" || first.Album != "Dummy" || first.Title != "Sour Times" || first.Length != 251 || first.Rating != "L" {
+		t.Errorf("first entry = %+v", first)
+	}
+	// The player's clock said 16:13:20 local time, two hours ahead of UTC.
+	if want := time.Unix(1714580000, 0).Add(-2 * time.Hour); !first.Time.Equal(want) {
+		t.Errorf("first entry time = %v, want %v", first.Time, want)
+	}
+	if entries[1].Rating != "S" {
+		t.Errorf("second entry rating = %q", entries[1].Rating)
+	}
+	if entries[2].MbID != "2bb6e5b4-1e0d-4b6e-8b3a-2d1e3c6b8a8f" {
+		t.Errorf("third entry mbid = %q", entries[2].MbID)
+	}
+}
+
+func TestParseScrobblerLogUTC(t *testing.T) {
+	log := "#AUDIOSCROBBLER/1.1\n#TZ/UTC\nA\t\tB\t\t200\tL\t1714580000\n"
+	entries, err := parseScrobblerLog(strings.NewReader(log), time.FixedZone("x", 3600))
+	if err != nil {
+		t.Fatalf("parseScrobblerLog: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Time.Unix() != 1714580000 {
+		t.Fatalf("entries = %+v", entries)
+	}
+}
+
+func TestParseScrobblerLogRejectsBadRating(t *testing.T) {
+	log := "#AUDIOSCROBBLER/1.1\nA\t\tB\t\t200\tX\t1714580000\n"
+	if _, err := parseScrobblerLog(strings.NewReader(log), time.UTC); err == nil {
+		t.Fatal("expected error for rating X")
+	}
+}
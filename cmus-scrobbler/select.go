@@ -0,0 +1,218 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// scrobbleSelector picks scrobbles from the user's history by index (as shown
+// by -ls), by event ID, or by filter flags.
+type scrobbleSelector struct {
+	artist string
+	track  string
+	album  string
+	since  string
+	until  string
+	limit  int
+}
+
+func (s *scrobbleSelector) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&s.artist, "artist", "", "Select scrobbles whose artist matches this regex")
+	fs.StringVar(&s.track, "track", "", "Select scrobbles whose track matches this regex")
+	fs.StringVar(&s.album, "album", "", "Select scrobbles whose album matches this regex")
+	fs.StringVar(&s.since, "since", "", "Select scrobbles at or after this date (YYYY-MM-DD or RFC3339)")
+	fs.StringVar(&s.until, "until", "", "Select scrobbles before this date (YYYY-MM-DD or RFC3339)")
+	fs.IntVar(&s.limit, "limit", 50, "Number of recent scrobbles indexes and filters without -since or -until refer to")
+}
+
+func (s *scrobbleSelector) hasFilter() bool {
+	return s.artist != "" || s.track != "" || s.album != "" || s.since != "" || s.until != ""
+}
+
+// historyRange turns -since and -until dates into the inclusive timestamp
+// range WalkHistory takes. Empty values leave that end open.
+func historyRange(since, until string) (sinceTS, untilTS nostr.Timestamp, err error) {
+	if since != "" {
+		t, err := parseDate(since)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid -since: %w", err)
+		}
+		sinceTS = nostr.Timestamp(t.Unix())
+	}
+	if until != "" {
+		t, err := parseDate(until)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid -until: %w", err)
+		}
+		untilTS = nostr.Timestamp(t.Unix() - 1)
+	}
+	return sinceTS, untilTS, nil
+}
+
+func parseDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+// selectScrobbles resolves args (indexes or event IDs) and the filter flags
+// into a list of events.
+func (s *scrobbleSelector) selectScrobbles(nostrClient *Nostr, args []string) ([]nostr.Event, error) {
+	if len(args) == 0 && !s.hasFilter() {
+		return nil, fmt.Errorf("no scrobbles selected: give indexes, event IDs or filter flags")
+	}
+
+	var recent []nostr.Event
+	loadRecent := func() error {
+		if recent != nil {
+			return nil
+		}
+		var err error
+		recent, err = nostrClient.QueryRecentScrobbles(s.limit)
+		return err
+	}
+
+	seen := make(map[string]bool)
+	var events []nostr.Event
+	add := func(ev nostr.Event) {
+		if !seen[ev.ID] {
+			seen[ev.ID] = true
+			events = append(events, ev)
+		}
+	}
+
+	var ids []string
+	for _, arg := range args {
+		index, err := strconv.Atoi(arg)
+		if err != nil {
+			ids = append(ids, arg)
+			continue
+		}
+		if err := loadRecent(); err != nil {
+			return nil, err
+		}
+		if index < 1 || index > len(recent) {
+			return nil, fmt.Errorf("no scrobble at index %d", index)
+		}
+		add(recent[index-1])
+	}
+
+	if len(ids) > 0 {
+		found, err := nostrClient.QueryScrobblesByID(ids)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) != len(ids) {
+			return nil, fmt.Errorf("found %d of %d requested events", len(found), len(ids))
+		}
+		for _, ev := range found {
+			add(ev)
+		}
+	}
+
+	if s.hasFilter() {
+		matches, err := s.compileFilter()
+		if err != nil {
+			return nil, err
+		}
+		candidates, err := s.filterCandidates(nostrClient, loadRecent, &recent)
+		if err != nil {
+			return nil, err
+		}
+		for i := range candidates {
+			scrobble, err := nostrClient.ScrobbleFromEvent(&candidates[i])
+			if err != nil {
+				continue
+			}
+			if matches(scrobble, candidates[i].CreatedAt.Time()) {
+				add(candidates[i])
+			}
+		}
+	}
+
+	return events, nil
+}
+
+// filterCandidates returns the scrobbles the filter flags are matched
+// against: the whole history between -since and -until when either is
+// given, the last -limit scrobbles otherwise.
+func (s *scrobbleSelector) filterCandidates(nostrClient *Nostr, loadRecent func() error, recent *[]nostr.Event) ([]nostr.Event, error) {
+	if s.since == "" && s.until == "" {
+		if err := loadRecent(); err != nil {
+			return nil, err
+		}
+		if len(*recent) >= s.limit {
+			fmt.Fprintf(os.Stderr, "Only the last %d scrobbles were searched; use -since, -until or -limit to search further back.\n", s.limit)
+		}
+		return *recent, nil
+	}
+
+	since, until, err := historyRange(s.since, s.until)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []nostr.Event
+	err = nostrClient.WalkHistory(since, until, func(ev *nostr.Event) error {
+		candidates = append(candidates, *ev)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading history: %w", err)
+	}
+	// Relays are walked one after another; show the newest first.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].CreatedAt > candidates[j].CreatedAt
+	})
+	return candidates, nil
+}
+
+func (s *scrobbleSelector) compileFilter() (func(ScrobbleEvent, time.Time) bool, error) {
+	artist, err := compileRuleRegexp(s.artist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid artist regex: %w", err)
+	}
+	track, err := compileRuleRegexp(s.track)
+	if err != nil {
+		return nil, fmt.Errorf("invalid track regex: %w", err)
+	}
+	album, err := compileRuleRegexp(s.album)
+	if err != nil {
+		return nil, fmt.Errorf("invalid album regex: %w", err)
+	}
+
+	var since, until time.Time
+	if s.since != "" {
+		if since, err = parseDate(s.since); err != nil {
+			return nil, fmt.Errorf("invalid -since date: %w", err)
+		}
+	}
+	if s.until != "" {
+		if until, err = parseDate(s.until); err != nil {
+			return nil, fmt.Errorf("invalid -until date: %w", err)
+		}
+	}
+
+	matchRegexp := func(re *regexp.Regexp, value string) bool {
+		return re == nil || re.MatchString(value)
+	}
+
+	return func(scrobble ScrobbleEvent, at time.Time) bool {
+		if !since.IsZero() && at.Before(since) {
+			return false
+		}
+		if !until.IsZero() && !at.Before(until) {
+			return false
+		}
+		return matchRegexp(artist, scrobble.Artist) &&
+			matchRegexp(track, scrobble.Track) &&
+			matchRegexp(album, scrobble.Album)
+	}, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// newTestHistory returns a client whose synced cache holds scrobbles of
+// tracks, one a day from 2024-01-01, newest last.
+func newTestHistory(t *testing.T, tracks ...string) *Nostr {
+	t.Helper()
+	n := newTestNostr(t)
+	cache := openTestCache(t)
+	if err := cache.SetCursor("wss://relay.example.com", nostr.Now()); err != nil {
+		t.Fatal(err)
+	}
+	n.UseCache(cache)
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	for i, track := range tracks {
+		at := nostr.Timestamp(start.AddDate(0, 0, i).Unix())
+		ev, err := n.CreateScrobbleEvent(ScrobbleEvent{Artist: "Low", Track: track, CreatedAt: at})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Put(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return n
+}
+
+func selectedTracks(t *testing.T, n *Nostr, events []nostr.Event) []string {
+	t.Helper()
+	var tracks []string
+	for i := range events {
+		scrobble, err := n.ScrobbleFromEvent(&events[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		tracks = append(tracks, scrobble.Track)
+	}
+	return tracks
+}
+
+func TestSelectScrobblesByIndexAndID(t *testing.T) {
+	n := newTestHistory(t, "Words", "Sunflower", "Lullaby")
+	s := &scrobbleSelector{limit: 50}
+
+	recent, err := n.QueryRecentScrobbles(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Indexes count from the newest, as ls shows them; an event picked
+	// twice is selected once.
+	events, err := s.selectScrobbles(n, []string{"1", "3", recent[0].ID})
+	if err != nil {
+		t.Fatalf("selectScrobbles: %v", err)
+	}
+	if got := selectedTracks(t, n, events); !slices.Equal(got, []string{"Lullaby", "Words"}) {
+		t.Errorf("selected %v", got)
+	}
+
+	for _, args := range [][]string{{"0"}, {"4"}, {"missing"}, nil} {
+		if _, err := s.selectScrobbles(n, args); err == nil {
+			t.Errorf("selectScrobbles(%q) succeeded", args)
+		}
+	}
+}
+
+func TestSelectScrobblesByFilter(t *testing.T) {
+	n := newTestHistory(t, "Words", "Sunflower", "Lullaby", "Sunflower", "Laser Beam")
+
+	// Without dates, only the last -limit scrobbles are searched.
+	s := &scrobbleSelector{track: "^Sunflower$", limit: 2}
+	events, err := s.selectScrobbles(n, nil)
+	if err != nil {
+		t.Fatalf("selectScrobbles: %v", err)
+	}
+	if len(events) != 1 || events[0].CreatedAt.Time().Day() != 4 {
+		t.Errorf("selected %v within the limit", selectedTracks(t, n, events))
+	}
+
+	// With dates, the whole range is searched whatever the limit; since
+	// is inclusive and until exclusive.
+	s = &scrobbleSelector{track: "^Sunflower$|Words|Laser", since: "2024-01-01", until: "2024-01-05", limit: 2}
+	events, err = s.selectScrobbles(n, nil)
+	if err != nil {
+		t.Fatalf("selectScrobbles: %v", err)
+	}
+	if got := selectedTracks(t, n, events); !slices.Equal(got, []string{"Sunflower", "Sunflower", "Words"}) {
+		t.Errorf("selected %v between the dates", got)
+	}
+
+	s = &scrobbleSelector{since: "yesterday", limit: 2}
+	if _, err := s.selectScrobbles(n, nil); err == nil {
+		t.Error("invalid -since accepted")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip44"
+	"github.com/nbd-wtf/go-nostr/nip46"
+)
+
+// signerTimeout bounds each request to a remote signer, which may wait for
+// the user to approve it.
+const signerTimeout = 30 * time.Second
+
+// signer signs events for the user's key and encrypts to it. The key is
+// either in the config or held by a NIP-46 remote signer.
+type signer interface {
+	PublicKey() string
+	SignEvent(ev *nostr.Event) error
+	// EncryptSelf and DecryptSelf NIP-44 encrypt to the user's own key.
+	EncryptSelf(plaintext string) (string, error)
+	DecryptSelf(ciphertext string) (string, error)
+	Close()
+}
+
+// newSigner returns the signer config asks for: its remote signer when
+// bunker is set, its nsec otherwise.
+func newSigner(config Config) (signer, error) {
+	if config.Bunker != "" {
+		return newBunkerSigner(config.Bunker, config.Npub)
+	}
+	return newKeySigner(config.Nsec)
+}
+
+// keySigner signs with a private key it holds.
+type keySigner struct {
+	sk, pk string
+}
+
+func newKeySigner(nsec string) (*keySigner, error) {
+	sk, err := decodeNsec(nsec)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		return nil, fmt.Errorf("error getting public key: %w", err)
+	}
+	return &keySigner{sk: sk, pk: pk}, nil
+}
+
+func (s *keySigner) PublicKey() string { return s.pk }
+
+func (s *keySigner) SignEvent(ev *nostr.Event) error {
+	return ev.Sign(s.sk)
+}
+
+func (s *keySigner) EncryptSelf(plaintext string) (string, error) {
+	key, err := nip44.GenerateConversationKey(s.pk, s.sk)
+	if err != nil {
+		return "", fmt.Errorf("error deriving encryption key: %w", err)
+	}
+	// nip44.Encrypt in this go-nostr version ignores its own random nonce,
+	// so always pass one explicitly.
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("error generating nonce: %w", err)
+	}
+	return nip44.Encrypt(plaintext, key, nip44.WithCustomNonce(nonce))
+}
+
+func (s *keySigner) DecryptSelf(ciphertext string) (string, error) {
+	key, err := nip44.GenerateConversationKey(s.pk, s.sk)
+	if err != nil {
+		return "", fmt.Errorf("error deriving encryption key: %w", err)
+	}
+	return nip44.Decrypt(ciphertext, key)
+}
+
+func (s *keySigner) Close() {}
+
+// bunkerSigner has a NIP-46 remote signer sign and encrypt. It talks to the
+// signer with a client key kept in the state directory, so the signer only
+// has to approve it once.
+type bunkerSigner struct {
+	client *nip46.BunkerClient
+	pk     string
+	cancel context.CancelFunc
+}
+
+// validateBunkerURL checks that bunkerURL is a bunker:// URL with the
+// signer's public key and at least one relay.
+func validateBunkerURL(bunkerURL string) error {
+	u, err := url.Parse(bunkerURL)
+	if err != nil || u.Scheme != "bunker" {
+		return errors.New("must be a bunker:// URL")
+	}
+	if !nostr.IsValidPublicKey(u.Host) {
+		return fmt.Errorf("%q is not a hex public key", u.Host)
+	}
+	if len(u.Query()["relay"]) == 0 {
+		return errors.New("has no relay")
+	}
+	return nil
+}
+
+func newBunkerSigner(bunkerURL, npub string) (*bunkerSigner, error) {
+	if err := validateBunkerURL(bunkerURL); err != nil {
+		return nil, fmt.Errorf("bunker URL %w", err)
+	}
+	want, err := decodePubkey(npub)
+	if err != nil {
+		return nil, fmt.Errorf("remote signer needs npub: %w", err)
+	}
+	clientKey, err := bunkerClientKey()
+	if err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(bunkerURL)
+
+	// The client listens for responses until Close.
+	listen, cancel := context.WithCancel(context.Background())
+	client := nip46.NewBunker(listen, clientKey, u.Host, u.Query()["relay"], nil, func(authURL string) {
+		slog.Warn("remote signer asks for approval", "url", authURL)
+	})
+	s := &bunkerSigner{client: client, pk: want, cancel: cancel}
+
+	ctx, done := context.WithTimeout(context.Background(), signerTimeout)
+	defer done()
+	if _, err := client.RPC(ctx, "connect", []string{u.Host, u.Query().Get("secret")}); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("error connecting to remote signer: %w", err)
+	}
+	pk, err := client.GetPublicKey(ctx)
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("error getting public key from remote signer: %w", err)
+	}
+	if pk != want {
+		s.Close()
+		return nil, fmt.Errorf("remote signer signs for %s, not npub %s", pk, npub)
+	}
+	return s, nil
+}
+
+func (s *bunkerSigner) PublicKey() string { return s.pk }
+
+func (s *bunkerSigner) SignEvent(ev *nostr.Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), signerTimeout)
+	defer cancel()
+	ev.PubKey = s.pk
+	if err := s.client.SignEvent(ctx, ev); err != nil {
+		return fmt.Errorf("remote signer: %w", err)
+	}
+	if ok, err := ev.CheckSignature(); !ok || ev.PubKey != s.pk {
+		return fmt.Errorf("remote signer returned an invalid signature: %v", err)
+	}
+	return nil
+}
+
+func (s *bunkerSigner) EncryptSelf(plaintext string) (string, error) {
+	return s.rpc("nip44_encrypt", s.pk, plaintext)
+}
+
+func (s *bunkerSigner) DecryptSelf(ciphertext string) (string, error) {
+	return s.rpc("nip44_decrypt", s.pk, ciphertext)
+}
+
+func (s *bunkerSigner) rpc(method string, params ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), signerTimeout)
+	defer cancel()
+	result, err := s.client.RPC(ctx, method, params)
+	if err != nil {
+		return "", fmt.Errorf("remote signer %s: %w", method, err)
+	}
+	return result, nil
+}
+
+func (s *bunkerSigner) Close() {
+	s.cancel()
+}
+
+// bunkerClientKey returns the key cmus-scrobbler uses to talk to remote
+// signers, creating it on first use.
+func bunkerClientKey() (string, error) {
+	path, err := stateFilePath("bunker-client.json")
+	if err != nil {
+		return "", err
+	}
+	var key string
+	if err := readStateFile(path, &key); err != nil {
+		return "", err
+	}
+	if key != "" {
+		if !nostr.IsValid32ByteHex(key) {
+			return "", fmt.Errorf("%s is not a valid key", path)
+		}
+		return key, nil
+	}
+
+	key = nostr.GeneratePrivateKey()
+	if err := writeStateFile(path, key); err != nil {
+		return "", err
+	}
+	return key, nil
+}
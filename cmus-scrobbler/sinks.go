@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	defaultListenBrainzURL = "https://api.listenbrainz.org"
+	sinkTimeout            = 30 * time.Second
+	// sinkQueueSize bounds the scrobbles waiting for a slow sink; newer
+	// ones are dropped when it is full.
+	sinkQueueSize = 64
+)
+
+// Sink gets a copy of every scrobble a profile publishes, besides the
+// relays.
+type Sink struct {
+	Name string `yaml:"name"`
+	// File is appended to, in format (jsonl by default).
+	File   string `yaml:"file"`
+	Format string `yaml:"format"`
+	// ListenBrainz is a ListenBrainz user token; each scrobble is
+	// submitted as a listen. Environment variables in it are expanded.
+	ListenBrainz string `yaml:"listenbrainz"`
+	// URL is the ListenBrainz API, for other compatible servers.
+	URL string `yaml:"url"`
+}
+
+func (s Sink) String() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	if s.File != "" {
+		return s.File
+	}
+	return s.listenBrainzURL()
+}
+
+func (s Sink) listenBrainzURL() string {
+	if s.URL != "" {
+		return strings.TrimSuffix(s.URL, "/")
+	}
+	return defaultListenBrainzURL
+}
+
+func validateSink(s Sink) error {
+	if (s.File == "") == (s.ListenBrainz == "") {
+		return errors.New("needs either file or listenbrainz")
+	}
+	if s.File != "" {
+		if s.URL != "" {
+			return errors.New("url only applies to listenbrainz")
+		}
+		format := s.Format
+		if format == "" {
+			format = ExportFormatJSONL
+		}
+		if _, err := newExportWriter(format, nil); err != nil {
+			return err
+		}
+		return nil
+	}
+	if s.Format != "" {
+		return errors.New("format only applies to file")
+	}
+	if s.URL != "" {
+		u, err := url.Parse(s.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url %q must be an http:// or https:// URL", s.URL)
+		}
+	}
+	return nil
+}
+
+type sinkScrobble struct {
+	ev       *nostr.Event
+	scrobble ScrobbleEvent
+}
+
+// sinkRunner delivers scrobbles to the sinks of the profile that published
+// them. Like hooks, each sink has its own queue and goroutine.
+type sinkRunner struct {
+	workers []*sinkWorker
+	client  *http.Client
+	stop    chan struct{}
+	once    sync.Once
+}
+
+type sinkWorker struct {
+	profile string
+	sink    Sink
+	queue   chan sinkScrobble
+}
+
+// newSinkRunner starts the sinks of every profile in config.
+func newSinkRunner(config Config) *sinkRunner {
+	r := &sinkRunner{client: &http.Client{Timeout: sinkTimeout}, stop: make(chan struct{})}
+	for _, profile := range config.ProfileNames() {
+		merged, err := config.Profile(profile)
+		if err != nil {
+			continue
+		}
+		for _, sink := range merged.Sinks {
+			w := &sinkWorker{profile: profile, sink: sink, queue: make(chan sinkScrobble, sinkQueueSize)}
+			r.workers = append(r.workers, w)
+			go r.work(w)
+		}
+	}
+	return r
+}
+
+// deliver queues the scrobble in ev for the sinks of profile. It never
+// blocks. A nil runner does nothing.
+func (r *sinkRunner) deliver(profile string, ev *nostr.Event, scrobble ScrobbleEvent) {
+	if r == nil {
+		return
+	}
+	for _, w := range r.workers {
+		if w.profile != profile {
+			continue
+		}
+		select {
+		case w.queue <- sinkScrobble{ev: ev, scrobble: scrobble}:
+		default:
+			slog.Warn("sink is falling behind, dropping scrobble", "sink", w.sink.String(), "id", ev.ID)
+		}
+	}
+}
+
+// Close stops the sinks once the running deliveries finish. Queued
+// scrobbles are dropped.
+func (r *sinkRunner) Close() {
+	if r != nil {
+		r.once.Do(func() { close(r.stop) })
+	}
+}
+
+func (r *sinkRunner) work(w *sinkWorker) {
+	for {
+		select {
+		case <-r.stop:
+			return
+		case s := <-w.queue:
+			if err := r.send(w.sink, s); err != nil {
+				slog.Warn("sink failed", "sink", w.sink.String(), "id", s.ev.ID, "err", err)
+			} else {
+				slog.Debug("sent scrobble to sink", "sink", w.sink.String(), "id", s.ev.ID)
+			}
+		}
+	}
+}
+
+func (r *sinkRunner) send(sink Sink, s sinkScrobble) error {
+	if sink.File != "" {
+		return appendToSinkFile(sink, s)
+	}
+	// Private scrobbles stay on the user's relays, encrypted.
+	if s.scrobble.Private {
+		return nil
+	}
+	return r.submitListen(sink, s)
+}
+
+// appendToSinkFile appends the scrobble to the sink's file, writing the
+// format's header first if the file is new.
+func appendToSinkFile(sink Sink, s sinkScrobble) error {
+	format := sink.Format
+	if format == "" {
+		format = ExportFormatJSONL
+	}
+	path := os.ExpandEnv(sink.File)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Buffer the whole entry so it is appended in one write.
+	var buf bytes.Buffer
+	w, err := newExportWriter(format, &buf)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if err := w.header(); err != nil {
+			return err
+		}
+	}
+	if err := w.write(s.ev, s.scrobble); err != nil {
+		return err
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// submitListen submits the scrobble to ListenBrainz as a single listen.
+func (r *sinkRunner) submitListen(sink Sink, s sinkScrobble) error {
+	body, err := json.Marshal(map[string]any{
+		"listen_type": "single",
+		"payload":     []listenBrainzListen{newListenBrainzListen(s.ev, s.scrobble)},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sink.listenBrainzURL()+"/1/submit-listens", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Token "+os.ExpandEnv(sink.ListenBrainz))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("ListenBrainz returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSinks(t *testing.T) {
+	n := newTestNostr(t)
+	submitted := make(chan []byte, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path != "/1/submit-listens" || r.Header.Get("Authorization") != "Token secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		submitted <- body
+	}))
+	defer server.Close()
+
+	t.Setenv("LB_TOKEN", "secret")
+	file := filepath.Join(t.TempDir(), "scrobbles.jsonl")
+	config := Config{
+		Sinks: []Sink{{File: file}},
+		Profiles: map[string]Profile{
+			"work": {Sinks: []Sink{{ListenBrainz: "${LB_TOKEN}", URL: server.URL + "/"}}},
+		},
+	}
+	r := newSinkRunner(config)
+	defer r.Close()
+
+	scrobble := ScrobbleEvent{Artist: "Low", Track: "Words"}
+	ev, err := n.CreateScrobbleEvent(scrobble)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the work profile's sink gets work scrobbles, and private ones
+	// aren't submitted.
+	r.deliver("work", ev, ScrobbleEvent{Artist: "Low", Track: "Sunflower", Private: true})
+	r.deliver("work", ev, scrobble)
+	select {
+	case body := <-submitted:
+		var got struct {
+			ListenType string               `json:"listen_type"`
+			Payload    []listenBrainzListen `json:"payload"`
+		}
+		if err := json.Unmarshal(body, &got); err != nil || got.ListenType != "single" || len(got.Payload) != 1 ||
+			got.Payload[0].TrackMetadata.TrackName != "Words" || got.Payload[0].ListenedAt != int64(ev.CreatedAt) {
+			t.Errorf("submitted %s (%v)", body, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listen wasn't submitted")
+	}
+	select {
+	case body := <-submitted:
+		t.Errorf("submitted again: %s", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("default sink got a work scrobble: %v", err)
+	}
+
+	// The default profile appends the signed events to its file.
+	r.deliver(DefaultProfile, ev, scrobble)
+	r.deliver(DefaultProfile, ev, scrobble)
+	deadline := time.Now().Add(5 * time.Second)
+	var lines []string
+	for len(lines) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		lines = readLines(t, file)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("file has %d lines, want 2", len(lines))
+	}
+	if err := r.send(Sink{ListenBrainz: "wrong", URL: server.URL}, sinkScrobble{ev: ev, scrobble: scrobble}); err == nil {
+		t.Error("rejected listen didn't fail")
+	}
+	<-submitted
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func TestValidateSink(t *testing.T) {
+	for _, s := range []Sink{
+		{},
+		{File: "a.jsonl", ListenBrainz: "token"},
+		{File: "a.csv", Format: "xml"},
+		{File: "a.jsonl", URL: "https://example.com"},
+		{ListenBrainz: "token", URL: "example.com"},
+		{ListenBrainz: "token", Format: "jsonl"},
+	} {
+		if validateSink(s) == nil {
+			t.Errorf("validateSink(%+v) accepted an invalid sink", s)
+		}
+	}
+	for _, s := range []Sink{{File: "a.csv", Format: ExportFormatLastfmCSV}, {ListenBrainz: "token"}} {
+		if err := validateSink(s); err != nil {
+			t.Errorf("validateSink(%+v): %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// runState is what run keeps across restarts: the scrobbles it couldn't
+// publish yet and where it was in the play queue.
+type runState struct {
+	SavedAt          time.Time      `json:"saved_at"`
+	LastTrack        string         `json:"last_track,omitempty"`
+	SkipTrack        string         `json:"skip_track,omitempty"`
+	ScrobblingPaused bool           `json:"scrobbling_paused"`
+	Pending          []pendingState `json:"pending,omitempty"`
+}
+
+type pendingState struct {
+	Profile string       `json:"profile"`
+	Event   *nostr.Event `json:"event"`
+}
+
+func defaultStateDir() (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("error getting state directory: %w", err)
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "cmus-scrobbler"), nil
+}
+
+// runStatePath is the state file of run for pubkey.
+func runStatePath(pubkey string) (string, error) {
+	return stateFilePath("run-" + pubkey + ".json")
+}
+
+func stateFilePath(name string) (string, error) {
+	dir, err := defaultStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// loadRunState reads the state saved at path. A missing file is an empty
+// state.
+func loadRunState(path string) (runState, error) {
+	var state runState
+	err := readStateFile(path, &state)
+	return state, err
+}
+
+// saveRunState writes state to path, replacing it atomically.
+func saveRunState(path string, state runState) error {
+	return writeStateFile(path, state)
+}
+
+// readStateFile decodes the JSON at path into v, leaving v alone when the
+// file doesn't exist.
+func readStateFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading state: %w", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error reading state %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeStateFile writes v to path as JSON, replacing it atomically.
+func writeStateFile(path string, v any) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating state directory: %w", err)
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("error writing state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error writing state: %w", err)
+	}
+	return nil
+}
+
+// snapshot returns the state to save on shutdown.
+func (d *daemon) snapshot(now time.Time) runState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state := runState{
+		SavedAt:          now,
+		LastTrack:        d.lastTrack,
+		SkipTrack:        d.skipKey,
+		ScrobblingPaused: d.status.ScrobblingPaused,
+	}
+	for _, p := range d.pending {
+		state.Pending = append(state.Pending, pendingState{Profile: p.profile, Event: p.event})
+	}
+	return state
+}
+
+// restore takes over state saved by an earlier run. The last track is
+// only kept if the save is recent enough for it to still be playing.
+// Queued scrobbles whose profile can't be connected now stay queued, and
+// connectPending tries again later.
+func (d *daemon) restore(state runState, targets *profileTargets, now time.Time) {
+	var pending []pendingEvent
+	for _, p := range state.Pending {
+		if _, err := targets.config.Profile(p.Profile); err != nil {
+			slog.Warn("dropping queued scrobble of a removed profile", "id", p.Event.ID, "profile", p.Profile)
+			continue
+		}
+		e := pendingEvent{profile: p.Profile, event: p.Event}
+		if target, err := targets.forProfile(p.Profile); err != nil {
+			slog.Warn("keeping queued scrobble until its profile can be connected", "id", p.Event.ID, "profile", p.Profile, "err", err)
+		} else {
+			e.nostr = target.nostr
+		}
+		pending = append(pending, e)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(state.SavedAt) < resubmitThreshold {
+		d.lastTrack = state.LastTrack
+		d.skipKey = state.SkipTrack
+	}
+	d.pending = append(pending, d.pending...)
+	if n := len(d.pending) - maxPendingScrobbles; n > 0 {
+		slog.Warn("retry queue is full, dropping oldest restored scrobbles", "count", n)
+		d.pending = d.pending[n:]
+	}
+	d.updateLocked(func(status *DaemonStatus) {
+		status.ScrobblingPaused = state.ScrobblingPaused
+	})
+}
+
+// connectPending connects the queued scrobbles that were restored without a
+// connection to their profile. Those of a profile a reload removed are
+// dropped.
+func (d *daemon) connectPending(targets *profileTargets) {
+	d.mu.Lock()
+	var profiles []string
+	for _, p := range d.pending {
+		if p.nostr == nil && !slices.Contains(profiles, p.profile) {
+			profiles = append(profiles, p.profile)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, profile := range profiles {
+		if _, err := targets.config.Profile(profile); err != nil {
+			d.update(func(*DaemonStatus) {
+				d.pending = slices.DeleteFunc(d.pending, func(p pendingEvent) bool {
+					if p.nostr != nil || p.profile != profile {
+						return false
+					}
+					slog.Warn("dropping queued scrobble of a removed profile", "id", p.event.ID, "profile", profile)
+					return true
+				})
+			})
+			continue
+		}
+		target, err := targets.forProfile(profile)
+		if err != nil {
+			slog.Debug("queued scrobbles still can't be connected", "profile", profile, "err", err)
+			continue
+		}
+		d.mu.Lock()
+		for i := range d.pending {
+			if d.pending[i].nostr == nil && d.pending[i].profile == profile {
+				d.pending[i].nostr = target.nostr
+			}
+		}
+		d.mu.Unlock()
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRunStateRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "run.json")
+	now := time.Date(2024, 2, 14, 18, 30, 0, 0, time.UTC)
+
+	client := &Nostr{}
+	d := newDaemon()
+	d.lastTrack = "Low - Words"
+	d.SetPaused(true)
+	d.pending = []pendingEvent{
+		{profile: DefaultProfile, nostr: client, event: &nostr.Event{ID: "a", Kind: KindScrobble}},
+		{profile: "work", nostr: client, event: &nostr.Event{ID: "b", Kind: KindScrobble}},
+	}
+	if err := saveRunState(path, d.snapshot(now)); err != nil {
+		t.Fatalf("saveRunState: %v", err)
+	}
+
+	state, err := loadRunState(path)
+	if err != nil {
+		t.Fatalf("loadRunState: %v", err)
+	}
+	// The work profile can't be connected to, so its scrobble waits.
+	targets := &profileTargets{
+		config:  Config{Profiles: map[string]Profile{"work": {}}},
+		targets: map[string]*scrobbleTarget{DefaultProfile: {profile: DefaultProfile, nostr: client}},
+	}
+
+	restored := newDaemon()
+	restored.restore(state, targets, now.Add(time.Minute))
+	if len(restored.pending) != 2 || restored.pending[0].nostr != client || restored.pending[1].event.ID != "b" || restored.pending[1].nostr != nil {
+		t.Errorf("pending = %+v", restored.pending)
+	}
+	if restored.lastTrack != "Low - Words" || !restored.Status().ScrobblingPaused || restored.Status().QueueDepth != 2 {
+		t.Errorf("restored last track %q, status %+v", restored.lastTrack, restored.Status())
+	}
+
+	// It is kept across another restart, and connected once the profile
+	// can be.
+	if state := restored.snapshot(now); len(state.Pending) != 2 || state.Pending[1].Profile != "work" {
+		t.Errorf("saved pending = %+v", state.Pending)
+	}
+	restored.connectPending(targets)
+	if restored.pending[1].nostr != nil {
+		t.Error("queued scrobble connected to a missing profile")
+	}
+	work := &Nostr{}
+	targets.targets["work"] = &scrobbleTarget{profile: "work", nostr: work}
+	restored.connectPending(targets)
+	if restored.pending[1].nostr != work {
+		t.Errorf("queued scrobble not connected: %+v", restored.pending[1])
+	}
+
+	// Once a reload removes the profile, its unconnected scrobble is
+	// dropped.
+	restored.pending[1].nostr = nil
+	targets.config = Config{}
+	restored.connectPending(targets)
+	if len(restored.pending) != 1 || restored.pending[0].event.ID != "a" || restored.Status().QueueDepth != 1 {
+		t.Errorf("pending after the profile was removed = %+v", restored.pending)
+	}
+	gone := newDaemon()
+	gone.restore(state, targets, now.Add(time.Minute))
+	if len(gone.pending) != 1 || gone.pending[0].event.ID != "a" {
+		t.Errorf("pending restored for a removed profile = %+v", gone.pending)
+	}
+
+	// Long after the save, the track that was playing can be scrobbled
+	// again.
+	later := newDaemon()
+	later.restore(state, targets, now.Add(time.Hour))
+	if later.lastTrack != "" {
+		t.Errorf("last track %q restored from an old state", later.lastTrack)
+	}
+
+	// The restored scrobbles count towards the retry queue's bound.
+	full := runState{}
+	for i := 0; i < maxPendingScrobbles+5; i++ {
+		full.Pending = append(full.Pending, pendingState{Profile: DefaultProfile, Event: &nostr.Event{ID: fmt.Sprint(i)}})
+	}
+	capped := newDaemon()
+	capped.pending = []pendingEvent{{profile: DefaultProfile, nostr: client, event: &nostr.Event{ID: "new"}}}
+	capped.restore(full, targets, now)
+	if len(capped.pending) != maxPendingScrobbles || capped.pending[0].event.ID != "6" || capped.pending[len(capped.pending)-1].event.ID != "new" {
+		t.Errorf("capped pending has %d scrobbles, first %s", len(capped.pending), capped.pending[0].event.ID)
+	}
+
+	if state, err := loadRunState(filepath.Join(t.TempDir(), "missing.json")); err != nil || len(state.Pending) != 0 {
+		t.Errorf("missing state = %+v, %v", state, err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type countEntry struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// topCounts returns the n most frequent entries, most frequent first.
+func topCounts(counts map[string]int, n int) []countEntry {
+	entries := make([]countEntry, 0, len(counts))
+	for name, count := range counts {
+		entries = append(entries, countEntry{Name: name, Count: count})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// ScrobbleStats summarises a set of scrobbles.
+type ScrobbleStats struct {
+	Total   int
+	Private int
+	First   time.Time
+	Last    time.Time
+	Artists map[string]int
+	Albums  map[string]int
+	Tracks  map[string]int
+}
+
+func (n *Nostr) computeStats(events []nostr.Event) ScrobbleStats {
+	stats := ScrobbleStats{
+		Artists: make(map[string]int),
+		Albums:  make(map[string]int),
+		Tracks:  make(map[string]int),
+	}
+
+	for i := range events {
+		scrobble, err := n.ScrobbleFromEvent(&events[i])
+		if err != nil {
+			continue
+		}
+
+		at := events[i].CreatedAt.Time()
+		if stats.First.IsZero() || at.Before(stats.First) {
+			stats.First = at
+		}
+		if at.After(stats.Last) {
+			stats.Last = at
+		}
+
+		stats.Total++
+		if scrobble.Private {
+			stats.Private++
+		}
+		stats.Artists[scrobble.Artist]++
+		stats.Tracks[fmt.Sprintf("%s - %s", scrobble.Artist, scrobble.Track)]++
+		if scrobble.Album != "" {
+			stats.Albums[fmt.Sprintf("%s - %s", scrobble.Artist, scrobble.Album)]++
+		}
+	}
+
+	return stats
+}
+
+// merge adds other to s.
+func (s *ScrobbleStats) merge(other ScrobbleStats) {
+	if s.Artists == nil {
+		s.Artists = make(map[string]int)
+		s.Albums = make(map[string]int)
+		s.Tracks = make(map[string]int)
+	}
+	if other.Total == 0 {
+		return
+	}
+
+	if s.Total == 0 || other.First.Before(s.First) {
+		s.First = other.First
+	}
+	if other.Last.After(s.Last) {
+		s.Last = other.Last
+	}
+	s.Total += other.Total
+	s.Private += other.Private
+	for k, v := range other.Artists {
+		s.Artists[k] += v
+	}
+	for k, v := range other.Albums {
+		s.Albums[k] += v
+	}
+	for k, v := range other.Tracks {
+		s.Tracks[k] += v
+	}
+}
+
+func printTop(title string, counts map[string]int, n int) {
+	fmt.Printf("\n%s:\n", title)
+	for i, entry := range topCounts(counts, n) {
+		fmt.Printf("%3d. %s (%d)\n", i+1, entry.Name, entry.Count)
+	}
+}
+
+func cmdStats(ctx *cliContext, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	limit := fs.Int("limit", 500, "Number of recent scrobbles to include")
+	top := fs.Int("top", 10, "Number of entries in each top list")
+	allProfiles := fs.Bool("all-profiles", false, "Combine scrobbles from every profile")
+	fs.Parse(args)
+
+	var stats ScrobbleStats
+	collect := func(profile string, n *Nostr) error {
+		events, err := n.QueryRecentScrobbles(*limit)
+		if err != nil {
+			return fmt.Errorf("error querying scrobbles: %w", err)
+		}
+		stats.merge(n.computeStats(events))
+		return nil
+	}
+
+	var err error
+	if *allProfiles {
+		err = forEachProfile(ctx, collect)
+	} else {
+		err = collect(ctx.profile, ctx.nostr)
+	}
+	if err != nil {
+		return err
+	}
+	if stats.Total == 0 {
+		fmt.Println("No scrobbles found.")
+		return nil
+	}
+
+	fmt.Printf("%d scrobbles (%d private) from %s to %s\n", stats.Total, stats.Private,
+		stats.First.Format("2006-01-02"), stats.Last.Format("2006-01-02"))
+	printTop("Top artists", stats.Artists, *top)
+	printTop("Top albums", stats.Albums, *top)
+	printTop("Top tracks", stats.Tracks, *top)
+	return nil
+}
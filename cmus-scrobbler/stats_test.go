@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestComputeStats(t *testing.T) {
+	n := newTestNostr(t)
+	scrobbles := []ScrobbleEvent{
+		{Artist: "Low", Track: "Words", Album: "I Could Live in Hope", CreatedAt: 3000},
+		{Artist: "Low", Track: "Words", Album: "I Could Live in Hope", CreatedAt: 1000},
+		{Artist: "Low", Track: "Lazy", CreatedAt: 2000, Private: true},
+		{Artist: "Broadcast", Track: "Black Cat", Album: "Haha Sound", CreatedAt: 4000},
+	}
+	var events []nostr.Event
+	for _, s := range scrobbles {
+		ev, err := n.CreateScrobbleEvent(s)
+		if err != nil {
+			t.Fatalf("CreateScrobbleEvent: %v", err)
+		}
+		events = append(events, *ev)
+	}
+
+	stats := n.computeStats(events[:3])
+	if stats.Total != 3 || stats.Private != 1 {
+		t.Errorf("total %d, private %d", stats.Total, stats.Private)
+	}
+	if !stats.First.Equal(time.Unix(1000, 0)) || !stats.Last.Equal(time.Unix(3000, 0)) {
+		t.Errorf("first %v, last %v", stats.First, stats.Last)
+	}
+	// Scrobbles without an album don't count towards the albums.
+	if stats.Albums["Low - I Could Live in Hope"] != 2 || len(stats.Albums) != 1 {
+		t.Errorf("albums = %v", stats.Albums)
+	}
+
+	stats.merge(n.computeStats(events[3:]))
+	stats.merge(ScrobbleStats{})
+	if stats.Total != 4 || !stats.First.Equal(time.Unix(1000, 0)) || !stats.Last.Equal(time.Unix(4000, 0)) {
+		t.Errorf("merged total %d, first %v, last %v", stats.Total, stats.First, stats.Last)
+	}
+	want := []countEntry{{Name: "Low", Count: 3}, {Name: "Broadcast", Count: 1}}
+	if got := topCounts(stats.Artists, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("top artists = %v, want %v", got, want)
+	}
+	// Ties are broken by name, and the list is cut at n.
+	want = []countEntry{{Name: "Low - Words", Count: 2}, {Name: "Broadcast - Black Cat", Count: 1}}
+	if got := topCounts(stats.Tracks, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("top tracks = %v, want %v", got, want)
+	}
+
+	var empty ScrobbleStats
+	empty.merge(stats)
+	if empty.Total != 4 || empty.Artists["Low"] != 3 || !empty.First.Equal(stats.First) {
+		t.Errorf("merged into empty stats = %+v", empty)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultStreamPattern matches the common "Artist - Title" ICY title format.
+const DefaultStreamPattern = `^(?P<artist>.+?)\s+-\s+(?P<title>.+)$`
+
+// StreamRule describes how to parse ICY titles for stations whose URL
+// matches Station. An empty Station matches every stream.
+type StreamRule struct {
+	Station string `yaml:"station"`
+	Pattern string `yaml:"pattern"`
+}
+
+type compiledStreamRule struct {
+	station *regexp.Regexp
+	pattern *regexp.Regexp
+}
+
+func compileStreamRules(rules []StreamRule) ([]compiledStreamRule, error) {
+	var compiled []compiledStreamRule
+	for i, rule := range rules {
+		c := compiledStreamRule{}
+		if rule.Station != "" {
+			re, err := regexp.Compile(rule.Station)
+			if err != nil {
+				return nil, fmt.Errorf("stream rule %d: invalid station regex: %w", i, err)
+			}
+			c.station = re
+		}
+
+		pattern := rule.Pattern
+		if pattern == "" {
+			pattern = DefaultStreamPattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("stream rule %d: invalid pattern: %w", i, err)
+		}
+		if re.SubexpIndex("title") < 0 {
+			return nil, fmt.Errorf("stream rule %d: pattern must have a (?P<title>...) group", i)
+		}
+		c.pattern = re
+		compiled = append(compiled, c)
+	}
+
+	// Always fall back to the default pattern.
+	compiled = append(compiled, compiledStreamRule{pattern: regexp.MustCompile(DefaultStreamPattern)})
+	return compiled, nil
+}
+
+// parseStreamTitle extracts artist and title from an ICY stream title using
+// the first rule whose station regex matches the stream URL and whose pattern
+// matches the title.
+func parseStreamTitle(rules []compiledStreamRule, stationURL, icyTitle string) (artist, title string, ok bool) {
+	icyTitle = strings.TrimSpace(icyTitle)
+	if icyTitle == "" {
+		return "", "", false
+	}
+
+	for _, rule := range rules {
+		if rule.station != nil && !rule.station.MatchString(stationURL) {
+			continue
+		}
+		match := rule.pattern.FindStringSubmatch(icyTitle)
+		if match == nil {
+			continue
+		}
+		if i := rule.pattern.SubexpIndex("artist"); i >= 0 {
+			artist = strings.TrimSpace(match[i])
+		}
+		title = strings.TrimSpace(match[rule.pattern.SubexpIndex("title")])
+		if title == "" {
+			continue
+		}
+		return artist, title, true
+	}
+
+	return "", "", false
+}
+
+// streamTracker remembers when the current ICY title started so that each
+// title on a stream is scrobbled once it has played long enough.
+type streamTracker struct {
+	title string
+	since time.Time
+}
+
+func (s *streamTracker) playedLongEnough(icyTitle string, now time.Time) bool {
+	if icyTitle != s.title {
+		s.title = icyTitle
+		s.since = now
+	}
+	return now.Sub(s.since) > scrobbleThreshold
+}
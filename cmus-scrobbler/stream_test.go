@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCmusStatusStream(t *testing.T) {
+	status, err := parseCmusStatus(`status playing
+file http://ice.example.com/radio.mp3
+duration -1
+position 95
+stream Boards of Canada - Roygbiv
+tag title Example Radio
+`)
+	if err != nil {
+		t.Fatalf("parseCmusStatus: %v", err)
+	}
+	if status.File != "http://ice.example.com/radio.mp3" {
+		t.Errorf("file = %q", status.File)
+	}
+	if status.Stream != "Boards of Canada - Roygbiv" {
+		t.Errorf("stream = %q", status.Stream)
+	}
+	if status.Duration != -1 {
+		t.Errorf("duration = %d", status.Duration)
+	}
+}
+
+func TestParseStreamTitle(t *testing.T) {
+	rules, err := compileStreamRules([]StreamRule{
+		{Station: `somafm\.com`, Pattern: `^(?P<title>.+?) by (?P<artist>.+)$`},
+	})
+	if err != nil {
+		t.Fatalf("compileStreamRules: %v", err)
+	}
+
+	tests := []struct {
+		station, icy, artist, title string
+		ok                          bool
+	}{
+		{"http://ice.somafm.com/groovesalad", "Roygbiv by Boards of Canada", "Boards of Canada", "Roygbiv", true},
+		{"http://other.example.com/live", "Boards of Canada - Roygbiv", "Boards of Canada", "Roygbiv", true},
+		{"http://other.example.com/live", "Station ID", "", "", false},
+		{"http://other.example.com/live", "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		artist, title, ok := parseStreamTitle(rules, tt.station, tt.icy)
+		if artist != tt.artist || title != tt.title || ok != tt.ok {
+			t.Errorf("parseStreamTitle(%q, %q) = %q, %q, %v; want %q, %q, %v",
+				tt.station, tt.icy, artist, title, ok, tt.artist, tt.title, tt.ok)
+		}
+	}
+}
+
+func TestStreamTrackerThreshold(t *testing.T) {
+	var tracker streamTracker
+	start := time.Unix(1700000000, 0)
+
+	if tracker.playedLongEnough("A - B", start) {
+		t.Fatal("new title should not be scrobbled immediately")
+	}
+	if !tracker.playedLongEnough("A - B", start.Add(scrobbleThreshold+time.Second)) {
+		t.Fatal("title should be scrobbled after the threshold")
+	}
+	if tracker.playedLongEnough("C - D", start.Add(2*scrobbleThreshold)) {
+		t.Fatal("title change should restart the threshold")
+	}
+}
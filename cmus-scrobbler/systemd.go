@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const serviceName = "cmus-scrobbler"
+
+// sdNotify sends state to systemd when run as a Type=notify service. It
+// does nothing when $NOTIFY_SOCKET isn't set.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ is an abstract socket.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("error notifying systemd: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("error notifying systemd: %w", err)
+	}
+	return nil
+}
+
+func notifySystemd(state string) {
+	if err := sdNotify(state); err != nil {
+		slog.Warn("systemd notification failed", "state", state, "err", err)
+	}
+}
+
+// watchdogInterval returns the watchdog timeout systemd set for this
+// process, or 0 when there is none.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdog pings systemd's watchdog at half its timeout for as long as the
+// run loop keeps polling, so a hung loop gets the service restarted.
+func watchdog(ctx context.Context, d *daemon, timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if time.Since(d.lastBeat()) < timeout {
+				notifySystemd("WATCHDOG=1")
+			} else {
+				slog.Warn("run loop is not polling, not pinging the watchdog", "last_poll", d.lastBeat())
+			}
+		}
+	}
+}
+
+// systemdQuote quotes an ExecStart argument if it needs it.
+func systemdQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\$%;") {
+		return arg
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", "$$", "%", "%%")
+	return `"` + r.Replace(arg) + `"`
+}
+
+// serviceUnit returns a systemd user unit running args as a notify service
+// with a watchdog.
+func serviceUnit(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = systemdQuote(arg)
+	}
+	return fmt.Sprintf(`[Unit]
+Description=Scrobble cmus to Nostr
+
+[Service]
+Type=notify
+ExecStart=%s
+ExecReload=/bin/kill -HUP $MAINPID
+WatchdogSec=2min
+Restart=on-failure
+RestartSec=10
+TimeoutStopSec=30
+
+[Install]
+WantedBy=default.target
+`, strings.Join(quoted, " "))
+}
+
+func userUnitDir() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "systemd", "user"), nil
+}
+
+func cmdInstallService(ctx *cliContext, args []string) error {
+	fs := flag.NewFlagSet("install-service", flag.ExitOnError)
+	force := fs.Bool("force", false, "Overwrite an existing unit")
+	printUnit := fs.Bool("print", false, "Print the unit instead of writing it")
+	fs.Parse(args)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error finding the executable: %w", err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return fmt.Errorf("error finding the executable: %w", err)
+	}
+	execArgs := []string{exe}
+	if ctx.configPath != "" {
+		configPath, err := filepath.Abs(ctx.configPath)
+		if err != nil {
+			return err
+		}
+		execArgs = append(execArgs, "-config", configPath)
+	}
+	if ctx.profile != "" {
+		execArgs = append(execArgs, "-profile", ctx.profile)
+	}
+	unit := serviceUnit(append(execArgs, "run"))
+
+	if *printUnit {
+		fmt.Print(unit)
+		return nil
+	}
+
+	dir, err := userUnitDir()
+	if err != nil {
+		return fmt.Errorf("error finding the systemd user directory: %w", err)
+	}
+	path := filepath.Join(dir, serviceName+".service")
+	if _, err := os.Stat(path); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", path)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating %s: %w", dir, err)
+	}
+	if err := os.WriteFile(path, []byte(unit), 0644); err != nil {
+		return fmt.Errorf("error writing unit: %w", err)
+	}
+
+	fmt.Println("Wrote", path)
+	fmt.Println("Start it with:")
+	fmt.Println("  systemctl --user daemon-reload")
+	fmt.Printf("  systemctl --user enable --now %s\n", serviceName)
+	return nil
+}
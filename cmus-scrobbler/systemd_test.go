@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("sdNotify: %v", err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Errorf("received %q, %v", buf[:n], err)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify without a socket: %v", err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "120000000")
+	t.Setenv("WATCHDOG_PID", "")
+	if got := watchdogInterval(); got != 2*time.Minute {
+		t.Errorf("watchdogInterval() = %v, want 2m", got)
+	}
+	t.Setenv("WATCHDOG_PID", "1")
+	if got := watchdogInterval(); got != 0 {
+		t.Errorf("watchdogInterval() for another process = %v", got)
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if got := watchdogInterval(); got != 2*time.Minute {
+		t.Errorf("watchdogInterval() for this process = %v", got)
+	}
+}
+
+func TestServiceUnit(t *testing.T) {
+	unit := serviceUnit([]string{"/usr/local/bin/cmus-scrobbler", "-config", "/home/me/My Music/scrobbler.yaml", "run"})
+	for _, want := range []string{
+		`ExecStart=/usr/local/bin/cmus-scrobbler -config "/home/me/My Music/scrobbler.yaml" run`,
+		"Type=notify",
+		"ExecReload=/bin/kill -HUP $MAINPID",
+		"WatchdogSec=",
+		"WantedBy=default.target",
+	} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit is missing %q:\n%s", want, unit)
+		}
+	}
+	if got := systemdQuote("50%$off"); got != `"50%%$$off"` {
+		t.Errorf("systemdQuote = %s", got)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// trackGroup collects the scrobbles of one recording.
+type trackGroup struct {
+	plays       int
+	names       map[string]int // "artist\ntitle" as scrobbled
+	albums      map[string]int
+	mbid        string
+	identifiers []string
+	image       string
+	latest      nostr.Timestamp
+}
+
+// scrobbleIdentifiers returns the "i" tag values of ev and its recording
+// MBID, taken from an "mbid" tag or an "i" tag of the mbid:recording form.
+func scrobbleIdentifiers(ev *nostr.Event) (mbid string, ids []string) {
+	for _, tag := range ev.Tags {
+		if len(tag) < 2 || tag[1] == "" {
+			continue
+		}
+		switch tag[0] {
+		case "mbid":
+			mbid = tag[1]
+		case "i":
+			ids = append(ids, tag[1])
+			if id, ok := strings.CutPrefix(tag[1], "mbid:recording:"); ok && mbid == "" {
+				mbid = id
+			}
+		}
+	}
+	return mbid, ids
+}
+
+// coverArtURL returns the "r" tag of ev if it points at an image. Scrobbles
+// from cmus use "r" for the stream URL instead.
+func coverArtURL(ev *nostr.Event) string {
+	for _, tag := range ev.Tags {
+		if len(tag) < 2 || tag[0] != "r" {
+			continue
+		}
+		u, err := url.Parse(tag[1])
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(path.Ext(u.Path)) {
+		case ".jpg", ".jpeg", ".png", ".webp", ".gif":
+			return tag[1]
+		}
+		if u.Host == "coverartarchive.org" {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+// mostCommon returns the key with the highest count, breaking ties by key
+// so the result doesn't depend on map order.
+func mostCommon(counts map[string]int) string {
+	best, bestCount := "", 0
+	for key, count := range counts {
+		if count > bestCount || (count == bestCount && key < best) {
+			best, bestCount = key, count
+		}
+	}
+	return best
+}
+
+// mergeScrobbles groups public scrobble events by recording and returns one
+// AudioTrack per recording, ordered by play count. Scrobbles are grouped by
+// MBID, and scrobbles without one join the group of another scrobble with
+// the same normalized artist and title.
+func mergeScrobbles(events []*nostr.Event) []AudioTrack {
+	// First find the MBID scrobbled for each name, so scrobbles without one
+	// can join the group.
+	nameMbids := make(map[string]string)
+	for _, ev := range events {
+		scrobble := scrobbleFromTags(ev)
+		if mbid, _ := scrobbleIdentifiers(ev); mbid != "" {
+			key := trackNameKey(scrobble.Artist, scrobble.Track)
+			if _, ok := nameMbids[key]; !ok {
+				nameMbids[key] = mbid
+			}
+		}
+	}
+
+	groups := make(map[string]*trackGroup)
+	var order []string
+	for _, ev := range events {
+		scrobble := scrobbleFromTags(ev)
+		if scrobble.Artist == "" || scrobble.Track == "" {
+			continue
+		}
+		mbid, ids := scrobbleIdentifiers(ev)
+		if mbid == "" {
+			mbid = nameMbids[trackNameKey(scrobble.Artist, scrobble.Track)]
+		}
+		key := "mbid:" + mbid
+		if mbid == "" {
+			key = "name:" + trackNameKey(scrobble.Artist, scrobble.Track)
+		}
+
+		g, ok := groups[key]
+		if !ok {
+			g = &trackGroup{names: make(map[string]int), albums: make(map[string]int), mbid: mbid}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.plays++
+		g.names[scrobble.Artist+"\n"+scrobble.Track]++
+		if scrobble.Album != "" {
+			g.albums[scrobble.Album]++
+		}
+		for _, id := range ids {
+			if !containsString(g.identifiers, id) {
+				g.identifiers = append(g.identifiers, id)
+			}
+		}
+		if image := coverArtURL(ev); image != "" && ev.CreatedAt >= g.latest {
+			g.image = image
+		}
+		g.latest = max(g.latest, ev.CreatedAt)
+	}
+
+	tracks := make([]AudioTrack, 0, len(groups))
+	plays := make(map[string]int)
+	for _, key := range order {
+		g := groups[key]
+		artist, title, _ := strings.Cut(mostCommon(g.names), "\n")
+		sort.Strings(g.identifiers)
+		t := AudioTrack{
+			Artist:      artist,
+			Title:       title,
+			Album:       mostCommon(g.albums),
+			MbID:        g.mbid,
+			Identifiers: g.identifiers,
+			Image:       g.image,
+		}
+		plays[t.DTag()] = g.plays
+		tracks = append(tracks, t)
+	}
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return plays[tracks[i].DTag()] > plays[tracks[j].DTag()]
+	})
+	return tracks
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// diffTags returns the tags only in old and only in new.
+func diffTags(old, new nostr.Tags) (removed, added []nostr.Tag) {
+	has := func(tags nostr.Tags, tag nostr.Tag) bool {
+		for _, t := range tags {
+			if strings.Join(t, "\x00") == strings.Join(tag, "\x00") {
+				return true
+			}
+		}
+		return false
+	}
+	for _, tag := range old {
+		if !has(new, tag) {
+			removed = append(removed, tag)
+		}
+	}
+	for _, tag := range new {
+		if !has(old, tag) {
+			added = append(added, tag)
+		}
+	}
+	return removed, added
+}
+
+func printTrackDiff(ev, current *nostr.Event) {
+	if current == nil {
+		fmt.Printf("+ %s (d=%s)\n", ev.Content, ev.Tags.GetD())
+		return
+	}
+	fmt.Printf("~ %s (d=%s)\n", ev.Content, ev.Tags.GetD())
+	if current.Content != ev.Content {
+		fmt.Printf("    - content %q\n", current.Content)
+		fmt.Printf("    + content %q\n", ev.Content)
+	}
+	removed, added := diffTags(current.Tags, ev.Tags)
+	for _, tag := range removed {
+		fmt.Printf("    - %q\n", []string(tag))
+	}
+	for _, tag := range added {
+		fmt.Printf("    + %q\n", []string(tag))
+	}
+}
+
+// cmdTracks converts the user's scrobbles into kind 31337 audio track
+// events, one per recording.
+func cmdTracks(ctx *cliContext, args []string) error {
+	fs := flag.NewFlagSet("tracks", flag.ExitOnError)
+	since := fs.String("since", "", "Only use scrobbles at or after this date (YYYY-MM-DD or RFC3339)")
+	until := fs.String("until", "", "Only use scrobbles before this date (YYYY-MM-DD or RFC3339)")
+	dryRun := fs.Bool("dry-run", false, "Show how the tracks differ from those on relays without publishing")
+	fs.Parse(args)
+
+	sinceTS, untilTS, err := historyRange(*since, *until)
+	if err != nil {
+		return err
+	}
+
+	// Private scrobbles are left out; publishing them as tracks would
+	// reveal them.
+	var events []*nostr.Event
+	err = ctx.nostr.WalkHistory(sinceTS, untilTS, func(ev *nostr.Event) error {
+		if ev.Kind != KindScrobble {
+			return nil
+		}
+		if ok, _ := ev.CheckSignature(); !ok {
+			return nil
+		}
+		events = append(events, ev)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error reading history: %w", err)
+	}
+
+	tracks := mergeScrobbles(events)
+	fmt.Printf("%d scrobbles of %d recordings\n", len(events), len(tracks))
+	if len(tracks) == 0 {
+		return nil
+	}
+
+	dTags := make([]string, len(tracks))
+	for i, t := range tracks {
+		dTags[i] = t.DTag()
+	}
+	existing, err := ctx.nostr.QueryAddressable(KindAudioTrack, dTags)
+	if err != nil {
+		return err
+	}
+
+	changed, unchanged := 0, 0
+	for _, t := range tracks {
+		current := existing[t.DTag()]
+		ev := updateAudioTrackEvent(t, current)
+		if current != nil && sameEventContent(&ev, current) {
+			unchanged++
+			continue
+		}
+		changed++
+
+		if *dryRun {
+			printTrackDiff(&ev, current)
+			continue
+		}
+		if _, err := ctx.nostr.publishIfChanged(&ev, current, false); err != nil {
+			return fmt.Errorf("error publishing %s: %w", ev.Content, err)
+		}
+		fmt.Printf("Published %s (d=%s)\n", ev.Content, t.DTag())
+	}
+
+	verb := "Published"
+	if *dryRun {
+		verb = "Would publish"
+	}
+	fmt.Printf("%s %d tracks, %d already up to date\n", verb, changed, unchanged)
+	return nil
+}
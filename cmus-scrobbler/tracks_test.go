@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func scrobbleFixture(createdAt nostr.Timestamp, tags ...nostr.Tag) *nostr.Event {
+	return &nostr.Event{Kind: KindScrobble, CreatedAt: createdAt, Tags: tags}
+}
+
+func TestMergeScrobbles(t *testing.T) {
+	events := []*nostr.Event{
+		scrobbleFixture(100,
+			nostr.Tag{"artist", "Phosphorescent"},
+			nostr.Tag{"track", "The Quotidian Beasts"},
+			nostr.Tag{"album", "Muchacho"},
+			nostr.Tag{"i", "mbid:recording:rec-1"},
+			nostr.Tag{"i", "mbid:release:rel-1"},
+			nostr.Tag{"r", "https://coverartarchive.org/release-group/rg-1/front"},
+		),
+		// Same recording without an MBID, in other case.
+		scrobbleFixture(200,
+			nostr.Tag{"artist", "phosphorescent"},
+			nostr.Tag{"track", "The Quotidian  Beasts"},
+			nostr.Tag{"album", "Muchacho"},
+		),
+		// An MBID from cmus's mbid tag.
+		scrobbleFixture(300,
+			nostr.Tag{"artist", "Phosphorescent"},
+			nostr.Tag{"track", "The Quotidian Beasts"},
+			nostr.Tag{"album", "Muchacho de Lujo"},
+			nostr.Tag{"mbid", "rec-1"},
+		),
+		scrobbleFixture(400,
+			nostr.Tag{"artist", "Low"},
+			nostr.Tag{"track", "Words"},
+			nostr.Tag{"r", "http://stream.example.com/radio"},
+		),
+		scrobbleFixture(500, nostr.Tag{"artist", "No Title"}),
+	}
+
+	tracks := mergeScrobbles(events)
+	if len(tracks) != 2 {
+		t.Fatalf("mergeScrobbles returned %d tracks, want 2: %+v", len(tracks), tracks)
+	}
+
+	first := tracks[0]
+	if first.MbID != "rec-1" || first.DTag() != "rec-1" {
+		t.Errorf("merged track MBID = %q, d = %q, want rec-1", first.MbID, first.DTag())
+	}
+	if first.Artist != "Phosphorescent" || first.Title != "The Quotidian Beasts" || first.Album != "Muchacho" {
+		t.Errorf("merged track = %+v", first)
+	}
+	if len(first.Identifiers) != 2 || first.Image == "" {
+		t.Errorf("merged track identifiers = %v, image = %q", first.Identifiers, first.Image)
+	}
+
+	second := tracks[1]
+	if second.Artist != "Low" || second.MbID != "" || second.Image != "" {
+		t.Errorf("second track = %+v, want Low without MBID or image", second)
+	}
+	if second.DTag() != (AudioTrack{Artist: "LOW", Title: "words"}).DTag() {
+		t.Error("d tag without MBID is not derived from the normalized name")
+	}
+
+	// The same input gives the same events, so reruns change nothing.
+	again := mergeScrobbles(events)
+	for i := range tracks {
+		a, b := audioTrackEvent(tracks[i]), audioTrackEvent(again[i])
+		if !sameEventContent(&a, &b) {
+			t.Errorf("track %d differs between runs: %v vs %v", i, a.Tags, b.Tags)
+		}
+	}
+}
+
+func TestDiffTags(t *testing.T) {
+	old := nostr.Tags{{"d", "x"}, {"title", "Words"}, {"c", "Low", "artist"}}
+	new := nostr.Tags{{"d", "x"}, {"title", "Words"}, {"c", "Low", "artist"}, {"c", "Slowcore", "genre"}}
+
+	removed, added := diffTags(old, new)
+	if len(removed) != 0 || len(added) != 1 || added[0][1] != "Slowcore" {
+		t.Errorf("diffTags = -%v +%v", removed, added)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd || dragonfly)
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var resizeSignals []os.Signal
+
+func isTerminal(f *os.File) bool {
+	return false
+}
+
+func makeCbreak(f *os.File) (func(), error) {
+	return nil, errors.New("terminal UI is not supported on this platform")
+}
+
+func terminalSize(f *os.File) (width, height int, err error) {
+	return 0, 0, errors.New("terminal UI is not supported on this platform")
+}
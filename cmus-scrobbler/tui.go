@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	tuiRecentScrobbles = 8
+	tuiFriends         = 8
+	tuiLogLines        = 100
+)
+
+var errNotTerminal = errors.New("not attached to a terminal")
+
+type tuiScrobble struct {
+	ID   string
+	At   time.Time
+	Text string
+}
+
+// tui is the full-screen view of run: the playing track, relays, recent
+// scrobbles, friends' scrobbles and the log, with keys for the local API's
+// commands.
+type tui struct {
+	term  *os.File
+	d     *daemon
+	nostr *Nostr
+
+	mu          sync.Mutex
+	status      DaemonStatus
+	recent      []tuiScrobble
+	friends     []feedEntry
+	friendsNote string
+	logs        []string
+	message     string
+	width       int
+	height      int
+
+	redraw chan struct{}
+	quit   chan struct{}
+}
+
+func newTUI(d *daemon, n *Nostr, width, height int) *tui {
+	return &tui{
+		d:           d,
+		nostr:       n,
+		status:      d.Status(),
+		friendsNote: "loading…",
+		width:       width,
+		height:      height,
+		redraw:      make(chan struct{}, 1),
+		quit:        make(chan struct{}),
+	}
+}
+
+// startTUI takes over the terminal. Everything written to stdout, stderr
+// or the logger is shown in the log pane instead. It returns
+// errNotTerminal when stdin or stdout isn't a terminal. quit is called
+// when the user quits. The returned function gives the terminal back.
+func startTUI(d *daemon, n *Nostr, logConfig LogConfig, quit func()) (func(), error) {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return nil, errNotTerminal
+	}
+	term := os.Stdout
+	width, height, err := terminalSize(term)
+	if err != nil {
+		return nil, err
+	}
+	restoreInput, err := makeCbreak(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+
+	logR, logW, err := os.Pipe()
+	if err != nil {
+		restoreInput()
+		return nil, err
+	}
+	stdout, stderr, logger := os.Stdout, os.Stderr, slog.Default()
+	os.Stdout, os.Stderr = logW, logW
+	// The log pane shows the time itself, and always as text.
+	logConfig.Format = "text"
+	slog.SetDefault(slog.New(newLogHandler(logConfig, logW, slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})))
+
+	t := newTUI(d, n, width, height)
+	t.term = term
+	fmt.Fprint(term, "\x1b[?1049h\x1b[?25l")
+
+	go t.readLogs(logR)
+	go t.watchStatus()
+	go t.readKeys(os.Stdin)
+	go t.loadRecent()
+	go t.followFriends()
+	go t.drawLoop()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			fmt.Fprint(term, "\x1b[?25h\x1b[?1049l")
+			restoreInput()
+			os.Stdout, os.Stderr = stdout, stderr
+			slog.SetDefault(logger)
+			logW.Close()
+		})
+	}
+
+	resize := make(chan os.Signal, 1)
+	signal.Notify(resize, resizeSignals...)
+	go func() {
+		for {
+			select {
+			case <-t.quit:
+				signal.Stop(resize)
+				quit()
+				return
+			case <-resize:
+				if width, height, err := terminalSize(term); err == nil {
+					t.mu.Lock()
+					t.width, t.height = width, height
+					t.mu.Unlock()
+				}
+				t.requestRedraw()
+			}
+		}
+	}()
+
+	return stop, nil
+}
+
+func (t *tui) requestRedraw() {
+	select {
+	case t.redraw <- struct{}{}:
+	default:
+	}
+}
+
+func (t *tui) drawLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		t.draw()
+		select {
+		case <-t.redraw:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *tui) draw() {
+	lines := t.render(time.Now())
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\x1b[K")
+		if i < len(lines)-1 {
+			b.WriteString("\r\n")
+		}
+	}
+	b.WriteString("\x1b[J")
+	t.term.WriteString(b.String())
+}
+
+func (t *tui) readLogs(r *os.File) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		t.addLog(time.Now(), scanner.Text())
+	}
+}
+
+func (t *tui) addLog(at time.Time, line string) {
+	t.mu.Lock()
+	t.logs = append(t.logs, at.Format("15:04:05")+" "+line)
+	if len(t.logs) > tuiLogLines {
+		t.logs = t.logs[len(t.logs)-tuiLogLines:]
+	}
+	t.mu.Unlock()
+	t.requestRedraw()
+}
+
+func (t *tui) watchStatus() {
+	updates, unsubscribe := t.d.Subscribe()
+	defer unsubscribe()
+	for status := range updates {
+		t.mu.Lock()
+		t.status = status
+		t.mu.Unlock()
+		if status.LastEvent != nil {
+			t.addScrobble(status.LastEvent)
+		}
+		t.requestRedraw()
+	}
+}
+
+func (t *tui) loadRecent() {
+	events, err := t.nostr.QueryRecentScrobbles(tuiRecentScrobbles)
+	if err != nil {
+		slog.Warn("error loading recent scrobbles", "err", err)
+		return
+	}
+	for i := range events {
+		t.addScrobble(&events[i])
+	}
+}
+
+func (t *tui) addScrobble(ev *nostr.Event) {
+	text := "[private]"
+	if scrobble, err := t.nostr.ScrobbleFromEvent(ev); err == nil {
+		text = fmt.Sprintf("%s - %s", scrobble.Artist, scrobble.Track)
+		if scrobble.Private {
+			text += " [private]"
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.recent {
+		if s.ID == ev.ID {
+			return
+		}
+	}
+	t.recent = append(t.recent, tuiScrobble{ID: ev.ID, At: ev.CreatedAt.Time(), Text: text})
+	sort.Slice(t.recent, func(i, j int) bool { return t.recent[i].At.After(t.recent[j].At) })
+	if len(t.recent) > tuiRecentScrobbles {
+		t.recent = t.recent[:tuiRecentScrobbles]
+	}
+}
+
+func (t *tui) setFriendsNote(note string) {
+	t.mu.Lock()
+	t.friendsNote = note
+	t.mu.Unlock()
+	t.requestRedraw()
+}
+
+// followFriends fills the friends pane from the contact list, like the feed
+// command.
+func (t *tui) followFriends() {
+	contacts, err := t.nostr.FetchContacts()
+	if err != nil {
+		slog.Warn("friends activity is unavailable", "err", err)
+		t.setFriendsNote("unavailable")
+		return
+	}
+	if len(contacts) == 0 {
+		t.setFriendsNote("you don't follow anyone yet")
+		return
+	}
+	names, err := t.nostr.FetchNames(contacts)
+	if err != nil {
+		slog.Warn("error resolving names", "err", err)
+	}
+
+	since := nostr.Now()
+	recent, err := t.nostr.queryFeed(contacts, tuiFriends)
+	if err != nil {
+		slog.Warn("error loading friends activity", "err", err)
+	}
+	t.setFriendsNote("no scrobbles yet")
+	for _, ev := range recent {
+		t.addFriend(ev, names)
+	}
+
+	events, err := t.nostr.SubscribeEvents(context.Background(), authorFilters(nostr.Filter{Kinds: []int{KindScrobble}, Since: &since}, contacts)...)
+	if err != nil {
+		slog.Warn("error following friends", "err", err)
+		return
+	}
+	for ev := range events {
+		t.addFriend(ev, names)
+	}
+}
+
+func (t *tui) addFriend(ev *nostr.Event, names map[string]string) {
+	entry, ok := newFeedEntry(ev, names)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	for _, e := range t.friends {
+		if e.ID == entry.ID {
+			t.mu.Unlock()
+			return
+		}
+	}
+	t.friends = append([]feedEntry{entry}, t.friends...)
+	if len(t.friends) > tuiFriends {
+		t.friends = t.friends[:tuiFriends]
+	}
+	t.mu.Unlock()
+	t.requestRedraw()
+}
+
+func (t *tui) readKeys(in *os.File) {
+	buf := make([]byte, 16)
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			return
+		}
+		// Longer reads are escape sequences such as arrow keys.
+		if n == 1 {
+			t.handleKey(buf[0])
+		}
+	}
+}
+
+func (t *tui) setMessage(message string) {
+	t.mu.Lock()
+	t.message = message
+	t.mu.Unlock()
+	t.requestRedraw()
+}
+
+func (t *tui) handleKey(key byte) {
+	report := func(err error, done string) {
+		if err != nil {
+			t.setMessage("Error: " + err.Error())
+		} else {
+			t.setMessage(done)
+		}
+	}
+
+	switch key {
+	case 'l':
+		t.setMessage("Loving…")
+		report(t.d.LoveTrack(true), "Loved the playing track")
+	case 'u':
+		t.setMessage("Unloving…")
+		report(t.d.LoveTrack(false), "Unloved the playing track")
+	case 's':
+		report(t.d.SkipTrack(), "This track won't be scrobbled")
+	case 'f':
+		report(t.d.ForceScrobble(), "Scrobbling now")
+	case 'r':
+		report(t.d.RetryQueue(), "Retrying queued scrobbles")
+	case 'p':
+		paused := !t.d.Status().ScrobblingPaused
+		t.d.SetPaused(paused)
+		if paused {
+			t.setMessage("Scrobbling paused")
+		} else {
+			t.setMessage("Scrobbling resumed")
+		}
+	case 'q':
+		select {
+		case <-t.quit:
+		default:
+			close(t.quit)
+		}
+	}
+}
+
+// render lays out the screen as lines no wider than the terminal.
+func (t *tui) render(now time.Time) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := t.status
+
+	var lines []string
+	add := func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	state := strings.ReplaceAll(status.Player, "_", " ")
+	if status.ScrobblingPaused {
+		state += ", scrobbling paused"
+	}
+	lines = append(lines, spread("cmus-scrobbler · "+state, now.Format("15:04:05"), t.width))
+	lines = append(lines, strings.Repeat("─", t.width))
+
+	add("Now playing")
+	if track := status.Track; track == nil {
+		add("  nothing")
+	} else {
+		add("  %s - %s", track.Artist, track.Track)
+		var details []string
+		if track.Album != "" {
+			details = append(details, track.Album)
+		}
+		if track.Duration > 0 {
+			details = append(details, fmt.Sprintf("%s / %s", clock(track.Position), clock(track.Duration)))
+		}
+		if track.Profile != "" {
+			details = append(details, "profile "+track.Profile)
+		}
+		if len(details) > 0 {
+			add("  %s", strings.Join(details, " · "))
+		}
+		barWidth := max(10, min(30, t.width-30))
+		add("  %s %s", progressBar(track.Progress, barWidth), scrobbleState(track, status.ScrobblingPaused))
+	}
+
+	add("")
+	lines = append(lines, spread("Relays", fmt.Sprintf("queue %d", status.QueueDepth), t.width))
+	for _, relay := range status.Relays {
+		state, detail := "ok", ""
+		switch {
+		case !relay.Connected:
+			state = "down"
+		case relay.LastError != "":
+			state, detail = "error", relay.LastError
+		case relay.LastPublish != nil:
+			detail = "published " + ago(now, *relay.LastPublish)
+		}
+		add("  %-5s %s  %s", state, relay.URL, detail)
+	}
+	if len(status.Relays) == 0 {
+		add("  no publishes yet")
+	}
+
+	add("")
+	add("Recent scrobbles")
+	for _, s := range t.recent {
+		add("  %s  %s", s.At.Local().Format("15:04"), s.Text)
+	}
+	if len(t.recent) == 0 {
+		add("  none yet")
+	}
+
+	add("")
+	add("Friends")
+	for _, entry := range t.friends {
+		name := entry.Name
+		if name == "" {
+			name = shortNpub(entry.Pubkey)
+		}
+		add("  %s  %-16s  %s - %s", entry.Time.Local().Format("15:04"), truncate(name, 16), entry.Artist, entry.Track)
+	}
+	if len(t.friends) == 0 {
+		add("  %s", t.friendsNote)
+	}
+
+	footer := []string{"", t.message, "l love  u unlove  s skip  f scrobble now  r retry queue  p pause  q quit"}
+	if room := t.height - len(lines) - len(footer) - 2; room > 0 && len(t.logs) > 0 {
+		add("")
+		add("Log")
+		for _, line := range t.logs[max(0, len(t.logs)-room):] {
+			add("  %s", line)
+		}
+	}
+
+	// A short terminal loses the bottom of the body, never the footer.
+	if extra := len(lines) + len(footer) - t.height; extra > 0 {
+		lines = lines[:max(0, len(lines)-extra)]
+	}
+	lines = append(lines, footer...)
+	for i := range lines {
+		lines[i] = truncate(lines[i], t.width)
+	}
+	return lines
+}
+
+func scrobbleState(track *TrackStatus, paused bool) string {
+	switch {
+	case track.Scrobbled:
+		return "scrobbled"
+	case track.Skipped:
+		return "not scrobbling: " + track.SkipReason
+	case paused:
+		return "scrobbling paused"
+	}
+	return fmt.Sprintf("%d%% to scrobble", int(track.Progress*100))
+}
+
+func progressBar(fraction float64, width int) string {
+	filled := int(fraction*float64(width) + 0.5)
+	filled = max(0, min(width, filled))
+	return strings.Repeat("█", filled) + strings.Repeat("░", width-filled)
+}
+
+// clock formats seconds as m:ss.
+func clock(seconds int) string {
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+func ago(now, t time.Time) string {
+	d := now.Sub(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+	return t.Local().Format("Jan 2")
+}
+
+// spread puts left and right at either end of a line of width.
+func spread(left, right string, width int) string {
+	gap := width - utf8.RuneCountInString(left) - utf8.RuneCountInString(right)
+	if gap < 1 {
+		return left
+	}
+	return left + strings.Repeat(" ", gap) + right
+}
+
+// truncate shortens s to width runes, marking the cut with an ellipsis.
+func truncate(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	if width <= 0 {
+		return ""
+	}
+	runes := []rune(s)
+	return string(runes[:width-1]) + "…"
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestTUIRender(t *testing.T) {
+	now := time.Date(2024, 2, 14, 18, 30, 0, 0, time.Local)
+	published := now.Add(-3 * time.Minute)
+
+	ui := newTUI(newDaemon(), nil, 72, 40)
+	ui.status = DaemonStatus{
+		Player: "playing",
+		Track: &TrackStatus{
+			Artist: "Low", Track: "Words", Album: "I Could Live in Hope",
+			Position: 15, Duration: 326, Progress: 0.5,
+		},
+		QueueDepth: 2,
+		Relays: []RelayHealth{
+			{URL: "wss://relay.example.com", Connected: true, LastPublish: &published},
+			{URL: "wss://down.example.com"},
+		},
+	}
+	ui.recent = []tuiScrobble{{ID: "1", At: now.Add(-time.Hour), Text: "Broadcast - Black Cat"}}
+	ui.friends = []feedEntry{{Time: now, Pubkey: alicePK, Name: "Alice", Artist: "Stereolab", Track: "French Disko"}}
+	ui.logs = []string{"18:29:00 level=INFO msg=published"}
+
+	lines := ui.render(now)
+	screen := strings.Join(lines, "\n")
+	for _, want := range []string{
+		"cmus-scrobbler · playing",
+		"Low - Words",
+		"I Could Live in Hope · 0:15 / 5:26",
+		"50% to scrobble",
+		"queue 2",
+		"ok    wss://relay.example.com  published 3m ago",
+		"down  wss://down.example.com",
+		"Broadcast - Black Cat",
+		"Alice",
+		"Stereolab - French Disko",
+		"msg=published",
+		"q quit",
+	} {
+		if !strings.Contains(screen, want) {
+			t.Errorf("screen is missing %q:\n%s", want, screen)
+		}
+	}
+	for i, line := range lines {
+		if n := utf8.RuneCountInString(line); n > 72 {
+			t.Errorf("line %d is %d wide: %q", i, n, line)
+		}
+	}
+	if len(lines) > 40 {
+		t.Errorf("%d lines on a 40 line terminal", len(lines))
+	}
+
+	// A small terminal keeps the key help.
+	ui.width, ui.height = 40, 8
+	lines = ui.render(now)
+	if len(lines) != 8 || !strings.Contains(lines[len(lines)-1], "l love") {
+		t.Errorf("small screen = %q", lines)
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	if got := progressBar(0.5, 10); got != "█████░░░░░" {
+		t.Errorf("progressBar(0.5) = %q", got)
+	}
+	if got := progressBar(1.5, 4); got != "████" {
+		t.Errorf("progressBar(1.5) = %q", got)
+	}
+}
@@ -0,0 +1,657 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// maxWebhookBody bounds webhook request bodies. Plex sends a thumbnail
+// with some events.
+const maxWebhookBody = 4 << 20
+
+// WebhooksConfig enables the media server webhook receiver of run.
+type WebhooksConfig struct {
+	// Listen is the host:port the receiver listens on.
+	Listen    string        `yaml:"listen"`
+	Jellyfin  WebhookSource `yaml:"jellyfin"`
+	Plex      WebhookSource `yaml:"plex"`
+	Navidrome WebhookSource `yaml:"navidrome"`
+}
+
+// WebhookSource is a media server allowed to send plays. It is enabled by
+// setting its secret.
+type WebhookSource struct {
+	Secret string `yaml:"secret"`
+	// Users limits scrobbles to these server users; all users when empty.
+	Users []string `yaml:"users"`
+}
+
+func (s WebhookSource) allows(user string) bool {
+	return len(s.Users) == 0 || slices.ContainsFunc(s.Users, func(u string) bool {
+		return strings.EqualFold(u, user)
+	})
+}
+
+func validateWebhooksConfig(config WebhooksConfig) error {
+	if _, _, err := net.SplitHostPort(config.Listen); err != nil {
+		return fmt.Errorf("listen must be host:port: %w", err)
+	}
+	if config.Jellyfin.Secret == "" && config.Plex.Secret == "" && config.Navidrome.Secret == "" {
+		return errors.New("set the secret of jellyfin, plex or navidrome")
+	}
+	for name, source := range map[string]WebhookSource{"jellyfin": config.Jellyfin, "plex": config.Plex, "navidrome": config.Navidrome} {
+		if source.Secret == "" && len(source.Users) > 0 {
+			return fmt.Errorf("%s has users but no secret", name)
+		}
+	}
+	return nil
+}
+
+type mediaAction int
+
+const (
+	mediaPlay mediaAction = iota
+	mediaPause
+	mediaResume
+	mediaProgress
+	mediaStop
+	// mediaScrobble is the server saying the track counts as played.
+	mediaScrobble
+	// mediaNowPlaying only announces the track; the server sends a
+	// scrobble for it later.
+	mediaNowPlaying
+)
+
+// mediaEvent is a playback event from a media server.
+type mediaEvent struct {
+	// source identifies one player, such as a user on a device, so plays
+	// on different players are tracked apart.
+	source string
+	action mediaAction
+	track  ScrobbleEvent
+	// position is the playback position, or -1 when the event has none.
+	position time.Duration
+	// completed is set on a stop when the server counted the track as
+	// played to the end.
+	completed bool
+	// done is called once the run loop has handled the scrobble of a
+	// listen with its own time.
+	done func()
+}
+
+// mediaTask is something for the run loop to do with a media server play:
+// announce that it started, or scrobble it.
+type mediaTask struct {
+	track   ScrobbleEvent
+	started bool
+	done    func()
+}
+
+type mediaSession struct {
+	track     ScrobbleEvent
+	played    time.Duration
+	resumed   time.Time // zero while paused
+	scrobbled bool
+}
+
+func (s *mediaSession) playedAt(now time.Time) time.Duration {
+	if s.resumed.IsZero() {
+		return s.played
+	}
+	return s.played + now.Sub(s.resumed)
+}
+
+func mediaKey(track ScrobbleEvent) string {
+	return strings.ToLower(track.Artist + " - " + track.Track)
+}
+
+// mediaTracker follows what each media server player is playing and
+// decides, like the cmus loop does, when a play has lasted long enough to
+// scrobble. Plays are handed to the run loop with take.
+type mediaTracker struct {
+	mu       sync.Mutex
+	sessions map[string]*mediaSession
+	ready    []mediaTask
+}
+
+func newMediaTracker() *mediaTracker {
+	return &mediaTracker{sessions: make(map[string]*mediaSession)}
+}
+
+// handle records ev and reports whether there is something for the run
+// loop to take.
+func (t *mediaTracker) handle(ev mediaEvent, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if ev.action == mediaScrobble && ev.track.CreatedAt != 0 {
+		// A listen with its own time stands alone, even when it repeats
+		// the last one.
+		t.ready = append(t.ready, mediaTask{track: ev.track, done: ev.done})
+		return true
+	}
+
+	s := t.sessions[ev.source]
+	if s != nil && mediaKey(s.track) != mediaKey(ev.track) {
+		// A new track without a stop for the last one.
+		t.finish(s, now, false)
+		delete(t.sessions, ev.source)
+		s = nil
+	}
+	if s == nil && ev.action != mediaStop {
+		s = &mediaSession{track: ev.track}
+		t.sessions[ev.source] = s
+		if ev.action != mediaScrobble {
+			t.ready = append(t.ready, mediaTask{track: ev.track, started: true})
+		}
+	}
+
+	switch ev.action {
+	case mediaNowPlaying:
+		// Never scrobbled from here.
+		s.scrobbled = true
+	case mediaPlay, mediaResume, mediaProgress:
+		if s.resumed.IsZero() {
+			s.resumed = now
+		}
+	case mediaPause:
+		s.played = s.playedAt(now)
+		s.resumed = time.Time{}
+	case mediaScrobble:
+		s.played = s.playedAt(now)
+		s.resumed = time.Time{}
+		t.scrobble(s)
+	case mediaStop:
+		if s == nil {
+			// The start was missed, so only the position tells how long
+			// it played.
+			s = &mediaSession{track: ev.track, played: max(0, ev.position)}
+		}
+		t.finish(s, now, ev.completed)
+		delete(t.sessions, ev.source)
+	}
+	return len(t.ready) > 0
+}
+
+func (t *mediaTracker) finish(s *mediaSession, now time.Time, completed bool) {
+	if completed || s.playedAt(now) > scrobbleThreshold {
+		t.scrobble(s)
+	}
+}
+
+func (t *mediaTracker) scrobble(s *mediaSession) {
+	if !s.scrobbled {
+		s.scrobbled = true
+		t.ready = append(t.ready, mediaTask{track: s.track})
+	}
+}
+
+// requeue puts tasks taken with take back in front of those that arrived
+// since.
+func (t *mediaTracker) requeue(tasks []mediaTask) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ready = append(slices.Clone(tasks), t.ready...)
+}
+
+// take returns the tasks waiting for the run loop, including those that
+// have been playing long enough by now. A nil tracker has none.
+func (t *mediaTracker) take(now time.Time) []mediaTask {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, s := range t.sessions {
+		if !s.resumed.IsZero() {
+			t.finish(s, now, false)
+		}
+	}
+	ready := t.ready
+	t.ready = nil
+	return ready
+}
+
+// submitMediaScrobble scrobbles a play from a media server, unless a rule
+// skips it, scrobbling is paused or it was just scrobbled. It reports
+// whether the play was handled: published, queued for retry or skipped on
+// purpose. A play that wasn't, because of an error that may go away, should
+// be submitted again.
+func submitMediaScrobble(d *daemon, targets *profileTargets, scrobble ScrobbleEvent, now time.Time) bool {
+	scrobble, err := scrobble.Normalize()
+	if err != nil {
+		// Retrying won't fix the track.
+		slog.Error("error in media server track", "err", err)
+		return true
+	}
+	at := now
+	if scrobble.CreatedAt != 0 {
+		at = scrobble.CreatedAt.Time()
+	}
+	target, scrobble, rule, publish, err := targets.prepare(scrobble, at)
+	if err != nil {
+		slog.Error("error selecting profile", "err", err)
+		return false
+	}
+	track := fmt.Sprintf("%s - %s", scrobble.Artist, scrobble.Track)
+	if !publish {
+		slog.Info("skipping submission", "track", track, "reason", "matched rule", "rule", rule.Name)
+		return true
+	}
+	if d.Status().ScrobblingPaused {
+		slog.Info("skipping submission", "track", track, "reason", "scrobbling paused")
+		return true
+	}
+	duplicate, err := isRecentDuplicate(target.nostr, track, at)
+	if err != nil {
+		slog.Error("error getting last scrobble", "err", err)
+		return false
+	}
+	if duplicate {
+		slog.Info("skipping submission", "track", track, "reason", "recent duplicate track")
+		return true
+	}
+
+	ev, err := target.nostr.CreateScrobbleEvent(scrobble)
+	if err != nil {
+		slog.Error("error creating scrobble event", "err", err)
+		return false
+	}
+	slog.Info("new scrobble", "track", track, "profile", target.profile, "id", ev.ID)
+	d.publish(target.profile, target.nostr, ev)
+	return true
+}
+
+// handleMediaPlays passes the plays media servers and Last.fm sent to the
+// rest of the run loop. When a scrobble can't be handled yet, it and the
+// plays after it are put back for the next poll, so they stay in order and
+// a Last.fm cursor never moves past a scrobble that was lost.
+func handleMediaPlays(d *daemon, targets *profileTargets, now time.Time) {
+	plays := d.media.take(now)
+	for i, play := range plays {
+		if play.started {
+			startTrack(d, targets, play.track, &TrackStatus{
+				Artist:   play.track.Artist,
+				Track:    play.track.Track,
+				Duration: play.track.Duration,
+			}, now)
+			continue
+		}
+		if !submitMediaScrobble(d, targets, play.track, now) {
+			d.media.requeue(plays[i:])
+			return
+		}
+		if play.done != nil {
+			play.done()
+		}
+	}
+}
+
+// checkSecret reports whether r carries secret in the X-Webhook-Secret
+// header or the secret query parameter. Plex can only be given a URL.
+func checkSecret(r *http.Request, secret string) bool {
+	given := r.Header.Get("X-Webhook-Secret")
+	if given == "" {
+		given = r.URL.Query().Get("secret")
+	}
+	return secret != "" && subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1
+}
+
+// webhookReceiver serves the media server endpoints.
+type webhookReceiver struct {
+	config  WebhooksConfig
+	tracker *mediaTracker
+	// notify is called when the tracker has plays for the run loop.
+	notify func()
+	now    func() time.Time
+}
+
+func (w *webhookReceiver) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhooks/jellyfin", w.jellyfin)
+	mux.HandleFunc("/webhooks/plex", w.plex)
+	mux.HandleFunc("/listenbrainz/1/validate-token", w.listenBrainzValidate)
+	mux.HandleFunc("/listenbrainz/1/submit-listens", w.listenBrainzSubmit)
+	return mux
+}
+
+func (w *webhookReceiver) handle(events ...mediaEvent) {
+	ready := false
+	for _, ev := range events {
+		if w.tracker.handle(ev, w.now()) {
+			ready = true
+		}
+	}
+	if ready {
+		w.notify()
+	}
+}
+
+func (w *webhookReceiver) jellyfin(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkSecret(r, w.config.Jellyfin.Secret) {
+		http.Error(rw, "wrong or missing secret", http.StatusUnauthorized)
+		return
+	}
+	var payload jellyfinPayload
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxWebhookBody)).Decode(&payload); err != nil {
+		http.Error(rw, "invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ev, ok := payload.mediaEvent()
+	if ok && w.config.Jellyfin.allows(payload.NotificationUsername) {
+		slog.Debug("jellyfin webhook", "type", payload.NotificationType, "user", payload.NotificationUsername, "track", ev.track.Artist+" - "+ev.track.Track)
+		w.handle(ev)
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (w *webhookReceiver) plex(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkSecret(r, w.config.Plex.Secret) {
+		http.Error(rw, "wrong or missing secret", http.StatusUnauthorized)
+		return
+	}
+	r.Body = http.MaxBytesReader(rw, r.Body, maxWebhookBody)
+	if err := r.ParseMultipartForm(maxWebhookBody); err != nil {
+		http.Error(rw, "invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var payload plexPayload
+	if err := json.Unmarshal([]byte(r.FormValue("payload")), &payload); err != nil {
+		http.Error(rw, "invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ev, ok := payload.mediaEvent()
+	if ok && w.config.Plex.allows(payload.Account.Title) {
+		slog.Debug("plex webhook", "event", payload.Event, "user", payload.Account.Title, "track", ev.track.Artist+" - "+ev.track.Track)
+		w.handle(ev)
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// listenBrainzToken checks the token Navidrome sends as
+// "Authorization: Token <token>".
+func (w *webhookReceiver) listenBrainzToken(rw http.ResponseWriter, r *http.Request) bool {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Token ")
+	secret := w.config.Navidrome.Secret
+	if secret == "" || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(secret)) != 1 {
+		writeListenBrainz(rw, http.StatusUnauthorized, map[string]any{"code": http.StatusUnauthorized, "error": "Invalid authorization token."})
+		return false
+	}
+	return true
+}
+
+func writeListenBrainz(rw http.ResponseWriter, code int, body any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(body)
+}
+
+func (w *webhookReceiver) listenBrainzValidate(rw http.ResponseWriter, r *http.Request) {
+	if !w.listenBrainzToken(rw, r) {
+		return
+	}
+	writeListenBrainz(rw, http.StatusOK, map[string]any{"code": http.StatusOK, "message": "Token valid.", "valid": true, "user_name": "cmus-scrobbler"})
+}
+
+func (w *webhookReceiver) listenBrainzSubmit(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !w.listenBrainzToken(rw, r) {
+		return
+	}
+	var payload listenBrainzSubmission
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxWebhookBody)).Decode(&payload); err != nil {
+		writeListenBrainz(rw, http.StatusBadRequest, map[string]any{"code": http.StatusBadRequest, "error": "Invalid JSON: " + err.Error()})
+		return
+	}
+	events := payload.mediaEvents()
+	slog.Debug("listenbrainz submission", "type", payload.ListenType, "listens", len(events))
+	w.handle(events...)
+	writeListenBrainz(rw, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// serveWebhooks receives media server webhooks in the background. The
+// returned function stops it.
+func serveWebhooks(config WebhooksConfig, d *daemon) (func(), error) {
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("error starting webhook receiver: %w", err)
+	}
+
+	receiver := &webhookReceiver{config: config, tracker: d.media, notify: d.wakeUp, now: time.Now}
+	server := &http.Server{Handler: receiver.handler()}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("error serving webhooks", "err", err)
+		}
+	}()
+	slog.Info("webhooks listening", "addr", config.Listen)
+
+	return func() { server.Close() }, nil
+}
+
+// jellyfinTicks is the length of a Jellyfin tick.
+const jellyfinTicks = 100 * time.Nanosecond
+
+// jellyfinPayload is what the Jellyfin webhook plugin sends with "Send All
+// Properties" enabled. Provider_musicbrainztrack is left out: it is a
+// MusicBrainz track ID, not the recording ID scrobbles carry.
+type jellyfinPayload struct {
+	NotificationType      string          `json:"NotificationType"`
+	NotificationUsername  string          `json:"NotificationUsername"`
+	UserID                string          `json:"UserId"`
+	DeviceID              string          `json:"DeviceId"`
+	ItemType              string          `json:"ItemType"`
+	Name                  string          `json:"Name"`
+	Album                 string          `json:"Album"`
+	Artist                json.RawMessage `json:"Artist"`
+	AlbumArtist           string          `json:"AlbumArtist"`
+	RunTimeTicks          int64           `json:"RunTimeTicks"`
+	PlaybackPositionTicks *int64          `json:"PlaybackPositionTicks"`
+	IsPaused              bool            `json:"IsPaused"`
+	PlayedToCompletion    bool            `json:"PlayedToCompletion"`
+	RecordingMbID         string          `json:"Provider_musicbrainzrecording"`
+}
+
+// artist reads Artist, which is a string or a list depending on the
+// plugin version.
+func (p jellyfinPayload) artist() string {
+	var artist string
+	if json.Unmarshal(p.Artist, &artist) == nil && artist != "" {
+		return artist
+	}
+	var artists []string
+	if json.Unmarshal(p.Artist, &artists) == nil && len(artists) > 0 {
+		return strings.Join(artists, ", ")
+	}
+	return p.AlbumArtist
+}
+
+func (p jellyfinPayload) mediaEvent() (mediaEvent, bool) {
+	if p.ItemType != "Audio" {
+		return mediaEvent{}, false
+	}
+	ev := mediaEvent{
+		source: "jellyfin:" + p.UserID + ":" + p.DeviceID,
+		track: ScrobbleEvent{
+			Artist:   p.artist(),
+			Track:    p.Name,
+			Album:    p.Album,
+			MbID:     p.RecordingMbID,
+			Duration: int(time.Duration(p.RunTimeTicks) * jellyfinTicks / time.Second),
+		},
+		position: -1,
+	}
+	if p.PlaybackPositionTicks != nil {
+		ev.position = time.Duration(*p.PlaybackPositionTicks) * jellyfinTicks
+	}
+	switch p.NotificationType {
+	case "PlaybackStart":
+		ev.action = mediaPlay
+	case "PlaybackProgress":
+		ev.action = mediaProgress
+		if p.IsPaused {
+			ev.action = mediaPause
+		}
+	case "PlaybackStop":
+		ev.action = mediaStop
+		ev.completed = p.PlayedToCompletion
+	default:
+		return mediaEvent{}, false
+	}
+	return ev, true
+}
+
+// plexPayload is the JSON in the payload field of a Plex webhook.
+type plexPayload struct {
+	Event   string `json:"event"`
+	Account struct {
+		Title string `json:"title"`
+	} `json:"Account"`
+	Player struct {
+		UUID string `json:"uuid"`
+	} `json:"Player"`
+	Metadata struct {
+		Type             string `json:"type"`
+		Title            string `json:"title"`
+		GrandparentTitle string `json:"grandparentTitle"`
+		ParentTitle      string `json:"parentTitle"`
+		OriginalTitle    string `json:"originalTitle"`
+		Duration         int64  `json:"duration"`
+		ViewOffset       *int64 `json:"viewOffset"`
+		// GUID is Plex's own ID. It has to be declared so that
+		// encoding/json, which matches names case-insensitively, doesn't
+		// read it as Guid.
+		GUID  string `json:"guid"`
+		GUIDs []struct {
+			ID string `json:"id"`
+		} `json:"Guid"`
+	} `json:"Metadata"`
+}
+
+func (p plexPayload) mediaEvent() (mediaEvent, bool) {
+	m := p.Metadata
+	if m.Type != "track" {
+		return mediaEvent{}, false
+	}
+	// originalTitle is the track artist when it differs from the album
+	// artist, as on compilations.
+	artist := m.OriginalTitle
+	if artist == "" {
+		artist = m.GrandparentTitle
+	}
+	ev := mediaEvent{
+		source: "plex:" + p.Account.Title + ":" + p.Player.UUID,
+		track: ScrobbleEvent{
+			Artist:   artist,
+			Track:    m.Title,
+			Album:    m.ParentTitle,
+			Duration: int(m.Duration / 1000),
+		},
+		position: -1,
+	}
+	for _, guid := range m.GUIDs {
+		if id, ok := strings.CutPrefix(guid.ID, "mbid://"); ok {
+			ev.track.MbID = id
+		}
+	}
+	if m.ViewOffset != nil {
+		ev.position = time.Duration(*m.ViewOffset) * time.Millisecond
+	}
+	switch p.Event {
+	case "media.play":
+		ev.action = mediaPlay
+	case "media.resume":
+		ev.action = mediaResume
+	case "media.pause":
+		ev.action = mediaPause
+	case "media.stop":
+		ev.action = mediaStop
+	case "media.scrobble":
+		ev.action = mediaScrobble
+	default:
+		return mediaEvent{}, false
+	}
+	return ev, true
+}
+
+// listenBrainzSubmission is a ListenBrainz submit-listens request, which
+// Navidrome sends when its ListenBrainz base URL points here. Like the
+// Jellyfin track ID, track_mbid is not a recording ID and is left out.
+type listenBrainzSubmission struct {
+	ListenType string `json:"listen_type"`
+	Payload    []struct {
+		ListenedAt    int64 `json:"listened_at"`
+		TrackMetadata struct {
+			ArtistName     string `json:"artist_name"`
+			TrackName      string `json:"track_name"`
+			ReleaseName    string `json:"release_name"`
+			AdditionalInfo struct {
+				RecordingMbID string `json:"recording_mbid"`
+				DurationMs    int    `json:"duration_ms"`
+				Duration      int    `json:"duration"`
+			} `json:"additional_info"`
+		} `json:"track_metadata"`
+	} `json:"payload"`
+}
+
+// mediaEvents maps a submission to events. Navidrome applies its own
+// scrobble rules, so single and import listens are scrobbles.
+func (s listenBrainzSubmission) mediaEvents() []mediaEvent {
+	var events []mediaEvent
+	for _, listen := range s.Payload {
+		meta := listen.TrackMetadata
+		info := meta.AdditionalInfo
+		ev := mediaEvent{
+			track: ScrobbleEvent{
+				Artist:   meta.ArtistName,
+				Track:    meta.TrackName,
+				Album:    meta.ReleaseName,
+				MbID:     info.RecordingMbID,
+				Duration: info.Duration,
+			},
+			position: -1,
+		}
+		if info.DurationMs > 0 {
+			ev.track.Duration = info.DurationMs / 1000
+		}
+		switch s.ListenType {
+		case "playing_now":
+			ev.source = "listenbrainz:playing"
+			ev.action = mediaNowPlaying
+		case "single", "import":
+			ev.source = "listenbrainz"
+			ev.action = mediaScrobble
+			if listen.ListenedAt > 0 {
+				ev.track.CreatedAt = nostr.Timestamp(listen.ListenedAt)
+			}
+		default:
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events
+}
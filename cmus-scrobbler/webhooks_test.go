@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "webhooks", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func plexRequest(t *testing.T, url, fixture string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("payload", string(readFixture(t, fixture)))
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, url, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+func newTestReceiver(now *time.Time) *webhookReceiver {
+	return &webhookReceiver{
+		config: WebhooksConfig{
+			Jellyfin:  WebhookSource{Secret: "jelly", Users: []string{"Alice"}},
+			Plex:      WebhookSource{Secret: "plex"},
+			Navidrome: WebhookSource{Secret: "navi"},
+		},
+		tracker: newMediaTracker(),
+		notify:  func() {},
+		now:     func() time.Time { return *now },
+	}
+}
+
+func TestJellyfinWebhook(t *testing.T) {
+	now := time.Date(2024, 2, 14, 18, 30, 0, 0, time.UTC)
+	receiver := newTestReceiver(&now)
+	handler := receiver.handler()
+
+	send := func(fixture, secret string) int {
+		req := httptest.NewRequest(http.MethodPost, "/webhooks/jellyfin", bytes.NewReader(readFixture(t, fixture)))
+		req.Header.Set("X-Webhook-Secret", secret)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := send("jellyfin-playback-start.json", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("wrong secret: status %d", code)
+	}
+	if code := send("jellyfin-playback-start.json", "jelly"); code != http.StatusNoContent {
+		t.Fatalf("start: status %d", code)
+	}
+	tasks := receiver.tracker.take(now)
+	if len(tasks) != 1 || !tasks[0].started {
+		t.Fatalf("after start: %+v", tasks)
+	}
+	track := tasks[0].track
+	if track.Artist != "Low" || track.Track != "Words" || track.Album != "I Could Live in Hope" ||
+		track.MbID != "5b6c7d8e-9f0a-4b1c-9d2e-3f4a5b6c7d8e" || track.Duration != 326 {
+		t.Errorf("track = %+v", track)
+	}
+
+	now = now.Add(326 * time.Second)
+	send("jellyfin-playback-stop.json", "jelly")
+	tasks = receiver.tracker.take(now)
+	if len(tasks) != 1 || tasks[0].started || tasks[0].track.Track != "Words" {
+		t.Errorf("after stop: %+v", tasks)
+	}
+
+	// Other users on the server are ignored.
+	receiver.config.Jellyfin.Users = []string{"bob"}
+	send("jellyfin-playback-start.json", "jelly")
+	if tasks := receiver.tracker.take(now); len(tasks) != 0 {
+		t.Errorf("play by another user: %+v", tasks)
+	}
+}
+
+func TestPlexWebhook(t *testing.T) {
+	now := time.Date(2024, 2, 14, 18, 30, 0, 0, time.UTC)
+	receiver := newTestReceiver(&now)
+	handler := receiver.handler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, plexRequest(t, "/webhooks/plex", "plex-media-play.json"))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("no secret: status %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, plexRequest(t, "/webhooks/plex?secret=plex", "plex-media-play.json"))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("play: status %d: %s", rec.Code, rec.Body)
+	}
+	tasks := receiver.tracker.take(now)
+	if len(tasks) != 1 || !tasks[0].started {
+		t.Fatalf("after play: %+v", tasks)
+	}
+	// The track artist of a compilation, not "Various Artists".
+	if track := tasks[0].track; track.Artist != "Low" || track.Track != "Tonight" || track.MbID != "2c4b6a8e-1d3f-4e5a-9b7c-0d2e4f6a8b1c" {
+		t.Errorf("track = %+v", track)
+	}
+
+	now = now.Add(3 * time.Minute)
+	handler.ServeHTTP(httptest.NewRecorder(), plexRequest(t, "/webhooks/plex?secret=plex", "plex-media-scrobble.json"))
+	tasks = receiver.tracker.take(now)
+	if len(tasks) != 1 || tasks[0].started {
+		t.Errorf("after scrobble: %+v", tasks)
+	}
+	if tasks := receiver.tracker.take(now.Add(time.Minute)); len(tasks) != 0 {
+		t.Errorf("scrobbled twice: %+v", tasks)
+	}
+}
+
+func TestNavidromeListenBrainz(t *testing.T) {
+	now := time.Date(2024, 2, 14, 18, 30, 0, 0, time.UTC)
+	receiver := newTestReceiver(&now)
+	handler := receiver.handler()
+
+	req := httptest.NewRequest(http.MethodGet, "/listenbrainz/1/validate-token", nil)
+	req.Header.Set("Authorization", "Token navi")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"valid":true`) {
+		t.Errorf("validate-token: %d %s", rec.Code, rec.Body)
+	}
+
+	submit := func(fixture string) {
+		req := httptest.NewRequest(http.MethodPost, "/listenbrainz/1/submit-listens", bytes.NewReader(readFixture(t, fixture)))
+		req.Header.Set("Authorization", "Token navi")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", fixture, rec.Code, rec.Body)
+		}
+	}
+
+	submit("navidrome-playing-now.json")
+	tasks := receiver.tracker.take(now)
+	if len(tasks) != 1 || !tasks[0].started || tasks[0].track.Duration != 261 {
+		t.Fatalf("after playing_now: %+v", tasks)
+	}
+	// Navidrome sends its own scrobble, so playing_now is never
+	// scrobbled by time.
+	if tasks := receiver.tracker.take(now.Add(5 * time.Minute)); len(tasks) != 0 {
+		t.Errorf("playing_now scrobbled: %+v", tasks)
+	}
+
+	submit("navidrome-single.json")
+	tasks = receiver.tracker.take(now)
+	if len(tasks) != 1 || tasks[0].started {
+		t.Fatalf("after single: %+v", tasks)
+	}
+	if track := tasks[0].track; track.Artist != "Stereolab" || track.CreatedAt != 1707931800 || track.MbID != "8e1b2c3d-4f5a-4b6c-8d7e-9f0a1b2c3d4e" {
+		t.Errorf("track = %+v", track)
+	}
+
+	// Listening to it again is another scrobble.
+	submit("navidrome-single.json")
+	if tasks := receiver.tracker.take(now); len(tasks) != 1 {
+		t.Errorf("after a second single: %+v", tasks)
+	}
+
+	// A track MBID is not a recording MBID.
+	var sub listenBrainzSubmission
+	body := `{"listen_type": "single", "payload": [{"track_metadata": {"artist_name": "Low", "track_name": "Words", "additional_info": {"track_mbid": "3e2d1c0b-9a8f-4e7d-b6c5-a4b3c2d1e0f9"}}}]}`
+	if err := json.Unmarshal([]byte(body), &sub); err != nil {
+		t.Fatal(err)
+	}
+	if events := sub.mediaEvents(); len(events) != 1 || events[0].track.MbID != "" {
+		t.Errorf("events = %+v", events)
+	}
+}
+
+func TestMediaTracker(t *testing.T) {
+	start := time.Date(2024, 2, 14, 18, 30, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	low := ScrobbleEvent{Artist: "Low", Track: "Words"}
+	broadcast := ScrobbleEvent{Artist: "Broadcast", Track: "Black Cat"}
+	scrobbled := func(tasks []mediaTask) []string {
+		var tracks []string
+		for _, task := range tasks {
+			if !task.started {
+				tracks = append(tracks, task.track.Track)
+			}
+		}
+		return tracks
+	}
+
+	tracker := newMediaTracker()
+	tracker.handle(mediaEvent{source: "a", action: mediaPlay, track: low, position: -1}, at(0))
+	tracker.handle(mediaEvent{source: "a", action: mediaPause, track: low, position: -1}, at(20))
+	if got := scrobbled(tracker.take(at(60))); len(got) != 0 {
+		t.Errorf("scrobbled after 20s of play: %v", got)
+	}
+	tracker.handle(mediaEvent{source: "a", action: mediaResume, track: low, position: -1}, at(100))
+	if got := scrobbled(tracker.take(at(105))); len(got) != 0 {
+		t.Errorf("scrobbled after 25s of play: %v", got)
+	}
+	if got := scrobbled(tracker.take(at(115))); len(got) != 1 {
+		t.Errorf("not scrobbled after 35s of play: %v", got)
+	}
+	// Stopping doesn't scrobble it again.
+	tracker.handle(mediaEvent{source: "a", action: mediaStop, track: low, position: -1}, at(200))
+	if got := scrobbled(tracker.take(at(200))); len(got) != 0 {
+		t.Errorf("scrobbled again on stop: %v", got)
+	}
+
+	// Skipping to another track within the threshold doesn't scrobble,
+	// and players are tracked apart.
+	tracker.handle(mediaEvent{source: "a", action: mediaPlay, track: low, position: -1}, at(300))
+	tracker.handle(mediaEvent{source: "b", action: mediaPlay, track: low, position: -1}, at(300))
+	tracker.handle(mediaEvent{source: "a", action: mediaPlay, track: broadcast, position: -1}, at(310))
+	tracker.handle(mediaEvent{source: "a", action: mediaStop, track: broadcast, position: -1}, at(320))
+	tracker.handle(mediaEvent{source: "b", action: mediaStop, track: low, position: -1}, at(340))
+	if got := scrobbled(tracker.take(at(340))); len(got) != 1 || got[0] != "Words" {
+		t.Errorf("scrobbled %v, want Words from player b", got)
+	}
+
+	// Without the start, a stop goes by the position.
+	tracker.handle(mediaEvent{source: "c", action: mediaStop, track: broadcast, position: 2 * time.Minute}, at(400))
+	if got := scrobbled(tracker.take(at(400))); len(got) != 1 || len(tracker.sessions) != 0 {
+		t.Errorf("stop without start scrobbled %v, sessions %v", got, tracker.sessions)
+	}
+}
+
+func TestHandleMediaPlaysKeepsUnhandledPlays(t *testing.T) {
+	d := newDaemon()
+	d.media = newMediaTracker()
+	now := time.Date(2024, 2, 14, 18, 30, 0, 0, time.UTC)
+	committed := 0
+	for _, track := range []string{"Words", "Lullaby"} {
+		d.media.handle(mediaEvent{
+			source: "lastfm:alice",
+			action: mediaScrobble,
+			track:  ScrobbleEvent{Artist: "Low", Track: track, CreatedAt: nostr.Timestamp(now.Unix())},
+			done:   func() { committed++ },
+		}, now)
+	}
+
+	// The profile can't be connected to, so neither play is handled and
+	// both wait, in order, for the next poll.
+	targets := &profileTargets{fixed: "missing", targets: make(map[string]*scrobbleTarget)}
+	handleMediaPlays(d, targets, now)
+	if committed != 0 {
+		t.Errorf("%d unhandled plays committed", committed)
+	}
+	var left []string
+	for _, task := range d.media.take(now) {
+		left = append(left, task.track.Track)
+	}
+	if !slices.Equal(left, []string{"Words", "Lullaby"}) {
+		t.Errorf("left %v for the next poll", left)
+	}
+}